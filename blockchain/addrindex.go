@@ -0,0 +1,208 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/btcsuite/btcutil/base58"
+)
+
+// AddressEvent is a transaction of the active chain that funded or spent an output of an address
+type AddressEvent struct {
+	TxID       []byte
+	Height     int
+	IsSpending bool
+	Index      int // output index for funding events, input index for spending events
+	Value      int
+	// Output spent by a spending event, kept so the event can be undone when its block is disconnected
+	SpentOutput TxOutputWithIndex
+	SpentTxID   []byte
+}
+
+// AddressBalance sums the history of an address
+type AddressBalance struct {
+	Received int
+	Sent     int
+	Balance  int
+	TxCount  int // funding and spending events
+}
+
+// AddressIndex records, for every address, the outputs funding it and the inputs spending them,
+// ordered by height, and its current unspent outputs
+type AddressIndex struct {
+	database Store
+}
+
+func NewAddressIndex(database Store) *AddressIndex {
+	return &AddressIndex{database}
+}
+
+func getPubkeyHashOfAddress(address string) ([]byte, error) {
+	decoded := base58.Decode(address)
+	if len(decoded) != 1+20+pubKeyChecksumLength {
+		return nil, fmt.Errorf("invalid address %s", address)
+	}
+	return getPubkeyHashFromAddress(address), nil
+}
+
+func addrHistoryKey(pubKeyHash []byte, height int, txnID []byte, isSpending bool, index int) []byte {
+	key := append(append([]byte{}, addrHistoryPrefix...), pubKeyHash...)
+	key = binary.BigEndian.AppendUint64(key, uint64(height))
+	key = append(key, txnID...)
+	if isSpending {
+		key = append(key, 1)
+	} else {
+		key = append(key, 0)
+	}
+	return binary.BigEndian.AppendUint32(key, uint32(index))
+}
+
+func addrUTXOKey(pubKeyHash, txnID []byte, index int) []byte {
+	key := append(append(append([]byte{}, addrUTXOPrefix...), pubKeyHash...), txnID...)
+	return binary.BigEndian.AppendUint32(key, uint32(index))
+}
+
+// ConnectBlock records the funding and spending events of a block that joined the active chain at height
+func (addrIndex *AddressIndex) ConnectBlock(block *Block, height int) {
+	batch := new(Batch)
+	addrIndex.connectBlock(block, height, batch)
+	addrIndex.database.Write(batch)
+}
+
+func (addrIndex *AddressIndex) connectBlock(block *Block, height int, batch *Batch) {
+	// Outputs created earlier in the same block are not stored yet
+	createdOutputs := make(map[string]TxOutputWithIndex)
+	for _, transaction := range block.Transactions {
+		isCoinbase := IsCoinbaseTransaction(transaction)
+		for inputIndex, txnInput := range transaction.Inputs {
+			pubKeyHash := getPubkeyHashFromPubkey(txnInput.ScriptSig.PubKey)
+			utxoKey := addrUTXOKey(pubKeyHash, txnInput.TxID, txnInput.VOut)
+			var spentOutput TxOutputWithIndex
+			if createdOutput, exists := createdOutputs[string(utxoKey)]; exists {
+				spentOutput = createdOutput
+			} else if encodedOutput, err := addrIndex.database.Get(utxoKey); err == nil {
+				genericDeserialize(encodedOutput, &spentOutput)
+			} else {
+				continue
+			}
+			batch.Delete(utxoKey)
+			event := AddressEvent{transaction.Hash, height, true, inputIndex, spentOutput.Value, spentOutput, txnInput.TxID}
+			batch.Put(addrHistoryKey(pubKeyHash, height, transaction.Hash, true, inputIndex), serialize(event))
+		}
+		for outputIndex, txOutput := range transaction.Outputs {
+			pubKeyHash := txOutput.ScriptPubKey.PubKeyHash
+			output := TxOutputWithIndex{txOutput, outputIndex, height, isCoinbase}
+			createdOutputs[string(addrUTXOKey(pubKeyHash, transaction.Hash, outputIndex))] = output
+			batch.Put(addrUTXOKey(pubKeyHash, transaction.Hash, outputIndex), serialize(output))
+			event := AddressEvent{TxID: transaction.Hash, Height: height, Index: outputIndex, Value: txOutput.Value}
+			batch.Put(addrHistoryKey(pubKeyHash, height, transaction.Hash, false, outputIndex), serialize(event))
+		}
+	}
+}
+
+// DisconnectBlock undoes ConnectBlock for a block that left the active chain
+func (addrIndex *AddressIndex) DisconnectBlock(block *Block, height int) {
+	batch := new(Batch)
+	addrIndex.disconnectBlock(block, height, batch)
+	addrIndex.database.Write(batch)
+}
+
+func (addrIndex *AddressIndex) disconnectBlock(block *Block, height int, batch *Batch) {
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		transaction := block.Transactions[i]
+		for outputIndex, txOutput := range transaction.Outputs {
+			pubKeyHash := txOutput.ScriptPubKey.PubKeyHash
+			batch.Delete(addrUTXOKey(pubKeyHash, transaction.Hash, outputIndex))
+			batch.Delete(addrHistoryKey(pubKeyHash, height, transaction.Hash, false, outputIndex))
+		}
+		for inputIndex, txnInput := range transaction.Inputs {
+			pubKeyHash := getPubkeyHashFromPubkey(txnInput.ScriptSig.PubKey)
+			historyKey := addrHistoryKey(pubKeyHash, height, transaction.Hash, true, inputIndex)
+			encodedEvent, err := addrIndex.database.Get(historyKey)
+			if err != nil {
+				continue
+			}
+			var event AddressEvent
+			genericDeserialize(encodedEvent, &event)
+			batch.Delete(historyKey)
+			// Outputs created and spent within this block are gone with it
+			if event.SpentOutput.Height < height {
+				batch.Put(addrUTXOKey(pubKeyHash, event.SpentTxID, event.SpentOutput.Index), serialize(event.SpentOutput))
+			}
+		}
+	}
+}
+
+// Clear removes every entry, before the index is rebuilt
+func (addrIndex *AddressIndex) Clear() {
+	batch := new(Batch)
+	for _, prefix := range [][]byte{addrHistoryPrefix, addrUTXOPrefix} {
+		iter := addrIndex.database.NewIterator(prefix)
+		for iter.Next() {
+			batch.Delete(iter.Key())
+		}
+		iter.Release()
+	}
+	addrIndex.database.Write(batch)
+}
+
+// GetHistory returns up to count events of address in the order of the chain, after skipping skip of them.
+// A count of 0 or less returns all remaining events.
+func (addrIndex *AddressIndex) GetHistory(address string, skip, count int) ([]AddressEvent, error) {
+	pubKeyHash, err := getPubkeyHashOfAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	events := []AddressEvent{}
+	iter := addrIndex.database.NewIterator(append(append([]byte{}, addrHistoryPrefix...), pubKeyHash...))
+	defer iter.Release()
+	for position := 0; iter.Next(); position++ {
+		if position < skip {
+			continue
+		}
+		if count > 0 && len(events) >= count {
+			break
+		}
+		var event AddressEvent
+		genericDeserialize(iter.Value(), &event)
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func (addrIndex *AddressIndex) GetBalance(address string) (AddressBalance, error) {
+	var balance AddressBalance
+	events, err := addrIndex.GetHistory(address, 0, 0)
+	if err != nil {
+		return balance, err
+	}
+	for _, event := range events {
+		if event.IsSpending {
+			balance.Sent += event.Value
+		} else {
+			balance.Received += event.Value
+		}
+	}
+	balance.Balance = balance.Received - balance.Sent
+	balance.TxCount = len(events)
+	return balance, nil
+}
+
+// GetUTXOs returns the unspent outputs of address keyed by transaction hash, reading only that address's entries
+func (addrIndex *AddressIndex) GetUTXOs(address string) (map[string]TxOutputs, error) {
+	pubKeyHash, err := getPubkeyHashOfAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	utxoMap := make(map[string]TxOutputs)
+	prefix := append(append([]byte{}, addrUTXOPrefix...), pubKeyHash...)
+	iter := addrIndex.database.NewIterator(prefix)
+	for iter.Next() {
+		txnID := iter.Key()[len(prefix) : len(iter.Key())-4]
+		var output TxOutputWithIndex
+		genericDeserialize(iter.Value(), &output)
+		utxoMap[string(txnID)] = append(utxoMap[string(txnID)], output)
+	}
+	iter.Release()
+	return utxoMap, nil
+}
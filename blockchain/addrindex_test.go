@@ -0,0 +1,60 @@
+package blockchain
+
+import (
+	"testing"
+)
+
+func TestAddressIndex(t *testing.T) {
+	t.Parallel()
+	database := NewMemoryStore()
+
+	pubKey := []byte("payer public key")
+	payer := MainNetParams.GetAddress(getPubkeyHashFromPubkey(pubKey))
+	payee := MainNetParams.GetAddress(getPubkeyHashFromPubkey([]byte("payee public key")))
+	index := NewAddressIndex(database)
+
+	coinbase := CoinBaseTransaction(payer, COINBASE_REWARD)
+	firstBlock := &Block{Transactions: []*Transaction{coinbase}}
+	index.ConnectBlock(firstBlock, 1)
+
+	payment := &Transaction{
+		Inputs:  []TxInput{{TxID: coinbase.Hash, VOut: 0, ScriptSig: UnlockingScript{PubKey: pubKey}}},
+		Outputs: []TxOutput{createTxnOutput(300, payee), createTxnOutput(COINBASE_REWARD-300, payer)},
+	}
+	payment.SetHash()
+	secondBlock := &Block{Transactions: []*Transaction{CoinBaseTransaction(payee, COINBASE_REWARD), payment}}
+	index.ConnectBlock(secondBlock, 2)
+
+	history, err := index.GetHistory(payer, 0, 0)
+	if err != nil || len(history) != 3 {
+		t.Fatalf("Expected coinbase, spend and change events for the payer, actual: %d (%v)", len(history), err)
+	}
+	if history[0].Height != 1 || history[0].IsSpending || history[1].Height != 2 {
+		t.Fatalf("Expected events ordered by height, actual: %+v", history)
+	}
+	if page, _ := index.GetHistory(payer, 1, 1); len(page) != 1 || page[0].Height != 2 {
+		t.Fatalf("Expected the second event alone when paging, actual: %+v", page)
+	}
+	balance, _ := index.GetBalance(payer)
+	if balance.Received != 2*COINBASE_REWARD-300 || balance.Sent != COINBASE_REWARD || balance.Balance != COINBASE_REWARD-300 || balance.TxCount != 3 {
+		t.Fatalf("Unexpected payer balance: %+v", balance)
+	}
+	utxos, _ := index.GetUTXOs(payee)
+	if len(utxos) != 2 || utxos[string(payment.Hash)][0].Value != 300 {
+		t.Fatalf("Expected the payment and a coinbase output for the payee, actual: %+v", utxos)
+	}
+
+	// Disconnecting the second block restores the coinbase output it spent
+	index.DisconnectBlock(secondBlock, 2)
+	utxos, _ = index.GetUTXOs(payer)
+	if len(utxos) != 1 || utxos[string(coinbase.Hash)][0].Height != 1 {
+		t.Fatalf("Expected the coinbase output to be unspent again, actual: %+v", utxos)
+	}
+	if history, _ := index.GetHistory(payee, 0, 0); len(history) != 0 {
+		t.Fatalf("Expected no history for the payee, actual: %+v", history)
+	}
+
+	if _, err := index.GetHistory("not an address", 0, 0); err == nil {
+		t.Fatalf("Expected invalid addresses to be rejected")
+	}
+}
@@ -3,7 +3,6 @@ package blockchain
 import (
 	"bytes"
 	"encoding/gob"
-	"time"
 )
 
 type BlockHeader struct {
@@ -29,27 +28,6 @@ func (block *Block) GetHash() []byte {
 	return block.BlockHeader.GetHash()
 }
 
-func GenerateGenesisBlock() *Block {
-	genesisBlockDate, _ := time.Parse("2006-Jan-02", "2009-Jan-03")
-	txOutput := createTxnOutput(COINBASE_REWARD, SATOSHI_ADDRESS)
-	coinbaseTransaction := Transaction{
-		Inputs:   []TxInput{},
-		Outputs:  []TxOutput{txOutput},
-		Locktime: genesisBlockDate.UnixMilli(),
-	}
-	coinbaseTransaction.SetHash()
-
-	block := Block{
-		BlockHeader: BlockHeader{
-			Timestamp: genesisBlockDate.String(),
-			PrevHash:  []byte{},
-			Nonce:     4436,
-		},
-		Transactions: []*Transaction{&coinbaseTransaction},
-	}
-	return &block
-}
-
 func DeserializeBlock(input []byte) *Block {
 	var block Block
 	byteBuffer := bytes.NewBuffer(input)
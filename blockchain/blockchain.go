@@ -1,112 +1,171 @@
 package blockchain
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"log"
-
-	"github.com/syndtr/goleveldb/leveldb"
-	"golang.org/x/exp/slices"
 )
 
 type BlockChain struct {
-	DataBase *leveldb.DB
-	LastHash []byte
+	Params    *ChainParams
+	DataBase  Store
+	LastHash  []byte
+	Index     *BlockIndex
+	TxIndex   *TxIndex      // nil unless enabled with EnableTxIndex
+	AddrIndex *AddressIndex // nil unless enabled with EnableAddressIndex
+
+	pruneDepth  int               // number of recent blocks whose data is kept, 0 unless enabled with EnablePruning
+	pruneHeight int               // blocks of the active chain below this height are pruned
+	snapshot    *SnapshotMetadata // UTXO snapshot the chain was loaded from, nil once the blocks below it are validated
+	snapshotErr error             // why the blocks below the snapshot failed the validation, nil unless they did
+	verify      BlockVerifier     // checks blocks before they are connected, nil unless set with SetBlockVerifier
 }
 
 type BlockChainHeader struct {
-	DataBase *leveldb.DB
+	Params   *ChainParams
+	DataBase Store
 	LastHash []byte
+	Index    *BlockIndex
 }
 
 type BlockChainIterator struct {
-	DataBase    *leveldb.DB
+	DataBase    Store
 	CurrentHash []byte
 }
 
-func InitBlockChain(networkAddress string) *BlockChain {
-	db, err := leveldb.OpenFile("storage/"+networkAddress, nil)
-	if err != nil {
+// InitBlockChain loads the chain stored in database, upgrading its schema and checking its chain state first.
+// The genesis block is stored in new databases.
+func InitBlockChain(params *ChainParams, database Store) *BlockChain {
+	if err := UpgradeStore(database); err != nil {
 		log.Fatal(err)
 	}
-
-	genesisBlock := GenerateGenesisBlock()
-	blockchain := BlockChain{db, genesisBlock.GetHash()}
-	blockchain.StoreNewBlock(genesisBlock)
-
-	utxoSet := blockchain.UTXOSet()
-	utxoSet.ReIndex()
-
+	blockchain := BlockChain{Params: params, DataBase: database}
+	blockchain.Index = NewBlockIndex(database, params, BLOCK_HAVE_DATA, blockchain.loadHeader)
+	if lastHash, err := database.Get(chainStateKey(tipStateName)); err == nil {
+		blockchain.LastHash = lastHash
+		if encodedPruneHeight, err := database.Get(chainStateKey(pruneStateName)); err == nil {
+			blockchain.pruneHeight = int(binary.BigEndian.Uint32(encodedPruneHeight))
+		}
+		if encodedSnapshot, err := database.Get(chainStateKey(snapshotStateName)); err == nil {
+			blockchain.snapshot = new(SnapshotMetadata)
+			genericDeserialize(encodedSnapshot, blockchain.snapshot)
+		}
+		if invalidReason, err := database.Get(chainStateKey(invalidStateName)); err == nil {
+			blockchain.snapshotErr = errors.New(string(invalidReason))
+		}
+		if err := blockchain.CheckChainState(); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		blockchain.StoreNewBlock(params.GenesisBlock())
+	}
 	return &blockchain
 }
 
-func InitBlockChainHeader(database *leveldb.DB) *BlockChainHeader {
+func InitBlockChainHeader(params *ChainParams, database Store) *BlockChainHeader {
+	if err := UpgradeStore(database); err != nil {
+		log.Fatal(err)
+	}
 	blockchainHeader := BlockChainHeader{
+		Params:   params,
 		DataBase: database,
 	}
-	genesisBlock := GenerateGenesisBlock()
-	blockchainHeader.LastHash = genesisBlock.GetHash()
-	blockchainHeader.DataBase.Put(blockchainHeader.LastHash, serialize(genesisBlock.BlockHeader), nil)
-	blockchainHeader.DataBase.Put([]byte(LAST_HASH_STOGAGE_KEY), blockchainHeader.LastHash, nil)
+	blockchainHeader.Index = NewBlockIndex(database, params, BLOCK_HAVE_HEADER, blockchainHeader.loadHeader)
+	if lastHash, err := database.Get(chainStateKey(tipStateName)); err == nil {
+		// Also repairs a height index that does not end at the tip
+		blockchainHeader.SetLastHash(lastHash)
+		return &blockchainHeader
+	}
+	genesisBlock := params.GenesisBlock()
+	genesisHash := genesisBlock.GetHash() // sets the Merkle root of the header
+	blockchainHeader.SetHeader(&genesisBlock.BlockHeader)
+	blockchainHeader.SetLastHash(genesisHash)
 	return &blockchainHeader
 }
 
+func (blockchain *BlockChain) loadHeader(hash []byte) (*BlockHeader, bool) {
+	return readHeader(blockchain.DataBase, hash)
+}
+
+// readHeader reads the header of a stored block, or of a block whose data is not stored
+func readHeader(database StoreReader, hash []byte) (*BlockHeader, bool) {
+	if encodedBlock, err := database.Get(blockKey(hash)); err == nil {
+		return &DeserializeBlock(encodedBlock).BlockHeader, true
+	}
+	// Pruned blocks and blocks below a UTXO snapshot keep their header
+	encodedHeader, err := database.Get(headerKey(hash))
+	if err != nil {
+		return nil, false
+	}
+	var header BlockHeader
+	genericDeserialize(encodedHeader, &header)
+	return &header, true
+}
+
+func (blockchainHeader *BlockChainHeader) loadHeader(hash []byte) (*BlockHeader, bool) {
+	encodedData, err := blockchainHeader.DataBase.Get(headerKey(hash))
+	if err != nil {
+		return nil, false
+	}
+	var header BlockHeader
+	genericDeserialize(encodedData, &header)
+	return &header, true
+}
+
 func (chainIterator *BlockChainIterator) CurrentBlock() *Block {
-	encodedBlock, _ := chainIterator.DataBase.Get(chainIterator.CurrentHash, nil)
+	encodedBlock, _ := chainIterator.DataBase.Get(blockKey(chainIterator.CurrentHash))
 	return DeserializeBlock(encodedBlock)
 }
 
+// GetHeight returns the number of headers in the active chain, including the genesis block
 func (blockchainHeader *BlockChainHeader) GetHeight() int {
-	currentHash := blockchainHeader.LastHash
-	height := 0
-	for {
-		encodedData, _ := blockchainHeader.DataBase.Get(currentHash, nil)
-		var header BlockHeader
-		genericDeserialize(encodedData, &header)
-		height++
-		if len(header.PrevHash) == 0 {
-			break
-		}
-		currentHash = header.PrevHash
-	}
-	return height
+	return blockchainHeader.Index.TipHeight() + 1
+}
+
+// GetBlockHeight returns the height of the header with the given hash, counting the genesis block as height 0,
+// or -1 if the header is unknown
+func (blockchainHeader *BlockChainHeader) GetBlockHeight(hash []byte) int {
+	return blockchainHeader.Index.GetHeight(hash)
 }
 
 func (blockchainHeader *BlockChainHeader) SetHeader(header *BlockHeader) {
-	blockchainHeader.DataBase.Put(header.GetHash(), serialize(header), nil)
+	blockchainHeader.DataBase.Put(headerKey(header.GetHash()), serialize(header))
+	blockchainHeader.Index.AddBlock(header.GetHash())
 }
 
+// SetLastHash moves the tip of the header chain, the tip and the height index are written at once
 func (blockchainHeader *BlockChainHeader) SetLastHash(lastHash []byte) {
-	blockchainHeader.LastHash = lastHash
-	blockchainHeader.DataBase.Put([]byte(LAST_HASH_STOGAGE_KEY), lastHash, nil)
+	batch := new(Batch)
+	blockchainHeader.Index.setTip(lastHash, batch)
+	batch.Put(chainStateKey(tipStateName), lastHash)
+	batch.onWrite(func() { blockchainHeader.LastHash = lastHash })
+	writeBatch(blockchainHeader.DataBase, batch)
 }
 
-func (blockchainHeader *BlockChainHeader) GetUnmatchedHeaders(targetHeaderHash []byte) (bool, []*BlockHeader) {
-	headerExisted := false
-	unmatchedHeaders := make([]*BlockHeader, 0)
-	currentHash := blockchainHeader.LastHash
-
-	for {
-		encodedData, _ := blockchainHeader.DataBase.Get(currentHash, nil)
-		var currentHeader BlockHeader
-		genericDeserialize(encodedData, &currentHeader)
-
-		if slices.Equal(currentHash, targetHeaderHash) {
-			headerExisted = true
-			break
-		}
+// GetBlockLocator describes the active header chain for a getheaders request
+func (blockchainHeader *BlockChainHeader) GetBlockLocator() [][]byte {
+	return blockchainHeader.Index.GetLocator(blockchainHeader.LastHash)
+}
 
-		if len(currentHeader.PrevHash) == 0 {
-			break
-		} else {
-			unmatchedHeaders = append(unmatchedHeaders, &currentHeader)
-		}
-		currentHash = currentHeader.PrevHash
+// GetHeadersAfter returns up to max headers of the active chain following the fork point with locator
+func (blockchainHeader *BlockChainHeader) GetHeadersAfter(locator [][]byte, stopHash []byte, max int) []*BlockHeader {
+	headers := []*BlockHeader{}
+	for _, hash := range blockchainHeader.Index.GetHashesAfter(locator, stopHash, max) {
+		header, _ := blockchainHeader.loadHeader(hash)
+		headers = append(headers, header)
 	}
+	return headers
+}
 
-	return headerExisted, unmatchedHeaders
+// HasMoreWork reports whether the chain ending at hash has more work than the active chain
+func (blockchainHeader *BlockChainHeader) HasMoreWork(hash []byte) bool {
+	return blockchainHeader.Index.HasMoreWork(hash, blockchainHeader.LastHash)
 }
 
 func (blockchainHeader *BlockChainHeader) CheckHeaderExistence(header *BlockHeader) bool {
-	headerHash, err := blockchainHeader.DataBase.Get(header.GetHash(), nil)
+	headerHash, err := blockchainHeader.DataBase.Get(headerKey(header.GetHash()))
 	var blockHeader BlockHeader
 	genericDeserialize(headerHash, &blockHeader)
 	if err != nil || blockHeader.Timestamp == "" {
@@ -115,18 +174,24 @@ func (blockchainHeader *BlockChainHeader) CheckHeaderExistence(header *BlockHead
 	return true
 }
 
+// GetHeight returns the number of blocks in the active chain, including the genesis block
 func (blockchain *BlockChain) GetHeight() int {
-	chainIterator := BlockChainIterator{blockchain.DataBase, blockchain.LastHash}
-	blockHeight := 0
-	for {
-		currentBlock := chainIterator.CurrentBlock()
-		blockHeight++
-		if len(currentBlock.PrevHash) == 0 {
-			break
-		}
-		chainIterator.CurrentHash = currentBlock.PrevHash
+	return blockchain.Index.TipHeight() + 1
+}
+
+// GetBlockHeight returns the height of the block with the given hash, genesis block is height 0,
+// or -1 if the block is unknown
+func (blockchain *BlockChain) GetBlockHeight(hash []byte) int {
+	return blockchain.Index.GetHeight(hash)
+}
+
+// GetBlockByHeight returns the active chain's block at height, or nil if the chain is shorter
+func (blockchain *BlockChain) GetBlockByHeight(height int) *Block {
+	blockHash := blockchain.Index.GetHashAtHeight(height)
+	if blockHash == nil {
+		return nil
 	}
-	return blockHeight
+	return blockchain.GetBlock(blockHash)
 }
 
 func (blockchain *BlockChain) UTXOSet() UTXOSet {
@@ -134,110 +199,185 @@ func (blockchain *BlockChain) UTXOSet() UTXOSet {
 }
 
 func (blockchain *BlockChain) SetBlock(block *Block) {
-	blockchain.DataBase.Put(block.GetHash(), serialize(block), nil)
+	blockchain.DataBase.Put(blockKey(block.GetHash()), serialize(block))
+	blockchain.Index.AddBlock(block.GetHash())
 }
 
-func (blockchain *BlockChain) SetLastHash(hash []byte) {
-	blockchain.LastHash = hash
-	blockchain.DataBase.Put([]byte(LAST_HASH_STOGAGE_KEY), hash, nil)
+// SetBlockVerifier makes verify check each block, at its height and against the UTXO set built by its parent,
+// before it is connected to the active chain
+func (blockchain *BlockChain) SetBlockVerifier(verify BlockVerifier) {
+	blockchain.verify = verify
 }
 
-func (blockchain *BlockChain) StoreNewBlock(block *Block) {
-	blockchain.LastHash = block.GetHash()
-	blockchain.DataBase.Put(blockchain.LastHash, serialize(block), nil)
-	blockchain.DataBase.Put([]byte(LAST_HASH_STOGAGE_KEY), blockchain.LastHash, nil)
-
-	utxoSet := blockchain.UTXOSet()
-	utxoSet.UpdateWithNewBlock(block)
+// SetLastHash makes the stored block hash the tip of the active chain. Blocks are disconnected and connected
+// one at a time, each in a single write, so the database always holds the chain state at one of them. If a block
+// can not be disconnected or connected, the previous tip is restored and the error returned.
+func (blockchain *BlockChain) SetLastHash(hash []byte) error {
+	previousTip := blockchain.LastHash
+	if err := blockchain.switchTip(hash); err != nil {
+		if restoreErr := blockchain.switchTip(previousTip); restoreErr != nil {
+			return fmt.Errorf("%w, the previous tip %x can not be restored either: %v", err, previousTip, restoreErr)
+		}
+		return err
+	}
+	return nil
 }
 
-func (blockchain *BlockChain) GetTransactionMapFromInputs(transaction *Transaction) map[string]Transaction {
-	txnIDs := map[string]bool{}
-	txnMap := map[string]Transaction{}
-
-	for _, txnInput := range transaction.Inputs {
-		txnIDs[string(txnInput.TxID)] = true
+func (blockchain *BlockChain) switchTip(hash []byte) error {
+	tipChange, ok := blockchain.Index.GetTipChange(hash)
+	if !ok {
+		return fmt.Errorf("can not switch the chain tip to %x, the block or one of its ancestors is unknown", hash)
 	}
-
-	chainIterator := BlockChainIterator{blockchain.DataBase, blockchain.LastHash}
-	for {
-		currentBlock := chainIterator.CurrentBlock()
-
-		for _, transaction := range currentBlock.Transactions {
-			if _, exists := txnIDs[string(transaction.Hash)]; exists {
-				txnMap[string(transaction.Hash)] = *transaction
-				delete(txnIDs, string(transaction.Hash))
-			}
+	for _, blockHash := range tipChange.Disconnected {
+		if exists, _ := blockchain.DataBase.Has(undoKey(blockHash)); !exists {
+			return fmt.Errorf("can not switch the chain tip to %x, block %x is pruned", hash, blockHash)
 		}
-
-		if len(currentBlock.PrevHash) == 0 {
-			break
+	}
+	for range tipChange.Disconnected {
+		if err := blockchain.disconnectTip(); err != nil {
+			return err
 		}
-		chainIterator.CurrentHash = currentBlock.PrevHash
 	}
-
-	return txnMap
+	for _, blockHash := range tipChange.Connected {
+		block := blockchain.GetBlock(blockHash)
+		if block == nil {
+			return fmt.Errorf("can not connect block %x, its data is missing", blockHash)
+		}
+		if err := blockchain.connectBlock(block, new(Batch)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (blockchain *BlockChain) GetUTXOs(address string) map[string]TxOutputs {
-	utxoSet := blockchain.UTXOSet()
-	unspentTransactionOutputs := utxoSet.FindUTXO(address)
-	return unspentTransactionOutputs
+// EnableTxIndex indexes the transactions of the active chain, except pruned blocks, and keeps the index up to
+// date from now on
+func (blockchain *BlockChain) EnableTxIndex() {
+	txIndex := NewTxIndex(blockchain.DataBase)
+	for height := blockchain.pruneHeight; height <= blockchain.Index.TipHeight(); height++ {
+		txIndex.ConnectBlock(blockchain.GetBlockByHeight(height))
+	}
+	blockchain.TxIndex = txIndex
 }
 
-func (blockchain *BlockChain) GetUnmatchedBlocks(targetBlockHash []byte) (bool, [][]byte) {
-	blockExisted := false
-	unmatchedBlocks := make([][]byte, 0)
-	chainIterator := BlockChainIterator{blockchain.DataBase, blockchain.LastHash}
-
-	for {
-		currentBlock := chainIterator.CurrentBlock()
-
-		if slices.Equal(currentBlock.GetHash(), targetBlockHash) {
-			blockExisted = true
-			break
-		}
+// EnableAddressIndex rebuilds the address index from the active chain and keeps it up to date from now on.
+// The index is rebuilt because blocks may have left the active chain while it was disabled. It needs every
+// block, so chains that are pruned or loaded from a UTXO snapshot not validated yet are rejected.
+func (blockchain *BlockChain) EnableAddressIndex() error {
+	if blockchain.pruneDepth > 0 || blockchain.pruneHeight > 0 {
+		return fmt.Errorf("the address index needs every block, the chain is pruned or loaded from a UTXO snapshot not validated yet")
+	}
+	addrIndex := NewAddressIndex(blockchain.DataBase)
+	addrIndex.Clear()
+	for height := 0; height <= blockchain.Index.TipHeight(); height++ {
+		addrIndex.ConnectBlock(blockchain.GetBlockByHeight(height), height)
+	}
+	blockchain.AddrIndex = addrIndex
+	return nil
+}
 
-		if len(currentBlock.PrevHash) == 0 {
-			break
-		} else {
-			unmatchedBlocks = append(unmatchedBlocks, currentBlock.GetHash())
-		}
-		chainIterator.CurrentHash = currentBlock.PrevHash
+// GetAddressHistory returns a page of the funding and spending events of address, oldest first
+func (blockchain *BlockChain) GetAddressHistory(address string, skip, count int) ([]AddressEvent, error) {
+	if blockchain.AddrIndex == nil {
+		return nil, fmt.Errorf("address index is not enabled")
 	}
+	return blockchain.AddrIndex.GetHistory(address, skip, count)
+}
 
-	return blockExisted, unmatchedBlocks
+// GetAddressBalance sums the funding and spending events of address
+func (blockchain *BlockChain) GetAddressBalance(address string) (AddressBalance, error) {
+	if blockchain.AddrIndex == nil {
+		return AddressBalance{}, fmt.Errorf("address index is not enabled")
+	}
+	return blockchain.AddrIndex.GetBalance(address)
 }
 
-func (blockchain *BlockChain) GetUnmatchedHeaders(targetHeaderHash []byte) (bool, []*BlockHeader) {
-	headerExisted := false
-	unmatchedHeaders := make([]*BlockHeader, 0)
-	chainIterator := BlockChainIterator{blockchain.DataBase, blockchain.LastHash}
+// GetTransaction looks up a transaction of the active chain and the block containing it
+func (blockchain *BlockChain) GetTransaction(txnID []byte) (*Transaction, *Block, error) {
+	if blockchain.TxIndex == nil {
+		return nil, nil, fmt.Errorf("transaction index is not enabled")
+	}
+	location, exists := blockchain.TxIndex.GetLocation(txnID)
+	// Entries of blocks that left the active chain while the index was disabled are stale
+	if !exists || !blockchain.Index.IsInActiveChain(location.BlockHash) {
+		return nil, nil, fmt.Errorf("transaction %x not found", txnID)
+	}
+	block := blockchain.GetBlock(location.BlockHash)
+	if block == nil || location.Position >= len(block.Transactions) {
+		return nil, nil, fmt.Errorf("block of transaction %x is missing", txnID)
+	}
+	return block.Transactions[location.Position], block, nil
+}
 
-	for {
-		currentBlock := chainIterator.CurrentBlock()
+// GetBlock returns the stored block with the given hash, or nil if it is unknown
+func (blockchain *BlockChain) GetBlock(hash []byte) *Block {
+	encodedBlock, err := blockchain.DataBase.Get(blockKey(hash))
+	if err != nil {
+		return nil
+	}
+	return DeserializeBlock(encodedBlock)
+}
 
-		if slices.Equal(currentBlock.GetHash(), targetHeaderHash) {
-			headerExisted = true
-			break
+// StoreNewBlock stores block and makes it the tip of the active chain if its chain has more work. A block
+// extending the tip is stored and connected in a single write, nothing is written if it can not be connected.
+// Other blocks are stored as a side branch, which becomes the active chain once it has more work.
+func (blockchain *BlockChain) StoreNewBlock(block *Block) error {
+	if !bytes.Equal(block.PrevHash, blockchain.LastHash) {
+		blockchain.SetBlock(block)
+		if !blockchain.HasMoreWork(block.GetHash()) {
+			return nil
+		}
+		return blockchain.SetLastHash(block.GetHash())
+	}
+	hash := block.GetHash()
+	wasIndexed := blockchain.Index.GetEntry(hash) != nil
+	batch := new(Batch)
+	batch.Put(blockKey(hash), serialize(block))
+	if !blockchain.Index.addHeader(&block.BlockHeader, batch) {
+		return nil
+	}
+	if err := blockchain.connectBlock(block, batch); err != nil {
+		if !wasIndexed {
+			blockchain.Index.forget(hash)
 		}
+		return err
+	}
+	return nil
+}
 
-		if len(currentBlock.PrevHash) == 0 {
-			break
-		} else {
-			unmatchedHeaders = append(unmatchedHeaders, &currentBlock.BlockHeader)
+// GetUTXOs returns the unspent outputs of address, from the address index if enabled instead of scanning the UTXO set
+func (blockchain *BlockChain) GetUTXOs(address string) map[string]TxOutputs {
+	if blockchain.AddrIndex != nil {
+		if utxoMap, err := blockchain.AddrIndex.GetUTXOs(address); err == nil {
+			return utxoMap
 		}
-		chainIterator.CurrentHash = currentBlock.PrevHash
 	}
+	utxoSet := blockchain.UTXOSet()
+	unspentTransactionOutputs := utxoSet.FindUTXO(address)
+	return unspentTransactionOutputs
+}
+
+// GetBlockLocator describes the active chain for a getblocks or getheaders request
+func (blockchain *BlockChain) GetBlockLocator() [][]byte {
+	return blockchain.Index.GetLocator(blockchain.LastHash)
+}
 
-	return headerExisted, unmatchedHeaders
+// GetBlockHashesAfter returns up to max hashes of the active chain following the fork point with locator
+func (blockchain *BlockChain) GetBlockHashesAfter(locator [][]byte, stopHash []byte, max int) [][]byte {
+	return blockchain.Index.GetHashesAfter(locator, stopHash, max)
 }
 
-func (blockchain *BlockChain) GetBlocksFromHashes(hashList [][]byte) []*Block {
-	blockList := []*Block{}
-	for _, blockHash := range hashList {
-		encodedBlock, _ := blockchain.DataBase.Get(blockHash, nil)
-		blockList = append(blockList, DeserializeBlock(encodedBlock))
+// GetHeadersAfter returns up to max headers of the active chain following the fork point with locator
+func (blockchain *BlockChain) GetHeadersAfter(locator [][]byte, stopHash []byte, max int) []*BlockHeader {
+	headers := []*BlockHeader{}
+	for _, hash := range blockchain.Index.GetHashesAfter(locator, stopHash, max) {
+		header, _ := blockchain.loadHeader(hash)
+		headers = append(headers, header)
 	}
-	return blockList
+	return headers
+}
+
+// HasMoreWork reports whether the chain ending at hash has more work than the active chain
+func (blockchain *BlockChain) HasMoreWork(hash []byte) bool {
+	return blockchain.Index.HasMoreWork(hash, blockchain.LastHash)
 }
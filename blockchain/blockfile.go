@@ -0,0 +1,93 @@
+package blockchain
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MAX_BLOCK_RECORD_SIZE bounds the serialized size of a block read from a block file
+const MAX_BLOCK_RECORD_SIZE = 32 << 20
+
+// A block file holds a sequence of blocks, each one written as its serialized size in 4 big-endian bytes followed
+// by the gob encoded block. Blocks are encoded on their own, so files do not depend on the process writing them.
+
+// ExportBlocks writes the blocks of the active chain from the genesis block up to the tip to writer as a block
+// file and returns the number of blocks written. The chain is read from a snapshot of the database, so blocks
+// connected meanwhile are not written. Pruned blocks and blocks below a UTXO snapshot can not be exported.
+func (blockchain *BlockChain) ExportBlocks(writer io.Writer) (int, error) {
+	snapshot, err := blockchain.DataBase.NewSnapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer snapshot.Release()
+	tip, err := snapshot.Get(chainStateKey(tipStateName))
+	if err != nil {
+		return 0, err
+	}
+	hashes := [][]byte{}
+	for current := tip; len(current) > 0; {
+		header, exists := readHeader(snapshot, current)
+		if !exists {
+			return 0, fmt.Errorf("header of block %x is missing", current)
+		}
+		hashes = append(hashes, current)
+		current = header.PrevHash
+	}
+
+	bufferedWriter := bufio.NewWriter(writer)
+	for i := len(hashes) - 1; i >= 0; i-- {
+		encodedBlock, err := snapshot.Get(blockKey(hashes[i]))
+		if err != nil {
+			return 0, fmt.Errorf("data of block %x at height %d is not stored", hashes[i], len(hashes)-1-i)
+		}
+		bufferedWriter.Write(binary.BigEndian.AppendUint32(nil, uint32(len(encodedBlock))))
+		if _, err := bufferedWriter.Write(encodedBlock); err != nil {
+			return 0, err
+		}
+	}
+	return len(hashes), bufferedWriter.Flush()
+}
+
+// BlockFileReader reads the blocks of a block file one by one
+type BlockFileReader struct {
+	reader *bufio.Reader
+	count  int // blocks read so far
+}
+
+func NewBlockFileReader(reader io.Reader) *BlockFileReader {
+	return &BlockFileReader{reader: bufio.NewReader(reader)}
+}
+
+// Next returns the next block of the file, or io.EOF at the end of the file. A file ending within a block,
+// as left by an interrupted export, is reported with io.ErrUnexpectedEOF.
+func (blockFileReader *BlockFileReader) Next() (*Block, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(blockFileReader.reader, size[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("block %d is truncated: %w", blockFileReader.count, err)
+		}
+		return nil, err
+	}
+	recordSize := binary.BigEndian.Uint32(size[:])
+	if recordSize == 0 || recordSize > MAX_BLOCK_RECORD_SIZE {
+		return nil, fmt.Errorf("block %d has an invalid size of %d bytes", blockFileReader.count, recordSize)
+	}
+	encodedBlock := make([]byte, recordSize)
+	if _, err := io.ReadFull(blockFileReader.reader, encodedBlock); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("block %d is truncated: %w", blockFileReader.count, err)
+	}
+	var block Block
+	if err := gob.NewDecoder(bytes.NewReader(encodedBlock)).Decode(&block); err != nil {
+		return nil, fmt.Errorf("can not decode block %d: %w", blockFileReader.count, err)
+	}
+	blockFileReader.count++
+	return &block, nil
+}
@@ -0,0 +1,49 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"testing"
+)
+
+func TestBlockFile(t *testing.T) {
+	t.Parallel()
+	chain := InitBlockChain(&RegTestParams, NewMemoryStore())
+	targetHash := RegTestParams.TargetHash()
+	for i := 1; i <= 3; i++ {
+		transactions := []*Transaction{CoinBaseTransaction(RegTestParams.GenesisAddress, COINBASE_REWARD+i)}
+		block := &Block{BlockHeader: BlockHeader{PrevHash: chain.LastHash, Timestamp: fmt.Sprint("block", i)}, Transactions: transactions}
+		for new(big.Int).SetBytes(block.GetHash()).Cmp(targetHash) != -1 {
+			block.Nonce++
+		}
+		chain.StoreNewBlock(block)
+	}
+
+	var blockFile bytes.Buffer
+	if count, err := chain.ExportBlocks(&blockFile); count != 4 || err != nil {
+		t.Fatalf("Expected the 4 blocks of the active chain to be exported, actual: %d (%v)", count, err)
+	}
+	blockFileReader := NewBlockFileReader(bytes.NewReader(blockFile.Bytes()))
+	for height := 0; height < 4; height++ {
+		block, err := blockFileReader.Next()
+		if err != nil || !bytes.Equal(block.GetHash(), chain.Index.GetHashAtHeight(height)) {
+			t.Fatalf("Expected block %d of the active chain to be read (%v)", height, err)
+		}
+	}
+	if _, err := blockFileReader.Next(); err != io.EOF {
+		t.Fatalf("Expected the file to end after the tip, actual: %v", err)
+	}
+
+	truncated := blockFile.Bytes()[:blockFile.Len()-10]
+	blockFileReader = NewBlockFileReader(bytes.NewReader(truncated))
+	var err error
+	for err == nil {
+		_, err = blockFileReader.Next()
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) || blockFileReader.count != 3 {
+		t.Fatalf("Expected a truncated last block to be reported, actual: %v after %d blocks", err, blockFileReader.count)
+	}
+}
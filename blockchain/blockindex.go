@@ -0,0 +1,315 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/big"
+	"sync"
+)
+
+type BlockStatus int
+
+const (
+	BLOCK_HAVE_HEADER BlockStatus = iota // only the header is stored, as on SPV nodes and for pruned blocks
+	BLOCK_HAVE_DATA                      // the full block is stored
+)
+
+// BlockIndexEntry is what the index knows about a stored block
+type BlockIndexEntry struct {
+	Hash      []byte
+	PrevHash  []byte
+	Height    int      // genesis block is height 0
+	ChainWork *big.Int // expected number of hashes needed to build the chain up to and including this block
+	Status    BlockStatus
+}
+
+// BlockIndex keeps every stored block's height, parent and cumulative work, and the hash at each height of
+// the active chain, in memory and in the database. Blocks are indexed lazily from the database the first time
+// they are looked up, so blocks arriving out of order are indexed once their ancestors are stored.
+type BlockIndex struct {
+	database    Store
+	blockWork   *big.Int // work of each block, all blocks are mined at the network's target
+	status      BlockStatus
+	loadHeader  func(hash []byte) (*BlockHeader, bool)
+	mutex       sync.RWMutex
+	entries     map[string]*BlockIndexEntry
+	activeChain [][]byte // activeChain[height] is the hash of the active chain's block at height
+}
+
+// NewBlockIndex loads the index stored in database. loadHeader reads the header stored under a block hash,
+// status is recorded for newly indexed blocks.
+func NewBlockIndex(database Store, params *ChainParams, status BlockStatus, loadHeader func(hash []byte) (*BlockHeader, bool)) *BlockIndex {
+	index := &BlockIndex{
+		database:   database,
+		blockWork:  getBlockWork(params.TargetHash()),
+		status:     status,
+		loadHeader: loadHeader,
+		entries:    make(map[string]*BlockIndexEntry),
+	}
+	iter := database.NewIterator(blockIndexPrefix)
+	for iter.Next() {
+		var entry BlockIndexEntry
+		genericDeserialize(iter.Value(), &entry)
+		index.entries[string(entry.Hash)] = &entry
+	}
+	iter.Release()
+
+	iter = database.NewIterator(heightIndexPrefix)
+	for iter.Next() {
+		index.activeChain = append(index.activeChain, bytes.Clone(iter.Value()))
+	}
+	iter.Release()
+	return index
+}
+
+func blockIndexKey(hash []byte) []byte {
+	return append(append([]byte{}, blockIndexPrefix...), hash...)
+}
+
+func heightIndexKey(height int) []byte {
+	key := make([]byte, len(heightIndexPrefix)+8)
+	copy(key, heightIndexPrefix)
+	binary.BigEndian.PutUint64(key[len(heightIndexPrefix):], uint64(height))
+	return key
+}
+
+// getBlockWork is the expected number of hashes needed to mine a block below targetHash
+func getBlockWork(targetHash *big.Int) *big.Int {
+	maxHash := new(big.Int).Lsh(big.NewInt(1), hashValueLength)
+	return maxHash.Div(maxHash, new(big.Int).Add(targetHash, big.NewInt(1)))
+}
+
+// lookup returns the entry of hash, indexing it and its unindexed ancestors from the database if needed.
+// It returns nil if the block or one of its ancestors is not stored. Must be called with the write lock held.
+func (index *BlockIndex) lookup(hash []byte) *BlockIndexEntry {
+	if entry, exists := index.entries[string(hash)]; exists {
+		return entry
+	}
+
+	unindexedHeaders := []*BlockHeader{}
+	var parent *BlockIndexEntry
+	for currentHash := hash; ; {
+		header, exists := index.loadHeader(currentHash)
+		if !exists {
+			return nil
+		}
+		unindexedHeaders = append(unindexedHeaders, header)
+		if len(header.PrevHash) == 0 {
+			break
+		}
+		if parentEntry, exists := index.entries[string(header.PrevHash)]; exists {
+			parent = parentEntry
+			break
+		}
+		currentHash = header.PrevHash
+	}
+
+	batch := new(Batch)
+	var entry *BlockIndexEntry
+	for i := len(unindexedHeaders) - 1; i >= 0; i-- {
+		entry = index.addEntry(unindexedHeaders[i], parent, batch)
+		parent = entry
+	}
+	index.database.Write(batch)
+	return entry
+}
+
+// addEntry indexes header as a child of parent, nil for the genesis block. Must be called with the write lock held.
+func (index *BlockIndex) addEntry(header *BlockHeader, parent *BlockIndexEntry, batch *Batch) *BlockIndexEntry {
+	entry := &BlockIndexEntry{Hash: header.GetHash(), PrevHash: header.PrevHash, ChainWork: new(big.Int).Set(index.blockWork), Status: index.status}
+	if parent != nil {
+		entry.Height = parent.Height + 1
+		entry.ChainWork.Add(entry.ChainWork, parent.ChainWork)
+	}
+	index.entries[string(entry.Hash)] = entry
+	batch.Put(blockIndexKey(entry.Hash), serialize(entry))
+	return entry
+}
+
+// addHeader indexes a block whose data is written together with batch, so it can not be loaded from the
+// database yet. It reports false if the parent of the block is not stored.
+func (index *BlockIndex) addHeader(header *BlockHeader, batch *Batch) bool {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	if _, exists := index.entries[string(header.GetHash())]; exists {
+		return true
+	}
+	var parent *BlockIndexEntry
+	if len(header.PrevHash) > 0 {
+		if parent = index.lookup(header.PrevHash); parent == nil {
+			return false
+		}
+	}
+	index.addEntry(header, parent, batch)
+	return true
+}
+
+// forget drops the entry added by addHeader for a block whose batch was not written
+func (index *BlockIndex) forget(hash []byte) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	delete(index.entries, string(hash))
+}
+
+// AddBlock indexes a block whose data has just been stored, it reports false if an ancestor is still missing
+func (index *BlockIndex) AddBlock(hash []byte) bool {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	return index.lookup(hash) != nil
+}
+
+// setStatus records what is stored of an indexed block, the change is added to batch and applied once it is written
+func (index *BlockIndex) setStatus(hash []byte, status BlockStatus, batch *Batch) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	if entry, exists := index.entries[string(hash)]; exists {
+		updatedEntry := *entry
+		updatedEntry.Status = status
+		batch.Put(blockIndexKey(hash), serialize(&updatedEntry))
+		batch.onWrite(func() {
+			index.mutex.Lock()
+			defer index.mutex.Unlock()
+			entry.Status = status
+		})
+	}
+}
+
+// TipChange lists the blocks that left and joined the active chain when its tip moved
+type TipChange struct {
+	Disconnected [][]byte // from the old tip down to the fork point
+	Connected    [][]byte // from the fork point up to the new tip
+}
+
+// SetTip makes hash the last block of the active chain and updates the height index accordingly.
+// It reports false if hash or one of its ancestors is not stored, or if the height index can not be written.
+func (index *BlockIndex) SetTip(hash []byte) (TipChange, bool) {
+	batch := new(Batch)
+	change, ok := index.setTip(hash, batch)
+	if ok && writeBatch(index.database, batch) != nil {
+		return TipChange{}, false
+	}
+	return change, ok
+}
+
+// GetTipChange returns the blocks that would leave and join the active chain if hash became its tip,
+// without moving the tip. It reports false if hash or one of its ancestors is not stored.
+func (index *BlockIndex) GetTipChange(hash []byte) (TipChange, bool) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	tip := index.lookup(hash)
+	if tip == nil {
+		return TipChange{}, false
+	}
+	return index.findTipChange(tip), true
+}
+
+// findTipChange walks back from tip until its chain joins the active chain. Must be called with the lock held.
+func (index *BlockIndex) findTipChange(tip *BlockIndexEntry) TipChange {
+	var change TipChange
+	for entry := tip; entry != nil; entry = index.entries[string(entry.PrevHash)] {
+		if entry.Height < len(index.activeChain) && bytes.Equal(index.activeChain[entry.Height], entry.Hash) {
+			break
+		}
+		change.Connected = append([][]byte{entry.Hash}, change.Connected...)
+	}
+	forkHeight := tip.Height - len(change.Connected)
+	for height := len(index.activeChain) - 1; height > forkHeight; height-- {
+		change.Disconnected = append(change.Disconnected, index.activeChain[height])
+	}
+	return change
+}
+
+// setTip is SetTip adding the height index changes to batch, the active chain moves once it is written
+func (index *BlockIndex) setTip(hash []byte, batch *Batch) (TipChange, bool) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	tip := index.lookup(hash)
+	if tip == nil {
+		return TipChange{}, false
+	}
+	change := index.findTipChange(tip)
+	forkHeight := tip.Height - len(change.Connected)
+
+	for height := tip.Height + 1; height < len(index.activeChain); height++ {
+		batch.Delete(heightIndexKey(height))
+	}
+	for i, connectedHash := range change.Connected {
+		batch.Put(heightIndexKey(forkHeight+1+i), connectedHash)
+	}
+	batch.onWrite(func() {
+		index.mutex.Lock()
+		defer index.mutex.Unlock()
+		index.activeChain = append(index.activeChain[:forkHeight+1], change.Connected...)
+	})
+	return change, true
+}
+
+// TipHeight returns the height of the active chain's last block, -1 if the chain is empty
+func (index *BlockIndex) TipHeight() int {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+	return len(index.activeChain) - 1
+}
+
+// GetEntry returns the index entry of hash, or nil if the block is not stored
+func (index *BlockIndex) GetEntry(hash []byte) *BlockIndexEntry {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	entry := index.lookup(hash)
+	if entry == nil {
+		return nil
+	}
+	entryCopy := *entry
+	return &entryCopy
+}
+
+// GetHeight returns the height of hash, or -1 if the block is not stored
+func (index *BlockIndex) GetHeight(hash []byte) int {
+	if entry := index.GetEntry(hash); entry != nil {
+		return entry.Height
+	}
+	return -1
+}
+
+// HasMoreWork reports whether the chain ending at hash has more work than the one ending at otherHash,
+// false if hash is not stored
+func (index *BlockIndex) HasMoreWork(hash, otherHash []byte) bool {
+	entry, other := index.GetEntry(hash), index.GetEntry(otherHash)
+	return entry != nil && (other == nil || entry.ChainWork.Cmp(other.ChainWork) > 0)
+}
+
+// GetHashAtHeight returns the hash of the active chain's block at height, or nil if the chain is shorter
+func (index *BlockIndex) GetHashAtHeight(height int) []byte {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+	if height < 0 || height >= len(index.activeChain) {
+		return nil
+	}
+	return index.activeChain[height]
+}
+
+// IsInActiveChain reports whether hash is a block of the active chain
+func (index *BlockIndex) IsInActiveChain(hash []byte) bool {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	entry := index.lookup(hash)
+	return entry != nil && entry.Height < len(index.activeChain) && bytes.Equal(index.activeChain[entry.Height], hash)
+}
+
+// GetAncestor returns the hash of the ancestor of hash at height. Blocks of the active chain are answered
+// from the height index, blocks of a fork walk back until they join the active chain.
+func (index *BlockIndex) GetAncestor(hash []byte, height int) []byte {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	entry := index.lookup(hash)
+	if entry == nil || height < 0 || height > entry.Height {
+		return nil
+	}
+	for entry.Height > height {
+		if entry.Height < len(index.activeChain) && bytes.Equal(index.activeChain[entry.Height], entry.Hash) {
+			return index.activeChain[height]
+		}
+		entry = index.entries[string(entry.PrevHash)]
+	}
+	return entry.Hash
+}
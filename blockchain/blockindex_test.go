@@ -0,0 +1,63 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestBlockIndex(t *testing.T) {
+	t.Parallel()
+	database := NewMemoryStore()
+
+	headers := make(map[string]*BlockHeader)
+	loadHeader := func(hash []byte) (*BlockHeader, bool) {
+		header, exists := headers[string(hash)]
+		return header, exists
+	}
+	buildChain := func(parent []byte, length int, label string) [][]byte {
+		hashes := [][]byte{}
+		for i := 0; i < length; i++ {
+			header := &BlockHeader{PrevHash: parent, Timestamp: fmt.Sprint(label, i)}
+			parent = header.GetHash()
+			headers[string(parent)] = header
+			hashes = append(hashes, parent)
+		}
+		return hashes
+	}
+
+	index := NewBlockIndex(database, &MainNetParams, BLOCK_HAVE_HEADER, loadHeader)
+	mainChain := buildChain(nil, 10, "main")
+	// Indexing the tip indexes every stored ancestor
+	if _, ok := index.SetTip(mainChain[9]); !ok || index.TipHeight() != 9 || !bytes.Equal(index.GetHashAtHeight(4), mainChain[4]) {
+		t.Fatalf("Expected active chain of 10 blocks, actual tip height: %d", index.TipHeight())
+	}
+	entry := index.GetEntry(mainChain[9])
+	if entry.ChainWork.Cmp(index.GetEntry(mainChain[0]).ChainWork) <= 0 {
+		t.Fatalf("Expected chain work to grow with height")
+	}
+
+	fork := buildChain(mainChain[5], 6, "fork")
+	if index.IsInActiveChain(fork[0]) || !bytes.Equal(index.GetAncestor(fork[5], 3), mainChain[3]) {
+		t.Fatalf("Expected fork ancestor below the fork point to be on the active chain")
+	}
+	change, ok := index.SetTip(fork[5])
+	if !ok || index.TipHeight() != 11 || !bytes.Equal(index.GetHashAtHeight(6), fork[0]) {
+		t.Fatalf("Expected the fork to become the active chain")
+	}
+	if len(change.Disconnected) != 4 || !bytes.Equal(change.Disconnected[0], mainChain[9]) || len(change.Connected) != 6 || !bytes.Equal(change.Connected[0], fork[0]) {
+		t.Fatalf("Expected blocks 6 to 9 of the main chain to be replaced by the fork, actual: %d disconnected, %d connected", len(change.Disconnected), len(change.Connected))
+	}
+	if index.IsInActiveChain(mainChain[9]) || !index.IsInActiveChain(mainChain[5]) {
+		t.Fatalf("Expected blocks after the fork point to leave the active chain")
+	}
+
+	if index.AddBlock([]byte("unknown")) || index.GetHeight([]byte("unknown")) != -1 {
+		t.Fatalf("Expected unknown blocks not to be indexed")
+	}
+
+	reloaded := NewBlockIndex(database, &MainNetParams, BLOCK_HAVE_HEADER, loadHeader)
+	if reloaded.TipHeight() != 11 || reloaded.GetHeight(mainChain[9]) != 9 || !bytes.Equal(reloaded.GetHashAtHeight(11), fork[5]) {
+		t.Fatalf("Expected the index to be restored from the database")
+	}
+}
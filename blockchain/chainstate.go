@@ -0,0 +1,343 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"golang.org/x/exp/slices"
+)
+
+// SpentOutput is an output spent by a block, with the hash of the transaction that created it
+type SpentOutput struct {
+	TxID []byte
+	TxOutputWithIndex
+}
+
+// BlockUndo holds what is needed to disconnect a block from the active chain: the outputs its transactions spent
+type BlockUndo struct {
+	SpentOutputs []SpentOutput
+}
+
+func undoKey(hash []byte) []byte {
+	return append(append([]byte{}, undoPrefix...), hash...)
+}
+
+// utxoView is the UTXO set seen through changes not written yet, so a block can spend outputs created earlier
+// in the same block and all its changes can be written at once
+type utxoView struct {
+	database StoreReader
+	changed  map[string]TxOutputs // transaction hash -> unspent outputs, empty once they are all spent
+}
+
+func newUTXOView(database StoreReader) *utxoView {
+	return &utxoView{database, make(map[string]TxOutputs)}
+}
+
+func (view *utxoView) get(txnID []byte) TxOutputs {
+	if txnOutputs, exists := view.changed[string(txnID)]; exists {
+		return txnOutputs
+	}
+	encodedTxnOutputs, err := view.database.Get(utxoKey(txnID))
+	if err != nil {
+		return nil
+	}
+	return deserializeTxnOutputs(encodedTxnOutputs)
+}
+
+// write adds the changes of the view to batch
+func (view *utxoView) write(batch *Batch) {
+	for txnID, txnOutputs := range view.changed {
+		if len(txnOutputs) > 0 {
+			batch.Put(utxoKey([]byte(txnID)), serialize(txnOutputs))
+		} else {
+			batch.Delete(utxoKey([]byte(txnID)))
+		}
+	}
+}
+
+// forEach calls fn with the unspent outputs of every transaction of the view in ascending order of transaction hash
+func (view *utxoView) forEach(fn func(txnID []byte, txnOutputs TxOutputs) error) error {
+	changedTxnIDs := make([]string, 0, len(view.changed))
+	for txnID := range view.changed {
+		changedTxnIDs = append(changedTxnIDs, txnID)
+	}
+	sort.Strings(changedTxnIDs)
+	next := 0
+	emitChanged := func(txnID string) error {
+		if txnOutputs := view.changed[txnID]; len(txnOutputs) > 0 {
+			return fn([]byte(txnID), txnOutputs)
+		}
+		return nil
+	}
+
+	iter := view.database.NewIterator(utxoPrefix)
+	defer iter.Release()
+	for iter.Next() {
+		txnID := string(iter.Key()[len(utxoPrefix):])
+		for ; next < len(changedTxnIDs) && changedTxnIDs[next] < txnID; next++ {
+			if err := emitChanged(changedTxnIDs[next]); err != nil {
+				return err
+			}
+		}
+		if next < len(changedTxnIDs) && changedTxnIDs[next] == txnID {
+			next++
+			if err := emitChanged(txnID); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := fn([]byte(txnID), deserializeTxnOutputs(iter.Value())); err != nil {
+			return err
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	for ; next < len(changedTxnIDs); next++ {
+		if err := emitChanged(changedTxnIDs[next]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// spend removes the output referenced by txnInput from the view and returns it, or reports false if it is
+// unknown or already spent
+func (view *utxoView) spend(txnInput *TxInput) (SpentOutput, bool) {
+	txnOutputs := view.get(txnInput.TxID)
+	position := slices.IndexFunc(txnOutputs, func(txnOutput TxOutputWithIndex) bool { return txnOutput.Index == txnInput.VOut })
+	if position < 0 {
+		return SpentOutput{}, false
+	}
+	view.changed[string(txnInput.TxID)] = slices.Delete(slices.Clone(txnOutputs), position, position+1)
+	return SpentOutput{txnInput.TxID, txnOutputs[position]}, true
+}
+
+// addOutputs adds the outputs of transaction, created by the block at height
+func (view *utxoView) addOutputs(transaction *Transaction, height int) {
+	isCoinbase := IsCoinbaseTransaction(transaction)
+	var txnOutputs TxOutputs
+	for outputIndex, txnOutput := range transaction.Outputs {
+		txnOutputs = append(txnOutputs, TxOutputWithIndex{txnOutput, outputIndex, height, isCoinbase})
+	}
+	view.changed[string(transaction.Hash)] = txnOutputs
+}
+
+// connectBlock spends the outputs referenced by the transactions of block and adds their outputs, created at
+// height, and returns the spent outputs. An input referencing an output that is unknown or already spent, also
+// by an earlier input of the block, is an error and leaves the view half updated, to be dropped by the caller.
+func (view *utxoView) connectBlock(block *Block, height int) (*BlockUndo, error) {
+	undo := &BlockUndo{}
+	for _, transaction := range block.Transactions {
+		for _, txnInput := range transaction.Inputs {
+			spentOutput, ok := view.spend(&txnInput)
+			if !ok {
+				return nil, fmt.Errorf("transaction %x spends output %x:%d, which is unknown or already spent", transaction.Hash, txnInput.TxID, txnInput.VOut)
+			}
+			undo.SpentOutputs = append(undo.SpentOutputs, spentOutput)
+		}
+		view.addOutputs(transaction, height)
+	}
+	return undo, nil
+}
+
+// disconnectBlock removes the outputs created by block and restores the outputs it spent
+func (view *utxoView) disconnectBlock(block *Block, undo *BlockUndo) {
+	createdTxnIDs := make(map[string]bool)
+	for _, transaction := range block.Transactions {
+		view.changed[string(transaction.Hash)] = nil
+		createdTxnIDs[string(transaction.Hash)] = true
+	}
+	for _, spentOutput := range undo.SpentOutputs {
+		// Outputs created and spent within this block are gone with it
+		if createdTxnIDs[string(spentOutput.TxID)] {
+			continue
+		}
+		txnOutputs := append(slices.Clone(view.get(spentOutput.TxID)), spentOutput.TxOutputWithIndex)
+		sort.Slice(txnOutputs, func(i, j int) bool { return txnOutputs[i].Index < txnOutputs[j].Index })
+		view.changed[string(spentOutput.TxID)] = txnOutputs
+	}
+}
+
+// rebuildChainState replays the active chain from the genesis block into batch: the UTXO set is replaced and
+// the undo data of every block is written. Databases of header chains are left alone.
+func rebuildChainState(database StoreReader, batch *Batch) error {
+	tip, err := database.Get(chainStateKey(tipStateName))
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if isHeaderChain, _ := database.Has(headerKey(tip)); isHeaderChain {
+		return nil
+	}
+
+	hashes := [][]byte{} // from the tip down to the genesis block
+	for hash := tip; len(hash) > 0; {
+		encodedBlock, err := database.Get(blockKey(hash))
+		if err != nil {
+			return fmt.Errorf("block %x of the active chain is missing: %w", hash, err)
+		}
+		hashes = append(hashes, hash)
+		hash = DeserializeBlock(encodedBlock).PrevHash
+	}
+
+	iter := database.NewIterator(utxoPrefix)
+	for iter.Next() {
+		batch.Delete(iter.Key())
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	view := newUTXOView(NewMemoryStore())
+	for i := len(hashes) - 1; i >= 0; i-- {
+		encodedBlock, err := database.Get(blockKey(hashes[i]))
+		if err != nil {
+			return err
+		}
+		undo, err := view.connectBlock(DeserializeBlock(encodedBlock), len(hashes)-1-i)
+		if err != nil {
+			return fmt.Errorf("can not connect block %x: %w", hashes[i], err)
+		}
+		batch.Put(undoKey(hashes[i]), serialize(undo))
+	}
+	view.write(batch)
+	return nil
+}
+
+// connectBlock connects block, a child of the tip, to the active chain. Its UTXO changes, undo data, index
+// entries and the new tip are added to batch, which may already hold the block itself, and written at once.
+// Nothing is written if the block spends outputs that are unknown or already spent, or fails the block verifier.
+func (blockchain *BlockChain) connectBlock(block *Block, batch *Batch) error {
+	hash := block.GetHash()
+	height := blockchain.Index.GetHeight(hash)
+	if blockchain.verify != nil {
+		if err := CheckBlockContent(block); err != nil {
+			return fmt.Errorf("block %x at height %d is invalid: %w", hash, height, err)
+		}
+		// The UTXO set is the one built by the parent, the tip
+		if !blockchain.verify(block, &UTXOSet{blockchain.DataBase}, height) {
+			return fmt.Errorf("block %x at height %d is invalid", hash, height)
+		}
+	}
+	view := newUTXOView(blockchain.DataBase)
+	undo, err := view.connectBlock(block, height)
+	if err != nil {
+		return fmt.Errorf("can not connect block %x: %w", hash, err)
+	}
+	view.write(batch)
+	batch.Put(undoKey(hash), serialize(undo))
+	if blockchain.TxIndex != nil {
+		blockchain.TxIndex.connectBlock(block, batch)
+	}
+	if blockchain.AddrIndex != nil {
+		blockchain.AddrIndex.connectBlock(block, height, batch)
+	}
+	blockchain.pruneBlocks(height, batch)
+	return blockchain.writeTip(hash, batch)
+}
+
+// disconnectTip moves the tip of the active chain back to its parent in a single write, restoring the outputs
+// the tip block spent
+func (blockchain *BlockChain) disconnectTip() error {
+	hash := blockchain.LastHash
+	block := blockchain.GetBlock(hash)
+	encodedUndo, err := blockchain.DataBase.Get(undoKey(hash))
+	if block == nil || err != nil {
+		return fmt.Errorf("can not disconnect block %x, its data or undo data is missing", hash)
+	}
+	var undo BlockUndo
+	genericDeserialize(encodedUndo, &undo)
+
+	batch := new(Batch)
+	view := newUTXOView(blockchain.DataBase)
+	view.disconnectBlock(block, &undo)
+	view.write(batch)
+	batch.Delete(undoKey(hash))
+	if blockchain.TxIndex != nil {
+		blockchain.TxIndex.disconnectBlock(block, batch)
+	}
+	if blockchain.AddrIndex != nil {
+		blockchain.AddrIndex.disconnectBlock(block, blockchain.Index.GetHeight(hash), batch)
+	}
+	return blockchain.writeTip(block.PrevHash, batch)
+}
+
+// writeTip adds the new tip and its height index changes to batch and writes it. The tip moves in memory only
+// once the batch is written.
+func (blockchain *BlockChain) writeTip(hash []byte, batch *Batch) error {
+	blockchain.Index.setTip(hash, batch)
+	batch.Put(chainStateKey(tipStateName), hash)
+	batch.onWrite(func() { blockchain.LastHash = hash })
+	if err := writeBatch(blockchain.DataBase, batch); err != nil {
+		return fmt.Errorf("can not write the chain tip %x: %w", hash, err)
+	}
+	return nil
+}
+
+// CheckChainState verifies that the stored tip, the height index and the UTXO set agree, as they may not after
+// a crash of an older version. The height index and the UTXO set are repaired from the stored blocks, missing
+// blocks are reported.
+func (blockchain *BlockChain) CheckChainState() error {
+	tipBlock := blockchain.GetBlock(blockchain.LastHash)
+	if tipBlock == nil {
+		return fmt.Errorf("block %x at the chain tip is missing", blockchain.LastHash)
+	}
+	if !bytes.Equal(blockchain.Index.GetHashAtHeight(blockchain.Index.TipHeight()), blockchain.LastHash) {
+		fmt.Println("Height index does not end at the chain tip, repairing it")
+		if _, ok := blockchain.Index.SetTip(blockchain.LastHash); !ok {
+			return fmt.Errorf("ancestors of the chain tip %x are missing", blockchain.LastHash)
+		}
+	}
+	if err := blockchain.checkUTXOSet(tipBlock); err != nil {
+		if blockchain.pruneHeight > 0 {
+			return fmt.Errorf("UTXO set does not match the chain tip (%v) and can not be rebuilt from pruned blocks", err)
+		}
+		fmt.Printf("UTXO set does not match the chain tip (%v), rebuilding it\n", err)
+		batch := new(Batch)
+		if err := rebuildChainState(blockchain.DataBase, batch); err != nil {
+			return err
+		}
+		return blockchain.DataBase.Write(batch)
+	}
+	return nil
+}
+
+// checkUTXOSet reports whether the UTXO set is the one left by connecting the tip block: the outputs it
+// created are unspent and the outputs it spent are gone
+func (blockchain *BlockChain) checkUTXOSet(tipBlock *Block) error {
+	encodedUndo, err := blockchain.DataBase.Get(undoKey(blockchain.LastHash))
+	if err != nil {
+		return fmt.Errorf("undo data of the tip is missing")
+	}
+	var undo BlockUndo
+	genericDeserialize(encodedUndo, &undo)
+
+	type outpoint struct {
+		txnID string
+		index int
+	}
+	utxoSet := blockchain.UTXOSet()
+	spentOutputs := make(map[outpoint]bool)
+	for _, spentOutput := range undo.SpentOutputs {
+		spentOutputs[outpoint{string(spentOutput.TxID), spentOutput.Index}] = true
+		if utxoSet.GetUTXOFromTxInput(&TxInput{TxID: spentOutput.TxID, VOut: spentOutput.Index}) != nil {
+			return fmt.Errorf("output %x:%d spent by the tip is unspent", spentOutput.TxID, spentOutput.Index)
+		}
+	}
+	for _, transaction := range tipBlock.Transactions {
+		for outputIndex := range transaction.Outputs {
+			if spentOutputs[outpoint{string(transaction.Hash), outputIndex}] {
+				continue
+			}
+			if utxoSet.GetUTXOFromTxInput(&TxInput{TxID: transaction.Hash, VOut: outputIndex}) == nil {
+				return fmt.Errorf("output %x:%d created by the tip is missing", transaction.Hash, outputIndex)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestChainState(t *testing.T) {
+	t.Parallel()
+	database := NewMemoryStore()
+	blockchain := InitBlockChain(&RegTestParams, database)
+	genesisHash := blockchain.LastHash
+	address := RegTestParams.GenesisAddress
+
+	newBlock := func(prevHash []byte, label string, transactions ...*Transaction) *Block {
+		return &Block{BlockHeader: BlockHeader{PrevHash: prevHash, Timestamp: label}, Transactions: transactions}
+	}
+	firstCoinbase := CoinBaseTransaction(address, COINBASE_REWARD+1)
+	firstBlock := newBlock(genesisHash, "first", firstCoinbase)
+	payment := &Transaction{
+		Inputs:  []TxInput{{TxID: firstCoinbase.Hash, VOut: 0}},
+		Outputs: []TxOutput{createTxnOutput(300, address), createTxnOutput(COINBASE_REWARD-299, address)},
+	}
+	payment.SetHash()
+	secondBlock := newBlock(firstBlock.GetHash(), "second", CoinBaseTransaction(address, COINBASE_REWARD+2), payment)
+	blockchain.StoreNewBlock(firstBlock)
+	blockchain.StoreNewBlock(secondBlock)
+
+	utxoSet := blockchain.UTXOSet()
+	isUnspent := func(txnID []byte, index int) bool {
+		return utxoSet.GetUTXOFromTxInput(&TxInput{TxID: txnID, VOut: index}) != nil
+	}
+	if isUnspent(firstCoinbase.Hash, 0) || !isUnspent(payment.Hash, 1) || blockchain.GetHeight() != 3 {
+		t.Fatalf("Expected the payment to spend the first coinbase")
+	}
+
+	// A longer fork from the genesis block disconnects both blocks
+	forkHashes := [][]byte{}
+	for prevHash, i := genesisHash, 0; i < 3; i++ {
+		forkBlock := newBlock(prevHash, fmt.Sprint("fork", i), CoinBaseTransaction(address, COINBASE_REWARD+10+i))
+		blockchain.SetBlock(forkBlock)
+		prevHash = forkBlock.GetHash()
+		forkHashes = append(forkHashes, prevHash)
+	}
+	blockchain.SetLastHash(forkHashes[2])
+	if isUnspent(firstCoinbase.Hash, 0) || isUnspent(payment.Hash, 0) || !bytes.Equal(blockchain.LastHash, forkHashes[2]) {
+		t.Fatalf("Expected outputs of disconnected blocks to leave the UTXO set")
+	}
+	if info := utxoSet.GetInfo(); info.TxOutputs != 4 {
+		t.Fatalf("Expected genesis and fork coinbases in the UTXO set, actual: %+v", info)
+	}
+	if exists, _ := database.Has(undoKey(secondBlock.GetHash())); exists {
+		t.Fatalf("Expected undo data of disconnected blocks to be removed")
+	}
+
+	blockchain.SetLastHash(secondBlock.GetHash())
+	if isUnspent(firstCoinbase.Hash, 0) || !isUnspent(payment.Hash, 0) || blockchain.GetHeight() != 3 {
+		t.Fatalf("Expected reconnected blocks to spend and create outputs again")
+	}
+
+	// A branch with no more work than the active chain is stored without becoming its tip
+	sideBlock := newBlock(firstBlock.GetHash(), "side", CoinBaseTransaction(address, COINBASE_REWARD+5))
+	if err := blockchain.StoreNewBlock(sideBlock); err != nil || !bytes.Equal(blockchain.LastHash, secondBlock.GetHash()) || blockchain.GetBlock(sideBlock.GetHash()) == nil {
+		t.Fatalf("Expected the side block to be stored and the tip to stay in place (%v)", err)
+	}
+
+	// A block spending an output twice is not connected, a branch with such a block leaves the tip in place
+	doubleSpend := &Transaction{
+		Inputs:  []TxInput{{TxID: payment.Hash, VOut: 0}, {TxID: payment.Hash, VOut: 0}},
+		Outputs: []TxOutput{createTxnOutput(600, address)},
+	}
+	doubleSpend.SetHash()
+	invalidBlock := newBlock(secondBlock.GetHash(), "invalid", CoinBaseTransaction(address, COINBASE_REWARD+4), doubleSpend)
+	if err := blockchain.StoreNewBlock(invalidBlock); err == nil || !bytes.Equal(blockchain.LastHash, secondBlock.GetHash()) || !isUnspent(payment.Hash, 0) {
+		t.Fatalf("Expected a block spending an output twice to be rejected (%v)", err)
+	}
+	invalidFork := newBlock(forkHashes[2], "fork3", CoinBaseTransaction(address, COINBASE_REWARD+13), doubleSpend)
+	blockchain.SetBlock(invalidFork)
+	if err := blockchain.SetLastHash(invalidFork.GetHash()); err == nil || !bytes.Equal(blockchain.LastHash, secondBlock.GetHash()) || !isUnspent(payment.Hash, 0) {
+		t.Fatalf("Expected the previous tip to be restored when a block of the branch can not be connected (%v)", err)
+	}
+
+	// Blocks of a branch are verified as they are connected, at their height against the UTXO set of their parent,
+	// the second block again as the previous tip is restored
+	verifiedHeights := []int{}
+	blockchain.SetBlockVerifier(func(block *Block, utxoSet *UTXOSet, height int) bool {
+		verifiedHeights = append(verifiedHeights, height)
+		return utxoSet.GetUTXOFromTxInput(&TxInput{TxID: payment.Hash, VOut: 0}) == nil && block.Timestamp != "rejected"
+	})
+	rejectedBlock := newBlock(sideBlock.GetHash(), "rejected", CoinBaseTransaction(address, COINBASE_REWARD+6))
+	if err := blockchain.StoreNewBlock(rejectedBlock); err == nil || !bytes.Equal(blockchain.LastHash, secondBlock.GetHash()) || fmt.Sprint(verifiedHeights) != "[2 3 2]" {
+		t.Fatalf("Expected the branch to be rejected at its second block, verified heights: %v (%v)", verifiedHeights, err)
+	}
+	blockchain.SetBlockVerifier(nil)
+
+	// Tip written without the UTXO changes of its block, as older versions could leave it after a crash
+	thirdBlock := newBlock(secondBlock.GetHash(), "third", CoinBaseTransaction(address, COINBASE_REWARD+3))
+	database.Put(blockKey(thirdBlock.GetHash()), serialize(thirdBlock))
+	database.Put(chainStateKey(tipStateName), thirdBlock.GetHash())
+	reopened := InitBlockChain(&RegTestParams, database)
+	utxoSet = reopened.UTXOSet()
+	if !isUnspent(thirdBlock.Transactions[0].Hash, 0) || !isUnspent(payment.Hash, 1) || reopened.GetHeight() != 4 {
+		t.Fatalf("Expected the height index and the UTXO set to be repaired")
+	}
+
+	reopened.LastHash = []byte("missing")
+	if err := reopened.CheckChainState(); err == nil {
+		t.Fatalf("Expected a missing tip block to be reported")
+	}
+}
+
+// failingStore fails every batch write while failWrites is set
+type failingStore struct {
+	*MemoryStore
+	failWrites bool
+}
+
+func (store *failingStore) Write(batch *Batch) error {
+	if store.failWrites {
+		return errors.New("disk full")
+	}
+	return store.MemoryStore.Write(batch)
+}
+
+func TestChainStateWriteFailure(t *testing.T) {
+	t.Parallel()
+	database := &failingStore{MemoryStore: NewMemoryStore()}
+	blockchain := InitBlockChain(&RegTestParams, database)
+	if err := blockchain.EnablePruning(MIN_PRUNE_DEPTH); err != nil {
+		t.Fatal(err)
+	}
+	address := RegTestParams.GenesisAddress
+	newBlock := func(height int) *Block {
+		coinbase := CoinBaseTransaction(address, COINBASE_REWARD+height)
+		return &Block{BlockHeader: BlockHeader{PrevHash: blockchain.LastHash, Timestamp: fmt.Sprint("block", height)}, Transactions: []*Transaction{coinbase}}
+	}
+	for height := 1; height < MIN_PRUNE_DEPTH; height++ {
+		if err := blockchain.StoreNewBlock(newBlock(height)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The next block prunes the genesis block, neither happens in memory if the write fails
+	previousTip := blockchain.LastHash
+	genesisHash := blockchain.Index.GetHashAtHeight(0)
+	block := newBlock(MIN_PRUNE_DEPTH)
+	database.failWrites = true
+	if err := blockchain.StoreNewBlock(block); err == nil {
+		t.Fatalf("Expected the failed write to be reported")
+	}
+	if !bytes.Equal(blockchain.LastHash, previousTip) || blockchain.Index.TipHeight() != MIN_PRUNE_DEPTH-1 || blockchain.GetPruneHeight() != 0 || blockchain.IsPruned(genesisHash) {
+		t.Fatalf("Expected the tip, the height index and the prune height to stay in place")
+	}
+
+	database.failWrites = false
+	if err := blockchain.StoreNewBlock(block); err != nil || blockchain.GetPruneHeight() != 1 || !blockchain.IsPruned(genesisHash) {
+		t.Fatalf("Expected the block to be connected and the genesis block pruned once writes succeed (%v)", err)
+	}
+}
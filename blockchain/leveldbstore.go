@@ -0,0 +1,105 @@
+package blockchain
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// LevelDBStore is a Store in a LevelDB database on disk
+type LevelDBStore struct {
+	db *leveldb.DB
+}
+
+type levelDBSnapshot struct {
+	snapshot *leveldb.Snapshot
+}
+
+// OpenLevelDBStore opens the database in directory path, creating it if needed
+func OpenLevelDBStore(path string) (*LevelDBStore, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &LevelDBStore{db}, nil
+}
+
+func levelDBError(err error) error {
+	if err == leveldb.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+func newLevelDBIterator(prefix []byte, newIterator func(*util.Range) iterator.Iterator) Iterator {
+	if prefix == nil {
+		return newIterator(nil)
+	}
+	return newIterator(util.BytesPrefix(prefix))
+}
+
+func (store *LevelDBStore) Get(key []byte) ([]byte, error) {
+	value, err := store.db.Get(key, nil)
+	return value, levelDBError(err)
+}
+
+func (store *LevelDBStore) Has(key []byte) (bool, error) {
+	return store.db.Has(key, nil)
+}
+
+func (store *LevelDBStore) NewIterator(prefix []byte) Iterator {
+	return newLevelDBIterator(prefix, func(slice *util.Range) iterator.Iterator {
+		return store.db.NewIterator(slice, nil)
+	})
+}
+
+func (store *LevelDBStore) Put(key, value []byte) error {
+	return store.db.Put(key, value, nil)
+}
+
+func (store *LevelDBStore) Delete(key []byte) error {
+	return store.db.Delete(key, nil)
+}
+
+func (store *LevelDBStore) Write(batch *Batch) error {
+	levelDBBatch := new(leveldb.Batch)
+	for _, operation := range batch.operations {
+		if operation.delete {
+			levelDBBatch.Delete(operation.key)
+		} else {
+			levelDBBatch.Put(operation.key, operation.value)
+		}
+	}
+	return store.db.Write(levelDBBatch, nil)
+}
+
+func (store *LevelDBStore) NewSnapshot() (Snapshot, error) {
+	snapshot, err := store.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &levelDBSnapshot{snapshot}, nil
+}
+
+func (store *LevelDBStore) Close() error {
+	return store.db.Close()
+}
+
+func (snapshot *levelDBSnapshot) Get(key []byte) ([]byte, error) {
+	value, err := snapshot.snapshot.Get(key, nil)
+	return value, levelDBError(err)
+}
+
+func (snapshot *levelDBSnapshot) Has(key []byte) (bool, error) {
+	return snapshot.snapshot.Has(key, nil)
+}
+
+func (snapshot *levelDBSnapshot) NewIterator(prefix []byte) Iterator {
+	return newLevelDBIterator(prefix, func(slice *util.Range) iterator.Iterator {
+		return snapshot.snapshot.NewIterator(slice, nil)
+	})
+}
+
+func (snapshot *levelDBSnapshot) Release() {
+	snapshot.snapshot.Release()
+}
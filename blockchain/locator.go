@@ -0,0 +1,54 @@
+package blockchain
+
+import "bytes"
+
+// Number of blocks below the tip listed one by one in a locator before the step starts doubling
+const locatorDenseBlocks = 10
+
+// GetLocator lists hashes of the chain ending at hash, densely near hash and exponentially spaced further
+// back, always ending with the genesis block, so a peer can find the latest block both chains share
+// even if hash is on a fork it doesn't know
+func (index *BlockIndex) GetLocator(hash []byte) [][]byte {
+	entry := index.GetEntry(hash)
+	if entry == nil {
+		return [][]byte{}
+	}
+	locator := [][]byte{}
+	step := 1
+	for height := entry.Height; height > 0; height -= step {
+		locator = append(locator, index.GetAncestor(hash, height))
+		if len(locator) >= locatorDenseBlocks {
+			step *= 2
+		}
+	}
+	return append(locator, index.GetAncestor(hash, 0))
+}
+
+// FindFork returns the height of the first locator hash on the active chain, the latest block shared with
+// the chain the locator describes. It returns -1 if none is, which means the chains don't share a genesis block.
+func (index *BlockIndex) FindFork(locator [][]byte) int {
+	for _, hash := range locator {
+		if index.IsInActiveChain(hash) {
+			return index.GetHeight(hash)
+		}
+	}
+	return -1
+}
+
+// GetHashesAfter returns up to max hashes of the active chain following the fork point with locator,
+// oldest first, ending early at stopHash. An empty stopHash means up to the tip.
+func (index *BlockIndex) GetHashesAfter(locator [][]byte, stopHash []byte, max int) [][]byte {
+	hashes := [][]byte{}
+	forkHeight := index.FindFork(locator)
+	if forkHeight < 0 {
+		return hashes
+	}
+	for height := forkHeight + 1; height <= index.TipHeight() && len(hashes) < max; height++ {
+		hash := index.GetHashAtHeight(height)
+		hashes = append(hashes, hash)
+		if bytes.Equal(hash, stopHash) {
+			break
+		}
+	}
+	return hashes
+}
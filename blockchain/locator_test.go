@@ -0,0 +1,57 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestBlockLocator(t *testing.T) {
+	t.Parallel()
+	database := NewMemoryStore()
+
+	headers := make(map[string]*BlockHeader)
+	loadHeader := func(hash []byte) (*BlockHeader, bool) {
+		header, exists := headers[string(hash)]
+		return header, exists
+	}
+	index := NewBlockIndex(database, &MainNetParams, BLOCK_HAVE_HEADER, loadHeader)
+	buildChain := func(parent []byte, length int, label string) [][]byte {
+		hashes := [][]byte{}
+		for i := 0; i < length; i++ {
+			header := &BlockHeader{PrevHash: parent, Timestamp: fmt.Sprint(label, i)}
+			parent = header.GetHash()
+			headers[string(parent)] = header
+			hashes = append(hashes, parent)
+		}
+		return hashes
+	}
+
+	mainChain := buildChain(nil, 100, "main")
+	index.SetTip(mainChain[99])
+	locator := index.GetLocator(mainChain[99])
+	// 10 dense entries, then steps of 2, 4, 8, 16, 32 and the genesis block
+	if len(locator) != 16 || !bytes.Equal(locator[0], mainChain[99]) || !bytes.Equal(locator[10], mainChain[88]) || !bytes.Equal(locator[15], mainChain[0]) {
+		t.Fatalf("Unexpected locator of %d hashes", len(locator))
+	}
+
+	// A peer whose chain forks off block 60
+	peerDatabase := NewMemoryStore()
+	peerIndex := NewBlockIndex(peerDatabase, &MainNetParams, BLOCK_HAVE_HEADER, loadHeader)
+	fork := buildChain(mainChain[60], 20, "fork")
+	peerIndex.SetTip(fork[19])
+	peerLocator := peerIndex.GetLocator(fork[19])
+	if forkHeight := index.FindFork(peerLocator); forkHeight > 60 || forkHeight < 50 {
+		t.Fatalf("Expected a fork point close below height 60, actual: %d", forkHeight)
+	}
+	hashes := index.GetHashesAfter(peerLocator, mainChain[70], 500)
+	if len(hashes) == 0 || !bytes.Equal(hashes[len(hashes)-1], mainChain[70]) || index.GetHeight(hashes[0]) > 61 {
+		t.Fatalf("Expected hashes from the fork point up to the stop hash, actual: %d", len(hashes))
+	}
+	if hashes := index.GetHashesAfter(peerLocator, nil, 5); len(hashes) != 5 {
+		t.Fatalf("Expected at most 5 hashes, actual: %d", len(hashes))
+	}
+	if index.FindFork([][]byte{[]byte("unknown")}) != -1 {
+		t.Fatalf("Expected no fork point for unknown blocks")
+	}
+}
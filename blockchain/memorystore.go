@@ -0,0 +1,164 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+)
+
+var errStoreClosed = errors.New("store is closed")
+
+// MemoryStore is a Store kept in memory, for tests and throwaway nodes
+type MemoryStore struct {
+	mutex  sync.RWMutex
+	data   map[string][]byte
+	closed bool
+}
+
+// memoryView is a read-only copy of the data of a MemoryStore
+type memoryView map[string][]byte
+
+type memoryIterator struct {
+	keys   []string
+	values [][]byte
+	index  int
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: make(map[string][]byte)}
+}
+
+func (store *MemoryStore) Get(key []byte) ([]byte, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if store.closed {
+		return nil, errStoreClosed
+	}
+	return memoryView(store.data).Get(key)
+}
+
+func (store *MemoryStore) Has(key []byte) (bool, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if store.closed {
+		return false, errStoreClosed
+	}
+	return memoryView(store.data).Has(key)
+}
+
+// NewIterator walks the keys present when it was created, later writes are not visible to it
+func (store *MemoryStore) NewIterator(prefix []byte) Iterator {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if store.closed {
+		return &memoryIterator{index: -1}
+	}
+	return memoryView(store.data).NewIterator(prefix)
+}
+
+func (store *MemoryStore) Put(key, value []byte) error {
+	batch := new(Batch)
+	batch.Put(key, value)
+	return store.Write(batch)
+}
+
+func (store *MemoryStore) Delete(key []byte) error {
+	batch := new(Batch)
+	batch.Delete(key)
+	return store.Write(batch)
+}
+
+func (store *MemoryStore) Write(batch *Batch) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.closed {
+		return errStoreClosed
+	}
+	for _, operation := range batch.operations {
+		if operation.delete {
+			delete(store.data, string(operation.key))
+		} else {
+			store.data[string(operation.key)] = operation.value
+		}
+	}
+	return nil
+}
+
+func (store *MemoryStore) NewSnapshot() (Snapshot, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if store.closed {
+		return nil, errStoreClosed
+	}
+	view := make(memoryView, len(store.data))
+	for key, value := range store.data {
+		view[key] = value // values are never modified in place
+	}
+	return view, nil
+}
+
+func (store *MemoryStore) Close() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.closed = true
+	return nil
+}
+
+func (view memoryView) Get(key []byte) ([]byte, error) {
+	value, exists := view[string(key)]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return bytes.Clone(value), nil
+}
+
+func (view memoryView) Has(key []byte) (bool, error) {
+	_, exists := view[string(key)]
+	return exists, nil
+}
+
+func (view memoryView) NewIterator(prefix []byte) Iterator {
+	iter := &memoryIterator{index: -1}
+	for key := range view {
+		if bytes.HasPrefix([]byte(key), prefix) {
+			iter.keys = append(iter.keys, key)
+		}
+	}
+	sort.Strings(iter.keys)
+	for _, key := range iter.keys {
+		iter.values = append(iter.values, view[key])
+	}
+	return iter
+}
+
+func (view memoryView) Release() {}
+
+func (iter *memoryIterator) Next() bool {
+	if iter.index < len(iter.keys) {
+		iter.index++
+	}
+	return iter.index < len(iter.keys)
+}
+
+func (iter *memoryIterator) Key() []byte {
+	if iter.index < 0 || iter.index >= len(iter.keys) {
+		return nil
+	}
+	return []byte(iter.keys[iter.index])
+}
+
+func (iter *memoryIterator) Value() []byte {
+	if iter.index < 0 || iter.index >= len(iter.keys) {
+		return nil
+	}
+	return iter.values[iter.index]
+}
+
+func (iter *memoryIterator) Release() {
+	iter.keys, iter.values = nil, nil
+}
+
+func (iter *memoryIterator) Error() error {
+	return nil
+}
@@ -9,7 +9,6 @@ type MerkleProofNode struct {
 
 func (block *Block) SetMerkleRoot() {
 	currentHashList := [][]byte{}
-	nextHashList := [][]byte{}
 
 	for _, transaction := range block.Transactions {
 		currentHashList = append(currentHashList, getDoubleSHA256(serialize(transaction)))
@@ -23,6 +22,7 @@ func (block *Block) SetMerkleRoot() {
 			block.MerkleRoot = currentHashList[0]
 			break
 		}
+		nextHashList := [][]byte{}
 		for i := 0; i < len(currentHashList); i += 2 {
 			if i == len(currentHashList)-1 {
 				nextHashList = append(nextHashList, getDoubleSHA256(append(currentHashList[i], currentHashList[i]...)))
@@ -36,7 +36,6 @@ func (block *Block) SetMerkleRoot() {
 
 func (block *Block) GetMerkleProof(targetTransaction *Transaction) []MerkleProofNode {
 	currentHashList := [][]byte{}
-	nextHashList := [][]byte{}
 	targetHash := getDoubleSHA256(serialize(targetTransaction))
 	merkleProof := []MerkleProofNode{}
 
@@ -48,6 +47,7 @@ func (block *Block) GetMerkleProof(targetTransaction *Transaction) []MerkleProof
 		if len(currentHashList) == 1 {
 			break
 		}
+		nextHashList := [][]byte{}
 		for i := 0; i < len(currentHashList); i += 2 {
 			if i == len(currentHashList)-1 {
 				nextHash := getDoubleSHA256(append(currentHashList[i], currentHashList[i]...))
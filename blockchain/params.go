@@ -0,0 +1,152 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"time"
+
+	"github.com/btcsuite/btcutil/base58"
+)
+
+// ChainParams holds the consensus rules and identity of a network. Nodes and wallets of different
+// networks don't talk to each other: they differ in network magic, address version byte and genesis block.
+type ChainParams struct {
+	Name             string
+	NetworkMagic     [4]byte // exchanged in the version handshake, peers of other networks are ignored
+	AddressVersion   byte    // prefixed to pubkey hash when calculating address
+	DataDirName      string  // subdirectory of the data directory, empty for mainnet
+	DataDir          string  // root of the node databases and wallet files, "storage" in the working directory if empty
+	InitialPeers     []string
+	DefaultPort      string // P2P port of nodes started without a listen address
+	RPCPort          string
+	DifficultyLevel  int // leading zero bits required in block hashes
+	CoinbaseMaturity int // confirmations a coinbase output needs before it can be spent
+	MonetaryPolicy   MonetaryPolicy
+	MineOnDemand     bool // miners don't mine on a timer, blocks are only mined when requested with GenerateBlocks
+
+	GenesisDate    string // yyyy-Mon-dd
+	GenesisNonce   int
+	GenesisAddress string // receives the genesis block reward
+}
+
+var MainNetParams = ChainParams{
+	Name:             "mainnet",
+	NetworkMagic:     [4]byte{0xf9, 0xbe, 0xb4, 0xd9},
+	AddressVersion:   0x00,
+	InitialPeers:     []string{"localhost:8333", "localhost:8334", "localhost:8335"},
+	DefaultPort:      "8333",
+	RPCPort:          "8332",
+	DifficultyLevel:  12,
+	CoinbaseMaturity: 100,
+	MonetaryPolicy:   MonetaryPolicy{InitialSubsidy: COINBASE_REWARD, HalvingInterval: 210000},
+	GenesisDate:      "2009-Jan-03",
+	GenesisNonce:     4436,
+	GenesisAddress:   "1G78MhhtATZoRZ69qhNNqeSJ2LY1NjQQSV",
+}
+
+var TestNetParams = ChainParams{
+	Name:             "testnet",
+	NetworkMagic:     [4]byte{0x0b, 0x11, 0x09, 0x07},
+	AddressVersion:   0x6f,
+	DataDirName:      "testnet",
+	InitialPeers:     []string{"localhost:18333", "localhost:18334", "localhost:18335"},
+	DefaultPort:      "18333",
+	RPCPort:          "18332",
+	DifficultyLevel:  12,
+	CoinbaseMaturity: 100,
+	MonetaryPolicy:   MonetaryPolicy{InitialSubsidy: COINBASE_REWARD, HalvingInterval: 210000},
+	GenesisDate:      "2011-Feb-02",
+	GenesisNonce:     3078,
+	GenesisAddress:   "mvd5eknryV14CfZmZGLkfZectL8iGfMLgT",
+}
+
+// RegTestParams is a private network for tests: blocks are only mined on request and found at the
+// first few nonces, and the subsidy halves quickly
+var RegTestParams = ChainParams{
+	Name:             "regtest",
+	NetworkMagic:     [4]byte{0xfa, 0xbf, 0xb5, 0xda},
+	AddressVersion:   0x6f,
+	DataDirName:      "regtest",
+	InitialPeers:     []string{"localhost:18444", "localhost:18445", "localhost:18446"},
+	DefaultPort:      "18444",
+	RPCPort:          "18443",
+	DifficultyLevel:  1,
+	CoinbaseMaturity: 100,
+	MonetaryPolicy:   MonetaryPolicy{InitialSubsidy: COINBASE_REWARD, HalvingInterval: 150},
+	MineOnDemand:     true,
+	GenesisDate:      "2011-Feb-02",
+	GenesisNonce:     2,
+	GenesisAddress:   "mvd5eknryV14CfZmZGLkfZectL8iGfMLgT",
+}
+
+// GetChainParams returns the predefined network called name
+func GetChainParams(name string) (*ChainParams, error) {
+	for _, params := range []*ChainParams{&MainNetParams, &TestNetParams, &RegTestParams} {
+		if params.Name == name {
+			return params, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown network %s", name)
+}
+
+// TargetHash is the value block hashes must stay below
+func (params *ChainParams) TargetHash() *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(hashValueLength-params.DifficultyLevel))
+}
+
+// GetBlockSubsidy returns the subsidy of a block at height under the network's monetary policy
+func (params *ChainParams) GetBlockSubsidy(height int) int {
+	return params.MonetaryPolicy.Subsidy(height)
+}
+
+// GetAddress encodes a pubkey hash as an address of the network
+func (params *ChainParams) GetAddress(pubKeyHash []byte) string {
+	return getAddressFromPubkeyHash(pubKeyHash, params.AddressVersion)
+}
+
+// IsAddressValid reports whether address is a well-formed address of the network
+func (params *ChainParams) IsAddressValid(address string) bool {
+	decoded := base58.Decode(address)
+	if len(decoded) != 1+20+pubKeyChecksumLength || decoded[0] != params.AddressVersion {
+		return false
+	}
+	payloadLength := len(decoded) - pubKeyChecksumLength
+	return bytes.Equal(getChecksum(decoded[:payloadLength]), decoded[payloadLength:])
+}
+
+// DataDirPath is the directory holding the node databases and wallet files of the network
+func (params *ChainParams) DataDirPath() string {
+	dataDir := params.DataDir
+	if dataDir == "" {
+		dataDir = "storage"
+	}
+	return filepath.Join(dataDir, params.DataDirName)
+}
+
+// StoragePath is the database directory of the node listening at networkAddress
+func (params *ChainParams) StoragePath(networkAddress string) string {
+	return filepath.Join(params.DataDirPath(), networkAddress)
+}
+
+func (params *ChainParams) GenesisBlock() *Block {
+	genesisBlockDate, _ := time.Parse("2006-Jan-02", params.GenesisDate)
+	txOutput := createTxnOutput(params.GetBlockSubsidy(0), params.GenesisAddress)
+	coinbaseTransaction := Transaction{
+		Inputs:   []TxInput{},
+		Outputs:  []TxOutput{txOutput},
+		Locktime: genesisBlockDate.UnixMilli(),
+	}
+	coinbaseTransaction.SetHash()
+
+	block := Block{
+		BlockHeader: BlockHeader{
+			Timestamp: genesisBlockDate.String(),
+			PrevHash:  []byte{},
+			Nonce:     params.GenesisNonce,
+		},
+		Transactions: []*Transaction{&coinbaseTransaction},
+	}
+	return &block
+}
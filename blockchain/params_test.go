@@ -0,0 +1,36 @@
+package blockchain
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+)
+
+func TestChainParams(t *testing.T) {
+	genesisHashes := [][]byte{}
+	for _, name := range []string{"mainnet", "testnet", "regtest"} {
+		params, err := GetChainParams(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		genesisHash := params.GenesisBlock().GetHash()
+		for _, otherHash := range genesisHashes {
+			if bytes.Equal(genesisHash, otherHash) {
+				t.Fatalf("Expected %s to have its own genesis block", name)
+			}
+		}
+		genesisHashes = append(genesisHashes, genesisHash)
+
+		pubKeyHash := getPubkeyHashFromAddress(params.GenesisAddress)
+		if params.GetAddress(pubKeyHash) != params.GenesisAddress {
+			t.Fatalf("Expected the genesis address of %s to use version byte %d", name, params.AddressVersion)
+		}
+	}
+
+	if new(big.Int).SetBytes(RegTestParams.GenesisBlock().GetHash()).Cmp(RegTestParams.TargetHash()) >= 0 {
+		t.Fatalf("Expected the regtest genesis block to meet the regtest target")
+	}
+	if _, err := GetChainParams("unknown"); err == nil {
+		t.Fatalf("Expected unknown networks to be rejected")
+	}
+}
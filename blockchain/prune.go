@@ -0,0 +1,72 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// MIN_PRUNE_DEPTH is the fewest recent blocks a pruning node keeps, it can not switch to forks branching off deeper
+const MIN_PRUNE_DEPTH = 10
+
+// EnablePruning deletes the data and undo data of the active chain's blocks more than depth blocks below the tip,
+// now and as new blocks are connected. Headers, the block index and the UTXO set are kept.
+func (blockchain *BlockChain) EnablePruning(depth int) error {
+	if depth < MIN_PRUNE_DEPTH {
+		return fmt.Errorf("pruning nodes keep at least %d blocks", MIN_PRUNE_DEPTH)
+	}
+	if blockchain.AddrIndex != nil {
+		return fmt.Errorf("the address index needs every block, it can not be used with pruning")
+	}
+	blockchain.pruneDepth = depth
+	batch := new(Batch)
+	blockchain.pruneBlocks(blockchain.Index.TipHeight(), batch)
+	return writeBatch(blockchain.DataBase, batch)
+}
+
+// GetPruneHeight returns the height of the lowest block of the active chain whose data is stored,
+// 0 unless blocks were pruned
+func (blockchain *BlockChain) GetPruneHeight() int {
+	return blockchain.pruneHeight
+}
+
+// IsPruned reports whether the block with the given hash is indexed but its data was pruned
+func (blockchain *BlockChain) IsPruned(hash []byte) bool {
+	entry := blockchain.Index.GetEntry(hash)
+	return entry != nil && entry.Status == BLOCK_HAVE_HEADER
+}
+
+// pruneBlocks adds to batch the pruning of the blocks more than the prune depth below tipHeight,
+// their header replaces their data. The prune height and the index move once batch is written.
+func (blockchain *BlockChain) pruneBlocks(tipHeight int, batch *Batch) {
+	pruneHeight := tipHeight - blockchain.pruneDepth + 1
+	if blockchain.pruneDepth == 0 || pruneHeight <= blockchain.pruneHeight {
+		return
+	}
+	for height := blockchain.pruneHeight; height < pruneHeight; height++ {
+		// The snapshot block is kept until the blocks below it are validated, the validation connects it last
+		if blockchain.snapshot != nil && height == blockchain.snapshot.Height {
+			continue
+		}
+		blockchain.pruneBlock(blockchain.Index.GetHashAtHeight(height), batch)
+	}
+	blockchain.setPruneHeight(pruneHeight, batch)
+}
+
+// pruneBlock adds to batch the replacement of the data and undo data of the block with the given hash by its header
+func (blockchain *BlockChain) pruneBlock(hash []byte, batch *Batch) {
+	block := blockchain.GetBlock(hash)
+	if block == nil {
+		return
+	}
+	batch.Put(headerKey(hash), serialize(&block.BlockHeader))
+	batch.Delete(blockKey(hash))
+	batch.Delete(undoKey(hash))
+	blockchain.Index.setStatus(hash, BLOCK_HAVE_HEADER, batch)
+}
+
+// setPruneHeight records that the blocks of the active chain below height are pruned, the change is added to batch
+// and applied once it is written
+func (blockchain *BlockChain) setPruneHeight(height int, batch *Batch) {
+	batch.Put(chainStateKey(pruneStateName), binary.BigEndian.AppendUint32(nil, uint32(height)))
+	batch.onWrite(func() { blockchain.pruneHeight = height })
+}
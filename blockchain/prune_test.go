@@ -0,0 +1,61 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestPruning(t *testing.T) {
+	t.Parallel()
+	database := NewMemoryStore()
+	blockchain := InitBlockChain(&RegTestParams, database)
+	genesisHash := blockchain.LastHash
+	if err := blockchain.EnablePruning(MIN_PRUNE_DEPTH - 1); err == nil {
+		t.Fatalf("Expected a prune depth below %d to be rejected", MIN_PRUNE_DEPTH)
+	}
+	if err := blockchain.EnablePruning(MIN_PRUNE_DEPTH); err != nil {
+		t.Fatal(err)
+	}
+
+	hashes := [][]byte{genesisHash}
+	for i := 1; i < 15; i++ {
+		coinbase := CoinBaseTransaction(RegTestParams.GenesisAddress, COINBASE_REWARD+i)
+		block := &Block{BlockHeader: BlockHeader{PrevHash: blockchain.LastHash, Timestamp: fmt.Sprint("block", i)}, Transactions: []*Transaction{coinbase}}
+		blockchain.StoreNewBlock(block)
+		hashes = append(hashes, block.GetHash())
+	}
+	// Heights 5 to 14 are kept
+	if blockchain.GetPruneHeight() != 5 || !blockchain.IsPruned(hashes[4]) || blockchain.IsPruned(hashes[5]) {
+		t.Fatalf("Expected blocks below height 5 to be pruned, actual prune height: %d", blockchain.GetPruneHeight())
+	}
+	if blockchain.GetBlock(hashes[4]) != nil || blockchain.GetBlock(hashes[5]) == nil {
+		t.Fatalf("Expected only the data of pruned blocks to be deleted")
+	}
+	if exists, _ := database.Has(undoKey(hashes[4])); exists {
+		t.Fatalf("Expected undo data of pruned blocks to be deleted")
+	}
+	headers := blockchain.GetHeadersAfter([][]byte{genesisHash}, nil, 3)
+	if len(headers) != 3 || !bytes.Equal(headers[0].GetHash(), hashes[1]) {
+		t.Fatalf("Expected headers of pruned blocks to be served")
+	}
+	utxoSet := blockchain.UTXOSet()
+	if info := utxoSet.GetInfo(); info.TxOutputs != 15 {
+		t.Fatalf("Expected the UTXO set to keep outputs of pruned blocks, actual: %+v", info)
+	}
+
+	// Forks branching off below the prune height can not become the active chain
+	fork := &Block{BlockHeader: BlockHeader{PrevHash: hashes[3], Timestamp: "fork"}, Transactions: []*Transaction{CoinBaseTransaction(RegTestParams.GenesisAddress, 1)}}
+	blockchain.StoreNewBlock(fork)
+	if !bytes.Equal(blockchain.LastHash, hashes[14]) {
+		t.Fatalf("Expected the tip to stay on the pruned chain")
+	}
+
+	reopened := InitBlockChain(&RegTestParams, database)
+	if reopened.GetPruneHeight() != 5 || !reopened.IsPruned(hashes[4]) || !bytes.Equal(reopened.LastHash, hashes[14]) {
+		t.Fatalf("Expected the prune height to be stored")
+	}
+	if err := reopened.EnableAddressIndex(); err == nil {
+		t.Fatalf("Expected the address index to be rejected on a pruned chain")
+	}
+}
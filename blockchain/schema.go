@@ -0,0 +1,172 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+)
+
+// Namespaces of the node database: every key starts with the one-byte prefix of its namespace, so keys of
+// different namespaces never collide and each namespace can be walked on its own
+var (
+	blockPrefix       = []byte("b") // block hash -> Block
+	headerPrefix      = []byte("h") // block hash -> BlockHeader, stored by SPV nodes and for blocks whose data is not
+	blockIndexPrefix  = []byte("i") // block hash -> BlockIndexEntry
+	heightIndexPrefix = []byte("n") // height -> block hash, for blocks of the active chain
+	undoPrefix        = []byte("u") // block hash -> outputs spent by the block, to disconnect it
+	utxoPrefix        = []byte("c") // transaction hash -> TxOutputs
+	chainStatePrefix  = []byte("s") // name -> chain state, see chainStateKey
+	txIndexPrefix     = []byte("t") // transaction hash -> TxLocation
+	addrHistoryPrefix = []byte("a") // pubkey hash + height + txid + event -> AddressEvent
+	addrUTXOPrefix    = []byte("o") // pubkey hash + txid + output index -> TxOutputWithIndex
+)
+
+// WalletNamespace prefixes the verified transactions SPV nodes keep for their wallets
+const WalletNamespace = "w"
+
+const (
+	hashLength        = hashValueLength / 8
+	tipStateName      = "tip"           // hash of the last block of the active chain
+	schemaStateName   = "schemaversion" // uint32, see schemaVersion
+	pruneStateName    = "pruneheight"   // uint32, height of the lowest block whose data is stored
+	snapshotStateName = "snapshot"      // SnapshotMetadata of the UTXO snapshot the chain was loaded from
+	invalidStateName  = "invalid"       // why the blocks below the UTXO snapshot failed the validation
+)
+
+// schemaVersion is the layout of databases written by this version, older databases are upgraded when opened
+var schemaVersion = len(migrations)
+
+type migration struct {
+	description string
+	migrate     func(store StoreReader, batch *Batch) error // adds the changes to batch
+}
+
+// migrations upgrade the database one schema version at a time, migrations[i] upgrades version i to i+1
+var migrations = []migration{
+	{"move keys into namespaces", migrateToNamespaces},
+	{"store undo data of the active chain", rebuildChainState},
+}
+
+func chainStateKey(name string) []byte {
+	return append(append([]byte{}, chainStatePrefix...), name...)
+}
+
+func blockKey(hash []byte) []byte {
+	return append(append([]byte{}, blockPrefix...), hash...)
+}
+
+func headerKey(hash []byte) []byte {
+	return append(append([]byte{}, headerPrefix...), hash...)
+}
+
+// GetSchemaVersion returns the schema version of store, 0 for databases written before versioning
+func GetSchemaVersion(store StoreReader) (int, error) {
+	encodedVersion, err := store.Get(chainStateKey(schemaStateName))
+	if err == ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(encodedVersion) != 4 {
+		return 0, fmt.Errorf("malformed schema version %x", encodedVersion)
+	}
+	return int(binary.BigEndian.Uint32(encodedVersion)), nil
+}
+
+func putSchemaVersion(batch *Batch, version int) {
+	batch.Put(chainStateKey(schemaStateName), binary.BigEndian.AppendUint32(nil, uint32(version)))
+}
+
+// UpgradeStore runs the migrations store needs to reach the current schema version, new databases are marked with the current
+// version. Databases of a newer version than this one can not be opened.
+func UpgradeStore(store Store) error {
+	version, err := GetSchemaVersion(store)
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		iter := store.NewIterator(nil)
+		isEmpty := !iter.Next()
+		iter.Release()
+		if isEmpty {
+			batch := new(Batch)
+			putSchemaVersion(batch, schemaVersion)
+			return store.Write(batch)
+		}
+	}
+	if version > schemaVersion {
+		return fmt.Errorf("database schema version %d is newer than the supported version %d", version, schemaVersion)
+	}
+	for ; version < schemaVersion; version++ {
+		fmt.Printf("Upgrading database to schema version %d: %s\n", version+1, migrations[version].description)
+		// The changes of a migration and the new version are written at once, an interrupted upgrade restarts
+		// from the last completed migration
+		batch := new(Batch)
+		err := migrations[version].migrate(store, batch)
+		if err == nil {
+			putSchemaVersion(batch, version+1)
+			err = store.Write(batch)
+		}
+		if err != nil {
+			return fmt.Errorf("can not upgrade database to schema version %d: %w", version+1, err)
+		}
+	}
+	return nil
+}
+
+// legacyPrefixes map the prefixes of the unversioned layout to their namespace
+var legacyPrefixes = []struct {
+	legacy    string
+	namespace []byte
+}{
+	{"utxo-", utxoPrefix},
+	{"bidx-", blockIndexPrefix},
+	{"hidx-", heightIndexPrefix},
+	{"tidx-", txIndexPrefix},
+	{"aidx-", addrHistoryPrefix},
+	{"autxo-", addrUTXOPrefix},
+	{"wtx-", []byte(WalletNamespace)},
+}
+
+// migrateToNamespaces moves the keys of the unversioned layout into their namespace: blocks and headers stored
+// under their raw hash, LAST_HASH and the dash-prefixed keys. Unknown keys are left in place.
+func migrateToNamespaces(store StoreReader, batch *Batch) error {
+	iter := store.NewIterator(nil)
+	defer iter.Release()
+	for iter.Next() {
+		key, value := iter.Key(), iter.Value()
+		var newKey []byte
+		switch {
+		case string(key) == LAST_HASH_STOGAGE_KEY:
+			newKey = chainStateKey(tipStateName)
+		case len(key) == hashLength:
+			// Legacy keys with a dash prefix are longer than a hash
+			if isEncodedBlock(value) {
+				newKey = blockKey(key)
+			} else {
+				newKey = headerKey(key)
+			}
+		default:
+			for _, prefix := range legacyPrefixes {
+				if bytes.HasPrefix(key, []byte(prefix.legacy)) {
+					newKey = append(append([]byte{}, prefix.namespace...), key[len(prefix.legacy):]...)
+					break
+				}
+			}
+		}
+		if newKey != nil {
+			batch.Delete(key)
+			batch.Put(newKey, value)
+		}
+	}
+	return iter.Error()
+}
+
+// isEncodedBlock tells stored blocks from stored headers, every block has a coinbase transaction
+func isEncodedBlock(value []byte) bool {
+	var block Block
+	err := gob.NewDecoder(bytes.NewReader(value)).Decode(&block)
+	return err == nil && len(block.Transactions) > 0
+}
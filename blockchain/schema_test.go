@@ -0,0 +1,79 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUpgradeStore(t *testing.T) {
+	t.Parallel()
+	genesis := MainNetParams.GenesisBlock()
+	header := &BlockHeader{PrevHash: genesis.GetHash(), Timestamp: "header"}
+	txID := genesis.Transactions[0].Hash
+
+	// Database written before namespaces and schema versions
+	legacy := NewMemoryStore()
+	legacy.Put(genesis.GetHash(), serialize(genesis))
+	legacy.Put(header.GetHash(), serialize(header))
+	legacy.Put([]byte(LAST_HASH_STOGAGE_KEY), genesis.GetHash())
+	legacy.Put(append([]byte("utxo-"), txID...), []byte("outputs"))
+	legacy.Put(append([]byte("bidx-"), genesis.GetHash()...), []byte("entry"))
+	legacy.Put([]byte("wtx-tx"), []byte("wallet"))
+	legacy.Put([]byte("unknown"), []byte("kept"))
+
+	if err := UpgradeStore(legacy); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := GetSchemaVersion(legacy); err != nil || version != schemaVersion {
+		t.Fatalf("Expected schema version %d, actual: %d (%v)", schemaVersion, version, err)
+	}
+	moved := map[string][]byte{
+		string(blockKey(genesis.GetHash())):                                         serialize(genesis),
+		string(headerKey(header.GetHash())):                                         serialize(header),
+		string(chainStateKey(tipStateName)):                                         genesis.GetHash(),
+		string(append(append([]byte{}, blockIndexPrefix...), genesis.GetHash()...)): []byte("entry"),
+		WalletNamespace + "tx":                                                      []byte("wallet"),
+		"unknown":                                                                   []byte("kept"),
+	}
+	for key, expected := range moved {
+		if value, err := legacy.Get([]byte(key)); err != nil || !bytes.Equal(value, expected) {
+			t.Fatalf("Expected key %x to hold %x, actual: %x (%v)", key, expected, value, err)
+		}
+	}
+	// The UTXO set is rebuilt from the chain along with its undo data
+	utxoSet := NewUTXOSet(legacy)
+	if info := utxoSet.GetInfo(); info.TotalAmount != COINBASE_REWARD {
+		t.Fatalf("Expected the UTXO set to hold the genesis reward, actual: %+v", info)
+	}
+	if exists, _ := legacy.Has(undoKey(genesis.GetHash())); !exists {
+		t.Fatalf("Expected undo data of the genesis block to be stored")
+	}
+	for _, key := range [][]byte{genesis.GetHash(), header.GetHash(), []byte(LAST_HASH_STOGAGE_KEY), []byte("wtx-tx")} {
+		if exists, _ := legacy.Has(key); exists {
+			t.Fatalf("Expected legacy key %x to be removed", key)
+		}
+	}
+
+	legacyChain := NewMemoryStore()
+	legacyChain.Put(genesis.GetHash(), serialize(genesis))
+	legacyChain.Put([]byte(LAST_HASH_STOGAGE_KEY), genesis.GetHash())
+	blockchain := InitBlockChain(&MainNetParams, legacyChain)
+	if !bytes.Equal(blockchain.LastHash, genesis.GetHash()) || blockchain.GetBlock(genesis.GetHash()) == nil {
+		t.Fatalf("Expected the upgraded database to be loaded")
+	}
+
+	empty := NewMemoryStore()
+	if err := UpgradeStore(empty); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := GetSchemaVersion(empty); version != schemaVersion {
+		t.Fatalf("Expected new databases to get schema version %d, actual: %d", schemaVersion, version)
+	}
+	newer := NewMemoryStore()
+	batch := new(Batch)
+	putSchemaVersion(batch, schemaVersion+1)
+	newer.Write(batch)
+	if err := UpgradeStore(newer); err == nil {
+		t.Fatalf("Expected databases of a newer schema version to be rejected")
+	}
+}
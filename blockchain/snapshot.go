@@ -0,0 +1,444 @@
+package blockchain
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"sync"
+)
+
+// SnapshotMetadata describes a UTXO snapshot: the block it was taken at and the content of its UTXO set
+type SnapshotMetadata struct {
+	BlockHash    []byte
+	Height       int    // height of the snapshot block
+	Transactions int    // transactions with unspent outputs
+	Hash         []byte // SHA-256 of the UTXO set, see hashUTXOEntry
+}
+
+// snapshotEntry holds the unspent outputs of a transaction in a snapshot file
+type snapshotEntry struct {
+	TxID      []byte
+	TxOutputs TxOutputs
+}
+
+// hashUTXOEntry adds the unspent outputs of a transaction to the content hash of a snapshot. Fields are written
+// one by one instead of gob encoded, as gob type ids depend on the order types are first used in a process.
+func hashUTXOEntry(hasher hash.Hash, txnID []byte, txnOutputs TxOutputs) {
+	writeBytes := func(data []byte) {
+		hasher.Write(binary.BigEndian.AppendUint32(nil, uint32(len(data))))
+		hasher.Write(data)
+	}
+	writeBytes(txnID)
+	hasher.Write(binary.BigEndian.AppendUint32(nil, uint32(len(txnOutputs))))
+	for _, txnOutput := range txnOutputs {
+		for _, value := range []int{txnOutput.Index, txnOutput.Height, txnOutput.Value} {
+			hasher.Write(binary.BigEndian.AppendUint64(nil, uint64(value)))
+		}
+		if txnOutput.IsCoinbase {
+			hasher.Write([]byte{1})
+		} else {
+			hasher.Write([]byte{0})
+		}
+		writeBytes(txnOutput.ScriptPubKey.PubKeyHash)
+	}
+}
+
+// hashUTXOSet returns the content hash of the UTXO set seen through view and its number of transactions
+func hashUTXOSet(view *utxoView) ([]byte, int, error) {
+	hasher := sha256.New()
+	transactions := 0
+	err := view.forEach(func(txnID []byte, txnOutputs TxOutputs) error {
+		hashUTXOEntry(hasher, txnID, txnOutputs)
+		transactions++
+		return nil
+	})
+	return hasher.Sum(nil), transactions, err
+}
+
+func readBlockAndUndo(database StoreReader, hash []byte) (*Block, *BlockUndo, error) {
+	encodedBlock, err := database.Get(blockKey(hash))
+	if err != nil {
+		return nil, nil, fmt.Errorf("data of block %x is not stored", hash)
+	}
+	encodedUndo, err := database.Get(undoKey(hash))
+	if err != nil {
+		return nil, nil, fmt.Errorf("undo data of block %x is not stored", hash)
+	}
+	var undo BlockUndo
+	genericDeserialize(encodedUndo, &undo)
+	return DeserializeBlock(encodedBlock), &undo, nil
+}
+
+// CheckBlockContent reports an error if the first transaction of block is not a coinbase, or if its transactions
+// do not match their hashes or the Merkle root of the block
+func CheckBlockContent(block *Block) error {
+	if len(block.Transactions) == 0 || !IsCoinbaseTransaction(block.Transactions[0]) {
+		return fmt.Errorf("first transaction is not a coinbase")
+	}
+	for _, transaction := range block.Transactions {
+		hashedTxn := *transaction
+		hashedTxn.SetHash()
+		if !bytes.Equal(hashedTxn.Hash, transaction.Hash) {
+			return fmt.Errorf("transaction %x does not match its hash", transaction.Hash)
+		}
+	}
+	merkleBlock := Block{Transactions: block.Transactions}
+	merkleBlock.SetMerkleRoot()
+	if !bytes.Equal(merkleBlock.MerkleRoot, block.MerkleRoot) {
+		return fmt.Errorf("transactions do not match the Merkle root")
+	}
+	return nil
+}
+
+func countInputs(block *Block) int {
+	inputs := 0
+	for _, transaction := range block.Transactions {
+		inputs += len(transaction.Inputs)
+	}
+	return inputs
+}
+
+// DumpUTXOSnapshot writes the UTXO set as it was when the active chain's block with the given hash was the tip,
+// the current tip if hash is nil, to writer. Besides the UTXO set, the snapshot holds the headers below the
+// block, the block and its undo data, all a node loaded from it with LoadUTXOSnapshot needs.
+func (blockchain *BlockChain) DumpUTXOSnapshot(hash []byte, writer io.Writer) (*SnapshotMetadata, error) {
+	snapshot, err := blockchain.DataBase.NewSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Release()
+	tip, err := snapshot.Get(chainStateKey(tipStateName))
+	if err != nil {
+		return nil, err
+	}
+	if hash == nil {
+		hash = tip
+	} else if !blockchain.Index.IsInActiveChain(hash) {
+		return nil, fmt.Errorf("block %x is not in the active chain", hash)
+	}
+
+	// The UTXO set of the tip is rolled back with the undo data of the blocks above the snapshot block
+	view := newUTXOView(snapshot)
+	for current := tip; !bytes.Equal(current, hash); {
+		block, undo, err := readBlockAndUndo(snapshot, current)
+		if err != nil {
+			return nil, fmt.Errorf("can not roll the UTXO set back to block %x, %w", hash, err)
+		}
+		if len(block.PrevHash) == 0 {
+			return nil, fmt.Errorf("block %x is not in the active chain", hash)
+		}
+		view.disconnectBlock(block, undo)
+		current = block.PrevHash
+	}
+	block, undo, err := readBlockAndUndo(snapshot, hash)
+	if err != nil {
+		return nil, err
+	}
+	headers := []*BlockHeader{} // from the genesis block up to the parent of the snapshot block
+	for current := block.PrevHash; len(current) > 0; {
+		header, exists := readHeader(snapshot, current)
+		if !exists {
+			return nil, fmt.Errorf("header of block %x is missing", current)
+		}
+		headers = append([]*BlockHeader{header}, headers...)
+		current = header.PrevHash
+	}
+
+	metadata := &SnapshotMetadata{BlockHash: hash, Height: len(headers)}
+	if metadata.Hash, metadata.Transactions, err = hashUTXOSet(view); err != nil {
+		return nil, err
+	}
+	bufferedWriter := bufio.NewWriter(writer)
+	encoder := gob.NewEncoder(bufferedWriter)
+	for _, value := range []interface{}{metadata, headers, block, undo} {
+		if err := encoder.Encode(value); err != nil {
+			return nil, err
+		}
+	}
+	err = view.forEach(func(txnID []byte, txnOutputs TxOutputs) error {
+		return encoder.Encode(snapshotEntry{txnID, txnOutputs})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return metadata, bufferedWriter.Flush()
+}
+
+// LoadUTXOSnapshot loads the UTXO snapshot read from reader into a chain holding only the genesis block. The
+// snapshot block becomes the tip, the blocks below it are stored as headers until a SnapshotValidator has
+// validated them. The headers must extend the genesis block with valid proof of work and the UTXO set must match
+// the content hash, which should be compared with the one reported by the node the snapshot was dumped from.
+func (blockchain *BlockChain) LoadUTXOSnapshot(reader io.Reader) (*SnapshotMetadata, error) {
+	if tipHeight := blockchain.Index.TipHeight(); tipHeight != 0 {
+		return nil, fmt.Errorf("snapshots are loaded into chains holding only the genesis block, the chain is at height %d", tipHeight)
+	}
+	decoder := gob.NewDecoder(bufio.NewReader(reader))
+	var metadata SnapshotMetadata
+	var headers []*BlockHeader
+	var block Block
+	var undo BlockUndo
+	for _, value := range []interface{}{&metadata, &headers, &block, &undo} {
+		if err := decoder.Decode(value); err != nil {
+			return nil, fmt.Errorf("can not read snapshot: %w", err)
+		}
+	}
+
+	if len(headers) == 0 || len(headers) != metadata.Height || !bytes.Equal(headers[0].GetHash(), blockchain.LastHash) {
+		return nil, fmt.Errorf("snapshot does not start at the %s genesis block", blockchain.Params.Name)
+	}
+	if !bytes.Equal(block.GetHash(), metadata.BlockHash) {
+		return nil, fmt.Errorf("snapshot block does not match hash %x", metadata.BlockHash)
+	}
+	if err := CheckBlockContent(&block); err != nil {
+		return nil, fmt.Errorf("snapshot block %x is invalid: %w", metadata.BlockHash, err)
+	}
+	if len(undo.SpentOutputs) != countInputs(&block) {
+		return nil, fmt.Errorf("undo data does not match the inputs of snapshot block %x", metadata.BlockHash)
+	}
+	targetHash := blockchain.Params.TargetHash()
+	chainHeaders := append(headers, &block.BlockHeader)
+	for height := 1; height < len(chainHeaders); height++ {
+		hash := chainHeaders[height].GetHash()
+		if !bytes.Equal(chainHeaders[height].PrevHash, chainHeaders[height-1].GetHash()) || new(big.Int).SetBytes(hash).Cmp(targetHash) != -1 {
+			return nil, fmt.Errorf("header %x at height %d does not extend the chain with valid proof of work", hash, height)
+		}
+	}
+
+	batch := new(Batch)
+	iter := blockchain.DataBase.NewIterator(utxoPrefix)
+	for iter.Next() {
+		batch.Delete(iter.Key())
+	}
+	iter.Release()
+	hasher := sha256.New()
+	for i := 0; i < metadata.Transactions; i++ {
+		var entry snapshotEntry
+		if err := decoder.Decode(&entry); err != nil {
+			return nil, fmt.Errorf("can not read snapshot: %w", err)
+		}
+		hashUTXOEntry(hasher, entry.TxID, entry.TxOutputs)
+		batch.Put(utxoKey(entry.TxID), serialize(entry.TxOutputs))
+	}
+	if !bytes.Equal(hasher.Sum(nil), metadata.Hash) {
+		return nil, fmt.Errorf("UTXO set of the snapshot does not match its hash %x", metadata.Hash)
+	}
+
+	for _, header := range headers[1:] {
+		hash := header.GetHash()
+		batch.Put(headerKey(hash), serialize(header))
+		blockchain.Index.addHeader(header, batch)
+		blockchain.Index.setStatus(hash, BLOCK_HAVE_HEADER, batch)
+	}
+	batch.Put(blockKey(metadata.BlockHash), serialize(&block))
+	blockchain.Index.addHeader(&block.BlockHeader, batch)
+	batch.Put(undoKey(metadata.BlockHash), serialize(&undo))
+	batch.Put(chainStateKey(snapshotStateName), serialize(&metadata))
+	blockchain.setPruneHeight(metadata.Height, batch)
+	batch.onWrite(func() { blockchain.snapshot = &metadata })
+	if err := blockchain.writeTip(metadata.BlockHash, batch); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// GetSnapshot returns the UTXO snapshot the chain was loaded from, or nil if it was not or the blocks below the
+// snapshot have been validated
+func (blockchain *BlockChain) GetSnapshot() *SnapshotMetadata {
+	if blockchain.snapshot == nil {
+		return nil
+	}
+	metadata := *blockchain.snapshot
+	return &metadata
+}
+
+// SnapshotError returns why the blocks below the UTXO snapshot the chain was loaded from failed the validation,
+// nil unless they did. The UTXO set of such a chain can not be trusted and the chain must not be used.
+func (blockchain *BlockChain) SnapshotError() error {
+	return blockchain.snapshotErr
+}
+
+// BlockVerifier reports whether block is valid at height, spending the outputs of utxoSet, as blocks received
+// from peers are checked: proof of work, signatures, amounts, subsidy and coinbase maturity
+type BlockVerifier func(block *Block, utxoSet *UTXOSet, height int) bool
+
+// SnapshotValidator validates the blocks below the UTXO snapshot a chain was loaded from: it replays them from
+// the genesis block, checks them with a BlockVerifier and compares the UTXO set they build with the snapshot.
+// Validated blocks are stored unless the chain is pruned, once all of them are the chain is the same as if it
+// had been synced block by block. If a block is invalid or the UTXO sets differ the chain is marked invalid.
+type SnapshotValidator struct {
+	blockchain  *BlockChain
+	snapshot    SnapshotMetadata
+	verify      BlockVerifier
+	storeBlocks bool
+	mutex       sync.Mutex
+	utxos       *MemoryStore // UTXO set built by the blocks validated so far
+	height      int          // height of the next block to validate
+	validated   bool
+	err         error // why the validation failed
+}
+
+// NewSnapshotValidator starts the validation of the blocks below the UTXO snapshot the chain was loaded from,
+// each of them is checked with verify. Blocks validated and stored before the node was restarted are replayed
+// from the database.
+func (blockchain *BlockChain) NewSnapshotValidator(verify BlockVerifier) (*SnapshotValidator, error) {
+	if blockchain.snapshotErr != nil {
+		return nil, fmt.Errorf("the UTXO snapshot is invalid: %w", blockchain.snapshotErr)
+	}
+	if blockchain.snapshot == nil {
+		return nil, fmt.Errorf("the chain was not loaded from a UTXO snapshot or the snapshot is validated")
+	}
+	validator := &SnapshotValidator{
+		blockchain:  blockchain,
+		snapshot:    *blockchain.snapshot,
+		verify:      verify,
+		storeBlocks: blockchain.pruneDepth == 0,
+		utxos:       NewMemoryStore(),
+	}
+	for ; validator.height < validator.snapshot.Height; validator.height++ {
+		block := blockchain.GetBlockByHeight(validator.height)
+		if block == nil {
+			break
+		}
+		if _, err := validator.connect(block); err != nil {
+			validator.fail(err)
+			return nil, err
+		}
+	}
+	if validator.height == validator.snapshot.Height {
+		batch := new(Batch)
+		validator.finish(batch)
+		if err := writeBatch(blockchain.DataBase, batch); err != nil {
+			return nil, err
+		}
+		if validator.err != nil {
+			return nil, validator.err
+		}
+	}
+	return validator, nil
+}
+
+// connect verifies block, except the genesis block which is part of the chain parameters, and adds the outputs
+// it creates to the UTXO set of the validator and removes those it spends
+func (validator *SnapshotValidator) connect(block *Block) (*BlockUndo, error) {
+	if validator.height > 0 && !validator.verify(block, &UTXOSet{validator.utxos}, validator.height) {
+		return nil, fmt.Errorf("block %x at height %d is invalid", block.GetHash(), validator.height)
+	}
+	view := newUTXOView(validator.utxos)
+	undo, err := view.connectBlock(block, validator.height)
+	if err != nil {
+		return nil, fmt.Errorf("block %x at height %d is invalid: %w", block.GetHash(), validator.height, err)
+	}
+	batch := new(Batch)
+	view.write(batch)
+	return undo, validator.utxos.Write(batch)
+}
+
+// finish connects the snapshot block, which the snapshot holds, to the UTXO set built by the blocks below it and
+// compares the result with the snapshot. When they match, the chain stops being a snapshot chain with the changes
+// added to batch, otherwise it is marked invalid. Pruning nodes prune the snapshot block once it is validated.
+func (validator *SnapshotValidator) finish(batch *Batch) {
+	block := validator.blockchain.GetBlock(validator.snapshot.BlockHash)
+	if block == nil {
+		validator.err = fmt.Errorf("snapshot block %x is not stored", validator.snapshot.BlockHash)
+		return
+	}
+	if _, err := validator.connect(block); err != nil {
+		validator.fail(err)
+		return
+	}
+	utxoSetHash, transactions, err := hashUTXOSet(newUTXOView(validator.utxos))
+	if err != nil {
+		validator.err = err
+		return
+	}
+	if !bytes.Equal(utxoSetHash, validator.snapshot.Hash) || transactions != validator.snapshot.Transactions {
+		validator.fail(fmt.Errorf("the blocks below snapshot block %x build a UTXO set with hash %x, the snapshot has hash %x",
+			validator.snapshot.BlockHash, utxoSetHash, validator.snapshot.Hash))
+		return
+	}
+	validator.validated = true
+	batch.Delete(chainStateKey(snapshotStateName))
+	batch.onWrite(func() { validator.blockchain.snapshot = nil })
+	if validator.storeBlocks {
+		validator.blockchain.setPruneHeight(0, batch)
+	} else if validator.blockchain.pruneHeight > validator.snapshot.Height {
+		validator.blockchain.pruneBlock(validator.snapshot.BlockHash, batch)
+	}
+}
+
+// fail stops the validation with err and marks the chain invalid, in the database as well so it is not used
+// after a restart either
+func (validator *SnapshotValidator) fail(err error) {
+	validator.err = err
+	validator.blockchain.snapshotErr = err
+	if writeErr := validator.blockchain.DataBase.Put(chainStateKey(invalidStateName), []byte(err.Error())); writeErr != nil {
+		validator.err = fmt.Errorf("%w, can not mark the chain invalid: %v", err, writeErr)
+	}
+}
+
+// Height returns the height of the next block to validate
+func (validator *SnapshotValidator) Height() int {
+	validator.mutex.Lock()
+	defer validator.mutex.Unlock()
+	return validator.height
+}
+
+// NextHashes returns the hashes of up to max blocks to validate next, none once the validation is over
+func (validator *SnapshotValidator) NextHashes(max int) [][]byte {
+	validator.mutex.Lock()
+	defer validator.mutex.Unlock()
+	hashes := [][]byte{}
+	if validator.validated || validator.err != nil {
+		return hashes
+	}
+	for height := validator.height; height < validator.snapshot.Height && len(hashes) < max; height++ {
+		hashes = append(hashes, validator.blockchain.Index.GetHashAtHeight(height))
+	}
+	return hashes
+}
+
+// ValidateBlock validates block if it is the next block below the snapshot, other blocks are ignored. It reports
+// whether the snapshot is validated, or why the validation failed.
+func (validator *SnapshotValidator) ValidateBlock(block *Block) (bool, error) {
+	validator.mutex.Lock()
+	defer validator.mutex.Unlock()
+	if validator.validated || validator.err != nil {
+		return validator.validated, validator.err
+	}
+	hash := block.GetHash()
+	if !bytes.Equal(hash, validator.blockchain.Index.GetHashAtHeight(validator.height)) {
+		return false, nil
+	}
+	if err := CheckBlockContent(block); err != nil {
+		validator.fail(fmt.Errorf("block %x at height %d is invalid: %w", hash, validator.height, err))
+		return false, validator.err
+	}
+	undo, err := validator.connect(block)
+	if err != nil {
+		validator.fail(err)
+		return false, validator.err
+	}
+
+	batch := new(Batch)
+	if validator.storeBlocks {
+		batch.Put(blockKey(hash), serialize(block))
+		batch.Put(undoKey(hash), serialize(undo))
+		batch.Delete(headerKey(hash))
+		validator.blockchain.Index.setStatus(hash, BLOCK_HAVE_DATA, batch)
+	}
+	validator.height++
+	if validator.height == validator.snapshot.Height {
+		validator.finish(batch)
+	}
+	if err := writeBatch(validator.blockchain.DataBase, batch); err != nil {
+		validator.validated = false
+		validator.err = err
+	}
+	return validator.validated, validator.err
+}
@@ -0,0 +1,160 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/big"
+	"testing"
+)
+
+func TestUTXOSnapshot(t *testing.T) {
+	t.Parallel()
+	source := InitBlockChain(&RegTestParams, NewMemoryStore())
+	address := RegTestParams.GenesisAddress
+	targetHash := RegTestParams.TargetHash()
+	blocks := []*Block{}
+	for i := 1; i <= 6; i++ {
+		transactions := []*Transaction{CoinBaseTransaction(address, COINBASE_REWARD+i)}
+		if i == 2 {
+			payment := &Transaction{
+				Inputs:  []TxInput{{TxID: blocks[0].Transactions[0].Hash, VOut: 0}},
+				Outputs: []TxOutput{createTxnOutput(300, address), createTxnOutput(COINBASE_REWARD-299, address)},
+			}
+			payment.SetHash()
+			transactions = append(transactions, payment)
+		}
+		block := &Block{BlockHeader: BlockHeader{PrevHash: source.LastHash, Timestamp: fmt.Sprint("block", i)}, Transactions: transactions}
+		for new(big.Int).SetBytes(block.GetHash()).Cmp(targetHash) != -1 {
+			block.Nonce++
+		}
+		source.StoreNewBlock(block)
+		blocks = append(blocks, block)
+	}
+
+	var snapshotFile bytes.Buffer
+	metadata, err := source.DumpUTXOSnapshot(blocks[3].GetHash(), &snapshotFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Height != 4 || !bytes.Equal(metadata.BlockHash, blocks[3].GetHash()) {
+		t.Fatalf("Expected a snapshot of block 4, actual: %+v", metadata)
+	}
+	tipMetadata, _ := source.DumpUTXOSnapshot(nil, io.Discard)
+	if utxoSet := source.UTXOSet(); tipMetadata.Transactions != utxoSet.GetInfo().Transactions || bytes.Equal(tipMetadata.Hash, metadata.Hash) {
+		t.Fatalf("Expected the snapshot of the tip to hold the current UTXO set")
+	}
+
+	// The last pubkey hash of the file belongs to the UTXO set
+	tampered := bytes.Clone(snapshotFile.Bytes())
+	pubkeyHash := getPubkeyHashFromAddress(address)
+	tampered[bytes.LastIndex(tampered, pubkeyHash)] ^= 1
+	if _, err := InitBlockChain(&RegTestParams, NewMemoryStore()).LoadUTXOSnapshot(bytes.NewReader(tampered)); err == nil {
+		t.Fatalf("Expected a snapshot not matching its hash to be rejected")
+	}
+	if _, err := source.LoadUTXOSnapshot(bytes.NewReader(snapshotFile.Bytes())); err == nil {
+		t.Fatalf("Expected snapshots to be loaded only into fresh chains")
+	}
+
+	database := NewMemoryStore()
+	loaded := InitBlockChain(&RegTestParams, database)
+	if _, err := loaded.LoadUTXOSnapshot(bytes.NewReader(snapshotFile.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.GetHeight() != 5 || loaded.GetPruneHeight() != 4 || !loaded.IsPruned(blocks[1].GetHash()) || loaded.GetSnapshot() == nil {
+		t.Fatalf("Expected the snapshot block to be the tip above headers only")
+	}
+	if reloaded, _ := loaded.DumpUTXOSnapshot(nil, io.Discard); !bytes.Equal(reloaded.Hash, metadata.Hash) {
+		t.Fatalf("Expected the loaded UTXO set to match the snapshot")
+	}
+	loaded.StoreNewBlock(blocks[4])
+	loaded.StoreNewBlock(blocks[5])
+	if synced, _ := loaded.DumpUTXOSnapshot(nil, io.Discard); !bytes.Equal(synced.Hash, tipMetadata.Hash) {
+		t.Fatalf("Expected blocks above the snapshot to be connected as on the source chain")
+	}
+
+	// Validation resumes from the blocks stored before a restart
+	verifiedHeights := []int{}
+	verify := func(block *Block, utxoSet *UTXOSet, height int) bool {
+		verifiedHeights = append(verifiedHeights, height)
+		return utxoSet.GetInfo().Transactions == height // the UTXO set below the block, one coinbase per block
+	}
+	validator, err := loaded.NewSnapshotValidator(verify)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashes := validator.NextHashes(10); len(hashes) != 3 || !bytes.Equal(hashes[0], blocks[0].GetHash()) {
+		t.Fatalf("Expected blocks 1 to 3 to be validated, actual: %x", hashes)
+	}
+	if validated, err := validator.ValidateBlock(blocks[2]); validated || err != nil {
+		t.Fatalf("Expected blocks out of order to be ignored")
+	}
+	validator.ValidateBlock(blocks[0])
+	loaded = InitBlockChain(&RegTestParams, database)
+	if validator, _ = loaded.NewSnapshotValidator(verify); validator.Height() != 2 {
+		t.Fatalf("Expected the validation to resume at height 2, actual: %d", validator.Height())
+	}
+	validator.ValidateBlock(blocks[1])
+	if validated, err := validator.ValidateBlock(blocks[2]); !validated || err != nil {
+		t.Fatalf("Expected the snapshot to be validated (%v)", err)
+	}
+	if fmt.Sprint(verifiedHeights) != "[1 1 2 3 4]" {
+		t.Fatalf("Expected every block above the genesis block to be verified at its height, actual: %v", verifiedHeights)
+	}
+	loaded = InitBlockChain(&RegTestParams, database)
+	if loaded.GetSnapshot() != nil || loaded.GetPruneHeight() != 0 || loaded.GetBlock(blocks[1].GetHash()) == nil {
+		t.Fatalf("Expected the validated blocks to be stored")
+	}
+
+	// A pruning node keeps the snapshot block until the blocks below it are validated
+	pruned := InitBlockChain(&RegTestParams, NewMemoryStore())
+	pruned.LoadUTXOSnapshot(bytes.NewReader(snapshotFile.Bytes()))
+	if err := pruned.EnablePruning(MIN_PRUNE_DEPTH); err != nil {
+		t.Fatal(err)
+	}
+	pruned.StoreNewBlock(blocks[4])
+	pruned.StoreNewBlock(blocks[5])
+	for height := 7; height <= metadata.Height+MIN_PRUNE_DEPTH+1; height++ {
+		coinbase := CoinBaseTransaction(address, COINBASE_REWARD+height)
+		pruned.StoreNewBlock(&Block{BlockHeader: BlockHeader{PrevHash: pruned.LastHash, Timestamp: fmt.Sprint("block", height)}, Transactions: []*Transaction{coinbase}})
+	}
+	if pruned.GetPruneHeight() != metadata.Height+2 || !pruned.IsPruned(blocks[4].GetHash()) || pruned.IsPruned(blocks[3].GetHash()) {
+		t.Fatalf("Expected the blocks above the snapshot block to be pruned, actual prune height: %d", pruned.GetPruneHeight())
+	}
+	validator, _ = pruned.NewSnapshotValidator(func(block *Block, utxoSet *UTXOSet, height int) bool { return true })
+	validated := false
+	for _, block := range blocks[:3] {
+		validated, err = validator.ValidateBlock(block)
+	}
+	if !validated || err != nil || pruned.GetSnapshot() != nil || !pruned.IsPruned(blocks[3].GetHash()) {
+		t.Fatalf("Expected the snapshot to be validated and its block pruned afterwards (%v)", err)
+	}
+
+	mismatched := InitBlockChain(&RegTestParams, NewMemoryStore())
+	mismatched.LoadUTXOSnapshot(bytes.NewReader(snapshotFile.Bytes()))
+	validator, _ = mismatched.NewSnapshotValidator(verify)
+	validator.snapshot.Hash = tipMetadata.Hash
+	for _, block := range blocks[:3] {
+		_, err = validator.ValidateBlock(block)
+	}
+	if err == nil || mismatched.GetSnapshot() == nil || mismatched.SnapshotError() == nil {
+		t.Fatalf("Expected a UTXO set not matching the snapshot to fail the validation and mark the chain invalid")
+	}
+
+	// A block rejected by the verifier fails the validation, the chain stays invalid after a restart
+	database = NewMemoryStore()
+	rejected := InitBlockChain(&RegTestParams, database)
+	rejected.LoadUTXOSnapshot(bytes.NewReader(snapshotFile.Bytes()))
+	validator, _ = rejected.NewSnapshotValidator(func(block *Block, utxoSet *UTXOSet, height int) bool { return height != 2 })
+	validator.ValidateBlock(blocks[0])
+	if _, err := validator.ValidateBlock(blocks[1]); err == nil || rejected.SnapshotError() == nil {
+		t.Fatalf("Expected a block failing verification to fail the validation")
+	}
+	if hashes := validator.NextHashes(10); len(hashes) != 0 {
+		t.Fatalf("Expected no blocks to be requested once the validation failed")
+	}
+	rejected = InitBlockChain(&RegTestParams, database)
+	if _, err := rejected.NewSnapshotValidator(verify); err == nil || rejected.SnapshotError() == nil {
+		t.Fatalf("Expected the chain to stay invalid after a restart")
+	}
+}
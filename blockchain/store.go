@@ -0,0 +1,88 @@
+package blockchain
+
+import "errors"
+
+// ErrNotFound is returned by Store.Get for missing keys
+var ErrNotFound = errors.New("key not found")
+
+// StoreReader is the read side of a Store, shared with its snapshots
+type StoreReader interface {
+	Get(key []byte) ([]byte, error)
+	Has(key []byte) (bool, error)
+	// NewIterator walks the keys starting with prefix in ascending order, the whole store if prefix is nil.
+	// Keys and values returned by the iterator are only valid until the next call to Next.
+	NewIterator(prefix []byte) Iterator
+}
+
+// Store is the key-value store holding a node's blocks, block index, UTXO set and indexes
+type Store interface {
+	StoreReader
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	// Write applies all operations of batch atomically
+	Write(batch *Batch) error
+	// NewSnapshot returns a consistent read-only view of the store, unaffected by later writes
+	NewSnapshot() (Snapshot, error)
+	Close() error
+}
+
+type Snapshot interface {
+	StoreReader
+	Release()
+}
+
+type Iterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Release()
+	Error() error
+}
+
+type batchOperation struct {
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+// Batch collects writes applied at once with Store.Write, later operations on a key override earlier ones
+type Batch struct {
+	operations []batchOperation
+	afterWrite []func() // in-memory changes applied by writeBatch once the batch is written
+}
+
+func (batch *Batch) Put(key, value []byte) {
+	batch.operations = append(batch.operations, batchOperation{key: append([]byte{}, key...), value: append([]byte{}, value...)})
+}
+
+func (batch *Batch) Delete(key []byte) {
+	batch.operations = append(batch.operations, batchOperation{key: append([]byte{}, key...), delete: true})
+}
+
+// Len returns the number of operations in the batch
+func (batch *Batch) Len() int {
+	return len(batch.operations)
+}
+
+func (batch *Batch) Reset() {
+	batch.operations = batch.operations[:0]
+	batch.afterWrite = nil
+}
+
+// onWrite registers an in-memory change matching the batch's operations, applied by writeBatch once they are
+// written so memory never gets ahead of the database
+func (batch *Batch) onWrite(apply func()) {
+	batch.afterWrite = append(batch.afterWrite, apply)
+}
+
+// writeBatch writes batch to database and then applies the in-memory changes registered with onWrite,
+// none of them if the write fails
+func writeBatch(database Store, batch *Batch) error {
+	if err := database.Write(batch); err != nil {
+		return err
+	}
+	for _, apply := range batch.afterWrite {
+		apply()
+	}
+	return nil
+}
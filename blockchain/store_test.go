@@ -0,0 +1,81 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestStores(t *testing.T) {
+	t.Parallel()
+	levelDBStore, err := OpenLevelDBStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, store := range map[string]Store{"leveldb": levelDBStore, "memory": NewMemoryStore()} {
+		store := store
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			testStore(t, store)
+		})
+	}
+}
+
+func readPrefix(reader StoreReader, prefix string) string {
+	iter := reader.NewIterator([]byte(prefix))
+	defer iter.Release()
+	keys := ""
+	for iter.Next() {
+		keys += string(iter.Key()) + "=" + string(iter.Value()) + " "
+	}
+	return keys
+}
+
+func testStore(t *testing.T, store Store) {
+	if _, err := store.Get([]byte("missing")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound for missing keys, actual: %v", err)
+	}
+	store.Put([]byte("a-2"), []byte("2"))
+	store.Put([]byte("a-1"), []byte("1"))
+	store.Put([]byte("b-1"), []byte("3"))
+	if value, err := store.Get([]byte("a-1")); err != nil || !bytes.Equal(value, []byte("1")) {
+		t.Fatalf("Expected the stored value, actual: %s (%v)", value, err)
+	}
+
+	batch := new(Batch)
+	batch.Put([]byte("a-3"), []byte("3"))
+	batch.Delete([]byte("a-2"))
+	batch.Put([]byte("a-1"), []byte("old"))
+	batch.Put([]byte("a-1"), []byte("new"))
+	snapshot, err := store.NewSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	if keys := readPrefix(store, "a-"); keys != "a-1=new a-3=3 " {
+		t.Fatalf("Expected the batch to be applied and the prefix walked in order, actual: %s", keys)
+	}
+	if keys := readPrefix(snapshot, "a-"); keys != "a-1=1 a-2=2 " {
+		t.Fatalf("Expected the snapshot to ignore later writes, actual: %s", keys)
+	}
+	if keys := readPrefix(store, ""); keys != "a-1=new a-3=3 b-1=3 " {
+		t.Fatalf("Expected an empty prefix to walk the whole store, actual: %s", keys)
+	}
+
+	store.Delete([]byte("b-1"))
+	if exists, _ := store.Has([]byte("b-1")); exists {
+		t.Fatalf("Expected deleted keys to be gone")
+	}
+	if exists, _ := snapshot.Has([]byte("b-1")); !exists {
+		t.Fatalf("Expected the snapshot to keep deleted keys")
+	}
+	snapshot.Release()
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put([]byte("a-4"), nil); err == nil {
+		t.Fatalf("Expected writes to a closed store to fail")
+	}
+}
@@ -0,0 +1,52 @@
+package blockchain
+
+// MonetaryPolicy decides how many new coins each block creates.
+// The subsidy starts at InitialSubsidy and halves every HalvingInterval blocks until it reaches zero.
+type MonetaryPolicy struct {
+	InitialSubsidy  int // satoshi
+	HalvingInterval int // blocks
+}
+
+// Subsidy returns the new coins a block at height may create, genesis block is height 0
+func (policy MonetaryPolicy) Subsidy(height int) int {
+	if height < 0 || policy.HalvingInterval <= 0 {
+		return policy.InitialSubsidy
+	}
+	halvings := height / policy.HalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+	return policy.InitialSubsidy >> halvings
+}
+
+// SupplyAt returns the coins created by the blocks from genesis up to and including height
+func (policy MonetaryPolicy) SupplyAt(height int) int {
+	if policy.HalvingInterval <= 0 {
+		return policy.InitialSubsidy * (height + 1)
+	}
+	supply := 0
+	for eraStart := 0; eraStart <= height; eraStart += policy.HalvingInterval {
+		subsidy := policy.Subsidy(eraStart)
+		if subsidy == 0 {
+			break
+		}
+		eraBlocks := policy.HalvingInterval
+		if eraStart+eraBlocks > height+1 {
+			eraBlocks = height + 1 - eraStart
+		}
+		supply += subsidy * eraBlocks
+	}
+	return supply
+}
+
+// MaxSupply returns the number of coins that will ever exist, 0 if the subsidy never halves
+func (policy MonetaryPolicy) MaxSupply() int {
+	if policy.HalvingInterval <= 0 {
+		return 0
+	}
+	supply := 0
+	for subsidy := policy.InitialSubsidy; subsidy > 0; subsidy >>= 1 {
+		supply += subsidy * policy.HalvingInterval
+	}
+	return supply
+}
@@ -0,0 +1,19 @@
+package blockchain
+
+import "testing"
+
+func TestMonetaryPolicy(t *testing.T) {
+	policy := MonetaryPolicy{InitialSubsidy: 1000, HalvingInterval: 10}
+	for height, expected := range map[int]int{0: 1000, 9: 1000, 10: 500, 25: 250, 99: 1, 100: 0} {
+		if subsidy := policy.Subsidy(height); subsidy != expected {
+			t.Fatalf("Expected subsidy %d at height %d, actual: %d", expected, height, subsidy)
+		}
+	}
+	if supply := policy.SupplyAt(14); supply != 10*1000+5*500 {
+		t.Fatalf("Expected supply %d after 15 blocks, actual: %d", 10*1000+5*500, supply)
+	}
+	// 1000 + 500 + 250 + 125 + 62 + 31 + 15 + 7 + 3 + 1 satoshi for 10 blocks each
+	if maxSupply := policy.MaxSupply(); maxSupply != 19940 || policy.SupplyAt(1000) != maxSupply {
+		t.Fatalf("Expected supply to be capped at 19940, actual: %d", maxSupply)
+	}
+}
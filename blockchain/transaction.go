@@ -43,8 +43,9 @@ func (txnInput TxInput) Hash() []byte {
 	return hash[:]
 }
 
-func CoinBaseTransaction(toAddress string) *Transaction {
-	txOutput := createTxnOutput(COINBASE_REWARD, toAddress)
+// CoinBaseTransaction pays reward, the block subsidy plus the fees of the block's transactions, to toAddress
+func CoinBaseTransaction(toAddress string, reward int) *Transaction {
+	txOutput := createTxnOutput(reward, toAddress)
 	transaction := Transaction{
 		Inputs:   []TxInput{},
 		Outputs:  []TxOutput{txOutput},
@@ -60,6 +61,11 @@ func (transaction *Transaction) SetHash() {
 	transaction.Hash = txHash[:]
 }
 
+// Size is the number of bytes the transaction occupies in a serialized block
+func (transaction *Transaction) Size() int {
+	return len(serialize(transaction))
+}
+
 func (txInput *TxInput) IsSignedBy(address string) bool {
 	return bytes.Equal(getPubkeyHashFromPubkey(txInput.ScriptSig.PubKey), getPubkeyHashFromAddress(address))
 }
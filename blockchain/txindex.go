@@ -0,0 +1,58 @@
+package blockchain
+
+// TxLocation is where a transaction is stored: the block containing it and its position in the block
+type TxLocation struct {
+	BlockHash []byte
+	Position  int
+}
+
+// TxIndex maps the hash of every transaction of the active chain to its block, so transactions can be
+// looked up without scanning the chain
+type TxIndex struct {
+	database Store
+}
+
+func NewTxIndex(database Store) *TxIndex {
+	return &TxIndex{database}
+}
+
+func txIndexKey(txnID []byte) []byte {
+	return append(append([]byte{}, txIndexPrefix...), txnID...)
+}
+
+// ConnectBlock indexes the transactions of a block that joined the active chain
+func (txIndex *TxIndex) ConnectBlock(block *Block) {
+	batch := new(Batch)
+	txIndex.connectBlock(block, batch)
+	txIndex.database.Write(batch)
+}
+
+func (txIndex *TxIndex) connectBlock(block *Block, batch *Batch) {
+	blockHash := block.GetHash()
+	for position, transaction := range block.Transactions {
+		batch.Put(txIndexKey(transaction.Hash), serialize(TxLocation{blockHash, position}))
+	}
+}
+
+// DisconnectBlock removes the transactions of a block that left the active chain
+func (txIndex *TxIndex) DisconnectBlock(block *Block) {
+	batch := new(Batch)
+	txIndex.disconnectBlock(block, batch)
+	txIndex.database.Write(batch)
+}
+
+func (txIndex *TxIndex) disconnectBlock(block *Block, batch *Batch) {
+	for _, transaction := range block.Transactions {
+		batch.Delete(txIndexKey(transaction.Hash))
+	}
+}
+
+func (txIndex *TxIndex) GetLocation(txnID []byte) (*TxLocation, bool) {
+	encodedLocation, err := txIndex.database.Get(txIndexKey(txnID))
+	if err != nil {
+		return nil, false
+	}
+	var location TxLocation
+	genericDeserialize(encodedLocation, &location)
+	return &location, true
+}
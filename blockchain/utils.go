@@ -2,12 +2,9 @@ package blockchain
 
 import (
 	"bytes"
-	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/sha256"
 	"encoding/gob"
 	"log"
-	"math/big"
 	"time"
 
 	"github.com/btcsuite/btcutil/base58"
@@ -16,16 +13,11 @@ import (
 
 const (
 	hashValueLength       = 256 // bits
-	difficultyLevel       = 12  // bits
 	pubKeyChecksumLength  = 4
-	versionByte           = byte(0) // prefixed to pubkey hash when calculating address
-	COINBASE_REWARD       = 1000    // satoshi
-	LAST_HASH_STOGAGE_KEY = "LAST_HASH"
-	SATOSHI_ADDRESS		  = "1G78MhhtATZoRZ69qhNNqeSJ2LY1NjQQSV"
+	COINBASE_REWARD       = 1000        // satoshi, initial block subsidy of the predefined networks
+	LAST_HASH_STOGAGE_KEY = "LAST_HASH" // key of the chain tip in databases of schema version 0
 )
 
-var TARGET_HASH = new(big.Int).Lsh(big.NewInt(1), hashValueLength-difficultyLevel)
-
 func IsCoinbaseTransaction(transaction *Transaction) bool {
 	return len(transaction.Inputs) == 0
 }
@@ -37,18 +29,6 @@ func getPubkeyHashFromPubkey(pubkey []byte) []byte {
 	return hasher.Sum(nil)
 }
 
-func getECDSAPubkeyFromUncompressedPubkey(uncompressedPubKey []byte) ecdsa.PublicKey {
-	pubkeyCoordinates := uncompressedPubKey[1:] // remove the 1st byte prefix for uncompressed version
-	pubkeyLength := len(pubkeyCoordinates)
-	x := pubkeyCoordinates[:(pubkeyLength / 2)]
-	y := pubkeyCoordinates[(pubkeyLength / 2):]
-	bigIntX := new(big.Int).SetBytes(x)
-	bigIntY := new(big.Int).SetBytes(y)
-	curve := elliptic.P256()
-	ecdsaPubkey := ecdsa.PublicKey{Curve: curve, X: bigIntX, Y: bigIntY}
-	return ecdsaPubkey
-}
-
 func getChecksum(versionedHash []byte) []byte {
 	firstHash := sha256.Sum256(versionedHash)
 	secondHash := sha256.Sum256(firstHash[:])
@@ -56,15 +36,15 @@ func getChecksum(versionedHash []byte) []byte {
 	return checksum
 }
 
-func getAddressFromPubkeyHash(pubkeyHash []byte) string {
-	versionedHash := append([]byte{versionByte}, pubkeyHash...)
+func getAddressFromPubkeyHash(pubkeyHash []byte, version byte) string {
+	versionedHash := append([]byte{version}, pubkeyHash...)
 	encoded := base58.Encode(append(versionedHash, getChecksum(versionedHash)...))
 	return encoded
 }
 
-func getAddressFromPubkey(pubkey []byte) string {
+func getAddressFromPubkey(pubkey []byte, version byte) string {
 	pubkeyHash := getPubkeyHashFromPubkey(pubkey)
-	return getAddressFromPubkeyHash(pubkeyHash)
+	return getAddressFromPubkeyHash(pubkeyHash, version)
 }
 
 func getPubkeyHashFromAddress(address string) []byte {
@@ -6,35 +6,41 @@ import (
 	"fmt"
 
 	"github.com/davecgh/go-spew/spew"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/util"
-	"golang.org/x/exp/slices"
 )
 
 type UTXOSet struct {
-	database *leveldb.DB
+	database Store
 }
 
 type TxOutputWithIndex struct {
 	TxOutput
-	Index int
+	Index      int
+	Height     int  // height of the block that created the output, genesis block is height 0
+	IsCoinbase bool // created by a coinbase transaction, see ChainParams.CoinbaseMaturity
+}
+
+// IsMatureAt reports whether the output may be spent in a block at spendHeight, coinbase outputs
+// need maturity confirmations
+func (txOutput *TxOutputWithIndex) IsMatureAt(spendHeight, maturity int) bool {
+	return !txOutput.IsCoinbase || spendHeight-txOutput.Height >= maturity
 }
 
 type TxOutputs []TxOutputWithIndex
 
-var (
-	utxoPrefix       = []byte("utxo-")
-	utxoPrefixLength = len(utxoPrefix)
-)
+var utxoPrefixLength = len(utxoPrefix)
+
+func utxoKey(txnID []byte) []byte {
+	return append(append([]byte{}, utxoPrefix...), txnID...)
+}
 
-func NewUTXOSet(database *leveldb.DB) UTXOSet {
+func NewUTXOSet(database Store) UTXOSet {
 	return UTXOSet{database}
 }
 
 func (utxoSet *UTXOSet) FindSpendableOutput(address string, amount int) (int, map[string]TxOutputs) {
 	accumulatedAmount := 0
 	utxoMap := make(map[string]TxOutputs)
-	iter := utxoSet.database.NewIterator(util.BytesPrefix(utxoPrefix), nil)
+	iter := utxoSet.database.NewIterator(utxoPrefix)
 
 OuterLoop:
 	for iter.Next() {
@@ -58,7 +64,7 @@ OuterLoop:
 
 func (utxoSet *UTXOSet) FindUTXO(address string) map[string]TxOutputs {
 	utxoMap := make(map[string]TxOutputs)
-	iter := utxoSet.database.NewIterator(util.BytesPrefix(utxoPrefix), nil)
+	iter := utxoSet.database.NewIterator(utxoPrefix)
 
 	for iter.Next() {
 		txnID := iter.Key()[utxoPrefixLength:]
@@ -75,104 +81,71 @@ func (utxoSet *UTXOSet) FindUTXO(address string) map[string]TxOutputs {
 	return utxoMap
 }
 
-func (utxoSet *UTXOSet) UpdateWithNewTransaction(newTransaction *Transaction) {
-	spentTxnOutputs := make(map[string][]int)
-	batch := new(leveldb.Batch)
-
-	var txOutputs TxOutputs
+// UpdateWithNewTransaction spends the outputs referenced by newTransaction and adds its outputs,
+// created by the block at height. Inputs referencing unknown outputs are skipped, as the UTXO sets of
+// SPV nodes only hold the outputs of monitored addresses.
+func (utxoSet *UTXOSet) UpdateWithNewTransaction(newTransaction *Transaction, height int) {
+	batch := new(Batch)
+	view := newUTXOView(utxoSet.database)
 	for _, txnInput := range newTransaction.Inputs {
-		spentTxnOutputs[string(txnInput.TxID)] = append(spentTxnOutputs[string(txnInput.TxID)], txnInput.VOut)
-	}
-
-	for outputIndex, txOutput := range newTransaction.Outputs {
-		txOutputs = append(txOutputs, TxOutputWithIndex{txOutput, outputIndex})
-	}
-
-	utxoSetTxnID := append(utxoPrefix, newTransaction.Hash...)
-	batch.Put(utxoSetTxnID, serialize(txOutputs))
-
-	for txnID, spentTxnOutputIDs := range spentTxnOutputs {
-		utxoSetTxnID := append(utxoPrefix, []byte(txnID)...)
-		encodedTxnOutputs, _ := utxoSet.database.Get(utxoSetTxnID, nil)
-		currentTxnOutputs := deserializeTxnOutputs(encodedTxnOutputs)
-
-		var newTxOutputs TxOutputs
-		for _, unspentTxOutput := range currentTxnOutputs {
-			if !slices.Contains(spentTxnOutputIDs, unspentTxOutput.Index) {
-				newTxOutputs = append(newTxOutputs, unspentTxOutput)
-			}
-		}
-
-		if len(newTxOutputs) > 0 {
-			batch.Put(utxoSetTxnID, serialize(newTxOutputs))
-		} else {
-			batch.Delete(utxoSetTxnID)
-		}
+		view.spend(&txnInput)
 	}
-	utxoSet.database.Write(batch, nil)
+	view.addOutputs(newTransaction, height)
+	view.write(batch)
+	utxoSet.database.Write(batch)
 }
 
-func (utxoSet *UTXOSet) UpdateWithNewBlock(newBlock *Block) {
-	for _, transaction := range newBlock.Transactions {
-		utxoSet.UpdateWithNewTransaction(transaction)
+func (utxoSet *UTXOSet) GetTxOutputFromTxInput(txnInput *TxInput) *TxOutput {
+	utxo := utxoSet.GetUTXOFromTxInput(txnInput)
+	if utxo == nil {
+		return nil
 	}
+	return &utxo.TxOutput
 }
 
-func (utxoSet *UTXOSet) GetTxOutputFromTxInput(txnInput *TxInput) *TxOutput {
-	referencedTxnID := txnInput.TxID
-	utxoSetTxnID := append(utxoPrefix, referencedTxnID...)
-	encodedTxnOutputs, _ := utxoSet.database.Get(utxoSetTxnID, nil)
+// GetUTXOFromTxInput returns the unspent output referenced by txnInput, or nil if it does not exist
+func (utxoSet *UTXOSet) GetUTXOFromTxInput(txnInput *TxInput) *TxOutputWithIndex {
+	encodedTxnOutputs, _ := utxoSet.database.Get(utxoKey(txnInput.TxID))
 	currentTxnOutputs := deserializeTxnOutputs(encodedTxnOutputs)
 	for _, txOutput := range currentTxnOutputs {
 		if txOutput.Index == txnInput.VOut {
-			return &txOutput.TxOutput
+			return &txOutput
 		}
 	}
 	return nil
 }
 
+// ReIndex rebuilds the UTXO set and the undo data of the active chain by replaying it from the genesis block,
+// in a single write
 func (utxoSet *UTXOSet) ReIndex() {
-	// ===== Batch delete existing UTXO set =====
-	batch := new(leveldb.Batch)
-	iter := utxoSet.database.NewIterator(util.BytesPrefix(utxoPrefix), nil)
-
-	for iter.Next() {
-		utxoKey := iter.Key()
-		batch.Delete(utxoKey)
-	}
-	iter.Release()
-	err := utxoSet.database.Write(batch, nil)
-	handleErr(err)
-
-	// ===== Traverse the blockchain to create new UTXO set
-	lastHash, _ := utxoSet.database.Get([]byte(LAST_HASH_STOGAGE_KEY), nil)
-	chainIterator := BlockChainIterator{utxoSet.database, lastHash}
-	spentTxnOutputs := make(map[string][]int)
-
-	for {
-		currentBlock := chainIterator.CurrentBlock()
-		for _, transaction := range currentBlock.Transactions {
-			for _, txnInput := range transaction.Inputs {
-				spentTxnOutputs[string(txnInput.TxID)] = append(spentTxnOutputs[string(txnInput.TxID)], txnInput.VOut)
-			}
+	batch := new(Batch)
+	handleErr(rebuildChainState(utxoSet.database, batch))
+	handleErr(utxoSet.database.Write(batch))
+}
 
-			var txnOutputs TxOutputs
-			for outputIndex, txnOutput := range transaction.Outputs {
-				if !slices.Contains(spentTxnOutputs[string(transaction.Hash)], outputIndex) {
-					txnOutputWithIndex := TxOutputWithIndex{txnOutput, outputIndex}
-					txnOutputs = append(txnOutputs, txnOutputWithIndex)
-				}
-			}
+// UTXOSetInfo summarizes the UTXO set, TotalAmount is the supply of coins in circulation
+type UTXOSetInfo struct {
+	Transactions int // transactions with at least one unspent output
+	TxOutputs    int
+	TotalAmount  int // satoshi
+}
 
-			utxoSetTxnID := append(utxoPrefix, transaction.Hash...)
-			utxoSet.database.Put(utxoSetTxnID, serialize(txnOutputs), nil)
+func (utxoSet *UTXOSet) GetInfo() UTXOSetInfo {
+	var info UTXOSetInfo
+	iter := utxoSet.database.NewIterator(utxoPrefix)
+	for iter.Next() {
+		txnOutputs := deserializeTxnOutputs(iter.Value())
+		if len(txnOutputs) == 0 {
+			continue
 		}
-
-		if len(currentBlock.PrevHash) == 0 {
-			break
+		info.Transactions++
+		for _, txnOutput := range txnOutputs {
+			info.TxOutputs++
+			info.TotalAmount += txnOutput.Value
 		}
-		chainIterator.CurrentHash = currentBlock.PrevHash
 	}
+	iter.Release()
+	return info
 }
 
 func deserializeTxnOutputs(outputs []byte) TxOutputs {
@@ -184,7 +157,7 @@ func deserializeTxnOutputs(outputs []byte) TxOutputs {
 }
 
 func (utxoSet *UTXOSet) print() {
-	iter := utxoSet.database.NewIterator(util.BytesPrefix(utxoPrefix), nil)
+	iter := utxoSet.database.NewIterator(utxoPrefix)
 
 	fmt.Println("===== Start Logging UTXO Set =====")
 	for iter.Next() {
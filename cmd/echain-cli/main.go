@@ -0,0 +1,436 @@
+// echain-cli drives EChain nodes over their JSON-RPC interface and manages a local wallet file.
+//
+// Node commands are sent to the RPC server given with -rpcconnect, the network and RPC settings default to
+// those of the node's config file. Wallet commands work on the wallet file given with -wallet; balances are
+// queried over RPC, while sending coins and syncing the transaction history go through the wallet's SPV node
+// given with -connect.
+package main
+
+import (
+	"EChain/blockchain"
+	"EChain/config"
+	"EChain/network"
+	"EChain/wallet"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+type command struct {
+	usage       string
+	description string
+	run         func(cli *cli, args []string) (interface{}, error)
+}
+
+// rpcCommand is a node command sent to the RPC server as is. Params listed in jsonParams are decoded as
+// JSON values, all other params are sent as strings.
+type rpcCommand struct {
+	usage       string
+	description string
+	jsonParams  []int
+}
+
+type cli struct {
+	params           *blockchain.ChainParams
+	rpcClient        *network.RPCClient
+	walletPath       string
+	walletPassphrase string
+	spvAddress       string
+}
+
+var rpcCommands = map[string]rpcCommand{
+	"getblockchaininfo":  {"", "Show the network, height and best block of the node", nil},
+	"getblockcount":      {"", "Show the height of the node's best block", nil},
+	"getbestblockhash":   {"", "Show the hash of the node's best block", nil},
+	"getblockhash":       {"<height>", "Show the hash of the active chain's block at height", []int{0}},
+	"getblock":           {"<hash> [verbosity]", "Show a block: 0 raw, 1 with transaction ids (default), 2 with transactions", []int{1}},
+	"getrawtransaction":  {"<txid> [verbose]", "Show a mempool or indexed transaction, raw unless verbose is true", []int{1}},
+	"sendrawtransaction": {"<hex>", "Verify and broadcast a raw transaction", nil},
+	"getmempoolinfo":     {"", "Show the size and fees of the node's mempool", nil},
+	"getpeerinfo":        {"", "List the node's peers", nil},
+	"getaddresshistory":  {"<address> [skip] [count]", "List the funding and spending events of address, oldest first (address index only)", []int{1, 2}},
+	"getaddressbalance":  {"<address>", "Show the amounts received and sent by address (address index only)", nil},
+	"dumptxoutset":       {"<path> [blockhash]", "Write the UTXO set at the tip or at blockhash to a snapshot file on the node, relative to its data directory", nil},
+	"exportblocks":       {"<path>", "Write the active chain to a block file on the node, relative to its data directory", nil},
+	"importblocks":       {"<path>", "Validate and connect the blocks of a block file on the node, skipping those already in the chain", nil},
+	"generate":           {"<count>", "Mine count blocks paying the miner's address (miner nodes only)", []int{0}},
+	"generatetoaddress":  {"<count> <address>", "Mine count blocks paying address (miner nodes only)", []int{0}},
+	"stop":               {"", "Stop the node", nil},
+}
+
+var walletCommands = map[string]command{
+	"createwallet":     {"[mnemonic passphrase]", "Create an HD wallet and print its mnemonic and first address", (*cli).createWallet},
+	"encryptwallet":    {"<passphrase>", "Encrypt the private keys of the wallet with passphrase", (*cli).encryptWallet},
+	"getnewaddress":    {"", "Create a new receiving address", (*cli).getNewAddress},
+	"listaddresses":    {"", "List the addresses of the wallet", (*cli).listAddresses},
+	"getbalance":       {"[minconf]", "Show the balance of the wallet, split by the state of its coins", (*cli).getBalance},
+	"send":             {"<address> <amount> [feerate]", "Pay amount to address, feerate is in satoshi per byte", (*cli).send},
+	"listtransactions": {"[count] [skip]", "List the transactions of the wallet, most recent first", (*cli).listTransactions},
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "Usage: echain-cli [options] <command> [params]")
+	fmt.Fprintln(out, "\nOptions:")
+	flag.PrintDefaults()
+	printCommands := func(title string, usages map[string][2]string) {
+		fmt.Fprintln(out, "\n"+title+":")
+		names := []string{}
+		for name := range usages {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(out, "  %-40s %s\n", strings.TrimSpace(name+" "+usages[name][0]), usages[name][1])
+		}
+	}
+	walletUsages := make(map[string][2]string)
+	for name, walletCommand := range walletCommands {
+		walletUsages[name] = [2]string{walletCommand.usage, walletCommand.description}
+	}
+	printCommands("Wallet commands", walletUsages)
+	nodeUsages := make(map[string][2]string)
+	for name, nodeCommand := range rpcCommands {
+		nodeUsages[name] = [2]string{nodeCommand.usage, nodeCommand.description}
+	}
+	printCommands("Node commands", nodeUsages)
+}
+
+func main() {
+	configFile := flag.String("conf", "", "config file of the node, its network and RPC settings are used unless given as flags; defaults to "+config.DefaultConfigFileName+" in the data directory")
+	dataDir := flag.String("datadir", config.DefaultDataDir, "data directory of the node, holding the default wallet file")
+	networkName := flag.String("network", "mainnet", "network of the node and wallet: mainnet, testnet or regtest")
+	rpcAddress := flag.String("rpcconnect", "", "address of the node's RPC server, defaults to the network's RPC port on localhost")
+	rpcUser := flag.String("rpcuser", os.Getenv("ECHAIN_RPC_USER"), "RPC user, defaults to $ECHAIN_RPC_USER")
+	rpcPassword := flag.String("rpcpassword", os.Getenv("ECHAIN_RPC_PASSWORD"), "RPC password, defaults to $ECHAIN_RPC_PASSWORD")
+	walletPath := flag.String("wallet", "", "wallet file, defaults to "+wallet.DefaultWalletFilePath+" in the network's data directory")
+	walletPassphrase := flag.String("walletpassphrase", os.Getenv("ECHAIN_WALLET_PASSPHRASE"), "passphrase of an encrypted wallet, defaults to $ECHAIN_WALLET_PASSPHRASE")
+	spvAddress := flag.String("connect", "", "P2P address of the SPV node used to send coins and sync the wallet history")
+	asJSON := flag.Bool("json", false, "print results as JSON")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	setOnCommandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+	nodeConfig, err := readNodeConfig(*configFile, *dataDir)
+	if err != nil {
+		fail(err)
+	}
+	for name, target := range map[string]*string{"datadir": dataDir, "network": networkName} {
+		if value, exists := nodeConfig[name]; exists && !setOnCommandLine[name] {
+			*target = value
+		}
+	}
+	// credentials from the command line or the environment take precedence over the config file
+	for name, target := range map[string]*string{"rpcuser": rpcUser, "rpcpassword": rpcPassword} {
+		if value, exists := nodeConfig[name]; exists && *target == "" {
+			*target = value
+		}
+	}
+
+	networkParams, err := blockchain.GetChainParams(*networkName)
+	if err != nil {
+		fail(err)
+	}
+	params := *networkParams
+	params.DataDir = *dataDir
+	if *rpcAddress == "" {
+		*rpcAddress = rpcConnectAddress(nodeConfig["rpcbind"], params.RPCPort)
+	}
+	if *walletPath == "" {
+		*walletPath = filepath.Join(params.DataDirPath(), wallet.DefaultWalletFilePath)
+	}
+	cli := &cli{
+		params:           &params,
+		rpcClient:        network.NewRPCClient(*rpcAddress, *rpcUser, *rpcPassword),
+		walletPath:       *walletPath,
+		walletPassphrase: *walletPassphrase,
+		spvAddress:       *spvAddress,
+	}
+
+	commandName, args := flag.Arg(0), flag.Args()[1:]
+	var result interface{}
+	if walletCommand, exists := walletCommands[commandName]; exists {
+		result, err = walletCommand.run(cli, args)
+	} else if nodeCommand, exists := rpcCommands[commandName]; exists {
+		result, err = cli.callRPC(commandName, nodeCommand, args)
+	} else {
+		err = fmt.Errorf("unknown command %s, run echain-cli -h for the list of commands", commandName)
+	}
+	if err != nil {
+		fail(err)
+	}
+	if err := printResult(os.Stdout, result, *asJSON); err != nil {
+		fail(err)
+	}
+}
+
+// readNodeConfig returns the last value of each option of the node's config file, a missing default config file is empty
+func readNodeConfig(configFile, dataDir string) (map[string]string, error) {
+	explicit := configFile != ""
+	if !explicit {
+		configFile = filepath.Join(dataDir, config.DefaultConfigFileName)
+	}
+	options, err := config.ReadFile(configFile)
+	if err != nil && (explicit || !errors.Is(err, fs.ErrNotExist)) {
+		return nil, fmt.Errorf("can not read config file: %w", err)
+	}
+	values := make(map[string]string)
+	for _, option := range options {
+		values[option.Name] = option.Value
+	}
+	return values, nil
+}
+
+// rpcConnectAddress is the address reaching an RPC server bound to rpcBind, wildcard hosts are reached on localhost
+func rpcConnectAddress(rpcBind, defaultPort string) string {
+	host, port, err := net.SplitHostPort(rpcBind)
+	if err != nil {
+		return net.JoinHostPort("localhost", defaultPort)
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "error:", err)
+	os.Exit(1)
+}
+
+// convertParams turns command line params into RPC params, see rpcCommand
+func convertParams(args []string, jsonParams []int) ([]interface{}, error) {
+	params := []interface{}{}
+	for index, arg := range args {
+		if !slices.Contains(jsonParams, index) {
+			params = append(params, arg)
+			continue
+		}
+		var value interface{}
+		if err := json.Unmarshal([]byte(arg), &value); err != nil {
+			return nil, fmt.Errorf("param %d is not a valid JSON value: %s", index+1, arg)
+		}
+		params = append(params, value)
+	}
+	return params, nil
+}
+
+func (cli *cli) callRPC(method string, nodeCommand rpcCommand, args []string) (interface{}, error) {
+	params, err := convertParams(args, nodeCommand.jsonParams)
+	if err != nil {
+		return nil, err
+	}
+	var result json.RawMessage
+	if err := cli.rpcClient.Call(method, params, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ======= Wallet commands =======
+
+// loadWallet opens the wallet file, unlocking it if it is encrypted and unlock is set
+func (cli *cli) loadWallet(unlock bool) (*wallet.Wallets, error) {
+	if err := os.MkdirAll(filepath.Dir(cli.walletPath), 0700); err != nil {
+		return nil, err
+	}
+	wallets, err := wallet.LoadWallets(cli.walletPath, cli.params)
+	if err != nil {
+		return nil, fmt.Errorf("can not load wallet %s: %w", cli.walletPath, err)
+	}
+	if cli.spvAddress != "" {
+		wallets.ConnectNode(network.SPV, cli.spvAddress)
+	}
+	if unlock && wallets.IsEncrypted() {
+		if cli.walletPassphrase == "" {
+			return nil, fmt.Errorf("wallet is encrypted, pass its passphrase with -walletpassphrase")
+		}
+		if err := wallets.Unlock(cli.walletPassphrase, wallet.NoUnlockTimeout); err != nil {
+			return nil, fmt.Errorf("can not unlock wallet: %w", err)
+		}
+	}
+	return wallets, nil
+}
+
+func checkArgCount(args []string, min, max int) error {
+	if len(args) < min || len(args) > max {
+		return fmt.Errorf("expected %d to %d params, got %d", min, max, len(args))
+	}
+	return nil
+}
+
+func parseIntArg(args []string, index, defaultValue int, name string) (int, error) {
+	if index >= len(args) {
+		return defaultValue, nil
+	}
+	value, err := strconv.Atoi(args[index])
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a number, got %s", name, args[index])
+	}
+	return value, nil
+}
+
+func (cli *cli) createWallet(args []string) (interface{}, error) {
+	if err := checkArgCount(args, 0, 1); err != nil {
+		return nil, err
+	}
+	wallets, err := cli.loadWallet(false)
+	if err != nil {
+		return nil, err
+	}
+	if len(wallets.GetAddresses()) > 0 {
+		return nil, fmt.Errorf("wallet %s already exists", cli.walletPath)
+	}
+	passphrase := ""
+	if len(args) > 0 {
+		passphrase = args[0]
+	}
+	mnemonic, err := wallets.CreateHDWallet(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	address, err := wallets.AddNewWallet()
+	if err != nil {
+		return nil, err
+	}
+	wallets.AddWalletAddrToSPVNodes(address)
+	return struct {
+		Mnemonic string `json:"mnemonic"`
+		Address  string `json:"address"`
+	}{mnemonic, address}, nil
+}
+
+func (cli *cli) encryptWallet(args []string) (interface{}, error) {
+	if err := checkArgCount(args, 1, 1); err != nil {
+		return nil, err
+	}
+	wallets, err := cli.loadWallet(false)
+	if err != nil {
+		return nil, err
+	}
+	if err := wallets.EncryptWallet(args[0]); err != nil {
+		return nil, err
+	}
+	return "wallet encrypted, pass the passphrase with -walletpassphrase to spend coins", nil
+}
+
+func (cli *cli) getNewAddress(args []string) (interface{}, error) {
+	if err := checkArgCount(args, 0, 0); err != nil {
+		return nil, err
+	}
+	wallets, err := cli.loadWallet(true)
+	if err != nil {
+		return nil, err
+	}
+	address, err := wallets.AddNewWallet()
+	if err != nil {
+		return nil, err
+	}
+	wallets.AddWalletAddrToSPVNodes(address)
+	return address, nil
+}
+
+func (cli *cli) listAddresses(args []string) (interface{}, error) {
+	if err := checkArgCount(args, 0, 0); err != nil {
+		return nil, err
+	}
+	wallets, err := cli.loadWallet(false)
+	if err != nil {
+		return nil, err
+	}
+	addresses := wallets.GetAddresses()
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
+// getBalance asks the node for the balance of the wallet's addresses. SPV nodes only know the balance
+// of the addresses they monitor.
+func (cli *cli) getBalance(args []string) (interface{}, error) {
+	if err := checkArgCount(args, 0, 1); err != nil {
+		return nil, err
+	}
+	minConfirmations, err := parseIntArg(args, 0, 1, "minconf")
+	if err != nil {
+		return nil, err
+	}
+	wallets, err := cli.loadWallet(false)
+	if err != nil {
+		return nil, err
+	}
+	addresses := wallets.GetAddresses()
+	if len(addresses) == 0 {
+		return wallet.Balance{}, nil
+	}
+	var balance wallet.Balance
+	if err := cli.rpcClient.Call("getbalance", []interface{}{addresses, minConfirmations}, &balance); err != nil {
+		return nil, err
+	}
+	return balance, nil
+}
+
+func (cli *cli) send(args []string) (interface{}, error) {
+	if err := checkArgCount(args, 2, 3); err != nil {
+		return nil, err
+	}
+	toAddress := args[0]
+	if !wallet.IsAddressValid(toAddress, cli.params) {
+		return nil, fmt.Errorf("invalid %s address %s", cli.params.Name, toAddress)
+	}
+	amount, err := parseIntArg(args, 1, 0, "amount")
+	if err != nil {
+		return nil, err
+	}
+	feeRate, err := parseIntArg(args, 2, 0, "feerate")
+	if err != nil {
+		return nil, err
+	}
+	if cli.spvAddress == "" {
+		return nil, fmt.Errorf("sending coins needs the wallet's SPV node, pass its address with -connect")
+	}
+	wallets, err := cli.loadWallet(true)
+	if err != nil {
+		return nil, err
+	}
+	return wallets.Send(toAddress, amount, wallet.TransferOptions{FeeRate: feeRate})
+}
+
+func (cli *cli) listTransactions(args []string) (interface{}, error) {
+	if err := checkArgCount(args, 0, 2); err != nil {
+		return nil, err
+	}
+	count, err := parseIntArg(args, 0, 10, "count")
+	if err != nil {
+		return nil, err
+	}
+	skip, err := parseIntArg(args, 1, 0, "skip")
+	if err != nil {
+		return nil, err
+	}
+	wallets, err := cli.loadWallet(false)
+	if err != nil {
+		return nil, err
+	}
+	if cli.spvAddress != "" {
+		if err := wallets.SyncTransactions(); err != nil {
+			fmt.Fprintln(os.Stderr, "warning: showing the stored history,", err)
+		}
+	}
+	return wallets.ListTransactions(count, skip), nil
+}
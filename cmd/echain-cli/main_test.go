@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestConvertParams(t *testing.T) {
+	params, err := convertParams([]string{"0012ab", "2"}, rpcCommands["getblock"].jsonParams)
+	if err != nil || params[0] != "0012ab" || params[1] != float64(2) {
+		t.Fatalf("Expected the hash as string and the verbosity as number, actual: %#v (%v)", params, err)
+	}
+	if _, err := convertParams([]string{"ten"}, rpcCommands["generate"].jsonParams); err == nil {
+		t.Fatalf("Expected invalid JSON params to be rejected")
+	}
+}
+
+func TestPrintResult(t *testing.T) {
+	result := json.RawMessage(`{"hash":"ab","height":2,"tx":["01","02"],"peers":[],"vout":[{"value":10,"n":0},{"value":5,"n":1}]}`)
+	var output bytes.Buffer
+	if err := printResult(&output, result, false); err != nil {
+		t.Fatal(err)
+	}
+	expected := "hash: ab\nheight: 2\ntx:\n  01\n  02\npeers: (none)\nvout:\n  value: 10\n  n: 0\n\n  value: 5\n  n: 1\n"
+	if output.String() != expected {
+		t.Fatalf("Expected keys in order with nested values indented, actual:\n%s", output.String())
+	}
+
+	output.Reset()
+	printResult(&output, "address", true)
+	if output.String() != "\"address\"\n" {
+		t.Fatalf("Expected JSON output, actual: %s", output.String())
+	}
+}
+
+func TestRPCConnectAddress(t *testing.T) {
+	for rpcBind, expected := range map[string]string{
+		"":                "localhost:18443",
+		"0.0.0.0:9000":    "localhost:9000",
+		":9000":           "localhost:9000",
+		"127.0.0.1:9000":  "127.0.0.1:9000",
+		"node.local:9000": "node.local:9000",
+	} {
+		if address := rpcConnectAddress(rpcBind, "18443"); address != expected {
+			t.Fatalf("Expected rpcbind %q to be reached at %s, actual: %s", rpcBind, expected, address)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+type jsonField struct {
+	key   string
+	value interface{}
+}
+
+// jsonObject is a decoded JSON object that keeps the order of its keys
+type jsonObject []jsonField
+
+// printResult writes result as indented JSON, or as a list of "key: value" lines for people
+func printResult(w io.Writer, result interface{}, asJSON bool) error {
+	encoded, ok := result.(json.RawMessage)
+	if !ok {
+		var err error
+		if encoded, err = json.Marshal(result); err != nil {
+			return err
+		}
+	}
+	if asJSON {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, encoded, "", "  "); err != nil {
+			return err
+		}
+		fmt.Fprintln(w, indented.String())
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	value, err := decodeOrdered(decoder)
+	if err != nil {
+		return err
+	}
+	writeHuman(w, value, "")
+	return nil
+}
+
+// decodeOrdered decodes the next JSON value of decoder, objects are decoded as jsonObject
+func decodeOrdered(decoder *json.Decoder) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case json.Delim('{'):
+		object := jsonObject{}
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeOrdered(decoder)
+			if err != nil {
+				return nil, err
+			}
+			object = append(object, jsonField{key.(string), value})
+		}
+		_, err := decoder.Token()
+		return object, err
+	case json.Delim('['):
+		array := []interface{}{}
+		for decoder.More() {
+			value, err := decodeOrdered(decoder)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		_, err := decoder.Token()
+		return array, err
+	}
+	return token, nil
+}
+
+func isComposite(value interface{}) bool {
+	switch value.(type) {
+	case jsonObject, []interface{}:
+		return true
+	}
+	return false
+}
+
+func isEmpty(value interface{}) bool {
+	switch typedValue := value.(type) {
+	case jsonObject:
+		return len(typedValue) == 0
+	case []interface{}:
+		return len(typedValue) == 0
+	}
+	return false
+}
+
+func formatScalar(value interface{}) string {
+	if value == nil {
+		return "null"
+	}
+	return fmt.Sprint(value)
+}
+
+// writeHuman writes objects as "key: value" lines with nested values indented below their key,
+// elements of arrays one per line and array objects separated by blank lines
+func writeHuman(w io.Writer, value interface{}, indent string) {
+	switch typedValue := value.(type) {
+	case jsonObject:
+		for _, field := range typedValue {
+			switch {
+			case isEmpty(field.value):
+				fmt.Fprintf(w, "%s%s: (none)\n", indent, field.key)
+			case isComposite(field.value):
+				fmt.Fprintf(w, "%s%s:\n", indent, field.key)
+				writeHuman(w, field.value, indent+"  ")
+			default:
+				fmt.Fprintf(w, "%s%s: %s\n", indent, field.key, formatScalar(field.value))
+			}
+		}
+	case []interface{}:
+		for index, element := range typedValue {
+			if isComposite(element) {
+				if index > 0 {
+					fmt.Fprintln(w)
+				}
+				writeHuman(w, element, indent)
+			} else {
+				fmt.Fprintf(w, "%s%s\n", indent, formatScalar(element))
+			}
+		}
+	default:
+		fmt.Fprintf(w, "%s%s\n", indent, formatScalar(typedValue))
+	}
+}
@@ -0,0 +1,293 @@
+// Package config reads the settings of an EChain node from command line flags and a config file.
+//
+// The config file holds one "option = value" line per setting, named like the flags without the leading dash;
+// empty lines and lines starting with # are ignored, and repeated options add to list settings such as seed.
+// Flags given on the command line take precedence over the config file.
+package config
+
+import (
+	"EChain/blockchain"
+	"EChain/network"
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultDataDir        = "storage"
+	DefaultConfigFileName = "echain.conf" // read from the data directory unless -conf is given
+	DefaultMaxPeers       = 125
+	DefaultMaxConnections = 64
+)
+
+// Config holds the settings of a node, network dependent defaults are filled in once the network is known
+type Config struct {
+	ConfigFile       string
+	DataDir          string
+	Network          string
+	NodeType         string
+	ListenAddress    string
+	SeedPeers        []string
+	PayoutAddress    string // receives the rewards of miner nodes
+	RPCBind          string
+	RPCUser          string // the RPC server is only started when credentials are set
+	RPCPassword      string
+	LogLevel         string
+	MaxPeers         int
+	MaxConnections   int
+	Prune            int    // number of recent blocks whose data full and miner nodes keep, 0 keeps every block
+	LoadSnapshot     string // UTXO snapshot file a new full or miner node is loaded from
+	ValidateSnapshot bool   // validate the blocks below a loaded UTXO snapshot in the background
+	LoadBlocks       string // block file imported by full and miner nodes at startup
+	TxIndex          bool   // index the transactions of the active chain for getrawtransaction
+	AddrIndex        bool   // index the history and balance of every address, needs every block
+}
+
+// Option is a line of a config file
+type Option struct {
+	Name  string
+	Value string
+	Line  int
+}
+
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*list = append(*list, item)
+		}
+	}
+	return nil
+}
+
+func newFlagSet(config *Config) *flag.FlagSet {
+	flags := flag.NewFlagSet("EChain", flag.ContinueOnError)
+	flags.StringVar(&config.ConfigFile, "conf", "", "config file, defaults to "+DefaultConfigFileName+" in the data directory")
+	flags.StringVar(&config.DataDir, "datadir", DefaultDataDir, "directory of the node databases and wallet files")
+	flags.StringVar(&config.Network, "network", blockchain.MainNetParams.Name, "network to join: mainnet, testnet or regtest")
+	flags.StringVar(&config.NodeType, "nodetype", network.FULLNODE, "type of the node: fullnode, miner or spv")
+	flags.StringVar(&config.ListenAddress, "listen", "", "P2P address (host:port) to listen on, defaults to the network's port on localhost")
+	flags.Var((*stringList)(&config.SeedPeers), "seed", "P2P address of a peer to connect to at startup, may be repeated; defaults to the network's initial peers")
+	flags.StringVar(&config.PayoutAddress, "payoutaddress", "", "address receiving the block rewards of a miner node")
+	flags.StringVar(&config.RPCBind, "rpcbind", "", "address (host:port) of the RPC server, defaults to the network's RPC port on localhost")
+	flags.StringVar(&config.RPCUser, "rpcuser", "", "RPC user, the RPC server is started when it is set")
+	flags.StringVar(&config.RPCPassword, "rpcpassword", "", "RPC password")
+	flags.StringVar(&config.LogLevel, "loglevel", "info", "log level: debug, info, warn or error")
+	flags.IntVar(&config.MaxPeers, "maxpeers", DefaultMaxPeers, "maximum number of peers, 0 for no limit")
+	flags.IntVar(&config.MaxConnections, "maxconnections", DefaultMaxConnections, "maximum number of incoming connections handled at once, 0 for no limit")
+	flags.IntVar(&config.Prune, "prune", 0, fmt.Sprintf("keep the data of only the last N blocks, at least %d; 0 keeps every block", blockchain.MIN_PRUNE_DEPTH))
+	flags.StringVar(&config.LoadSnapshot, "loadsnapshot", "", "UTXO snapshot file written by dumptxoutset to start a new full or miner node from")
+	flags.BoolVar(&config.ValidateSnapshot, "validatesnapshot", true, "download and validate the blocks below a loaded UTXO snapshot in the background")
+	flags.StringVar(&config.LoadBlocks, "loadblocks", "", "block file written by exportblocks to import at startup, blocks already in the chain are skipped")
+	flags.BoolVar(&config.TxIndex, "txindex", false, "index the transactions of the active chain, so getrawtransaction finds mined transactions")
+	flags.BoolVar(&config.AddrIndex, "addrindex", false, "index the history and balance of every address for getaddresshistory and getaddressbalance")
+	return flags
+}
+
+// Load parses the command line args (without the program name) and the config file, and validates the result.
+// It returns flag.ErrHelp when help was requested, the usage has been written to output then.
+func Load(args []string, output io.Writer) (*Config, error) {
+	config := &Config{}
+	flags := newFlagSet(config)
+	flags.SetOutput(output)
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %s, nodes are configured with flags such as -listen %s -nodetype %s", flags.Arg(0), flags.Arg(0), network.FULLNODE)
+	}
+
+	setOnCommandLine := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+	configFile := config.ConfigFile
+	if configFile == "" {
+		configFile = filepath.Join(config.DataDir, DefaultConfigFileName)
+	}
+	options, err := ReadFile(configFile)
+	if err != nil && (config.ConfigFile != "" || !errors.Is(err, fs.ErrNotExist)) {
+		return nil, fmt.Errorf("can not read config file: %w", err)
+	}
+	for _, option := range options {
+		if setOnCommandLine[option.Name] {
+			continue
+		}
+		if option.Name == "conf" || flags.Lookup(option.Name) == nil {
+			return nil, fmt.Errorf("%s:%d: unknown option %s", configFile, option.Line, option.Name)
+		}
+		if err := flags.Set(option.Name, option.Value); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid value %q for %s: %v", configFile, option.Line, option.Value, option.Name, err)
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ReadFile returns the options of the config file at path in the order they appear
+func ReadFile(path string) ([]Option, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	options := []Option{}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("%s:%d: expected option = value, got %q", path, lineNumber, line)
+		}
+		options = append(options, Option{strings.TrimSpace(name), strings.TrimSpace(value), lineNumber})
+	}
+	return options, scanner.Err()
+}
+
+// Validate fills in the network dependent defaults and reports every invalid setting
+func (config *Config) Validate() error {
+	params, err := blockchain.GetChainParams(config.Network)
+	if err != nil {
+		return fmt.Errorf("%v, expected one of mainnet, testnet, regtest", err)
+	}
+	if config.ListenAddress == "" {
+		config.ListenAddress = net.JoinHostPort("localhost", params.DefaultPort)
+	}
+	if config.RPCBind == "" {
+		config.RPCBind = net.JoinHostPort("localhost", params.RPCPort)
+	}
+	if len(config.SeedPeers) == 0 {
+		config.SeedPeers = params.InitialPeers
+	}
+
+	problems := []error{}
+	switch config.NodeType {
+	case network.FULLNODE, network.SPV:
+		if config.PayoutAddress != "" {
+			problems = append(problems, fmt.Errorf("payoutaddress is only used by miner nodes"))
+		}
+	case network.MINER:
+		if config.PayoutAddress == "" {
+			problems = append(problems, fmt.Errorf("miner nodes need a payoutaddress to receive block rewards"))
+		} else if !params.IsAddressValid(config.PayoutAddress) {
+			problems = append(problems, fmt.Errorf("payoutaddress %s is not a valid %s address", config.PayoutAddress, params.Name))
+		}
+	default:
+		problems = append(problems, fmt.Errorf("unknown node type %s, expected one of fullnode, miner, spv", config.NodeType))
+	}
+	if err := checkHostPort(config.ListenAddress); err != nil {
+		problems = append(problems, fmt.Errorf("listen address %v", err))
+	}
+	for _, seedPeer := range config.SeedPeers {
+		if err := checkHostPort(seedPeer); err != nil {
+			problems = append(problems, fmt.Errorf("seed peer %v", err))
+		}
+	}
+	if config.RPCUser != "" || config.RPCPassword != "" {
+		if config.RPCUser == "" || config.RPCPassword == "" {
+			problems = append(problems, fmt.Errorf("the RPC server needs both rpcuser and rpcpassword"))
+		}
+		if err := checkHostPort(config.RPCBind); err != nil {
+			problems = append(problems, fmt.Errorf("rpcbind address %v", err))
+		} else if config.RPCBind == config.ListenAddress {
+			problems = append(problems, fmt.Errorf("rpcbind and listen can not share the address %s", config.RPCBind))
+		}
+	}
+	if _, err := network.ParseLogLevel(config.LogLevel); err != nil {
+		problems = append(problems, err)
+	}
+	if config.MaxPeers < 0 {
+		problems = append(problems, fmt.Errorf("maxpeers can not be negative"))
+	}
+	if config.MaxConnections < 0 {
+		problems = append(problems, fmt.Errorf("maxconnections can not be negative"))
+	}
+	if config.Prune < 0 || (config.Prune > 0 && config.Prune < blockchain.MIN_PRUNE_DEPTH) {
+		problems = append(problems, fmt.Errorf("prune must be 0 or at least %d blocks", blockchain.MIN_PRUNE_DEPTH))
+	} else if config.Prune > 0 && config.NodeType == network.SPV {
+		problems = append(problems, fmt.Errorf("prune is only used by full and miner nodes, SPV nodes store no blocks"))
+	}
+	if config.LoadSnapshot != "" {
+		if config.NodeType == network.SPV {
+			problems = append(problems, fmt.Errorf("loadsnapshot is only used by full and miner nodes, SPV nodes store no UTXO set"))
+		} else if _, err := os.Stat(config.LoadSnapshot); err != nil {
+			problems = append(problems, fmt.Errorf("loadsnapshot %v", err))
+		}
+	}
+	if config.LoadBlocks != "" {
+		if config.NodeType == network.SPV {
+			problems = append(problems, fmt.Errorf("loadblocks is only used by full and miner nodes, SPV nodes store no blocks"))
+		} else if _, err := os.Stat(config.LoadBlocks); err != nil {
+			problems = append(problems, fmt.Errorf("loadblocks %v", err))
+		}
+	}
+	if config.NodeType == network.SPV && (config.TxIndex || config.AddrIndex) {
+		problems = append(problems, fmt.Errorf("txindex and addrindex are only used by full and miner nodes, SPV nodes store no blocks"))
+	} else if config.AddrIndex && config.Prune > 0 {
+		problems = append(problems, fmt.Errorf("addrindex needs every block, it can not be used with prune"))
+	}
+	if err := checkDataDir(config.DataDir); err != nil {
+		problems = append(problems, err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(problems...))
+	}
+	return nil
+}
+
+// ChainParams returns the parameters of the configured network with the data directory and seed peers of the node
+func (config *Config) ChainParams() *blockchain.ChainParams {
+	networkParams, _ := blockchain.GetChainParams(config.Network)
+	params := *networkParams
+	params.DataDir = config.DataDir
+	params.InitialPeers = config.SeedPeers
+	return &params
+}
+
+func checkHostPort(address string) error {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("%s is not of the form host:port", address)
+	}
+	if portNumber, err := strconv.Atoi(port); err != nil || portNumber < 0 || portNumber > 65535 {
+		return fmt.Errorf("%s has an invalid port", address)
+	}
+	return nil
+}
+
+func checkDataDir(dataDir string) error {
+	if dataDir == "" {
+		return fmt.Errorf("datadir can not be empty")
+	}
+	info, err := os.Stat(dataDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil // created with the first database
+	}
+	if err != nil {
+		return fmt.Errorf("can not access datadir: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("datadir %s is not a directory", dataDir)
+	}
+	return nil
+}
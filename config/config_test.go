@@ -0,0 +1,88 @@
+package config
+
+import (
+	"EChain/blockchain"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	dataDir := t.TempDir()
+	config, err := Load([]string{"-datadir", dataDir}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Network != "mainnet" || config.NodeType != "fullnode" || config.ListenAddress != "localhost:8333" || config.RPCBind != "localhost:8332" {
+		t.Fatalf("Unexpected defaults: %+v", config)
+	}
+	if params := config.ChainParams(); params.StoragePath(config.ListenAddress) != filepath.Join(dataDir, "localhost:8333") || len(params.InitialPeers) != 3 {
+		t.Fatalf("Expected the chain params to use the data directory and the network's initial peers")
+	}
+
+	payoutAddress := blockchain.RegTestParams.GenesisAddress
+	configFile := filepath.Join(dataDir, DefaultConfigFileName)
+	os.WriteFile(configFile, []byte(strings.Join([]string{
+		"# regtest miner",
+		"network = regtest",
+		"nodetype = miner",
+		"payoutaddress = " + payoutAddress,
+		"listen = localhost:20000",
+		"seed = localhost:20001",
+		"seed = localhost:20002",
+		"",
+		"maxpeers = 8",
+	}, "\n")), 0600)
+	config, err = Load([]string{"-datadir", dataDir, "-listen", "localhost:20003"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Network != "regtest" || config.PayoutAddress != payoutAddress || config.MaxPeers != 8 || config.RPCBind != "localhost:18443" {
+		t.Fatalf("Expected the config file to be applied, actual: %+v", config)
+	}
+	if config.ListenAddress != "localhost:20003" || len(config.SeedPeers) != 2 {
+		t.Fatalf("Expected flags to take precedence over the config file, actual: %+v", config)
+	}
+	if params := config.ChainParams(); params.StoragePath("node") != filepath.Join(dataDir, "regtest", "node") {
+		t.Fatalf("Expected regtest databases in the regtest subdirectory, actual: %s", params.StoragePath("node"))
+	}
+
+	os.WriteFile(configFile, []byte("nodetype = miner\nrpcuser = user\nloglevel = verbose\nunknown = 1\n"), 0600)
+	if _, err := Load([]string{"-datadir", dataDir}, io.Discard); err == nil || !strings.Contains(err.Error(), ":4: unknown option unknown") {
+		t.Fatalf("Expected unknown options to be reported with their line, actual: %v", err)
+	}
+	os.WriteFile(configFile, []byte("nodetype = miner\nrpcuser = user\nloglevel = verbose\n"), 0600)
+	_, err = Load([]string{"-datadir", dataDir, "-maxpeers", "-1"}, io.Discard)
+	for _, problem := range []string{"payoutaddress", "rpcpassword", "log level", "maxpeers"} {
+		if err == nil || !strings.Contains(err.Error(), problem) {
+			t.Fatalf("Expected every invalid setting to be reported, missing %s in: %v", problem, err)
+		}
+	}
+
+	if _, err := Load([]string{"localhost:8333", "fullnode"}, io.Discard); err == nil || !strings.Contains(err.Error(), "-listen") {
+		t.Fatalf("Expected positional arguments to point to the flags, actual: %v", err)
+	}
+	if _, err := Load([]string{"-conf", filepath.Join(dataDir, "missing.conf")}, io.Discard); err == nil {
+		t.Fatalf("Expected a missing config file given with -conf to be rejected")
+	}
+	if _, err := Load([]string{"-datadir", dataDir, "-network", "regtest", "-seed", "localhost"}, io.Discard); err == nil {
+		t.Fatalf("Expected seed peers without a port to be rejected")
+	}
+	if _, err := Load([]string{"-datadir", dataDir, "-prune", "5"}, io.Discard); err == nil || !strings.Contains(err.Error(), "prune") {
+		t.Fatalf("Expected a prune depth below the minimum to be rejected, actual: %v", err)
+	}
+	if _, err := Load([]string{"-datadir", dataDir, "-nodetype", "spv", "-prune", "20"}, io.Discard); err == nil {
+		t.Fatalf("Expected pruning on an SPV node to be rejected")
+	}
+	if _, err := Load([]string{"-datadir", dataDir, "-loadsnapshot", filepath.Join(dataDir, "missing.snapshot")}, io.Discard); err == nil || !strings.Contains(err.Error(), "loadsnapshot") {
+		t.Fatalf("Expected a missing snapshot file to be rejected, actual: %v", err)
+	}
+	if _, err := Load([]string{"-datadir", dataDir, "-nodetype", "spv", "-loadblocks", filepath.Join(dataDir, "blocks.dat")}, io.Discard); err == nil {
+		t.Fatalf("Expected importing blocks into an SPV node to be rejected")
+	}
+	if _, err := Load([]string{"-datadir", dataDir, "-addrindex", "-prune", "20"}, io.Discard); err == nil || !strings.Contains(err.Error(), "addrindex") {
+		t.Fatalf("Expected the address index of a pruned node to be rejected, actual: %v", err)
+	}
+}
@@ -1,22 +1,148 @@
 package main
 
 import (
+	"EChain/blockchain"
+	"EChain/config"
 	"EChain/network"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
+// p2pNode is implemented by the full, miner and SPV nodes
+type p2pNode interface {
+	StartRPCServer(network.RPCConfig) error
+	Start(context.Context) error
+	Stop()
+	Done() <-chan struct{}
+}
+
 func main() {
-	networkAddress := os.Args[1]
-	nodeType := os.Args[2]
-
-	if nodeType == network.FULLNODE {
-		fullNode := network.NewFullNode(networkAddress)
-		fullNode.StartP2PNode()
-	} else if nodeType == network.MINER {
-		minerNode := network.NewMinerNode(networkAddress, "15Hgpfs67bXWcFPHxF4mCjSbtXXMwbttge")
-		minerNode.StartP2PNode()
-	} else if nodeType == network.SPV {
-		spvNode := network.NewSPVNode(networkAddress)
-		spvNode.StartP2PNode()
+	cfg, err := config.Load(os.Args[1:], os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logLevel, _ := network.ParseLogLevel(cfg.LogLevel)
+	network.SetLogLevel(logLevel)
+
+	params := cfg.ChainParams()
+	storagePath := params.StoragePath(cfg.ListenAddress)
+	store, err := blockchain.OpenLevelDBStore(storagePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can not open database at %s: %v\n", storagePath, err)
+		os.Exit(1)
+	}
+	var node p2pNode
+	var fullNode *network.FullNode // also set for miner nodes, nil for SPV nodes
+	switch cfg.NodeType {
+	case network.FULLNODE:
+		fullNode = network.NewFullNode(params, cfg.ListenAddress, store)
+		fullNode.MaxPeers, fullNode.MaxConnections = cfg.MaxPeers, cfg.MaxConnections
+		node = fullNode
+	case network.MINER:
+		minerNode := network.NewMinerNode(params, cfg.ListenAddress, cfg.PayoutAddress, store)
+		minerNode.MaxPeers, minerNode.MaxConnections = cfg.MaxPeers, cfg.MaxConnections
+		node, fullNode = minerNode, &minerNode.FullNode
+	case network.SPV:
+		spvNode := network.NewSPVNode(params, cfg.ListenAddress, store)
+		spvNode.MaxPeers, spvNode.MaxConnections = cfg.MaxPeers, cfg.MaxConnections
+		node = spvNode
+	}
+
+	// The snapshot is only loaded into a new node, restarted nodes keep the chain loaded before
+	if cfg.LoadSnapshot != "" && fullNode.Blockchain.GetHeight() == 1 {
+		if err := loadSnapshot(fullNode.Blockchain, cfg.LoadSnapshot); err != nil {
+			node.Stop()
+			fmt.Fprintln(os.Stderr, "can not load UTXO snapshot:", err)
+			os.Exit(1)
+		}
+	}
+	if fullNode != nil && fullNode.Blockchain.SnapshotError() != nil {
+		node.Stop()
+		fmt.Fprintln(os.Stderr, "the UTXO snapshot the chain was loaded from is invalid, remove the data directory to sync anew:", fullNode.Blockchain.SnapshotError())
+		os.Exit(1)
+	}
+	if cfg.LoadBlocks != "" {
+		if err := importBlocks(fullNode, cfg.LoadBlocks); err != nil {
+			node.Stop()
+			fmt.Fprintln(os.Stderr, "can not import blocks:", err)
+			os.Exit(1)
+		}
+	}
+	if cfg.Prune > 0 {
+		if err := fullNode.Blockchain.EnablePruning(cfg.Prune); err != nil {
+			node.Stop()
+			fmt.Fprintln(os.Stderr, "can not prune blocks:", err)
+			os.Exit(1)
+		}
+	}
+	if cfg.TxIndex {
+		fullNode.Blockchain.EnableTxIndex()
+	}
+	if cfg.AddrIndex {
+		if err := fullNode.Blockchain.EnableAddressIndex(); err != nil {
+			node.Stop()
+			fmt.Fprintln(os.Stderr, "can not enable the address index:", err)
+			os.Exit(1)
+		}
+	}
+	if fullNode != nil && cfg.ValidateSnapshot {
+		if err := fullNode.StartSnapshotValidation(node.Stop); err != nil {
+			node.Stop()
+			fmt.Fprintln(os.Stderr, "can not validate UTXO snapshot:", err)
+			os.Exit(1)
+		}
+	}
+
+	// The node is stopped on SIGINT or SIGTERM, or by the stop RPC method
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if cfg.RPCUser != "" {
+		rpcConfig := network.RPCConfig{ListenAddress: cfg.RPCBind, User: cfg.RPCUser, Password: cfg.RPCPassword}
+		if err := node.StartRPCServer(rpcConfig); err != nil {
+			node.Stop()
+			fmt.Fprintln(os.Stderr, "can not start RPC server:", err)
+			os.Exit(1)
+		}
+	}
+	if err := node.Start(ctx); err != nil {
+		node.Stop()
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	<-node.Done()
+	fmt.Println("EChain node stopped")
+}
+
+func loadSnapshot(localBlockchain *blockchain.BlockChain, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	metadata, err := localBlockchain.LoadUTXOSnapshot(file)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Loaded UTXO snapshot of block %x at height %d with hash %x\n", metadata.BlockHash, metadata.Height, metadata.Hash)
+	return nil
+}
+
+func importBlocks(fullNode *network.FullNode, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
 	}
+	defer file.Close()
+	result, err := fullNode.ImportBlocks(file)
+	fmt.Printf("Imported %d blocks from %s, skipped %d blocks already in the chain, height %d\n", result.Imported, path, result.Skipped, result.Height)
+	return err
 }
@@ -0,0 +1,83 @@
+package network
+
+import (
+	"EChain/blockchain"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ImportResult counts the blocks of a block file imported into the active chain
+type ImportResult struct {
+	Imported int // blocks validated and connected
+	Skipped  int // blocks already in the active chain
+	Height   int // height of the tip after the import
+}
+
+// ExportBlocks writes the active chain to the block file at path and returns the number of blocks written.
+// The file is replaced only once all blocks are written.
+func (node *FullNode) ExportBlocks(path string) (int, error) {
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmpPath)
+	count, err := node.Blockchain.ExportBlocks(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return count, os.Rename(tmpPath, path)
+}
+
+// ImportBlocks validates the blocks of the block file read from reader like blocks received from peers and
+// connects them to the tip one by one. Blocks already in the active chain are skipped, so an interrupted import
+// resumes when the file is imported again. The import stops at the first block not extending the tip or failing
+// the validation, the blocks before it stay connected.
+func (node *FullNode) ImportBlocks(reader io.Reader) (ImportResult, error) {
+	result := ImportResult{}
+	blockFileReader := blockchain.NewBlockFileReader(reader)
+	for {
+		block, err := blockFileReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return node.importResult(result), err
+		}
+		hash := block.GetHash()
+		if node.Blockchain.Index.IsInActiveChain(hash) {
+			result.Skipped++
+			continue
+		}
+		if !bytes.Equal(block.PrevHash, node.Blockchain.LastHash) {
+			return node.importResult(result), fmt.Errorf("block %x does not extend the tip %x", hash, node.Blockchain.LastHash)
+		}
+		if err := blockchain.CheckBlockContent(block); err != nil {
+			return node.importResult(result), fmt.Errorf("block %x is invalid: %w", hash, err)
+		}
+		if !node.verifyBlock(block) {
+			return node.importResult(result), fmt.Errorf("block %x is invalid", hash)
+		}
+		if err := node.storeNewBlock(block); err != nil {
+			return node.importResult(result), err
+		}
+		result.Imported++
+	}
+	result = node.importResult(result)
+	logInfo("imported", result.Imported, "blocks, skipped", result.Skipped, "blocks already in the chain, height", result.Height)
+	return result, nil
+}
+
+func (node *FullNode) importResult(result ImportResult) ImportResult {
+	result.Height = node.Blockchain.GetHeight() - 1
+	return result
+}
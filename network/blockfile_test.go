@@ -0,0 +1,50 @@
+package network
+
+import (
+	"EChain/blockchain"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImportBlocks(t *testing.T) {
+	t.Parallel()
+	params := &blockchain.RegTestParams
+	minerNode := NewMinerNode(params, "export-test", params.GenesisAddress, blockchain.NewMemoryStore())
+	defer minerNode.Stop()
+	if _, err := minerNode.GenerateBlocks(4); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "blocks.dat")
+	result, err := minerNode.rpcExportBlocks([]json.RawMessage{json.RawMessage(`"` + path + `"`)})
+	if err != nil || result.(ExportBlocksResult).Blocks != 5 {
+		t.Fatalf("Expected the 5 blocks of the active chain to be exported, actual: %+v (%v)", result, err)
+	}
+	blockFile, _ := os.ReadFile(path)
+
+	// An interrupted import resumes after the blocks already connected
+	fullNode := NewFullNode(params, "import-test", blockchain.NewMemoryStore())
+	defer fullNode.Stop()
+	importResult, err := fullNode.ImportBlocks(bytes.NewReader(blockFile[:len(blockFile)-10]))
+	if err == nil || importResult.Imported != 3 || importResult.Height != 3 {
+		t.Fatalf("Expected the blocks before the truncated one to be imported, actual: %+v (%v)", importResult, err)
+	}
+	importResult, err = fullNode.ImportBlocks(bytes.NewReader(blockFile))
+	if err != nil || importResult.Skipped != 4 || importResult.Imported != 1 || !bytes.Equal(fullNode.Blockchain.LastHash, minerNode.Blockchain.LastHash) {
+		t.Fatalf("Expected the import to resume at block 4, actual: %+v (%v)", importResult, err)
+	}
+
+	// Blocks are validated like blocks received from peers
+	tampered := minerNode.Blockchain.GetBlockByHeight(1)
+	tampered.Transactions[0].Outputs[0].Value *= 2
+	encodedBlock := serialize(tampered)
+	tamperedFile := append(binary.BigEndian.AppendUint32(nil, uint32(len(encodedBlock))), encodedBlock...)
+	otherNode := NewFullNode(params, "import-invalid-test", blockchain.NewMemoryStore())
+	defer otherNode.Stop()
+	if importResult, err := otherNode.ImportBlocks(bytes.NewReader(tamperedFile)); err == nil || importResult.Height != 0 {
+		t.Fatalf("Expected an invalid block to be rejected, actual: %+v", importResult)
+	}
+}
@@ -0,0 +1,142 @@
+package network
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	MAX_CONFIRMATION_TARGET = 25    // blocks, the furthest target fees are estimated for
+	feeBucketCount          = 16    // buckets cover 0 and 1, 2, 4, ... 2^14 satoshi per byte
+	feeEstimateDecay        = 0.998 // weight kept by old observations after every block
+	feeEstimateSuccessRatio = 0.85  // share of transactions that must confirm within the target
+	feeEstimateMinSamples   = 1.0   // minimal (decayed) number of transactions a bucket needs to be used
+)
+
+type feeBucket struct {
+	confirmedWithin [MAX_CONFIRMATION_TARGET + 1]float64 // confirmedWithin[n]: transactions confirmed in at most n blocks
+	total           float64                              // transactions that confirmed or gave up waiting
+}
+
+type trackedTransaction struct {
+	bucketIndex int
+	entryHeight int
+}
+
+// FeeEstimator learns how long mempool transactions of each fee rate take to be mined
+type FeeEstimator struct {
+	mutex   sync.Mutex
+	buckets [feeBucketCount]feeBucket
+	tracked map[string]trackedTransaction
+	height  int // height of the last processed block
+}
+
+func NewFeeEstimator() *FeeEstimator {
+	return &FeeEstimator{tracked: make(map[string]trackedTransaction)}
+}
+
+func feeBucketIndex(feeRate int) int {
+	bucketIndex := 0
+	for bucketRate := 1; bucketRate <= feeRate && bucketIndex < feeBucketCount-1; bucketRate *= 2 {
+		bucketIndex++
+	}
+	return bucketIndex
+}
+
+// feeBucketRate is the lowest fee rate of a bucket
+func feeBucketRate(bucketIndex int) int {
+	if bucketIndex == 0 {
+		return 0
+	}
+	return 1 << (bucketIndex - 1)
+}
+
+// TrackTransaction starts timing a transaction that entered the mempool at the given chain height
+func (estimator *FeeEstimator) TrackTransaction(txnID []byte, feeRate, height int) {
+	estimator.mutex.Lock()
+	defer estimator.mutex.Unlock()
+	estimator.tracked[string(txnID)] = trackedTransaction{feeBucketIndex(feeRate), height}
+}
+
+// ProcessBlock records the confirmation time of tracked transactions mined in a block at height
+func (estimator *FeeEstimator) ProcessBlock(txnIDs [][]byte, height int) {
+	estimator.mutex.Lock()
+	defer estimator.mutex.Unlock()
+	estimator.height = height
+
+	for bucketIndex := range estimator.buckets {
+		bucket := &estimator.buckets[bucketIndex]
+		for target := range bucket.confirmedWithin {
+			bucket.confirmedWithin[target] *= feeEstimateDecay
+		}
+		bucket.total *= feeEstimateDecay
+	}
+
+	for _, txnID := range txnIDs {
+		trackedTxn, exists := estimator.tracked[string(txnID)]
+		if !exists {
+			continue
+		}
+		delete(estimator.tracked, string(txnID))
+		blocksToConfirm := height - trackedTxn.entryHeight
+		if blocksToConfirm < 1 {
+			blocksToConfirm = 1
+		}
+		bucket := &estimator.buckets[trackedTxn.bucketIndex]
+		for target := blocksToConfirm; target <= MAX_CONFIRMATION_TARGET; target++ {
+			bucket.confirmedWithin[target]++
+		}
+		bucket.total++
+	}
+
+	// Transactions waiting longer than the largest target count as failures of their bucket
+	for txnID, trackedTxn := range estimator.tracked {
+		if height-trackedTxn.entryHeight > MAX_CONFIRMATION_TARGET {
+			estimator.buckets[trackedTxn.bucketIndex].total++
+			delete(estimator.tracked, txnID)
+		}
+	}
+}
+
+// RemoveTransaction stops tracking a transaction that left the mempool without being mined
+func (estimator *FeeEstimator) RemoveTransaction(txnID []byte) {
+	estimator.mutex.Lock()
+	defer estimator.mutex.Unlock()
+	delete(estimator.tracked, string(txnID))
+}
+
+// EstimateFee returns the lowest fee rate (satoshi per byte) at which transactions were confirmed
+// within targetBlocks blocks in the large majority of cases
+func (estimator *FeeEstimator) EstimateFee(targetBlocks int) (int, error) {
+	if targetBlocks < 1 || targetBlocks > MAX_CONFIRMATION_TARGET {
+		return 0, fmt.Errorf("confirmation target must be between 1 and %d blocks", MAX_CONFIRMATION_TARGET)
+	}
+	estimator.mutex.Lock()
+	defer estimator.mutex.Unlock()
+
+	// Transactions still waiting that already missed the target count against their bucket
+	var missedTarget [feeBucketCount]float64
+	for _, trackedTxn := range estimator.tracked {
+		if estimator.height-trackedTxn.entryHeight >= targetBlocks {
+			missedTarget[trackedTxn.bucketIndex]++
+		}
+	}
+
+	// Walk down from the highest fee rate while buckets keep confirming in time
+	estimatedBucket := -1
+	for bucketIndex := feeBucketCount - 1; bucketIndex >= 0; bucketIndex-- {
+		bucket := estimator.buckets[bucketIndex]
+		total := bucket.total + missedTarget[bucketIndex]
+		if total < feeEstimateMinSamples {
+			continue
+		}
+		if bucket.confirmedWithin[targetBlocks]/total < feeEstimateSuccessRatio {
+			break
+		}
+		estimatedBucket = bucketIndex
+	}
+	if estimatedBucket == -1 {
+		return 0, fmt.Errorf("insufficient data to estimate fee for %d blocks", targetBlocks)
+	}
+	return feeBucketRate(estimatedBucket), nil
+}
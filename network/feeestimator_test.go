@@ -0,0 +1,56 @@
+package network
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFeeEstimator(t *testing.T) {
+	estimator := NewFeeEstimator()
+	if _, err := estimator.EstimateFee(2); err == nil {
+		t.Fatalf("Expected no estimate without data")
+	}
+
+	// High fee transactions confirm in the next block, low fee transactions wait 5 blocks
+	height := 1
+	for round := 0; round < 20; round++ {
+		highFeeID := []byte(fmt.Sprint("high", round))
+		lowFeeID := []byte(fmt.Sprint("low", round))
+		estimator.TrackTransaction(highFeeID, 20, height)
+		estimator.TrackTransaction(lowFeeID, 1, height)
+
+		height++
+		estimator.ProcessBlock([][]byte{highFeeID}, height)
+		height += 4
+		estimator.ProcessBlock([][]byte{lowFeeID}, height)
+	}
+
+	if feeRate, err := estimator.EstimateFee(1); err != nil || feeRate != feeBucketRate(feeBucketIndex(20)) {
+		t.Fatalf("Expected 1-block estimate to be the high fee bucket, actual: %d (%v)", feeRate, err)
+	}
+	if feeRate, err := estimator.EstimateFee(6); err != nil || feeRate != 1 {
+		t.Fatalf("Expected 6-block estimate to be 1 satoshi per byte, actual: %d (%v)", feeRate, err)
+	}
+
+	// Transactions still waiting count against the targets they already missed
+	estimator = NewFeeEstimator()
+	for round := 0; round < 20; round++ {
+		highFeeID := []byte(fmt.Sprint("high", round))
+		midFeeID := []byte(fmt.Sprint("mid", round))
+		estimator.TrackTransaction(highFeeID, 20, height)
+		estimator.TrackTransaction(midFeeID, 4, height)
+		height++
+		estimator.ProcessBlock([][]byte{highFeeID, midFeeID}, height)
+	}
+	for round := 0; round < 10; round++ {
+		estimator.TrackTransaction([]byte(fmt.Sprint("stuck", round)), 4, height)
+	}
+	height += 2
+	estimator.ProcessBlock(nil, height)
+	if feeRate, err := estimator.EstimateFee(1); err != nil || feeRate != feeBucketRate(feeBucketIndex(20)) {
+		t.Fatalf("Expected 1-block estimate to skip the bucket of the waiting transactions, actual: %d (%v)", feeRate, err)
+	}
+	if feeRate, err := estimator.EstimateFee(3); err != nil || feeRate != feeBucketRate(feeBucketIndex(4)) {
+		t.Fatalf("Expected 3-block estimate to use the bucket of the waiting transactions, actual: %d (%v)", feeRate, err)
+	}
+}
@@ -3,10 +3,9 @@ package network
 import (
 	"EChain/blockchain"
 	"bytes"
-	"crypto/ecdsa"
+	"context"
 	"fmt"
 	"io"
-	"log"
 	"math/big"
 	"net"
 	"sync"
@@ -23,111 +22,108 @@ type FullNode struct {
 	connectedSpvBloomFilterMap map[string][]string
 	getdataMessageCount        int
 	mempool                    []*blockchain.Transaction
+	mempoolFees                map[string]int // fee paid by each mempool transaction, keyed by transaction hash
+	mempoolMutex               *sync.Mutex    // guards mempool and mempoolFees, written by concurrent message handlers
+	feeEstimator               *FeeEstimator
+	snapshotValidation         *snapshotValidation // nil unless the blocks below a UTXO snapshot are being validated
 }
 
-func NewFullNode(networkAddress string) *FullNode {
-	localBlockchain := blockchain.InitBlockChain(networkAddress)
-	p2pNode := P2PNode{
-		Version:        1,
-		NetworkAddress: networkAddress,
-	}
-	return &FullNode{
-		P2PNode:                    p2pNode,
+// NewFullNode returns a full node keeping its chain in store, the node closes store when it is stopped
+func NewFullNode(params *blockchain.ChainParams, networkAddress string, store blockchain.Store) *FullNode {
+	localBlockchain := blockchain.InitBlockChain(params, store)
+	node := &FullNode{
+		P2PNode:                    newP2PNode(params, networkAddress),
 		Blockchain:                 localBlockchain,
 		connectedSpvBloomFilterMap: make(map[string][]string),
+		mempoolFees:                make(map[string]int),
+		mempoolMutex:               &sync.Mutex{},
+		feeEstimator:               NewFeeEstimator(),
 	}
+	localBlockchain.SetBlockVerifier(node.verifyBlockAt)
+	return node
 }
 
-func (node *FullNode) StartP2PNode() {
-	fmt.Println(" ===== Starting blockchain node at", node.NetworkAddress, "=====")
-	ln, err := net.Listen(protocol, node.NetworkAddress)
-	if err != nil {
-		log.Fatal("can not start server at", node.NetworkAddress)
-	}
-
-	go func() {
-		time.Sleep(2 * time.Second)
-		for _, peerAddr := range initialPeers {
-			if peerAddr != node.NetworkAddress {
-				node.sendVersionMsg(peerAddr)
-			}
-		}
-	}()
-
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Panic(err.Error())
-		}
-
-		go node.handleConnection(conn)
+// Start listens for peers and connects to the initial peers in the background, the node is stopped once ctx is done
+func (node *FullNode) Start(ctx context.Context) error {
+	if err := node.listen(ctx, node.handleConnection, node.Stop); err != nil {
+		return err
 	}
+	node.goWorker(func() {
+		node.connectToInitialPeers(node.sendVersionMsg)
+	})
+	return nil
 }
 
 // ======= Send messages =======
 
 func (node *FullNode) sendAddrMsg(toAddress string) {
-	fmt.Println("Send Addr msg from", node.NetworkAddress, "to", toAddress)
+	logDebug("Send Addr msg from", node.NetworkAddress, "to", toAddress)
 	addrMsg := AddrMessage{node.NetworkAddress}
 	sentData := append(msgTypeToBytes(ADDR_MSG), serialize(addrMsg)...)
 	sendMessage(toAddress, sentData)
 }
 
 func (node *FullNode) sendVerackMsg(toAddress string) {
-	fmt.Println("Send Verack msg from", node.NetworkAddress, "to", toAddress)
+	logDebug("Send Verack msg from", node.NetworkAddress, "to", toAddress)
 	verackMsg := VerackMessage{FULLNODE, node.NetworkAddress}
 	sentData := append(msgTypeToBytes(VERACK_MSG), serialize(verackMsg)...)
 	sendMessage(toAddress, sentData)
 }
 
 func (node *FullNode) sendGetBlocksMsg(toAddress string) {
-	fmt.Println("Send Getblocks msg from", node.NetworkAddress, "to", toAddress)
-	lastBlockHash := node.Blockchain.LastHash
-	getblocksMsg := GetblocksMessage{lastBlockHash, node.NetworkAddress}
+	logDebug("Send Getblocks msg from", node.NetworkAddress, "to", toAddress)
+	getblocksMsg := GetblocksMessage{node.Blockchain.GetBlockLocator(), nil, node.NetworkAddress}
 	sentData := append(msgTypeToBytes(GETBLOCKS_MSG), serialize(getblocksMsg)...)
 	sendMessage(toAddress, sentData)
 }
 
 func (node *FullNode) sendVersionMsg(toAddress string) {
-	fmt.Println("Send Version msg from", node.NetworkAddress, "to", toAddress)
+	logDebug("Send Version msg from", node.NetworkAddress, "to", toAddress)
 	nBestHeight := node.Blockchain.GetHeight()
-	versionMsg := VersionMessage{node.Version, toAddress, node.NetworkAddress, nBestHeight}
+	versionMsg := VersionMessage{node.Version, toAddress, node.NetworkAddress, nBestHeight, node.Params.NetworkMagic, node.Blockchain.GetPruneHeight()}
 	sentData := append(msgTypeToBytes(VERSION_MSG), serialize(versionMsg)...)
 	sendMessage(toAddress, sentData)
 }
 
 func (node *FullNode) sendGetdataMessage(toAddress string, getdataMsg *GetdataMessage) {
-	fmt.Println("Send Getdata msg from", node.NetworkAddress, "to", toAddress)
+	logDebug("Send Getdata msg from", node.NetworkAddress, "to", toAddress)
 	sentData := append(msgTypeToBytes(GETDATA_MSG), serialize(getdataMsg)...)
 	sendMessageBlocking(toAddress, sentData)
 }
 
 func (node *FullNode) sendBlockdataMessage(toAddress string, msgIndex int, blockList []*blockchain.Block) {
-	fmt.Println("Send Blockdata msg from", node.NetworkAddress, "to", toAddress)
+	logDebug("Send Blockdata msg from", node.NetworkAddress, "to", toAddress)
 	sentData := append(msgTypeToBytes(BLOCKDATA_MSG), serialize(BlockdataMessage{msgIndex, blockList})...)
 	sendMessage(toAddress, sentData)
 }
 
+func (node *FullNode) sendNotFoundMessage(toAddress string, notFoundMsg *NotFoundMessage) {
+	logDebug("Send NotFound msg from", node.NetworkAddress, "to", toAddress)
+	sentData := append(msgTypeToBytes(NOTFOUND_MSG), serialize(notFoundMsg)...)
+	sendMessage(toAddress, sentData)
+}
+
 func (node *FullNode) sendInvMessage(toAddress string, invMsg *InvMessage) {
-	fmt.Println("Send Inv msg from", node.NetworkAddress, "to", toAddress)
+	logDebug("Send Inv msg from", node.NetworkAddress, "to", toAddress)
 	sentData := append(msgTypeToBytes(INV_MSG), serialize(invMsg)...)
 	sendMessage(toAddress, sentData)
 }
 
 func (node *FullNode) sendHeaderMessage(toAddress string, headerMsg *HeaderMessage) {
-	fmt.Println("Send Headers msg from", node.NetworkAddress, "to", toAddress)
+	logDebug("Send Headers msg from", node.NetworkAddress, "to", toAddress)
 	sentData := append(msgTypeToBytes(HEADERS_MSG), serialize(headerMsg)...)
 	sendMessage(toAddress, sentData)
 }
 
 func (node *FullNode) sendNewTxnMessage(toAddress string, newTxnMsg *NewTxnMessage) {
-	fmt.Println("Send NewTxn msg from", node.NetworkAddress, "to", toAddress)
-	sentData := append(msgTypeToBytes(NEWTXN_MSG), serialize(newTxnMsg)...)
+	logDebug("Send NewTxn msg from", node.NetworkAddress, "to", toAddress)
+	// Receivers decode the payload as a bare transaction, the format wallets send
+	sentData := append(msgTypeToBytes(NEWTXN_MSG), serialize(newTxnMsg.Transaction)...)
 	sendMessage(toAddress, sentData)
 }
 
 func (node *FullNode) sendMerkleblockMessage(toAddress string, merkleblockMsg *MerkleBlockMessage) {
-	fmt.Println("Send Merkleblock msg from", node.NetworkAddress, "to", toAddress)
+	logDebug("Send Merkleblock msg from", node.NetworkAddress, "to", toAddress)
 	sentData := append(msgTypeToBytes(MERKLEBLOCK_MSG), serialize(merkleblockMsg)...)
 	sendMessage(toAddress, sentData)
 }
@@ -138,19 +134,18 @@ func (node *FullNode) handleGetblocksMsg(msg []byte) {
 	var getblocksMsg GetblocksMessage
 	genericDeserialize(msg, &getblocksMsg)
 
-	remoteLastBlockHash := getblocksMsg.TopBlockHash
-	blockExisted, unmatchedBlocks := node.Blockchain.GetUnmatchedBlocks(remoteLastBlockHash)
-	if blockExisted && len(unmatchedBlocks) > 0 {
-		blockHashesToSend := [][]byte{}
-		for i := len(unmatchedBlocks) - 1; i >= 0; i-- {
-			blockHashesToSend = append(blockHashesToSend, unmatchedBlocks[i])
-			if len(blockHashesToSend) >= 500 {
-				break
-			}
-		}
+	blockHashesToSend := node.Blockchain.GetBlockHashesAfter(getblocksMsg.BlockLocator, getblocksMsg.StopHash, 500)
+	// The requester can not connect the blocks we still store without the pruned ones
+	if len(blockHashesToSend) > 0 && node.Blockchain.IsPruned(blockHashesToSend[0]) {
+		logDebug("Not serving pruned blocks to", getblocksMsg.AddrFrom)
+		blockHashesToSend = nil
+	}
+	if len(blockHashesToSend) > 0 {
 		invMsg := InvMessage{blockHashesToSend}
 		node.sendInvMessage(getblocksMsg.AddrFrom, &invMsg)
-	} else if !blockExisted {
+	}
+	// The requester's tip is unknown, it is ahead of us or on another branch
+	if len(getblocksMsg.BlockLocator) > 0 && node.Blockchain.Index.GetEntry(getblocksMsg.BlockLocator[0]) == nil {
 		node.sendGetBlocksMsg(getblocksMsg.AddrFrom)
 	}
 }
@@ -159,16 +154,8 @@ func (node *FullNode) handleGetheadersMsg(msg []byte) {
 	var getheadersMsg GetheadersMessage
 	genericDeserialize(msg, &getheadersMsg)
 
-	remoteLastHeaderHash := getheadersMsg.TopHeaderHash
-	headerExisted, unmatchedHeaders := node.Blockchain.GetUnmatchedHeaders(remoteLastHeaderHash)
-	if headerExisted && len(unmatchedHeaders) > 0 {
-		headerList := []*blockchain.BlockHeader{}
-		for i := len(unmatchedHeaders) - 1; i >= 0; i-- {
-			headerList = append(headerList, unmatchedHeaders[i])
-			if len(headerList) >= 2000 {
-				break
-			}
-		}
+	headerList := node.Blockchain.GetHeadersAfter(getheadersMsg.BlockLocator, getheadersMsg.StopHash, 2000)
+	if len(headerList) > 0 {
 		headerMsg := HeaderMessage{headerList}
 		node.sendHeaderMessage(getheadersMsg.AddrFrom, &headerMsg)
 	}
@@ -178,8 +165,39 @@ func (node *FullNode) handleGetdataMsg(msg []byte) {
 	var getdataMsg GetdataMessage
 	genericDeserialize(msg, &getdataMsg)
 
-	blockList := node.Blockchain.GetBlocksFromHashes(getdataMsg.HashList)
+	blockList := []*blockchain.Block{}
+	notFoundHashes := [][]byte{}
+	for _, blockHash := range getdataMsg.HashList {
+		if block := node.Blockchain.GetBlock(blockHash); block != nil {
+			blockList = append(blockList, block)
+		} else {
+			notFoundHashes = append(notFoundHashes, blockHash)
+		}
+	}
 	node.sendBlockdataMessage(getdataMsg.AddrFrom, getdataMsg.Index, blockList)
+	if len(notFoundHashes) > 0 {
+		node.sendNotFoundMessage(getdataMsg.AddrFrom, &NotFoundMessage{getdataMsg.Index, notFoundHashes, node.NetworkAddress})
+	}
+}
+
+// handleNotFoundMsg requests the blocks a pruning peer could not serve from a peer keeping every block
+func (node *FullNode) handleNotFoundMsg(msg []byte) {
+	var notFoundMsg NotFoundMessage
+	genericDeserialize(msg, &notFoundMsg)
+
+	logInfo(notFoundMsg.AddrFrom, "does not have", len(notFoundMsg.HashList), "of the requested blocks")
+	if _, isPruned := node.prunedPeers.Load(notFoundMsg.AddrFrom); !isPruned {
+		return
+	}
+	for _, connectedNode := range node.connectedPeers {
+		if _, isPruned := node.prunedPeers.Load(connectedNode.Address); isPruned || connectedNode.Address == notFoundMsg.AddrFrom {
+			continue
+		}
+		if connectedNode.NodeType == FULLNODE || connectedNode.NodeType == MINER {
+			node.sendGetdataMessage(connectedNode.Address, &GetdataMessage{notFoundMsg.Index, notFoundMsg.HashList, node.NetworkAddress})
+			return
+		}
+	}
 }
 
 func (node *FullNode) handleInvMsg(msg []byte) {
@@ -198,6 +216,18 @@ func (node *FullNode) handleInvMsg(msg []byte) {
 		}
 	}
 
+	// Pruning peers are not asked for blocks below their prune height
+	servingPeers := []string{}
+	for _, connectedNode := range node.connectedPeers {
+		if node.servesBlocksFrom(connectedNode.Address, node.Blockchain.GetHeight()) {
+			servingPeers = append(servingPeers, connectedNode.Address)
+		}
+	}
+	if len(servingPeers) == 0 {
+		logWarn("no peer serves the announced blocks")
+		return
+	}
+
 	// Send getdata messages to peers
 	var wg sync.WaitGroup
 	var mutex sync.Mutex
@@ -206,7 +236,7 @@ func (node *FullNode) handleInvMsg(msg []byte) {
 	node.getdataMessageCount = messageCount
 	wg.Add(messageCount)
 
-	for index, connectedNode := range node.connectedPeers {
+	for index, peerAddress := range servingPeers {
 		if index >= messageCount {
 			break
 		}
@@ -223,84 +253,280 @@ func (node *FullNode) handleInvMsg(msg []byte) {
 				node.sendGetdataMessage(toAddress, &getdataMsg)
 				wg.Done()
 			}
-		}(connectedNode.Address)
+		}(peerAddress)
 	}
 	wg.Wait()
-	time.Sleep(3 * time.Second) // Wait for all blockdata messages to be processed
-	utxoSet := node.Blockchain.UTXOSet()
-	utxoSet.ReIndex()
+	if !node.sleep(3 * time.Second) { // Wait for all blockdata messages to be processed
+		return
+	}
 	for _, connectedNode := range node.connectedPeers {
 		node.sendGetBlocksMsg(connectedNode.Address)
 	}
 }
 
-func (node *FullNode) verifyTransaction(newTransaction *blockchain.Transaction) bool {
+// outpoint identifies a transaction output spent by an input
+type outpoint struct {
+	txnID string
+	index int
+}
+
+// verifyTransaction checks the inputs of a transaction in a new block against utxoSet and returns its fee,
+// blockOutputs holds the outputs of the block's earlier transactions, which may be spent as well.
+// spentOutpoints holds the outputs spent by the block so far, an output may only be spent once, and the
+// outputs of the transaction may not be worth more than its inputs.
+func (node *FullNode) verifyTransaction(newTransaction *blockchain.Transaction, utxoSet *blockchain.UTXOSet, blockOutputs map[string][]blockchain.TxOutput, spentOutpoints map[outpoint]bool) (int, bool) {
 	if blockchain.IsCoinbaseTransaction(newTransaction) {
-		return true
+		return 0, true
 	}
-	txnMap := node.Blockchain.GetTransactionMapFromInputs(newTransaction)
+	inputValue := 0
 	for _, txnInput := range newTransaction.Inputs {
+		spentOutpoint := outpoint{string(txnInput.TxID), txnInput.VOut}
+		if spentOutpoints[spentOutpoint] {
+			return 0, false
+		}
+		spentOutpoints[spentOutpoint] = true
+
 		signature := txnInput.ScriptSig.Signature
 		pubkey := txnInput.ScriptSig.PubKey
-		referencedUTXO := txnMap[string(txnInput.TxID)].Outputs[txnInput.VOut]
+		referencedUTXO := utxoSet.GetTxOutputFromTxInput(&txnInput)
+		if referencedUTXO == nil {
+			outputs := blockOutputs[string(txnInput.TxID)]
+			if txnInput.VOut < 0 || txnInput.VOut >= len(outputs) {
+				return 0, false
+			}
+			referencedUTXO = &outputs[txnInput.VOut]
+		}
 
 		if !bytes.Equal(getPubkeyHashFromPubkey(pubkey), referencedUTXO.ScriptPubKey.PubKeyHash) {
-			return false
+			return 0, false
 		}
 
-		signatureLength := len(signature)
-		r := new(big.Int).SetBytes(signature[:(signatureLength / 2)])
-		s := new(big.Int).SetBytes(signature[(signatureLength / 2):])
-		ecdsaPubkey := getECDSAPubkeyFromUncompressedPubkey(pubkey)
-		if !ecdsa.Verify(&ecdsaPubkey, txnInput.Hash(), r, s) {
-			return false
+		if !verifySignature(pubkey, signature, txnInput.Hash()) {
+			return 0, false
 		}
+		inputValue += referencedUTXO.Value
 	}
-	return true
+	outputValue := 0
+	for _, txOutput := range newTransaction.Outputs {
+		if txOutput.Value < 0 {
+			return 0, false
+		}
+		outputValue += txOutput.Value
+	}
+	return inputValue - outputValue, outputValue <= inputValue
+}
+
+// checkNewBlock checks the proof of work and the transactions of a block received from a peer before it is
+// stored, the transactions are verified against the UTXO set once the block is connected
+func (node *FullNode) checkNewBlock(newBlock *blockchain.Block) error {
+	if new(big.Int).SetBytes(newBlock.GetHash()).Cmp(node.Params.TargetHash()) != -1 {
+		return fmt.Errorf("block %x does not have a valid proof of work", newBlock.GetHash())
+	}
+	return blockchain.CheckBlockContent(newBlock)
 }
 
 func (node *FullNode) verifyBlock(newBlock *blockchain.Block) bool {
+	parentHeight := node.Blockchain.GetBlockHeight(newBlock.PrevHash)
+	if parentHeight < 0 {
+		return false
+	}
+	utxoSet := node.Blockchain.UTXOSet()
+	return node.verifyBlockAt(newBlock, &utxoSet, parentHeight+1)
+}
+
+// verifyBlockAt checks newBlock as the block at blockHeight spending the outputs of utxoSet, the UTXO set built
+// by the blocks below it
+func (node *FullNode) verifyBlockAt(newBlock *blockchain.Block, utxoSet *blockchain.UTXOSet, blockHeight int) bool {
 	// Step 1: Check if block header hash is smaller than target hash
 	blockHash := new(big.Int).SetBytes(newBlock.GetHash())
-	if blockHash.Cmp(blockchain.TARGET_HASH) != -1 {
+	if blockHash.Cmp(node.Params.TargetHash()) != -1 {
 		return false
 	}
-	// Step 2: Check if the first transaction is Coinbase transaction
-	if !blockchain.IsCoinbaseTransaction(newBlock.Transactions[0]) {
+	// Step 2: Check if the first transaction, and only the first, is Coinbase transaction
+	if len(newBlock.Transactions) == 0 || !blockchain.IsCoinbaseTransaction(newBlock.Transactions[0]) {
 		return false
 	}
-	// Step 3: Verify the validity of each transaction
-	for _, transaction := range newBlock.Transactions {
-		if !node.verifyTransaction(transaction) {
+	// Step 3: Verify the validity of each transaction, each spent output counts once towards the fees
+	blockOutputs := make(map[string][]blockchain.TxOutput)
+	spentOutpoints := make(map[outpoint]bool)
+	fees := 0
+	for i, transaction := range newBlock.Transactions {
+		if i > 0 && blockchain.IsCoinbaseTransaction(transaction) {
 			return false
 		}
+		fee, ok := node.verifyTransaction(transaction, utxoSet, blockOutputs, spentOutpoints)
+		if !ok {
+			return false
+		}
+		fees += fee
+		blockOutputs[string(transaction.Hash)] = transaction.Outputs
+	}
+	// Step 4: Check that the coinbase does not claim more than the subsidy at the block's height and the fees
+	coinbaseValue := 0
+	for _, txOutput := range newBlock.Transactions[0].Outputs {
+		coinbaseValue += txOutput.Value
+	}
+	if coinbaseValue > node.Params.GetBlockSubsidy(blockHeight)+fees {
+		return false
+	}
+	// Step 5: Check that spent coinbase outputs are mature, including the block's own coinbase
+	for _, transaction := range newBlock.Transactions[1:] {
+		if node.spendsImmatureCoinbase(transaction, utxoSet, blockHeight) {
+			return false
+		}
+		for _, txnInput := range transaction.Inputs {
+			if bytes.Equal(txnInput.TxID, newBlock.Transactions[0].Hash) && node.Params.CoinbaseMaturity > 0 {
+				return false
+			}
+		}
 	}
 	return true
 }
 
-func (node *FullNode) storeNewBlock(newBlock *blockchain.Block) {
-	node.Blockchain.SetBlock(newBlock)
-	node.Blockchain.SetLastHash(newBlock.GetHash())
+// spendsImmatureCoinbase reports whether transaction spends a coinbase output of utxoSet that can not be spent
+// in a block at spendHeight yet
+func (node *FullNode) spendsImmatureCoinbase(transaction *blockchain.Transaction, utxoSet *blockchain.UTXOSet, spendHeight int) bool {
+	for _, txnInput := range transaction.Inputs {
+		utxo := utxoSet.GetUTXOFromTxInput(&txnInput)
+		if utxo != nil && !utxo.IsMatureAt(spendHeight, node.Params.CoinbaseMaturity) {
+			return true
+		}
+	}
+	return false
+}
+
+func (node *FullNode) storeNewBlock(newBlock *blockchain.Block) error {
+	if err := node.Blockchain.StoreNewBlock(newBlock); err != nil {
+		return err
+	}
+	// Blocks of a side branch confirm nothing
+	if node.Blockchain.Index.IsInActiveChain(newBlock.GetHash()) {
+		node.removeConfirmedTransactions(newBlock)
+	}
+	return nil
+}
+
+// removeConfirmedTransactions drops the transactions of a new block from the mempool
+// and reports their confirmation to the fee estimator
+func (node *FullNode) removeConfirmedTransactions(newBlock *blockchain.Block) {
+	confirmedTxnIDs := [][]byte{}
+	for _, transaction := range newBlock.Transactions {
+		confirmedTxnIDs = append(confirmedTxnIDs, transaction.Hash)
+	}
+	node.mempoolMutex.Lock()
+	defer node.mempoolMutex.Unlock()
+	node.feeEstimator.ProcessBlock(confirmedTxnIDs, node.Blockchain.GetHeight())
+
+	remainingTxns := []*blockchain.Transaction{}
+	for _, transaction := range node.mempool {
+		if slices.ContainsFunc(confirmedTxnIDs, func(txnID []byte) bool { return bytes.Equal(txnID, transaction.Hash) }) {
+			delete(node.mempoolFees, string(transaction.Hash))
+		} else {
+			remainingTxns = append(remainingTxns, transaction)
+		}
+	}
+	node.mempool = remainingTxns
+}
 
+// GetTxOutSetInfo reports the UTXO set of the active chain together with the supply the monetary policy allows
+func (node *FullNode) GetTxOutSetInfo() TxOutSetInfoMessage {
 	utxoSet := node.Blockchain.UTXOSet()
-	utxoSet.UpdateWithNewBlock(newBlock)
+	utxoSetInfo := utxoSet.GetInfo()
+	height := node.Blockchain.GetHeight() - 1
+	return TxOutSetInfoMessage{
+		Height:         height,
+		BestBlockHash:  node.Blockchain.LastHash,
+		Transactions:   utxoSetInfo.Transactions,
+		TxOutputs:      utxoSetInfo.TxOutputs,
+		TotalAmount:    utxoSetInfo.TotalAmount,
+		ExpectedSupply: node.Params.MonetaryPolicy.SupplyAt(height),
+		MaxSupply:      node.Params.MonetaryPolicy.MaxSupply(),
+	}
+}
+
+func (node *FullNode) handleTxOutSetInfoMsg(conn net.Conn) {
+	conn.Write(serialize(node.GetTxOutSetInfo()))
+	conn.Close()
+}
+
+// EstimateFee returns the fee rate in satoshi per byte needed for a transaction to be mined within targetBlocks blocks
+func (node *FullNode) EstimateFee(targetBlocks int) (int, error) {
+	return node.feeEstimator.EstimateFee(targetBlocks)
+}
+
+// GetBalance splits the balance of addresses by the state of their outputs like SPV nodes do for wallets,
+// mempool transactions count as unconfirmed
+func (node *FullNode) GetBalance(addresses []string, minConfirmations int) BalanceMessage {
+	if minConfirmations < 1 {
+		minConfirmations = 1
+	}
+
+	var balanceMsg BalanceMessage
+	spentByMempool := make(map[string][]int)
+	for _, transaction := range node.getMempool() {
+		for _, input := range transaction.Inputs {
+			spentByMempool[string(input.TxID)] = append(spentByMempool[string(input.TxID)], input.VOut)
+		}
+		for _, output := range transaction.Outputs {
+			if isOutputBoundToAny(&output, addresses) {
+				balanceMsg.UnconfirmedIncoming += output.Value
+			}
+		}
+	}
+
+	tipHeight := node.Blockchain.GetHeight() - 1
+	for _, address := range addresses {
+		for txnID, txnOutputs := range node.Blockchain.GetUTXOs(address) {
+			for _, output := range txnOutputs {
+				switch {
+				case slices.Contains(spentByMempool[txnID], output.Index):
+					balanceMsg.UnconfirmedOutgoing += output.Value
+				case !output.IsMatureAt(tipHeight+1, node.Params.CoinbaseMaturity):
+					balanceMsg.Immature += output.Value
+				case tipHeight-output.Height+1 < minConfirmations:
+					balanceMsg.UnconfirmedIncoming += output.Value
+				default:
+					balanceMsg.Confirmed += output.Value
+				}
+			}
+		}
+	}
+	return balanceMsg
+}
+
+// Stop closes the P2P listener and the RPC server, waits for in-flight handlers and closes the database
+func (node *FullNode) Stop() {
+	node.shutdown(func() {
+		node.Blockchain.DataBase.Close()
+	})
 }
 
 func (node *FullNode) handleBlockdataMsg(msg []byte) {
 	var blockdataMsg BlockdataMessage
 	genericDeserialize(msg, &blockdataMsg)
 
+	if blockdataMsg.Index == SNAPSHOT_BLOCKS_INDEX {
+		node.handleSnapshotBlocks(blockdataMsg.BlockList)
+		return
+	}
 	// Newly mined block
 	if blockdataMsg.Index == NEWBLOCK_FROM_MINER_INDEX && len(blockdataMsg.BlockList) == 1 {
 		newBlock := blockdataMsg.BlockList[0]
-		// Step 1: Verify newly mined block received from miner node
-		if !node.verifyBlock(newBlock) {
-			fmt.Println("new block is invalid")
+		// Step 1: Check newly mined block received from miner node
+		if err := node.checkNewBlock(newBlock); err != nil {
+			logWarn("new block is invalid:", err)
 			return
 		}
 
-		// Step 2: Store new block to local blockchain
-		node.storeNewBlock(newBlock)
+		// Step 2: Store new block to local blockchain, it is verified once it is connected. Blocks of a side
+		// branch with less work are not relayed.
+		if err := node.storeNewBlock(newBlock); err != nil {
+			logWarn("new block can not be connected:", err)
+			return
+		}
+		if !node.Blockchain.Index.IsInActiveChain(newBlock.GetHash()) {
+			return
+		}
 
 		// Step 3: Relay new block to other full nodes
 		for _, connectedNode := range node.connectedPeers {
@@ -328,19 +554,32 @@ func (node *FullNode) handleBlockdataMsg(msg []byte) {
 		}
 		return
 	}
+	// Blocks of a requested branch are verified once they are connected, a block failing the checks possible
+	// before drops the rest of the message
 	for _, block := range blockdataMsg.BlockList {
+		if err := node.checkNewBlock(block); err != nil {
+			logWarn("received block is invalid:", err)
+			return
+		}
 		node.Blockchain.SetBlock(block)
 	}
-	if blockdataMsg.Index == node.getdataMessageCount-1 {
-		node.Blockchain.SetLastHash(blockdataMsg.BlockList[len(blockdataMsg.BlockList)-1].GetHash())
+	// Switch to the received branch only if it has more work than the active chain
+	if blockdataMsg.Index == node.getdataMessageCount-1 && len(blockdataMsg.BlockList) > 0 {
+		lastHash := blockdataMsg.BlockList[len(blockdataMsg.BlockList)-1].GetHash()
+		if node.Blockchain.HasMoreWork(lastHash) {
+			if err := node.Blockchain.SetLastHash(lastHash); err != nil {
+				logWarn("can not switch to the received branch:", err)
+			}
+		}
 	}
 }
 
 func (node *FullNode) handleVersionMsg(msg []byte) {
 	var versionMsg VersionMessage
 	genericDeserialize(msg, &versionMsg)
+	node.recordPruneHeight(versionMsg.AddrMe, versionMsg.PruneHeight)
 
-	if node.Version == versionMsg.Version {
+	if node.Version == versionMsg.Version && node.Params.NetworkMagic == versionMsg.NetworkMagic && node.hasPeerSlot(versionMsg.AddrMe) {
 		node.sendVerackMsg(versionMsg.AddrMe)
 		if !slices.Contains(node.getConnectedNodeAddresses(), versionMsg.AddrMe) {
 			node.sendVersionMsg(versionMsg.AddrMe)
@@ -352,19 +591,20 @@ func (node *FullNode) handleVerackMsg(msg []byte) {
 	var verackMsg VerackMessage
 	genericDeserialize(msg, &verackMsg)
 
-	if slices.Contains(node.getConnectedNodeAddresses(), verackMsg.AddrFrom) {
+	if slices.Contains(node.getConnectedNodeAddresses(), verackMsg.AddrFrom) || !node.hasPeerSlot(verackMsg.AddrFrom) {
 		return
 	}
 	node.connectedPeers = append(node.connectedPeers, NodeInfo{verackMsg.NodeType, verackMsg.AddrFrom})
 	node.sendAddrMsg(verackMsg.AddrFrom)
 	node.sendGetBlocksMsg(verackMsg.AddrFrom)
+	node.requestSnapshotBlocks()
 }
 
 func (node *FullNode) handleAddrMsg(msg []byte) {
 	var addrMsg AddrMessage
 	genericDeserialize(msg, &addrMsg)
 
-	if !slices.Contains(node.getConnectedNodeAddresses(), addrMsg.Address) {
+	if !slices.Contains(node.getConnectedNodeAddresses(), addrMsg.Address) && node.hasPeerSlot(addrMsg.Address) {
 		node.sendVersionMsg(addrMsg.Address)
 	}
 
@@ -388,61 +628,123 @@ func (node *FullNode) handeGetUTXOMsg(conn net.Conn, msg []byte) {
 	conn.Close()
 }
 
+// getMempool returns the transactions of the mempool, the slice is not changed by later mempool updates
+func (node *FullNode) getMempool() []*blockchain.Transaction {
+	node.mempoolMutex.Lock()
+	defer node.mempoolMutex.Unlock()
+	return slices.Clone(node.mempool)
+}
+
+// getMempoolSpentOutpoints returns the outputs spent by mempool transactions, must be called with the mempool lock held
+func (node *FullNode) getMempoolSpentOutpoints() map[outpoint]bool {
+	spentOutpoints := make(map[outpoint]bool)
+	for _, transaction := range node.mempool {
+		for _, txnInput := range transaction.Inputs {
+			spentOutpoints[outpoint{string(txnInput.TxID), txnInput.VOut}] = true
+		}
+	}
+	return spentOutpoints
+}
+
 func (node *FullNode) handleNewTxnMsg(msg []byte) error {
-	utxoSet := node.Blockchain.UTXOSet()
-	totalInputAmount := 0
 	var newTransaction blockchain.Transaction
 	genericDeserialize(msg, &newTransaction)
+	if blockchain.IsCoinbaseTransaction(&newTransaction) {
+		return fmt.Errorf("coinbase transaction outside of a block")
+	}
+	added, err := node.addToMempool(&newTransaction)
+	if !added {
+		return err
+	}
 
+	// Step 4: Relay transaction to network
+	for _, connectedNode := range node.connectedPeers {
+		if connectedNode.NodeType == FULLNODE || connectedNode.NodeType == MINER {
+			node.sendNewTxnMessage(connectedNode.Address, &NewTxnMessage{newTransaction})
+		}
+	}
+	return nil
+}
+
+// addToMempool verifies newTransaction and adds it to the mempool, it reports false if the transaction is invalid
+// or already in the mempool
+func (node *FullNode) addToMempool(newTransaction *blockchain.Transaction) (bool, error) {
+	node.mempoolMutex.Lock()
+	defer node.mempoolMutex.Unlock()
+	utxoSet := node.Blockchain.UTXOSet()
+	totalInputAmount := 0
 	for _, txn := range node.mempool {
 		if slices.Equal(txn.Hash, newTransaction.Hash) {
-			return nil
+			return false, nil
 		}
 	}
-
-	// Step 1: Check if transaction inputs reference valid UTXOs &
+	// Step 1: Check if transaction inputs reference valid UTXOs, each once and not spent by mempool transactions, &
 	// check if input signature works with output's locking script
+	spentByMempool := node.getMempoolSpentOutpoints()
+	spentOutpoints := make(map[outpoint]bool)
 	for _, txnInput := range newTransaction.Inputs {
+		spentOutpoint := outpoint{string(txnInput.TxID), txnInput.VOut}
+		if spentOutpoints[spentOutpoint] {
+			return false, fmt.Errorf("transaction spends output %x:%d twice", txnInput.TxID, txnInput.VOut)
+		}
+		spentOutpoints[spentOutpoint] = true
+		if spentByMempool[spentOutpoint] {
+			return false, fmt.Errorf("transaction conflicts with a mempool transaction spending output %x:%d", txnInput.TxID, txnInput.VOut)
+		}
 		referencedTxOutput := utxoSet.GetTxOutputFromTxInput(&txnInput)
 		if referencedTxOutput == nil {
-			return fmt.Errorf("transaction input references UTXO that does not exist")
+			return false, fmt.Errorf("transaction input references UTXO that does not exist")
 		}
 		signature := txnInput.ScriptSig.Signature
 		pubkey := txnInput.ScriptSig.PubKey
 
 		if !bytes.Equal(getPubkeyHashFromPubkey(pubkey), referencedTxOutput.ScriptPubKey.PubKeyHash) {
-			return fmt.Errorf("invalid public key in transaction input")
+			return false, fmt.Errorf("invalid public key in transaction input")
 		}
 
-		signatureLength := len(signature)
-		r := new(big.Int).SetBytes(signature[:(signatureLength / 2)])
-		s := new(big.Int).SetBytes(signature[(signatureLength / 2):])
-		ecdsaPubkey := getECDSAPubkeyFromUncompressedPubkey(pubkey)
-		if !ecdsa.Verify(&ecdsaPubkey, txnInput.Hash(), r, s) {
-			return fmt.Errorf("invalid signature")
+		if !verifySignature(pubkey, signature, txnInput.Hash()) {
+			return false, fmt.Errorf("invalid signature")
 		}
 
 		totalInputAmount += referencedTxOutput.Value
 	}
+	// The transaction can be mined in the next block at the earliest
+	if node.spendsImmatureCoinbase(newTransaction, &utxoSet, node.Blockchain.GetHeight()) {
+		return false, fmt.Errorf("transaction spends immature coinbase output")
+	}
 
 	// Step 2: Verify if total input does not exceed spent output
 	spentAmount := 0
 	for _, txOutput := range newTransaction.Outputs {
+		if txOutput.Value < 0 {
+			return false, fmt.Errorf("negative output value")
+		}
 		spentAmount += txOutput.Value
 	}
 	if totalInputAmount < spentAmount {
-		return fmt.Errorf("spent output exceeds input amount")
+		return false, fmt.Errorf("spent output exceeds input amount")
 	}
 
-	// Step 3: Add to current node's mempool & Replay transaction to network
-	node.mempool = append(node.mempool, &newTransaction)
-	for _, connectedNode := range node.connectedPeers {
-		if connectedNode.NodeType == FULLNODE || connectedNode.NodeType == MINER {
-			node.sendNewTxnMessage(connectedNode.Address, &NewTxnMessage{newTransaction})
-		}
-	}
+	// Step 3: Add to current node's mempool
+	fee := totalInputAmount - spentAmount
+	node.mempool = append(node.mempool, newTransaction)
+	node.mempoolFees[string(newTransaction.Hash)] = fee
+	node.feeEstimator.TrackTransaction(newTransaction.Hash, fee/newTransaction.Size(), node.Blockchain.GetHeight())
+	return true, nil
+}
 
-	return nil
+func (node *FullNode) handleEstimateFeeMsg(conn net.Conn, msg []byte) {
+	var estimateFeeMsg EstimateFeeMessage
+	genericDeserialize(msg, &estimateFeeMsg)
+
+	var feeEstimateMsg FeeEstimateMessage
+	feeRate, err := node.EstimateFee(estimateFeeMsg.TargetBlocks)
+	if err != nil {
+		feeEstimateMsg.Error = err.Error()
+	}
+	feeEstimateMsg.FeeRate = feeRate
+	conn.Write(serialize(feeEstimateMsg))
+	conn.Close()
 }
 
 func (node *FullNode) handleFilterloadMsg(msg []byte) {
@@ -471,6 +773,8 @@ func (node *FullNode) handleConnection(conn net.Conn) {
 		node.handleInvMsg(payload)
 	case GETDATA_MSG:
 		node.handleGetdataMsg(payload)
+	case NOTFOUND_MSG:
+		node.handleNotFoundMsg(payload)
 	case BLOCKDATA_MSG:
 		node.handleBlockdataMsg(payload)
 	case GETHEADERS_MSG:
@@ -481,7 +785,11 @@ func (node *FullNode) handleConnection(conn net.Conn) {
 		node.handleNewTxnMsg(payload)
 	case FILTERLOAD_MSG:
 		node.handleFilterloadMsg(payload)
+	case ESTIMATEFEE_MSG:
+		node.handleEstimateFeeMsg(conn, payload)
+	case TXOUTSETINFO_MSG:
+		node.handleTxOutSetInfoMsg(conn)
 	default:
-		fmt.Println("invalid message")
+		logWarn("invalid message")
 	}
 }
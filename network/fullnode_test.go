@@ -0,0 +1,346 @@
+package network
+
+import (
+	"EChain/blockchain"
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+func TestCoinbaseMaturity(t *testing.T) {
+	t.Parallel()
+	fullNode := NewFullNode(&blockchain.RegTestParams, "maturity-test", blockchain.NewMemoryStore())
+	defer fullNode.Stop()
+	miner := MinerNode{FullNode: *fullNode}
+
+	coinbase := blockchain.CoinBaseTransaction(fullNode.Params.GenesisAddress, blockchain.COINBASE_REWARD)
+	block := blockchain.Block{
+		BlockHeader:  blockchain.BlockHeader{Timestamp: time.Now().String(), PrevHash: fullNode.Blockchain.LastHash},
+		Transactions: []*blockchain.Transaction{coinbase},
+	}
+	miner.mineBlock(&block)
+	fullNode.storeNewBlock(&block)
+
+	utxoSet := fullNode.Blockchain.UTXOSet()
+	utxo := utxoSet.GetUTXOFromTxInput(&blockchain.TxInput{TxID: coinbase.Hash, VOut: 0})
+	if utxo == nil || !utxo.IsCoinbase || utxo.Height != 1 {
+		t.Fatalf("Expected coinbase output created at height 1, actual: %+v", utxo)
+	}
+
+	spend := blockchain.Transaction{Inputs: []blockchain.TxInput{{TxID: coinbase.Hash, VOut: 0}}}
+	if !fullNode.spendsImmatureCoinbase(&spend, &utxoSet, fullNode.Blockchain.GetHeight()) {
+		t.Fatalf("Expected coinbase output to be immature in the next block")
+	}
+	if fullNode.spendsImmatureCoinbase(&spend, &utxoSet, 1+fullNode.Params.CoinbaseMaturity) {
+		t.Fatalf("Expected coinbase output to be spendable %d blocks later", fullNode.Params.CoinbaseMaturity)
+	}
+}
+
+func TestTxOutSetInfo(t *testing.T) {
+	t.Parallel()
+	fullNode := NewFullNode(&blockchain.RegTestParams, "txoutsetinfo-test", blockchain.NewMemoryStore())
+	defer fullNode.Stop()
+	miner := MinerNode{FullNode: *fullNode}
+
+	block := blockchain.Block{
+		BlockHeader:  blockchain.BlockHeader{Timestamp: time.Now().String(), PrevHash: fullNode.Blockchain.LastHash},
+		Transactions: []*blockchain.Transaction{blockchain.CoinBaseTransaction(fullNode.Params.GenesisAddress, blockchain.COINBASE_REWARD)},
+	}
+	miner.mineBlock(&block)
+	if !fullNode.verifyBlock(&block) {
+		t.Fatalf("Expected block claiming the subsidy to be valid")
+	}
+	fullNode.storeNewBlock(&block)
+
+	info := fullNode.GetTxOutSetInfo()
+	if info.Height != 1 || info.TxOutputs != 2 || info.TotalAmount != 2*blockchain.COINBASE_REWARD || info.TotalAmount != info.ExpectedSupply {
+		t.Fatalf("Expected genesis and block 1 rewards in the UTXO set, actual: %+v", info)
+	}
+
+	greedyBlock := blockchain.Block{
+		BlockHeader:  blockchain.BlockHeader{Timestamp: time.Now().String(), PrevHash: fullNode.Blockchain.LastHash},
+		Transactions: []*blockchain.Transaction{blockchain.CoinBaseTransaction(fullNode.Params.GenesisAddress, blockchain.COINBASE_REWARD+1)},
+	}
+	miner.mineBlock(&greedyBlock)
+	if fullNode.verifyBlock(&greedyBlock) {
+		t.Fatalf("Expected block claiming more than the subsidy to be rejected")
+	}
+}
+
+func TestTxIndex(t *testing.T) {
+	t.Parallel()
+	fullNode := NewFullNode(&blockchain.RegTestParams, "txindex-test", blockchain.NewMemoryStore())
+	defer fullNode.Stop()
+	miner := MinerNode{FullNode: *fullNode}
+
+	mineCoinbaseBlock := func(prevHash []byte, height int) *blockchain.Block {
+		block := blockchain.Block{
+			BlockHeader:  blockchain.BlockHeader{Timestamp: time.Now().String(), PrevHash: prevHash},
+			Transactions: []*blockchain.Transaction{blockchain.CoinBaseTransaction(fullNode.Params.GenesisAddress, blockchain.COINBASE_REWARD-height)},
+		}
+		miner.mineBlock(&block)
+		return &block
+	}
+	genesisHash := fullNode.Blockchain.LastHash
+	firstBlock := mineCoinbaseBlock(genesisHash, 1)
+	fullNode.storeNewBlock(firstBlock)
+
+	if _, _, err := fullNode.Blockchain.GetTransaction(firstBlock.Transactions[0].Hash); err == nil {
+		t.Fatalf("Expected lookups to fail while the transaction index is disabled")
+	}
+	fullNode.Blockchain.EnableTxIndex()
+	transaction, block, err := fullNode.Blockchain.GetTransaction(firstBlock.Transactions[0].Hash)
+	if err != nil || !bytes.Equal(transaction.Hash, firstBlock.Transactions[0].Hash) || !bytes.Equal(block.GetHash(), firstBlock.GetHash()) {
+		t.Fatalf("Expected coinbase of block 1 to be indexed (%v)", err)
+	}
+
+	// A competing block at height 1 replaces the first one
+	competingBlock := mineCoinbaseBlock(genesisHash, 2)
+	fullNode.Blockchain.SetBlock(competingBlock)
+	fullNode.Blockchain.SetLastHash(competingBlock.GetHash())
+	if _, _, err := fullNode.Blockchain.GetTransaction(firstBlock.Transactions[0].Hash); err == nil {
+		t.Fatalf("Expected transactions of disconnected blocks to leave the index")
+	}
+	if _, block, err := fullNode.Blockchain.GetTransaction(competingBlock.Transactions[0].Hash); err != nil || !bytes.Equal(block.GetHash(), competingBlock.GetHash()) {
+		t.Fatalf("Expected transactions of connected blocks to be indexed (%v)", err)
+	}
+}
+
+func TestPrunedBlocks(t *testing.T) {
+	t.Parallel()
+	params := &blockchain.RegTestParams
+	minerNode := NewMinerNode(params, "prune-test", params.GenesisAddress, blockchain.NewMemoryStore())
+	defer minerNode.Stop()
+	if err := minerNode.Blockchain.EnablePruning(blockchain.MIN_PRUNE_DEPTH); err != nil {
+		t.Fatal(err)
+	}
+	blockHashes, err := minerNode.GenerateBlocks(15)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requester, err := net.Listen(protocol, "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer requester.Close()
+	prunedHash, keptHash := blockHashes[0], blockHashes[14]
+	minerNode.handleGetdataMsg(serialize(GetdataMessage{0, [][]byte{prunedHash, keptHash}, requester.Addr().String()}))
+
+	receive := func(msgType string) []byte {
+		conn, err := requester.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		msg, _ := io.ReadAll(conn)
+		if getMsgType(msg) != msgType {
+			t.Fatalf("Expected a %s message, actual: %s", msgType, getMsgType(msg))
+		}
+		return msg[msgTypeLength:]
+	}
+	var blockdataMsg BlockdataMessage
+	genericDeserialize(receive(BLOCKDATA_MSG), &blockdataMsg)
+	if len(blockdataMsg.BlockList) != 1 || !bytes.Equal(blockdataMsg.BlockList[0].GetHash(), keptHash) {
+		t.Fatalf("Expected only the kept block to be sent")
+	}
+	var notFoundMsg NotFoundMessage
+	genericDeserialize(receive(NOTFOUND_MSG), &notFoundMsg)
+	if len(notFoundMsg.HashList) != 1 || !bytes.Equal(notFoundMsg.HashList[0], prunedHash) {
+		t.Fatalf("Expected the pruned block to be reported as not found")
+	}
+
+	minerNode.recordPruneHeight("pruned-peer", minerNode.Blockchain.GetPruneHeight())
+	if minerNode.servesBlocksFrom("pruned-peer", 1) || !minerNode.servesBlocksFrom("pruned-peer", minerNode.Blockchain.GetPruneHeight()) {
+		t.Fatalf("Expected peers to serve blocks from their prune height only")
+	}
+	if !minerNode.servesBlocksFrom("archive-peer", 1) {
+		t.Fatalf("Expected peers without a prune height to serve every block")
+	}
+}
+
+// signedTransaction returns a transaction spending inputs with privKey, each input is signed
+func signedTransaction(t *testing.T, privKey *btcec.PrivateKey, inputs []blockchain.TxInput, outputs []blockchain.TxOutput) *blockchain.Transaction {
+	transaction := &blockchain.Transaction{Inputs: inputs, Outputs: outputs}
+	for i := range transaction.Inputs {
+		transaction.Inputs[i].ScriptSig.PubKey = privKey.PubKey().SerializeCompressed()
+		signature, err := privKey.Sign(transaction.Inputs[i].Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		encodedSignature := make([]byte, signatureLength)
+		signature.R.FillBytes(encodedSignature[:signatureLength/2])
+		signature.S.FillBytes(encodedSignature[signatureLength/2:])
+		transaction.Inputs[i].ScriptSig.Signature = encodedSignature
+	}
+	transaction.SetHash()
+	return transaction
+}
+
+func TestDoubleSpends(t *testing.T) {
+	t.Parallel()
+	params := blockchain.RegTestParams
+	params.CoinbaseMaturity = 0
+	params.MonetaryPolicy.HalvingInterval = 2 // the subsidy of the block at height 2 is halved
+	privKey, _ := btcec.NewPrivateKey(btcec.S256())
+	pubkeyHash := getPubkeyHashFromPubkey(privKey.PubKey().SerializeCompressed())
+	minerNode := NewMinerNode(&params, "double-spend-test", params.GetAddress(pubkeyHash), blockchain.NewMemoryStore())
+	defer minerNode.Stop()
+	blockHashes, err := minerNode.GenerateBlocks(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase := minerNode.Blockchain.GetBlock(blockHashes[0]).Transactions[0]
+	value := coinbase.Outputs[0].Value
+	output := func(value int) blockchain.TxOutput {
+		return blockchain.TxOutput{Value: value, ScriptPubKey: blockchain.LockingScript{PubKeyHash: pubkeyHash}}
+	}
+	spendCoinbase := func(outputs ...blockchain.TxOutput) *blockchain.Transaction {
+		return signedTransaction(t, privKey, []blockchain.TxInput{{TxID: coinbase.Hash, VOut: 0}}, outputs)
+	}
+
+	newBlockOn := func(prevHash []byte, reward int, transactions ...*blockchain.Transaction) *blockchain.Block {
+		coinbase := blockchain.CoinBaseTransaction(params.GenesisAddress, reward)
+		block := &blockchain.Block{
+			BlockHeader:  blockchain.BlockHeader{Timestamp: time.Now().String(), PrevHash: prevHash},
+			Transactions: append([]*blockchain.Transaction{coinbase}, transactions...),
+		}
+		minerNode.mineBlock(block)
+		return block
+	}
+	newBlock := func(transactions ...*blockchain.Transaction) *blockchain.Block {
+		return newBlockOn(minerNode.Blockchain.LastHash, params.GetBlockSubsidy(2), transactions...)
+	}
+	sameInputTwice := signedTransaction(t, privKey, []blockchain.TxInput{{TxID: coinbase.Hash, VOut: 0}, {TxID: coinbase.Hash, VOut: 0}}, []blockchain.TxOutput{output(2 * value)})
+	if minerNode.verifyBlock(newBlock(sameInputTwice)) {
+		t.Fatalf("Expected a transaction spending an output twice to be rejected")
+	}
+	if minerNode.verifyBlock(newBlock(spendCoinbase(output(value)), spendCoinbase(output(value-1)))) {
+		t.Fatalf("Expected two transactions spending the same output to be rejected")
+	}
+	if minerNode.verifyBlock(newBlock(spendCoinbase(output(value + 1)))) {
+		t.Fatalf("Expected a transaction paying more than its inputs to be rejected")
+	}
+	if !minerNode.verifyBlock(newBlock(spendCoinbase(output(value)))) {
+		t.Fatalf("Expected a transaction spending its inputs once to be valid")
+	}
+
+	// The coinbase may claim the subsidy at the block's own height and the fees
+	if !minerNode.verifyBlock(newBlockOn(minerNode.Blockchain.LastHash, params.GetBlockSubsidy(2)+5, spendCoinbase(output(value-5)))) {
+		t.Fatalf("Expected the coinbase to claim the fees")
+	}
+	if minerNode.verifyBlock(newBlockOn(minerNode.Blockchain.LastHash, params.GetBlockSubsidy(2)+6, spendCoinbase(output(value-5)))) {
+		t.Fatalf("Expected a coinbase claiming more than the subsidy and fees to be rejected")
+	}
+	if !minerNode.verifyBlock(newBlockOn(minerNode.Blockchain.Index.GetHashAtHeight(0), params.GetBlockSubsidy(1))) {
+		t.Fatalf("Expected a block at height 1 to claim the subsidy of height 1")
+	}
+
+	// The mempool takes a single transaction spending an output
+	if err := minerNode.handleNewTxnMsg(serialize(sameInputTwice)); err == nil {
+		t.Fatalf("Expected the mempool to reject a transaction spending an output twice")
+	}
+	if err := minerNode.handleNewTxnMsg(serialize(spendCoinbase(output(value)))); err != nil {
+		t.Fatal(err)
+	}
+	if err := minerNode.handleNewTxnMsg(serialize(spendCoinbase(output(value - 1)))); err == nil || len(minerNode.mempool) != 1 {
+		t.Fatalf("Expected the mempool to reject a transaction conflicting with a mempool transaction")
+	}
+	if blockHashes, err = minerNode.GenerateBlocks(1); err != nil || len(minerNode.Blockchain.GetBlock(blockHashes[0]).Transactions) != 2 {
+		t.Fatalf("Expected the mempool transaction to be mined (%v)", err)
+	}
+}
+
+func TestReceivedBranch(t *testing.T) {
+	t.Parallel()
+	fullNode := NewFullNode(&blockchain.RegTestParams, "branch-test", blockchain.NewMemoryStore())
+	defer fullNode.Stop()
+	miner := MinerNode{FullNode: *fullNode}
+	newBlockOn := func(prevHash []byte, reward int) *blockchain.Block {
+		block := &blockchain.Block{
+			BlockHeader:  blockchain.BlockHeader{Timestamp: time.Now().String(), PrevHash: prevHash},
+			Transactions: []*blockchain.Transaction{blockchain.CoinBaseTransaction(fullNode.Params.GenesisAddress, reward)},
+		}
+		miner.mineBlock(block)
+		return block
+	}
+	genesisHash := fullNode.Blockchain.LastHash
+	tip := newBlockOn(genesisHash, blockchain.COINBASE_REWARD)
+	if err := fullNode.storeNewBlock(tip); err != nil {
+		t.Fatal(err)
+	}
+	receiveBranch := func(blocks ...*blockchain.Block) {
+		fullNode.getdataMessageCount = 1
+		fullNode.handleBlockdataMsg(serialize(BlockdataMessage{0, blocks}))
+	}
+
+	// A branch with more work whose second block claims more than the subsidy is rejected
+	firstBlock := newBlockOn(genesisHash, blockchain.COINBASE_REWARD-1)
+	receiveBranch(firstBlock, newBlockOn(firstBlock.GetHash(), blockchain.COINBASE_REWARD+1))
+	if !bytes.Equal(fullNode.Blockchain.LastHash, tip.GetHash()) {
+		t.Fatalf("Expected the branch with an invalid block to be rejected")
+	}
+
+	tamperedBlock := newBlockOn(firstBlock.GetHash(), blockchain.COINBASE_REWARD-2)
+	tamperedBlock.Transactions[0].Outputs[0].Value++
+	receiveBranch(tamperedBlock)
+	if fullNode.Blockchain.GetBlock(tamperedBlock.GetHash()) != nil {
+		t.Fatalf("Expected a block whose transactions do not match its hashes not to be stored")
+	}
+
+	secondBlock := newBlockOn(firstBlock.GetHash(), blockchain.COINBASE_REWARD-3)
+	receiveBranch(secondBlock)
+	if !bytes.Equal(fullNode.Blockchain.LastHash, secondBlock.GetHash()) {
+		t.Fatalf("Expected a valid branch with more work to become the active chain")
+	}
+}
+
+func TestConcurrentMempool(t *testing.T) {
+	t.Parallel()
+	params := blockchain.RegTestParams
+	params.CoinbaseMaturity = 0
+	privKey, _ := btcec.NewPrivateKey(btcec.S256())
+	pubkeyHash := getPubkeyHashFromPubkey(privKey.PubKey().SerializeCompressed())
+	minerNode := NewMinerNode(&params, "concurrent-mempool-test", params.GetAddress(pubkeyHash), blockchain.NewMemoryStore())
+	defer minerNode.Stop()
+
+	const transactions = 20
+	coinbase := &blockchain.Transaction{Inputs: []blockchain.TxInput{}}
+	for i := 0; i < transactions; i++ {
+		coinbase.Outputs = append(coinbase.Outputs, blockchain.TxOutput{Value: 10, ScriptPubKey: blockchain.LockingScript{PubKeyHash: pubkeyHash}})
+	}
+	coinbase.SetHash()
+	block := &blockchain.Block{
+		BlockHeader:  blockchain.BlockHeader{Timestamp: time.Now().String(), PrevHash: minerNode.Blockchain.LastHash},
+		Transactions: []*blockchain.Transaction{coinbase},
+	}
+	minerNode.mineBlock(block)
+	if err := minerNode.storeNewBlock(block); err != nil {
+		t.Fatal(err)
+	}
+
+	var handlers sync.WaitGroup
+	for i := 0; i < transactions; i++ {
+		transaction := signedTransaction(t, privKey, []blockchain.TxInput{{TxID: coinbase.Hash, VOut: i}}, []blockchain.TxOutput{coinbase.Outputs[i]})
+		transaction.Outputs[0].Value -= 1
+		transaction.SetHash()
+		handlers.Add(2)
+		go func() {
+			defer handlers.Done()
+			minerNode.handleNewTxnMsg(serialize(transaction))
+		}()
+		go func() {
+			defer handlers.Done()
+			minerNode.rpcGetMempoolInfo(nil)
+		}()
+	}
+	handlers.Wait()
+	if info, _ := minerNode.rpcGetMempoolInfo(nil); info.(MempoolInfo).Size != transactions || info.(MempoolInfo).TotalFee != transactions {
+		t.Fatalf("Expected all transactions in the mempool, actual: %+v", info)
+	}
+}
@@ -0,0 +1,56 @@
+package network
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+type LogLevel int32
+
+const (
+	LOG_DEBUG LogLevel = iota // every message sent between peers
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+// logLevel is shared by all nodes of the process, messages below it are dropped
+var logLevel = int32(LOG_DEBUG)
+
+// ParseLogLevel returns the level called name: debug, info, warn or error
+func ParseLogLevel(name string) (LogLevel, error) {
+	for level, levelName := range logLevelNames {
+		if levelName == name {
+			return LogLevel(level), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %s, expected one of debug, info, warn, error", name)
+}
+
+func SetLogLevel(level LogLevel) {
+	atomic.StoreInt32(&logLevel, int32(level))
+}
+
+func logMessage(level LogLevel, args ...interface{}) {
+	if int32(level) >= atomic.LoadInt32(&logLevel) {
+		fmt.Println(args...)
+	}
+}
+
+func logDebug(args ...interface{}) {
+	logMessage(LOG_DEBUG, args...)
+}
+
+func logInfo(args ...interface{}) {
+	logMessage(LOG_INFO, args...)
+}
+
+func logWarn(args ...interface{}) {
+	logMessage(LOG_WARN, args...)
+}
+
+func logError(args ...interface{}) {
+	logMessage(LOG_ERROR, args...)
+}
@@ -3,10 +3,12 @@ package network
 import "EChain/blockchain"
 
 type VersionMessage struct {
-	Version    int
-	AddrYou    string
-	AddrMe     string
-	BestHeight int
+	Version      int
+	AddrYou      string
+	AddrMe       string
+	BestHeight   int
+	NetworkMagic [4]byte
+	PruneHeight  int // lowest height of the blocks the sender serves, 0 unless it prunes blocks
 }
 
 type VerackMessage struct {
@@ -18,14 +20,18 @@ type AddrMessage struct {
 	Address string
 }
 
+// BlockLocator lists hashes of the requester's active chain from its tip back to genesis, exponentially
+// spaced, so the responder can find their latest common block. StopHash, if set, is the last block wanted.
 type GetblocksMessage struct {
-	TopBlockHash []byte
+	BlockLocator [][]byte
+	StopHash     []byte
 	AddrFrom     string
 }
 
 type GetheadersMessage struct {
-	TopHeaderHash []byte
-	AddrFrom      string
+	BlockLocator [][]byte
+	StopHash     []byte
+	AddrFrom     string
 }
 
 type InvMessage struct {
@@ -47,8 +53,17 @@ type BlockdataMessage struct {
 	BlockList []*blockchain.Block
 }
 
+// NotFoundMessage answers a getdata message with the requested blocks the sender does not store
+type NotFoundMessage struct {
+	Index    int // index of the getdata message
+	HashList [][]byte
+	AddrFrom string
+}
+
 type GetUTXOMessage struct {
-	TargetAddress string
+	TargetAddress    string
+	MinConfirmations int  // answered by SPV nodes only, outputs with fewer confirmations are left out
+	SpendableOnly    bool // answered by SPV nodes only, leaves out immature coinbase outputs
 }
 
 type NewTxnMessage struct {
@@ -72,3 +87,54 @@ type MerkleBlockMessage struct {
 	Transaction blockchain.Transaction
 	AddrFrom    string
 }
+
+type EstimateFeeMessage struct {
+	TargetBlocks int
+}
+
+type FeeEstimateMessage struct {
+	FeeRate int    // satoshi per byte
+	Error   string // set when the node has no estimate for the target
+}
+
+type GetTxnsMessage struct {
+	Addresses []string // wallet addresses whose transactions are requested
+}
+
+type ConfirmedTransaction struct {
+	Transaction blockchain.Transaction
+	BlockHash   []byte
+	BlockHeight int // height of the block, genesis block is height 0
+}
+
+type TxnsMessage struct {
+	Transactions []ConfirmedTransaction
+	TipHeight    int
+}
+
+type GetBalanceMessage struct {
+	Addresses        []string
+	MinConfirmations int // outputs with fewer confirmations count as unconfirmed incoming, defaults to 1
+}
+
+// BalanceMessage splits the balance of a set of addresses by the state of its outputs.
+// Confirmed is spendable, Immature holds coinbase outputs with fewer than ChainParams.CoinbaseMaturity confirmations.
+// UnconfirmedOutgoing is the value of confirmed outputs spent by mempool transactions, it is not part of Confirmed.
+type BalanceMessage struct {
+	Confirmed           int `json:"confirmed"`
+	UnconfirmedIncoming int `json:"unconfirmed_incoming"`
+	UnconfirmedOutgoing int `json:"unconfirmed_outgoing"`
+	Immature            int `json:"immature"`
+}
+
+// TxOutSetInfoMessage reports the UTXO set of a full node. TotalAmount can be below ExpectedSupply
+// when miners claim less than the subsidy, it must never exceed it.
+type TxOutSetInfoMessage struct {
+	Height         int // height of the best block, genesis block is height 0
+	BestBlockHash  []byte
+	Transactions   int
+	TxOutputs      int
+	TotalAmount    int
+	ExpectedSupply int // coins created by the subsidies of all blocks up to Height
+	MaxSupply      int
+}
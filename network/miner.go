@@ -2,83 +2,155 @@ package network
 
 import (
 	"EChain/blockchain"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"math/big"
 	"net"
+	"sync"
 	"time"
 
 	"golang.org/x/exp/slices"
 )
 
+// MAX_GENERATE_BLOCKS is the largest number of blocks mined by a single GenerateToAddress call
+const MAX_GENERATE_BLOCKS = 1000
+
+var errNodeStopping = errors.New("node is stopping")
+
 type MinerNode struct {
 	FullNode
-	recipientAddress string // Address to receive block reward after mining new blocks
+	recipientAddress string      // Address to receive block reward after mining new blocks
+	miningMutex      *sync.Mutex // blocks requested with GenerateBlocks are mined one at a time with the timer
 }
 
-func NewMinerNode(networkAddress, walletAddress string) *MinerNode {
-	fullNode := NewFullNode(networkAddress)
+// NewMinerNode returns a miner paying block rewards to walletAddress, see NewFullNode
+func NewMinerNode(params *blockchain.ChainParams, networkAddress, walletAddress string, store blockchain.Store) *MinerNode {
+	fullNode := NewFullNode(params, networkAddress, store)
 	return &MinerNode{
 		FullNode:         *fullNode,
 		recipientAddress: walletAddress,
+		miningMutex:      &sync.Mutex{},
 	}
 }
 
-func (node *MinerNode) StartP2PNode() {
-	fmt.Println(" ===== Starting blockchain node at", node.NetworkAddress, "=====")
-	ln, err := net.Listen(protocol, node.NetworkAddress)
-	if err != nil {
-		log.Fatal("can not start server at", node.NetworkAddress)
+// Start listens for peers, connects to the initial peers and mines blocks on a timer unless the network mines
+// on demand, the node is stopped once ctx is done
+func (node *MinerNode) Start(ctx context.Context) error {
+	if err := node.listen(ctx, node.handleConnection, node.Stop); err != nil {
+		return err
 	}
-
-	go func() {
-		time.Sleep(2 * time.Second)
-		for _, peerAddr := range initialPeers {
-			if peerAddr != node.NetworkAddress {
-				node.FullNode.sendVersionMsg(peerAddr)
+	node.goWorker(func() {
+		node.connectToInitialPeers(node.FullNode.sendVersionMsg)
+	})
+	if !node.Params.MineOnDemand {
+		node.goWorker(func() {
+			for delay := 5 * time.Second; node.sleep(delay); delay = 10 * time.Second {
+				node.startMining()
 			}
-		}
-	}()
-
-	go func() {
-		time.Sleep(5 * time.Second)
-		for {
-			node.startMining()
-			time.Sleep(10 * time.Second)
-		}
-	}()
-
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Panic(err.Error())
-		}
-
-		go node.handleConnection(conn)
+		})
 	}
+	return nil
+}
+
+// Stop closes the P2P listener and the RPC server, stops mining, waits for in-flight handlers and closes the
+// database. The block being mined is dropped.
+func (node *MinerNode) Stop() {
+	node.shutdown(func() {
+		node.miningMutex.Lock()
+		defer node.miningMutex.Unlock()
+		node.Blockchain.DataBase.Close()
+	})
 }
 
-func (node *MinerNode) mineBlock(newBlock *blockchain.Block) {
+// mineBlock searches the nonce of newBlock, it gives up and reports false once the node is stopping
+func (node *MinerNode) mineBlock(newBlock *blockchain.Block) bool {
+	targetHash := node.Params.TargetHash()
 	nonce := 1
 	for {
+		if node.isStopping() {
+			return false
+		}
 		newBlock.Nonce = nonce
 		hashValue := new(big.Int).SetBytes(newBlock.GetHash())
 
-		if hashValue.Cmp(blockchain.TARGET_HASH) == -1 {
+		if hashValue.Cmp(targetHash) == -1 {
 			newBlock.Nonce = nonce
-			break
+			return true
 		}
 		nonce++
 	}
 }
 
 func (node *MinerNode) startMining() {
+	node.miningMutex.Lock()
+	defer node.miningMutex.Unlock()
+	if node.isStopping() {
+		return
+	}
+	if _, err := node.mineNewBlock(node.recipientAddress); err != nil && !errors.Is(err, errNodeStopping) {
+		logError("can not store the mined block:", err)
+	}
+}
+
+// GenerateBlocks mines count blocks paying the block reward to the miner's address and returns their hashes
+func (node *MinerNode) GenerateBlocks(count int) ([][]byte, error) {
+	return node.GenerateToAddress(count, node.recipientAddress)
+}
+
+// GenerateToAddress mines count blocks on top of the active chain right away, paying the block reward to
+// address. Every block is stored and relayed before the next one is mined; the hashes are returned in order.
+// Mining stops when the node stops, the hashes of the blocks mined until then are returned with an error.
+// Only miners of networks that mine on demand generate blocks, at most MAX_GENERATE_BLOCKS at a time.
+func (node *MinerNode) GenerateToAddress(count int, address string) ([][]byte, error) {
+	if !node.Params.MineOnDemand {
+		return nil, fmt.Errorf("%s miners do not mine on demand", node.Params.Name)
+	}
+	if count <= 0 || count > MAX_GENERATE_BLOCKS {
+		return nil, fmt.Errorf("invalid number of blocks %d, expected 1 to %d", count, MAX_GENERATE_BLOCKS)
+	}
+	if !node.Params.IsAddressValid(address) {
+		return nil, fmt.Errorf("invalid %s address %s", node.Params.Name, address)
+	}
+	node.miningMutex.Lock()
+	defer node.miningMutex.Unlock()
+	if node.isStopping() {
+		return nil, errNodeStopping
+	}
+	blockHashes := [][]byte{}
+	for i := 0; i < count; i++ {
+		blockHash, err := node.mineNewBlock(address)
+		if err != nil {
+			return blockHashes, err
+		}
+		blockHashes = append(blockHashes, blockHash)
+	}
+	return blockHashes, nil
+}
+
+// mineNewBlock mines the mempool's transactions into a new block paying recipientAddress, stores it and
+// relays it, it returns the block's hash
+func (node *MinerNode) mineNewBlock(recipientAddress string) ([]byte, error) {
 	txnList := []*blockchain.Transaction{}
-	// Simply take all transactions in mempool to new block
-	txnList = append(txnList, node.mempool...)
+	// Take all transactions in mempool to new block, except those whose coinbase inputs are not mature yet and
+	// those no longer valid, as their inputs were spent by a block or an earlier transaction
+	newBlockHeight := node.Blockchain.GetHeight()
+	utxoSet := node.Blockchain.UTXOSet()
+	blockOutputs := make(map[string][]blockchain.TxOutput)
+	spentOutpoints := make(map[outpoint]bool)
+	fees := 0
+	for _, transaction := range node.getMempool() {
+		if node.spendsImmatureCoinbase(transaction, &utxoSet, newBlockHeight) {
+			continue
+		}
+		if fee, ok := node.verifyTransaction(transaction, &utxoSet, blockOutputs, spentOutpoints); ok {
+			txnList = append(txnList, transaction)
+			fees += fee
+		}
+	}
 
-	coinbaseTxn := blockchain.CoinBaseTransaction(node.recipientAddress)
+	coinbaseTxn := blockchain.CoinBaseTransaction(recipientAddress, node.Params.GetBlockSubsidy(newBlockHeight)+fees)
 	newBlock := blockchain.Block{
 		BlockHeader: blockchain.BlockHeader{
 			Timestamp: time.Now().String(),
@@ -86,10 +158,15 @@ func (node *MinerNode) startMining() {
 		},
 		Transactions: append([]*blockchain.Transaction{coinbaseTxn}, txnList...),
 	}
-	node.mineBlock(&newBlock)
+	// The block being mined is dropped when the node stops
+	if !node.mineBlock(&newBlock) {
+		return nil, errNodeStopping
+	}
 
 	// Step 1: Update local blockchain & UTXO set
-	node.storeNewBlock(&newBlock)
+	if err := node.storeNewBlock(&newBlock); err != nil {
+		return nil, err
+	}
 
 	// Step 2: Relay new block to other full nodes / miner nodes
 	for _, connectedNode := range node.connectedPeers {
@@ -97,10 +174,11 @@ func (node *MinerNode) startMining() {
 			node.FullNode.sendBlockdataMessage(connectedNode.Address, NEWBLOCK_FROM_MINER_INDEX, []*blockchain.Block{&newBlock})
 		}
 	}
+	return newBlock.GetHash(), nil
 }
 
 func (node *MinerNode) sendVerackMsg(toAddress string) {
-	fmt.Println("Send Verack msg from", node.NetworkAddress, "to", toAddress)
+	logDebug("Send Verack msg from", node.NetworkAddress, "to", toAddress)
 	verackMsg := VerackMessage{MINER, node.NetworkAddress}
 	sentData := append(msgTypeToBytes(VERACK_MSG), serialize(verackMsg)...)
 	sendMessage(toAddress, sentData)
@@ -109,8 +187,9 @@ func (node *MinerNode) sendVerackMsg(toAddress string) {
 func (node *MinerNode) handleVersionMsg(msg []byte) {
 	var versionMsg VersionMessage
 	genericDeserialize(msg, &versionMsg)
+	node.recordPruneHeight(versionMsg.AddrMe, versionMsg.PruneHeight)
 
-	if node.Version == versionMsg.Version {
+	if node.Version == versionMsg.Version && node.Params.NetworkMagic == versionMsg.NetworkMagic && node.hasPeerSlot(versionMsg.AddrMe) {
 		node.sendVerackMsg(versionMsg.AddrMe)
 		if !slices.Contains(node.getConnectedNodeAddresses(), versionMsg.AddrMe) {
 			node.sendVersionMsg(versionMsg.AddrMe)
@@ -139,6 +218,8 @@ func (node *MinerNode) handleConnection(conn net.Conn) {
 		node.FullNode.handleInvMsg(payload)
 	case GETDATA_MSG:
 		node.FullNode.handleGetdataMsg(payload)
+	case NOTFOUND_MSG:
+		node.FullNode.handleNotFoundMsg(payload)
 	case BLOCKDATA_MSG:
 		node.FullNode.handleBlockdataMsg(payload)
 	case GETHEADERS_MSG:
@@ -147,7 +228,11 @@ func (node *MinerNode) handleConnection(conn net.Conn) {
 		node.FullNode.handeGetUTXOMsg(conn, payload)
 	case NEWTXN_MSG:
 		node.FullNode.handleNewTxnMsg(payload)
+	case ESTIMATEFEE_MSG:
+		node.FullNode.handleEstimateFeeMsg(conn, payload)
+	case TXOUTSETINFO_MSG:
+		node.FullNode.handleTxOutSetInfoMsg(conn)
 	default:
-		fmt.Println("invalid message")
+		logWarn("invalid message")
 	}
 }
@@ -0,0 +1,76 @@
+package network
+
+import (
+	"EChain/blockchain"
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGenerateBlocks(t *testing.T) {
+	t.Parallel()
+	params := &blockchain.RegTestParams
+	minerNode := NewMinerNode(params, "generate-test", params.GenesisAddress, blockchain.NewMemoryStore())
+	defer minerNode.Stop()
+
+	blockHashes, err := minerNode.GenerateBlocks(3)
+	if err != nil || len(blockHashes) != 3 {
+		t.Fatalf("Expected 3 blocks to be generated (%v)", err)
+	}
+	if minerNode.Blockchain.GetHeight() != 4 || !bytes.Equal(minerNode.Blockchain.LastHash, blockHashes[2]) {
+		t.Fatalf("Expected the generated blocks to extend the active chain, actual height: %d", minerNode.Blockchain.GetHeight())
+	}
+
+	otherAddress := params.GetAddress(make([]byte, 20))
+	blockHashes, err = minerNode.GenerateToAddress(2, otherAddress)
+	if err != nil || len(blockHashes) != 2 {
+		t.Fatalf("Expected 2 blocks to be generated (%v)", err)
+	}
+	block := minerNode.Blockchain.GetBlock(blockHashes[1])
+	if !block.Transactions[0].Outputs[0].IsBoundTo(otherAddress) {
+		t.Fatalf("Expected the block reward to be paid to the requested address")
+	}
+
+	if _, err := minerNode.GenerateToAddress(1, blockchain.MainNetParams.GenesisAddress); err == nil {
+		t.Fatalf("Expected addresses of other networks to be rejected")
+	}
+	if _, err := minerNode.GenerateBlocks(MAX_GENERATE_BLOCKS + 1); err == nil || minerNode.Blockchain.GetHeight() != 6 {
+		t.Fatalf("Expected requests for more than %d blocks to be rejected", MAX_GENERATE_BLOCKS)
+	}
+
+	timedParams := *params
+	timedParams.MineOnDemand = false
+	timedMinerNode := NewMinerNode(&timedParams, "generate-timed-test", params.GenesisAddress, blockchain.NewMemoryStore())
+	defer timedMinerNode.Stop()
+	if _, err := timedMinerNode.GenerateBlocks(1); err == nil || timedMinerNode.Blockchain.GetHeight() != 1 {
+		t.Fatalf("Expected miners mining on a timer to refuse to generate blocks")
+	}
+}
+
+func TestStopMining(t *testing.T) {
+	t.Parallel()
+	params := blockchain.RegTestParams
+	params.DifficultyLevel = 64 // blocks are not found before the node stops
+	minerNode := NewMinerNode(&params, "stop-mining-test", params.GenesisAddress, blockchain.NewMemoryStore())
+	generated := make(chan error)
+	go func() {
+		_, err := minerNode.GenerateBlocks(10)
+		generated <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		minerNode.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected Stop to interrupt the block being mined")
+	}
+	if err := <-generated; !errors.Is(err, errNodeStopping) || minerNode.Blockchain.GetHeight() != 1 {
+		t.Fatalf("Expected the block being mined to be dropped, actual: %v", err)
+	}
+}
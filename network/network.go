@@ -1,27 +1,37 @@
 package network
 
 import (
+	"EChain/blockchain"
+	"context"
+	"fmt"
 	"net"
-)
+	"sync"
+	"time"
 
-var initialPeers = []string{"localhost:8333", "localhost:8334", "localhost:8335"}
+	"golang.org/x/exp/slices"
+)
 
 const (
-	VERSION_MSG     = "version"
-	VERACK_MSG      = "verack"
-	ADDR_MSG        = "addr"
-	GETBLOCKS_MSG   = "getblocks"
-	INV_MSG         = "inv"
-	HEADERS_MSG     = "headers"
-	GETDATA_MSG     = "getdata"
-	GETHEADERS_MSG  = "getheaders"
-	BLOCKDATA_MSG   = "blockdata"
-	HEADERDATA_MSG  = "headerdata"
-	GETUTXO_MSG     = "getutxo"
-	NEWTXN_MSG      = "newtxn"
-	NEWADDR_MSG     = "newaddr"
-	FILTERLOAD_MSG  = "filterload"
-	MERKLEBLOCK_MSG = "merkleblock"
+	VERSION_MSG      = "version"
+	VERACK_MSG       = "verack"
+	ADDR_MSG         = "addr"
+	GETBLOCKS_MSG    = "getblocks"
+	INV_MSG          = "inv"
+	HEADERS_MSG      = "headers"
+	GETDATA_MSG      = "getdata"
+	GETHEADERS_MSG   = "getheaders"
+	BLOCKDATA_MSG    = "blockdata"
+	HEADERDATA_MSG   = "headerdata"
+	GETUTXO_MSG      = "getutxo"
+	NEWTXN_MSG       = "newtxn"
+	NEWADDR_MSG      = "newaddr"
+	FILTERLOAD_MSG   = "filterload"
+	MERKLEBLOCK_MSG  = "merkleblock"
+	ESTIMATEFEE_MSG  = "estimatefee"
+	GETTXNS_MSG      = "gettxns"
+	GETBALANCE_MSG   = "getbalance"
+	TXOUTSETINFO_MSG = "txoutsetinfo"
+	NOTFOUND_MSG     = "notfound"
 )
 
 const (
@@ -34,6 +44,8 @@ const (
 	protocol                       = "tcp"
 	msgTypeLength                  = 12 // First 12 bytes of each byte slice exchanged between peers are reserved for message type
 	MAX_BLOCKS_IN_TRANSIT_PER_PEER = 10
+	compressedPubKeyLength         = 33 // 0x02/0x03 prefix followed by the 32-byte X coordinate
+	signatureLength                = 64 // fixed-width R || S, each 32 bytes
 )
 
 type NodeInfo struct {
@@ -42,10 +54,33 @@ type NodeInfo struct {
 }
 
 type P2PNode struct {
+	Params            *blockchain.ChainParams
 	Version           int
 	NetworkAddress    string
+	MaxPeers          int // peers kept after the version handshake, 0 for no limit
+	MaxConnections    int // incoming connections handled at once, further connections wait to be accepted; 0 for no limit
 	connectedPeers    []NodeInfo
 	forwardedAddrList []string
+	listener          net.Listener
+	rpcServer         *RPCServer    // nil unless started with StartRPCServer
+	quit              chan struct{} // closed when the node starts stopping
+	done              chan struct{} // closed once the node is stopped and its database closed
+	stopOnce          *sync.Once
+	workers           *sync.WaitGroup // connection handlers and background loops, drained when the node stops
+	prunedPeers       *sync.Map       // address -> lowest block height served by peers that prune blocks
+}
+
+func newP2PNode(params *blockchain.ChainParams, networkAddress string) P2PNode {
+	return P2PNode{
+		Params:         params,
+		Version:        1,
+		NetworkAddress: networkAddress,
+		quit:           make(chan struct{}),
+		done:           make(chan struct{}),
+		stopOnce:       &sync.Once{},
+		workers:        &sync.WaitGroup{},
+		prunedPeers:    &sync.Map{},
+	}
 }
 
 type Node interface {
@@ -56,7 +91,9 @@ type Node interface {
 	handleVerackMsg([]byte)
 	handleAddrMsg([]byte)
 	handleConnection(net.Conn)
-	StartP2PNode()
+	Start(context.Context) error
+	Stop()
+	Done() <-chan struct{}
 }
 
 func (node *P2PNode) getConnectedNodeAddresses() []string {
@@ -66,3 +103,173 @@ func (node *P2PNode) getConnectedNodeAddresses() []string {
 	}
 	return addrList
 }
+
+// hasPeerSlot reports whether the node accepts one more peer, peers it is already connected to always fit
+func (node *P2PNode) hasPeerSlot(address string) bool {
+	if node.MaxPeers <= 0 || slices.Contains(node.getConnectedNodeAddresses(), address) {
+		return true
+	}
+	return len(node.connectedPeers) < node.MaxPeers
+}
+
+// recordPruneHeight remembers the prune height a peer advertised in its version message
+func (node *P2PNode) recordPruneHeight(address string, pruneHeight int) {
+	if pruneHeight > 0 {
+		node.prunedPeers.Store(address, pruneHeight)
+	} else {
+		node.prunedPeers.Delete(address)
+	}
+}
+
+// servesBlocksFrom reports whether the peer at address stores the blocks from height up
+func (node *P2PNode) servesBlocksFrom(address string, height int) bool {
+	pruneHeight, isPruned := node.prunedPeers.Load(address)
+	return !isPruned || pruneHeight.(int) <= height
+}
+
+// listen opens the P2P listener and serves connections with handleConnection in the background, stop is called
+// once ctx is done
+func (node *P2PNode) listen(ctx context.Context, handleConnection func(net.Conn), stop func()) error {
+	if node.isStopping() {
+		return fmt.Errorf("node at %s is stopped", node.NetworkAddress)
+	}
+	logInfo(" ===== Starting blockchain node at", node.NetworkAddress, "=====")
+	ln, err := net.Listen(protocol, node.NetworkAddress)
+	if err != nil {
+		return fmt.Errorf("can not start server at %s: %w", node.NetworkAddress, err)
+	}
+	node.listener = ln
+	node.goWorker(func() {
+		node.serveConnections(ln, handleConnection)
+	})
+	go func() {
+		select {
+		case <-ctx.Done():
+			stop()
+		case <-node.quit:
+		}
+	}()
+	return nil
+}
+
+// serveConnections accepts connections on ln until the node is stopped, handling at most MaxConnections at once
+func (node *P2PNode) serveConnections(ln net.Listener, handleConnection func(net.Conn)) {
+	var slots chan struct{}
+	if node.MaxConnections > 0 {
+		slots = make(chan struct{}, node.MaxConnections)
+	}
+	for {
+		if slots != nil {
+			slots <- struct{}{}
+		}
+		conn, err := ln.Accept()
+		if err != nil {
+			if slots != nil {
+				<-slots
+			}
+			if node.isStopping() {
+				return
+			}
+			logError("can not accept connection at", node.NetworkAddress, err)
+			node.sleep(100 * time.Millisecond)
+			continue
+		}
+
+		node.goWorker(func() {
+			handleConnection(conn)
+			if slots != nil {
+				<-slots
+			}
+		})
+	}
+}
+
+// goWorker runs f in the background, the node waits for it when stopping
+func (node *P2PNode) goWorker(f func()) {
+	node.workers.Add(1)
+	go func() {
+		defer node.workers.Done()
+		f()
+	}()
+}
+
+// sleep waits for duration and reports false if the node started stopping meanwhile
+func (node *P2PNode) sleep(duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-node.quit:
+		return false
+	}
+}
+
+// connectToInitialPeers sends version messages to the initial peers once the peers had time to start
+func (node *P2PNode) connectToInitialPeers(sendVersionMsg func(string)) {
+	if !node.sleep(2 * time.Second) {
+		return
+	}
+	for _, peerAddr := range node.Params.InitialPeers {
+		if peerAddr != node.NetworkAddress {
+			sendVersionMsg(peerAddr)
+		}
+	}
+}
+
+func (node *P2PNode) getPeerInfo() []PeerInfo {
+	peers := []PeerInfo{}
+	for _, connectedNode := range node.connectedPeers {
+		peers = append(peers, PeerInfo{Address: connectedNode.Address, NodeType: connectedNode.NodeType})
+	}
+	return peers
+}
+
+func (node *P2PNode) startRPCServer(config RPCConfig, methods map[string]rpcHandler) error {
+	if node.rpcServer != nil {
+		return fmt.Errorf("RPC server is already running")
+	}
+	rpcServer, err := newRPCServer(config, methods)
+	if err != nil {
+		return err
+	}
+	if err := rpcServer.start(); err != nil {
+		return err
+	}
+	logInfo(" ===== Starting RPC server at", rpcServer.Address(), "=====")
+	node.rpcServer = rpcServer
+	return nil
+}
+
+// isStopping reports whether the node has been stopped, listener errors are expected then
+func (node *P2PNode) isStopping() bool {
+	select {
+	case <-node.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdown closes the P2P listener and the RPC server, waits for in-flight handlers and background loops and
+// runs closeStorage, the node is done afterwards. Later calls wait for the first one to finish.
+func (node *P2PNode) shutdown(closeStorage func()) {
+	node.stopOnce.Do(func() {
+		close(node.quit)
+		if node.rpcServer != nil {
+			node.rpcServer.Stop()
+		}
+		if node.listener != nil {
+			node.listener.Close()
+		}
+		node.workers.Wait()
+		closeStorage()
+		close(node.done)
+	})
+	<-node.done
+}
+
+// Done is closed once the node is stopped
+func (node *P2PNode) Done() <-chan struct{} {
+	return node.done
+}
@@ -0,0 +1,248 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// JSON-RPC 2.0 error codes, followed by the application error codes bitcoind uses
+const (
+	RPC_PARSE_ERROR      = -32700
+	RPC_INVALID_REQUEST  = -32600
+	RPC_METHOD_NOT_FOUND = -32601
+	RPC_INVALID_PARAMS   = -32602
+	RPC_INTERNAL_ERROR   = -32603
+
+	RPC_MISC_ERROR             = -1
+	RPC_INVALID_ADDRESS_OR_KEY = -5
+	RPC_INVALID_PARAMETER      = -8
+	RPC_DESERIALIZATION_ERROR  = -22
+	RPC_VERIFY_REJECTED        = -26
+)
+
+const (
+	maxRPCRequestSize  = 8 << 20 // raw transactions are sent hex encoded in the request body
+	rpcShutdownTimeout = 5 * time.Second
+)
+
+// RPCConfig configures the JSON-RPC server of a node. Clients authenticate with HTTP basic auth,
+// the server does not start without credentials.
+type RPCConfig struct {
+	ListenAddress string
+	User          string
+	Password      string
+}
+
+type RPCRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"` // positional params, named params are not supported
+	ID      json.RawMessage `json:"id,omitempty"`     // requests without id are notifications and get no response
+}
+
+type RPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *RPCError) Error() string {
+	return fmt.Sprintf("%s (code %d)", err.Message, err.Code)
+}
+
+func newRPCError(code int, format string, args ...interface{}) *RPCError {
+	return &RPCError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// rpcHandler serves a method call, errors other than *RPCError are reported as RPC_MISC_ERROR
+type rpcHandler func(params []json.RawMessage) (interface{}, error)
+
+// RPCServer serves JSON-RPC 2.0 requests, single or batched, POSTed over HTTP
+type RPCServer struct {
+	config     RPCConfig
+	handlers   map[string]rpcHandler
+	listener   net.Listener
+	httpServer *http.Server
+}
+
+func newRPCServer(config RPCConfig, handlers map[string]rpcHandler) (*RPCServer, error) {
+	if config.User == "" || config.Password == "" {
+		return nil, fmt.Errorf("RPC user and password must be set")
+	}
+	server := &RPCServer{config: config, handlers: handlers}
+	server.httpServer = &http.Server{Handler: server}
+	return server, nil
+}
+
+func (server *RPCServer) start() error {
+	ln, err := net.Listen(protocol, server.config.ListenAddress)
+	if err != nil {
+		return fmt.Errorf("can not start RPC server at %s: %w", server.config.ListenAddress, err)
+	}
+	server.listener = ln
+	go server.httpServer.Serve(ln)
+	return nil
+}
+
+// Address returns the address the server listens at, useful when it was started on port 0
+func (server *RPCServer) Address() string {
+	return server.listener.Addr().String()
+}
+
+// Stop closes the listener and waits for requests in flight to be answered
+func (server *RPCServer) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), rpcShutdownTimeout)
+	defer cancel()
+	return server.httpServer.Shutdown(ctx)
+}
+
+func (server *RPCServer) isAuthorized(r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	userMatch := subtle.ConstantTimeCompare([]byte(user), []byte(server.config.User))
+	passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(server.config.Password))
+	return userMatch&passwordMatch == 1
+}
+
+func (server *RPCServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "JSON-RPC server handles only POST requests", http.StatusMethodNotAllowed)
+		return
+	}
+	if !server.isAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="jsonrpc"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRPCRequestSize))
+	if err != nil {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var response interface{}
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(body, &batch); err != nil {
+			response = errorResponse(nil, newRPCError(RPC_PARSE_ERROR, "parse error"))
+		} else if len(batch) == 0 {
+			response = errorResponse(nil, newRPCError(RPC_INVALID_REQUEST, "empty batch"))
+		} else {
+			responses := []*RPCResponse{}
+			for _, request := range batch {
+				if resp := server.handleRequest(request); resp != nil {
+					responses = append(responses, resp)
+				}
+			}
+			if len(responses) > 0 {
+				response = responses
+			}
+		}
+	} else if !json.Valid(body) {
+		response = errorResponse(nil, newRPCError(RPC_PARSE_ERROR, "parse error"))
+	} else if resp := server.handleRequest(body); resp != nil {
+		response = resp
+	}
+
+	// Nothing to answer when all requests were notifications
+	if response == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleRequest calls the method of a single request, it returns nil for notifications
+func (server *RPCServer) handleRequest(data json.RawMessage) *RPCResponse {
+	var request RPCRequest
+	if err := json.Unmarshal(data, &request); err != nil || request.JSONRPC != "2.0" || request.Method == "" {
+		return errorResponse(request.ID, newRPCError(RPC_INVALID_REQUEST, "invalid request"))
+	}
+	result, rpcErr := server.call(&request)
+	if request.ID == nil {
+		return nil
+	}
+	if rpcErr != nil {
+		return errorResponse(request.ID, rpcErr)
+	}
+	encodedResult, err := json.Marshal(result)
+	if err != nil {
+		return errorResponse(request.ID, newRPCError(RPC_INTERNAL_ERROR, "can not encode result: %v", err))
+	}
+	return &RPCResponse{JSONRPC: "2.0", Result: encodedResult, ID: request.ID}
+}
+
+func (server *RPCServer) call(request *RPCRequest) (result interface{}, rpcErr *RPCError) {
+	handler, exists := server.handlers[request.Method]
+	if !exists {
+		return nil, newRPCError(RPC_METHOD_NOT_FOUND, "method not found: %s", request.Method)
+	}
+	var params []json.RawMessage
+	if len(request.Params) > 0 && !bytes.Equal(request.Params, []byte("null")) {
+		if err := json.Unmarshal(request.Params, &params); err != nil {
+			return nil, newRPCError(RPC_INVALID_PARAMS, "params must be an array")
+		}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			result, rpcErr = nil, newRPCError(RPC_INTERNAL_ERROR, "%s failed: %v", request.Method, r)
+		}
+	}()
+	result, err := handler(params)
+	if err != nil {
+		if typedErr, ok := err.(*RPCError); ok {
+			return nil, typedErr
+		}
+		return nil, newRPCError(RPC_MISC_ERROR, "%s", err.Error())
+	}
+	return result, nil
+}
+
+func errorResponse(id json.RawMessage, rpcErr *RPCError) *RPCResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &RPCResponse{JSONRPC: "2.0", Error: rpcErr, ID: id}
+}
+
+// parseParams decodes positional params into targets, only the first required targets must be given
+func parseParams(params []json.RawMessage, required int, targets ...interface{}) error {
+	if len(params) < required || len(params) > len(targets) {
+		return newRPCError(RPC_INVALID_PARAMS, "expected %d to %d params, got %d", required, len(targets), len(params))
+	}
+	for i, param := range params {
+		if err := json.Unmarshal(param, targets[i]); err != nil {
+			return newRPCError(RPC_INVALID_PARAMS, "invalid param %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// decodeHashParam decodes a hex encoded block or transaction hash
+func decodeHashParam(hexHash string) ([]byte, error) {
+	hash, err := hex.DecodeString(hexHash)
+	if err != nil || len(hash) != 32 {
+		return nil, newRPCError(RPC_INVALID_PARAMETER, "hash must be 64 hex characters, got %q", hexHash)
+	}
+	return hash, nil
+}
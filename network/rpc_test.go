@@ -0,0 +1,145 @@
+package network
+
+import (
+	"EChain/blockchain"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRPCServer(t *testing.T) {
+	t.Parallel()
+	params := &blockchain.RegTestParams
+	recipientAddress := params.GetAddress(make([]byte, 20))
+	minerNode := NewMinerNode(params, "rpc-test", recipientAddress, blockchain.NewMemoryStore())
+	defer minerNode.Stop()
+	if err := minerNode.StartRPCServer(RPCConfig{ListenAddress: "localhost:0"}); err == nil {
+		t.Fatalf("Expected the RPC server to require credentials")
+	}
+	if err := minerNode.StartRPCServer(RPCConfig{ListenAddress: "localhost:0", User: "user", Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + minerNode.rpcServer.Address()
+
+	post := func(body, password string) (*http.Response, error) {
+		req, _ := http.NewRequest(http.MethodPost, url, bytes.NewBufferString(body))
+		req.SetBasicAuth("user", password)
+		return http.DefaultClient.Do(req)
+	}
+	call := func(method string, params ...interface{}) RPCResponse {
+		request, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": method, "params": params})
+		resp, err := post(string(request), "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var rpcResp RPCResponse
+		json.NewDecoder(resp.Body).Decode(&rpcResp)
+		return rpcResp
+	}
+	decode := func(rpcResp RPCResponse, target interface{}) {
+		if rpcResp.Error != nil {
+			t.Fatalf("Unexpected RPC error: %v", rpcResp.Error)
+		}
+		json.Unmarshal(rpcResp.Result, target)
+	}
+
+	if resp, err := post(`{"jsonrpc":"2.0","id":1,"method":"getblockcount"}`, "wrong"); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected requests with a wrong password to be rejected")
+	}
+
+	var blockHashes []string
+	decode(call("generate", 2), &blockHashes)
+	var blockCount int
+	decode(call("getblockcount"), &blockCount)
+	if len(blockHashes) != 2 || blockCount != 2 {
+		t.Fatalf("Expected 2 generated blocks on top of the genesis block, actual height: %d", blockCount)
+	}
+	var blockHash string
+	decode(call("getblockhash", 2), &blockHash)
+	if blockHash != blockHashes[1] {
+		t.Fatalf("Expected getblockhash to return the last generated block")
+	}
+
+	var block struct {
+		BlockResult
+		Tx []TransactionResult `json:"tx"`
+	}
+	decode(call("getblock", blockHash, 2), &block)
+	if block.Height != 2 || block.Confirmations != 1 || len(block.Tx) != 1 || block.Tx[0].Vout[0].Address != recipientAddress {
+		t.Fatalf("Unexpected block: %+v", block)
+	}
+
+	decode(call("generatetoaddress", 1, params.GenesisAddress), &blockHashes)
+	var balance BalanceMessage
+	decode(call("getbalance", []string{params.GenesisAddress}), &balance)
+	if balance.Immature != 2*blockchain.COINBASE_REWARD || balance.Confirmed != 0 {
+		t.Fatalf("Expected the genesis and generated coinbase outputs to be immature, actual: %+v", balance)
+	}
+
+	if rpcResp := call("getaddressbalance", params.GenesisAddress); rpcResp.Error == nil {
+		t.Fatalf("Expected address lookups to fail while the address index is disabled")
+	}
+	if err := minerNode.Blockchain.EnableAddressIndex(); err != nil {
+		t.Fatal(err)
+	}
+	var addressBalance AddressBalanceResult
+	decode(call("getaddressbalance", params.GenesisAddress), &addressBalance)
+	if addressBalance.Balance != 2*blockchain.COINBASE_REWARD || addressBalance.TxCount != 2 {
+		t.Fatalf("Expected the genesis and generated coinbase outputs in the address balance, actual: %+v", addressBalance)
+	}
+	var history []AddressEventResult
+	decode(call("getaddresshistory", params.GenesisAddress, 1, 1), &history)
+	if len(history) != 1 || history[0].Height != 3 || history[0].Spending {
+		t.Fatalf("Expected the generated coinbase as second event, actual: %+v", history)
+	}
+
+	if rpcResp := call("getblock", "00"); rpcResp.Error == nil || rpcResp.Error.Code != RPC_INVALID_PARAMETER {
+		t.Fatalf("Expected malformed block hashes to be rejected, actual: %v", rpcResp.Error)
+	}
+	if rpcResp := call("sendrawtransaction", "0102"); rpcResp.Error == nil || rpcResp.Error.Code != RPC_DESERIALIZATION_ERROR {
+		t.Fatalf("Expected undecodable transactions to be rejected, actual: %v", rpcResp.Error)
+	}
+	if rpcResp := call("getblockhash"); rpcResp.Error == nil || rpcResp.Error.Code != RPC_INVALID_PARAMS {
+		t.Fatalf("Expected missing params to be rejected, actual: %v", rpcResp.Error)
+	}
+	if rpcResp := call("unknown"); rpcResp.Error == nil || rpcResp.Error.Code != RPC_METHOD_NOT_FOUND {
+		t.Fatalf("Expected unknown methods to be rejected, actual: %v", rpcResp.Error)
+	}
+
+	resp, err := post(`[{"jsonrpc":"2.0","id":1,"method":"getbestblockhash"},{"jsonrpc":"2.0","method":"getblockcount"}]`, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var batch []RPCResponse
+	json.NewDecoder(resp.Body).Decode(&batch)
+	resp.Body.Close()
+	if len(batch) != 1 || string(batch[0].Result) != `"`+blockHashes[0]+`"` {
+		t.Fatalf("Expected a single response to a batch with a notification, actual: %+v", batch)
+	}
+
+	client := NewRPCClient(minerNode.rpcServer.Address(), "user", "secret")
+	if err := client.Call("getblockcount", nil, &blockCount); err != nil || blockCount != 3 {
+		t.Fatalf("Expected the client to read the block count, actual: %d (%v)", blockCount, err)
+	}
+	if err, ok := client.Call("getblockhash", []interface{}{10}, nil).(*RPCError); !ok || err.Code != RPC_INVALID_PARAMETER {
+		t.Fatalf("Expected the client to return the method's error, actual: %v", err)
+	}
+	if err := NewRPCClient(minerNode.rpcServer.Address(), "user", "wrong").Call("getblockcount", nil, nil); err == nil {
+		t.Fatalf("Expected the client to report failed authentication")
+	}
+
+	var stopMsg string
+	decode(call("stop"), &stopMsg)
+	for i := 0; ; i++ {
+		if _, err := post(`{"jsonrpc":"2.0","id":1,"method":"getblockcount"}`, "secret"); err != nil {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("Expected the RPC server to be stopped")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
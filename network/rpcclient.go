@@ -0,0 +1,74 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const rpcClientTimeout = 5 * time.Minute // generating blocks on networks with a real difficulty takes a while
+
+// RPCClient calls the JSON-RPC methods of a node
+type RPCClient struct {
+	url        string
+	user       string
+	password   string
+	httpClient *http.Client
+	nextID     int64
+}
+
+// NewRPCClient returns a client of the RPC server listening at address (host:port)
+func NewRPCClient(address, user, password string) *RPCClient {
+	return &RPCClient{
+		url:        "http://" + address,
+		user:       user,
+		password:   password,
+		httpClient: &http.Client{Timeout: rpcClientTimeout},
+	}
+}
+
+// Call invokes method with positional params and decodes its result into result, which may be nil.
+// Errors returned by the method are *RPCError.
+func (client *RPCClient) Call(method string, params []interface{}, result interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	id := atomic.AddInt64(&client.nextID, 1)
+	request, err := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": id, "method": method, "params": params})
+	if err != nil {
+		return err
+	}
+	httpRequest, err := http.NewRequest(http.MethodPost, client.url, bytes.NewReader(request))
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	httpRequest.SetBasicAuth(client.user, client.password)
+
+	httpResponse, err := client.httpClient.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("RPC authentication failed, check the RPC user and password")
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		return fmt.Errorf("RPC server answered %s", httpResponse.Status)
+	}
+
+	var response RPCResponse
+	if err := json.NewDecoder(httpResponse.Body).Decode(&response); err != nil {
+		return fmt.Errorf("can not decode RPC response: %w", err)
+	}
+	if response.Error != nil {
+		return response.Error
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(response.Result, result)
+}
@@ -0,0 +1,709 @@
+package network
+
+import (
+	"EChain/blockchain"
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/exp/slices"
+)
+
+// Hashes, pubkeys and raw blocks or transactions are hex encoded in RPC params and results
+
+type BlockchainInfo struct {
+	Chain          string `json:"chain"`
+	Blocks         int    `json:"blocks"` // height of the best block, genesis block is height 0
+	BestBlockHash  string `json:"bestblockhash"`
+	Difficulty     int    `json:"difficulty"`
+	ChainWork      string `json:"chainwork"`
+	TxIndex        bool   `json:"txindex"`
+	AddressIndex   bool   `json:"addressindex"`
+	Pruned         bool   `json:"pruned"`
+	PruneHeight    int    `json:"pruneheight,omitempty"`    // lowest block whose data is stored
+	SnapshotHeight int    `json:"snapshotheight,omitempty"` // UTXO snapshot the chain was loaded from, until validated
+}
+
+// HeaderChainInfo is the getblockchaininfo result of SPV nodes, which only store block headers
+type HeaderChainInfo struct {
+	Chain         string `json:"chain"`
+	Headers       int    `json:"headers"` // height of the best header, genesis block is height 0
+	BestBlockHash string `json:"bestblockhash"`
+	Difficulty    int    `json:"difficulty"`
+	ChainWork     string `json:"chainwork"`
+}
+
+// SnapshotResult describes a UTXO snapshot written by dumptxoutset
+type SnapshotResult struct {
+	BlockHash    string `json:"blockhash"`
+	Height       int    `json:"height"`
+	Transactions int    `json:"transactions"` // transactions with unspent outputs
+	Hash         string `json:"hash"`         // content hash, checked when the snapshot is loaded
+	Path         string `json:"path"`
+}
+
+// ExportBlocksResult describes a block file written by exportblocks
+type ExportBlocksResult struct {
+	Blocks int    `json:"blocks"` // including the genesis block
+	Path   string `json:"path"`
+}
+
+// ImportBlocksResult describes the import of a block file by importblocks
+type ImportBlocksResult struct {
+	Imported int    `json:"imported"`
+	Skipped  int    `json:"skipped"` // blocks already in the active chain
+	Height   int    `json:"height"`
+	Path     string `json:"path"`
+}
+
+type BlockResult struct {
+	Hash              string      `json:"hash"`
+	Confirmations     int         `json:"confirmations"` // -1 for blocks outside of the active chain
+	Height            int         `json:"height"`
+	Size              int         `json:"size"`
+	Time              string      `json:"time"`
+	Nonce             int         `json:"nonce"`
+	MerkleRoot        string      `json:"merkleroot"`
+	PreviousBlockHash string      `json:"previousblockhash,omitempty"`
+	NextBlockHash     string      `json:"nextblockhash,omitempty"`
+	NTx               int         `json:"ntx"`
+	Tx                interface{} `json:"tx"` // transaction ids, or TransactionResults with verbosity 2
+}
+
+type TransactionResult struct {
+	TxID          string           `json:"txid"`
+	Size          int              `json:"size"`
+	Locktime      int64            `json:"locktime"`
+	Vin           []TxInputResult  `json:"vin"`
+	Vout          []TxOutputResult `json:"vout"`
+	BlockHash     string           `json:"blockhash,omitempty"`
+	Confirmations int              `json:"confirmations,omitempty"`
+}
+
+type TxInputResult struct {
+	TxID      string `json:"txid"`
+	Vout      int    `json:"vout"`
+	PubKey    string `json:"pubkey"`
+	Signature string `json:"signature"`
+}
+
+type TxOutputResult struct {
+	Value      int    `json:"value"`
+	N          int    `json:"n"`
+	PubKeyHash string `json:"pubkeyhash"`
+	Address    string `json:"address"`
+}
+
+type MempoolInfo struct {
+	Size     int `json:"size"`
+	Bytes    int `json:"bytes"`
+	TotalFee int `json:"totalfee"`
+}
+
+// AddressEventResult is a funding or spending event of an address in the getaddresshistory result
+type AddressEventResult struct {
+	TxID     string `json:"txid"`
+	Height   int    `json:"height"`
+	Spending bool   `json:"spending"`
+	Index    int    `json:"index"` // output index for funding events, input index for spending events
+	Value    int    `json:"value"`
+}
+
+type AddressBalanceResult struct {
+	Received int `json:"received"`
+	Sent     int `json:"sent"`
+	Balance  int `json:"balance"`
+	TxCount  int `json:"txcount"` // funding and spending events
+}
+
+type PeerInfo struct {
+	Address  string `json:"addr"`
+	NodeType string `json:"type"`
+}
+
+// addressList is an RPC param given either as a single address or as an array of addresses
+type addressList []string
+
+func (addresses *addressList) UnmarshalJSON(data []byte) error {
+	var address string
+	if err := json.Unmarshal(data, &address); err == nil {
+		*addresses = addressList{address}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(addresses))
+}
+
+func newTransactionResult(params *blockchain.ChainParams, transaction *blockchain.Transaction) TransactionResult {
+	txnResult := TransactionResult{
+		TxID:     hex.EncodeToString(transaction.Hash),
+		Size:     transaction.Size(),
+		Locktime: transaction.Locktime,
+		Vin:      []TxInputResult{},
+		Vout:     []TxOutputResult{},
+	}
+	for _, input := range transaction.Inputs {
+		txnResult.Vin = append(txnResult.Vin, TxInputResult{
+			TxID:      hex.EncodeToString(input.TxID),
+			Vout:      input.VOut,
+			PubKey:    hex.EncodeToString(input.ScriptSig.PubKey),
+			Signature: hex.EncodeToString(input.ScriptSig.Signature),
+		})
+	}
+	for index, output := range transaction.Outputs {
+		txnResult.Vout = append(txnResult.Vout, TxOutputResult{
+			Value:      output.Value,
+			N:          index,
+			PubKeyHash: hex.EncodeToString(output.ScriptPubKey.PubKeyHash),
+			Address:    params.GetAddress(output.ScriptPubKey.PubKeyHash),
+		})
+	}
+	return txnResult
+}
+
+// decodeRawTransaction decodes a hex encoded, gob serialized transaction and checks its hash
+func decodeRawTransaction(hexTxn string) (*blockchain.Transaction, []byte, error) {
+	rawTxn, err := hex.DecodeString(hexTxn)
+	if err != nil {
+		return nil, nil, newRPCError(RPC_DESERIALIZATION_ERROR, "transaction is not hex encoded")
+	}
+	var transaction blockchain.Transaction
+	if err := gob.NewDecoder(bytes.NewReader(rawTxn)).Decode(&transaction); err != nil {
+		return nil, nil, newRPCError(RPC_DESERIALIZATION_ERROR, "transaction decode failed: %v", err)
+	}
+	hashedTxn := transaction
+	hashedTxn.SetHash()
+	if !bytes.Equal(hashedTxn.Hash, transaction.Hash) {
+		return nil, nil, newRPCError(RPC_DESERIALIZATION_ERROR, "transaction hash does not match its content")
+	}
+	return &transaction, rawTxn, nil
+}
+
+func validateAddresses(params *blockchain.ChainParams, addresses []string) error {
+	for _, address := range addresses {
+		if !params.IsAddressValid(address) {
+			return newRPCError(RPC_INVALID_ADDRESS_OR_KEY, "invalid %s address %s", params.Name, address)
+		}
+	}
+	return nil
+}
+
+// stopHandler answers the stop method, the node is stopped once the response has been written
+func stopHandler(stop func()) rpcHandler {
+	return func(params []json.RawMessage) (interface{}, error) {
+		if err := parseParams(params, 0); err != nil {
+			return nil, err
+		}
+		go stop()
+		return "EChain node stopping", nil
+	}
+}
+
+// ======= Full node methods =======
+
+func (node *FullNode) rpcMethods(stop func()) map[string]rpcHandler {
+	return map[string]rpcHandler{
+		"getblockchaininfo":  node.rpcGetBlockchainInfo,
+		"getblockcount":      node.rpcGetBlockCount,
+		"getbestblockhash":   node.rpcGetBestBlockHash,
+		"getblockhash":       node.rpcGetBlockHash,
+		"getblock":           node.rpcGetBlock,
+		"getrawtransaction":  node.rpcGetRawTransaction,
+		"sendrawtransaction": node.rpcSendRawTransaction,
+		"getmempoolinfo":     node.rpcGetMempoolInfo,
+		"getpeerinfo":        node.rpcGetPeerInfo,
+		"getbalance":         node.rpcGetBalance,
+		"getaddresshistory":  node.rpcGetAddressHistory,
+		"getaddressbalance":  node.rpcGetAddressBalance,
+		"dumptxoutset":       node.rpcDumpTxOutSet,
+		"exportblocks":       node.rpcExportBlocks,
+		"importblocks":       node.rpcImportBlocks,
+		"stop":               stopHandler(stop),
+	}
+}
+
+// StartRPCServer serves the node's JSON-RPC methods at config.ListenAddress
+func (node *FullNode) StartRPCServer(config RPCConfig) error {
+	return node.startRPCServer(config, node.rpcMethods(node.Stop))
+}
+
+func (node *FullNode) rpcGetBlockchainInfo(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	tipEntry := node.Blockchain.Index.GetEntry(node.Blockchain.LastHash)
+	blockchainInfo := BlockchainInfo{
+		Chain:         node.Params.Name,
+		Blocks:        tipEntry.Height,
+		BestBlockHash: hex.EncodeToString(tipEntry.Hash),
+		Difficulty:    node.Params.DifficultyLevel,
+		ChainWork:     tipEntry.ChainWork.Text(16),
+		TxIndex:       node.Blockchain.TxIndex != nil,
+		AddressIndex:  node.Blockchain.AddrIndex != nil,
+		Pruned:        node.Blockchain.GetPruneHeight() > 0,
+		PruneHeight:   node.Blockchain.GetPruneHeight(),
+	}
+	if snapshot := node.Blockchain.GetSnapshot(); snapshot != nil {
+		blockchainInfo.SnapshotHeight = snapshot.Height
+	}
+	return blockchainInfo, nil
+}
+
+func (node *FullNode) rpcGetBlockCount(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	return node.Blockchain.GetHeight() - 1, nil
+}
+
+func (node *FullNode) rpcGetBestBlockHash(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	return hex.EncodeToString(node.Blockchain.LastHash), nil
+}
+
+func (node *FullNode) rpcGetBlockHash(params []json.RawMessage) (interface{}, error) {
+	var height int
+	if err := parseParams(params, 1, &height); err != nil {
+		return nil, err
+	}
+	blockHash := node.Blockchain.Index.GetHashAtHeight(height)
+	if blockHash == nil {
+		return nil, newRPCError(RPC_INVALID_PARAMETER, "block height %d out of range", height)
+	}
+	return hex.EncodeToString(blockHash), nil
+}
+
+// rpcGetBlock returns the raw block with verbosity 0, the block with its transaction ids with verbosity 1
+// and the block with its decoded transactions with verbosity 2
+func (node *FullNode) rpcGetBlock(params []json.RawMessage) (interface{}, error) {
+	var hexHash string
+	verbosity := 1
+	if err := parseParams(params, 1, &hexHash, &verbosity); err != nil {
+		return nil, err
+	}
+	blockHash, err := decodeHashParam(hexHash)
+	if err != nil {
+		return nil, err
+	}
+	entry := node.Blockchain.Index.GetEntry(blockHash)
+	if entry == nil {
+		return nil, newRPCError(RPC_INVALID_ADDRESS_OR_KEY, "block %s not found", hexHash)
+	}
+	if entry.Status != blockchain.BLOCK_HAVE_DATA {
+		return nil, newRPCError(RPC_MISC_ERROR, "block %s is pruned", hexHash)
+	}
+	block := node.Blockchain.GetBlock(blockHash)
+	if verbosity == 0 {
+		return hex.EncodeToString(serialize(block)), nil
+	}
+
+	blockResult := BlockResult{
+		Hash:          hexHash,
+		Confirmations: -1,
+		Height:        entry.Height,
+		Size:          len(serialize(block)),
+		Time:          block.Timestamp,
+		Nonce:         block.Nonce,
+		MerkleRoot:    hex.EncodeToString(block.MerkleRoot),
+		NTx:           len(block.Transactions),
+	}
+	if len(block.PrevHash) > 0 {
+		blockResult.PreviousBlockHash = hex.EncodeToString(block.PrevHash)
+	}
+	if node.Blockchain.Index.IsInActiveChain(blockHash) {
+		blockResult.Confirmations = node.Blockchain.GetHeight() - entry.Height
+		if nextHash := node.Blockchain.Index.GetHashAtHeight(entry.Height + 1); nextHash != nil {
+			blockResult.NextBlockHash = hex.EncodeToString(nextHash)
+		}
+	}
+	if verbosity == 1 {
+		txnIDs := []string{}
+		for _, transaction := range block.Transactions {
+			txnIDs = append(txnIDs, hex.EncodeToString(transaction.Hash))
+		}
+		blockResult.Tx = txnIDs
+	} else {
+		txnResults := []TransactionResult{}
+		for _, transaction := range block.Transactions {
+			txnResults = append(txnResults, newTransactionResult(node.Params, transaction))
+		}
+		blockResult.Tx = txnResults
+	}
+	return blockResult, nil
+}
+
+// rpcGetRawTransaction looks up a mempool transaction, or a transaction of the active chain if the
+// transaction index is enabled. It returns the raw transaction unless verbose is set.
+func (node *FullNode) rpcGetRawTransaction(params []json.RawMessage) (interface{}, error) {
+	var hexTxnID string
+	verbose := false
+	if err := parseParams(params, 1, &hexTxnID, &verbose); err != nil {
+		return nil, err
+	}
+	txnID, err := decodeHashParam(hexTxnID)
+	if err != nil {
+		return nil, err
+	}
+
+	var transaction *blockchain.Transaction
+	var block *blockchain.Block
+	mempool := node.getMempool()
+	if index := slices.IndexFunc(mempool, func(txn *blockchain.Transaction) bool { return bytes.Equal(txn.Hash, txnID) }); index != -1 {
+		transaction = mempool[index]
+	} else if node.Blockchain.TxIndex == nil {
+		return nil, newRPCError(RPC_INVALID_ADDRESS_OR_KEY, "no such mempool transaction, start the node with -txindex to look up blockchain transactions")
+	} else if transaction, block, err = node.Blockchain.GetTransaction(txnID); err != nil {
+		return nil, newRPCError(RPC_INVALID_ADDRESS_OR_KEY, "no such mempool or blockchain transaction")
+	}
+
+	if !verbose {
+		return hex.EncodeToString(serialize(transaction)), nil
+	}
+	txnResult := newTransactionResult(node.Params, transaction)
+	if block != nil {
+		blockHash := block.GetHash()
+		txnResult.BlockHash = hex.EncodeToString(blockHash)
+		txnResult.Confirmations = node.Blockchain.GetHeight() - node.Blockchain.GetBlockHeight(blockHash)
+	}
+	return txnResult, nil
+}
+
+// rpcSendRawTransaction verifies a raw transaction, adds it to the mempool and relays it
+func (node *FullNode) rpcSendRawTransaction(params []json.RawMessage) (interface{}, error) {
+	var hexTxn string
+	if err := parseParams(params, 1, &hexTxn); err != nil {
+		return nil, err
+	}
+	transaction, rawTxn, err := decodeRawTransaction(hexTxn)
+	if err != nil {
+		return nil, err
+	}
+	if err := node.handleNewTxnMsg(rawTxn); err != nil {
+		return nil, newRPCError(RPC_VERIFY_REJECTED, "transaction rejected: %v", err)
+	}
+	return hex.EncodeToString(transaction.Hash), nil
+}
+
+func (node *FullNode) rpcGetMempoolInfo(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	node.mempoolMutex.Lock()
+	defer node.mempoolMutex.Unlock()
+	mempoolInfo := MempoolInfo{Size: len(node.mempool)}
+	for _, transaction := range node.mempool {
+		mempoolInfo.Bytes += transaction.Size()
+		mempoolInfo.TotalFee += node.mempoolFees[string(transaction.Hash)]
+	}
+	return mempoolInfo, nil
+}
+
+func (node *FullNode) rpcGetPeerInfo(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	return node.getPeerInfo(), nil
+}
+
+// rpcGetBalance returns the balance of an address or a list of addresses, outputs with fewer than
+// minconf confirmations count as unconfirmed incoming
+func (node *FullNode) rpcGetBalance(params []json.RawMessage) (interface{}, error) {
+	var addresses addressList
+	minConfirmations := 1
+	if err := parseParams(params, 1, &addresses, &minConfirmations); err != nil {
+		return nil, err
+	}
+	if err := validateAddresses(node.Params, addresses); err != nil {
+		return nil, err
+	}
+	return node.GetBalance(addresses, minConfirmations), nil
+}
+
+// rpcGetAddressHistory returns up to count funding and spending events of an address in the order of the chain,
+// after skipping skip of them. A count of 0 returns all remaining events.
+func (node *FullNode) rpcGetAddressHistory(params []json.RawMessage) (interface{}, error) {
+	var address string
+	skip, count := 0, 0
+	if err := parseParams(params, 1, &address, &skip, &count); err != nil {
+		return nil, err
+	}
+	if err := node.checkAddressIndex(address); err != nil {
+		return nil, err
+	}
+	events, err := node.Blockchain.GetAddressHistory(address, skip, count)
+	if err != nil {
+		return nil, newRPCError(RPC_MISC_ERROR, "%s", err.Error())
+	}
+	eventResults := []AddressEventResult{}
+	for _, event := range events {
+		eventResults = append(eventResults, AddressEventResult{hex.EncodeToString(event.TxID), event.Height, event.IsSpending, event.Index, event.Value})
+	}
+	return eventResults, nil
+}
+
+func (node *FullNode) rpcGetAddressBalance(params []json.RawMessage) (interface{}, error) {
+	var address string
+	if err := parseParams(params, 1, &address); err != nil {
+		return nil, err
+	}
+	if err := node.checkAddressIndex(address); err != nil {
+		return nil, err
+	}
+	balance, err := node.Blockchain.GetAddressBalance(address)
+	if err != nil {
+		return nil, newRPCError(RPC_MISC_ERROR, "%s", err.Error())
+	}
+	return AddressBalanceResult{balance.Received, balance.Sent, balance.Balance, balance.TxCount}, nil
+}
+
+// checkAddressIndex reports an RPC error unless the address index is enabled and address is valid
+func (node *FullNode) checkAddressIndex(address string) error {
+	if node.Blockchain.AddrIndex == nil {
+		return newRPCError(RPC_MISC_ERROR, "address index is not enabled, start the node with -addrindex")
+	}
+	return validateAddresses(node.Params, []string{address})
+}
+
+// rpcDumpTxOutSet writes the UTXO set at the tip, or at the block with the given hash, to a snapshot file on the
+// node. Relative paths are relative to the data directory.
+func (node *FullNode) rpcDumpTxOutSet(params []json.RawMessage) (interface{}, error) {
+	var path, hexHash string
+	if err := parseParams(params, 1, &path, &hexHash); err != nil {
+		return nil, err
+	}
+	var blockHash []byte
+	if hexHash != "" {
+		var err error
+		if blockHash, err = decodeHashParam(hexHash); err != nil {
+			return nil, err
+		}
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(node.Params.DataDirPath(), path)
+	}
+	metadata, err := node.DumpUTXOSnapshot(path, blockHash)
+	if err != nil {
+		return nil, newRPCError(RPC_MISC_ERROR, "can not dump the UTXO set: %v", err)
+	}
+	return SnapshotResult{
+		BlockHash:    hex.EncodeToString(metadata.BlockHash),
+		Height:       metadata.Height,
+		Transactions: metadata.Transactions,
+		Hash:         hex.EncodeToString(metadata.Hash),
+		Path:         path,
+	}, nil
+}
+
+func (node *FullNode) rpcExportBlocks(params []json.RawMessage) (interface{}, error) {
+	var path string
+	if err := parseParams(params, 1, &path); err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(node.Params.DataDirPath(), path)
+	}
+	count, err := node.ExportBlocks(path)
+	if err != nil {
+		return nil, newRPCError(RPC_MISC_ERROR, "can not export blocks: %v", err)
+	}
+	return ExportBlocksResult{Blocks: count, Path: path}, nil
+}
+
+func (node *FullNode) rpcImportBlocks(params []json.RawMessage) (interface{}, error) {
+	var path string
+	if err := parseParams(params, 1, &path); err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(node.Params.DataDirPath(), path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, newRPCError(RPC_MISC_ERROR, "can not import blocks: %v", err)
+	}
+	defer file.Close()
+	result, err := node.ImportBlocks(file)
+	if err != nil {
+		return nil, newRPCError(RPC_MISC_ERROR, "can not import blocks after %d imported: %v", result.Imported, err)
+	}
+	return ImportBlocksResult{Imported: result.Imported, Skipped: result.Skipped, Height: result.Height, Path: path}, nil
+}
+
+// ======= Miner node methods =======
+
+// StartRPCServer serves the full node's JSON-RPC methods and generate and generatetoaddress at config.ListenAddress
+func (node *MinerNode) StartRPCServer(config RPCConfig) error {
+	methods := node.rpcMethods(node.Stop)
+	methods["generate"] = node.rpcGenerate
+	methods["generatetoaddress"] = node.rpcGenerateToAddress
+	return node.startRPCServer(config, methods)
+}
+
+func (node *MinerNode) rpcGenerate(params []json.RawMessage) (interface{}, error) {
+	var count int
+	if err := parseParams(params, 1, &count); err != nil {
+		return nil, err
+	}
+	return node.rpcGenerateBlocks(count, node.recipientAddress)
+}
+
+func (node *MinerNode) rpcGenerateToAddress(params []json.RawMessage) (interface{}, error) {
+	var count int
+	var address string
+	if err := parseParams(params, 2, &count, &address); err != nil {
+		return nil, err
+	}
+	if err := validateAddresses(node.Params, []string{address}); err != nil {
+		return nil, err
+	}
+	return node.rpcGenerateBlocks(count, address)
+}
+
+func (node *MinerNode) rpcGenerateBlocks(count int, address string) (interface{}, error) {
+	blockHashes, err := node.GenerateToAddress(count, address)
+	if err != nil {
+		return nil, newRPCError(RPC_INVALID_PARAMETER, "%s", err.Error())
+	}
+	hexHashes := []string{}
+	for _, blockHash := range blockHashes {
+		hexHashes = append(hexHashes, hex.EncodeToString(blockHash))
+	}
+	return hexHashes, nil
+}
+
+// ======= SPV node methods =======
+
+// StartRPCServer serves the SPV node's JSON-RPC methods at config.ListenAddress. Transactions can only be
+// looked up if they concern a monitored address.
+func (node *SPVNode) StartRPCServer(config RPCConfig) error {
+	return node.startRPCServer(config, map[string]rpcHandler{
+		"getblockchaininfo":  node.rpcGetBlockchainInfo,
+		"getblockcount":      node.rpcGetBlockCount,
+		"getbestblockhash":   node.rpcGetBestBlockHash,
+		"getblockhash":       node.rpcGetBlockHash,
+		"getrawtransaction":  node.rpcGetRawTransaction,
+		"sendrawtransaction": node.rpcSendRawTransaction,
+		"getpeerinfo":        node.rpcGetPeerInfo,
+		"getbalance":         node.rpcGetBalance,
+		"stop":               stopHandler(node.Stop),
+	})
+}
+
+func (node *SPVNode) rpcGetBlockchainInfo(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	tipEntry := node.blockchainHeader.Index.GetEntry(node.blockchainHeader.LastHash)
+	return HeaderChainInfo{
+		Chain:         node.Params.Name,
+		Headers:       tipEntry.Height,
+		BestBlockHash: hex.EncodeToString(tipEntry.Hash),
+		Difficulty:    node.Params.DifficultyLevel,
+		ChainWork:     tipEntry.ChainWork.Text(16),
+	}, nil
+}
+
+func (node *SPVNode) rpcGetBlockCount(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	return node.blockchainHeader.GetHeight() - 1, nil
+}
+
+func (node *SPVNode) rpcGetBestBlockHash(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	return hex.EncodeToString(node.blockchainHeader.LastHash), nil
+}
+
+func (node *SPVNode) rpcGetBlockHash(params []json.RawMessage) (interface{}, error) {
+	var height int
+	if err := parseParams(params, 1, &height); err != nil {
+		return nil, err
+	}
+	blockHash := node.blockchainHeader.Index.GetHashAtHeight(height)
+	if blockHash == nil {
+		return nil, newRPCError(RPC_INVALID_PARAMETER, "block height %d out of range", height)
+	}
+	return hex.EncodeToString(blockHash), nil
+}
+
+// rpcGetRawTransaction looks up a pending or verified transaction of a monitored address
+func (node *SPVNode) rpcGetRawTransaction(params []json.RawMessage) (interface{}, error) {
+	var hexTxnID string
+	verbose := false
+	if err := parseParams(params, 1, &hexTxnID, &verbose); err != nil {
+		return nil, err
+	}
+	txnID, err := decodeHashParam(hexTxnID)
+	if err != nil {
+		return nil, err
+	}
+
+	var confirmedTxn ConfirmedTransaction
+	node.pendingTxnsMutex.Lock()
+	pendingTxn, isPending := node.pendingTxns[string(txnID)]
+	node.pendingTxnsMutex.Unlock()
+	if isPending {
+		confirmedTxn.Transaction = pendingTxn
+	} else if encodedTxn, err := node.blockchainHeader.DataBase.Get(append(walletTxnPrefix, txnID...)); err == nil {
+		genericDeserialize(encodedTxn, &confirmedTxn)
+	} else {
+		return nil, newRPCError(RPC_INVALID_ADDRESS_OR_KEY, "no such transaction of a monitored address")
+	}
+
+	if !verbose {
+		return hex.EncodeToString(serialize(confirmedTxn.Transaction)), nil
+	}
+	txnResult := newTransactionResult(node.Params, &confirmedTxn.Transaction)
+	if !isPending {
+		txnResult.BlockHash = hex.EncodeToString(confirmedTxn.BlockHash)
+		txnResult.Confirmations, _ = node.getConfirmations(txnID, node.blockchainHeader.GetBlockHeight(node.blockchainHeader.LastHash))
+	}
+	return txnResult, nil
+}
+
+// rpcSendRawTransaction relays a raw transaction to the connected full nodes, which verify it
+func (node *SPVNode) rpcSendRawTransaction(params []json.RawMessage) (interface{}, error) {
+	var hexTxn string
+	if err := parseParams(params, 1, &hexTxn); err != nil {
+		return nil, err
+	}
+	transaction, rawTxn, err := decodeRawTransaction(hexTxn)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.ContainsFunc(node.connectedPeers, func(peer NodeInfo) bool { return peer.NodeType != SPV }) {
+		return nil, newRPCError(RPC_MISC_ERROR, "no full node connected")
+	}
+	node.handleNewTxnMsg(rawTxn)
+	return hex.EncodeToString(transaction.Hash), nil
+}
+
+func (node *SPVNode) rpcGetPeerInfo(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	return node.getPeerInfo(), nil
+}
+
+// rpcGetBalance returns the balance of the given addresses, or of all monitored addresses if none are given
+func (node *SPVNode) rpcGetBalance(params []json.RawMessage) (interface{}, error) {
+	var addresses addressList
+	minConfirmations := 1
+	if err := parseParams(params, 0, &addresses, &minConfirmations); err != nil {
+		return nil, err
+	}
+	if len(addresses) == 0 {
+		addresses = node.monitorAddrList
+	}
+	if err := validateAddresses(node.Params, addresses); err != nil {
+		return nil, err
+	}
+	return node.GetBalance(addresses, minConfirmations), nil
+}
@@ -0,0 +1,140 @@
+package network
+
+import (
+	"EChain/blockchain"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// SNAPSHOT_BLOCKS_INDEX marks getdata and blockdata messages of the blocks below a UTXO snapshot
+const SNAPSHOT_BLOCKS_INDEX = -2
+
+// snapshotRequestTimeout is how long blocks requested for the snapshot validation are waited for before
+// they are requested again, from another peer if there is one
+const snapshotRequestTimeout = 30 * time.Second
+
+// snapshotRequestInterval is how often the snapshot validation checks for timed out requests and new peers
+const snapshotRequestInterval = 5 * time.Second
+
+// snapshotValidation downloads the blocks below the UTXO snapshot of the chain for its validator, one
+// getdata message at a time
+type snapshotValidation struct {
+	validator     *blockchain.SnapshotValidator
+	stop          func() // stops the node once the validation fails
+	mutex         sync.Mutex
+	requestedAt   time.Time // zero unless blocks were requested and not received yet
+	requestedFrom string    // peer the blocks were last requested from
+}
+
+// DumpUTXOSnapshot writes the UTXO set at the active chain's block with the given hash, the tip if hash is nil,
+// to the file at path. The file is replaced only once the snapshot is complete.
+func (node *FullNode) DumpUTXOSnapshot(path string, hash []byte) (*blockchain.SnapshotMetadata, error) {
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpPath)
+	metadata, err := node.Blockchain.DumpUTXOSnapshot(hash, file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return metadata, os.Rename(tmpPath, path)
+}
+
+// StartSnapshotValidation validates the blocks below the UTXO snapshot the chain was loaded from in the
+// background, downloading them from peers that store them and checking them like blocks received from peers.
+// It does nothing if the chain was not loaded from a snapshot or the snapshot is validated. If the validation
+// fails the chain is marked invalid and stop is called, as the UTXO set of the node can not be trusted.
+func (node *FullNode) StartSnapshotValidation(stop func()) error {
+	if err := node.Blockchain.SnapshotError(); err != nil {
+		return fmt.Errorf("the UTXO snapshot is invalid: %w", err)
+	}
+	if node.Blockchain.GetSnapshot() == nil {
+		return nil
+	}
+	validator, err := node.Blockchain.NewSnapshotValidator(node.verifyBlockAt)
+	if err != nil {
+		return err
+	}
+	node.snapshotValidation = &snapshotValidation{validator: validator, stop: stop}
+	node.requestSnapshotBlocks()
+	node.goWorker(func() {
+		for node.sleep(snapshotRequestInterval) {
+			if !node.requestSnapshotBlocks() {
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// requestSnapshotBlocks asks a peer storing them for the next blocks below the snapshot, unless blocks were
+// requested recently. Blocks not received in time are requested from another peer, the same one only if no
+// other peer stores them. It reports false once no blocks are left to request.
+func (node *FullNode) requestSnapshotBlocks() bool {
+	validation := node.snapshotValidation
+	if validation == nil {
+		return false
+	}
+	validation.mutex.Lock()
+	hashes := validation.validator.NextHashes(MAX_BLOCKS_IN_TRANSIT_PER_PEER)
+	if len(hashes) == 0 || time.Since(validation.requestedAt) < snapshotRequestTimeout {
+		validation.mutex.Unlock()
+		return len(hashes) > 0
+	}
+	height := validation.validator.Height()
+	timedOut := !validation.requestedAt.IsZero()
+	peerAddress := ""
+	for _, connectedNode := range node.connectedPeers {
+		if (connectedNode.NodeType == FULLNODE || connectedNode.NodeType == MINER) && node.servesBlocksFrom(connectedNode.Address, height) {
+			peerAddress = connectedNode.Address
+			if !timedOut || peerAddress != validation.requestedFrom {
+				break
+			}
+		}
+	}
+	if peerAddress != "" {
+		validation.requestedAt = time.Now()
+		validation.requestedFrom = peerAddress
+	}
+	validation.mutex.Unlock()
+	if peerAddress != "" {
+		node.sendGetdataMessage(peerAddress, &GetdataMessage{SNAPSHOT_BLOCKS_INDEX, hashes, node.NetworkAddress})
+	}
+	return true
+}
+
+// handleSnapshotBlocks validates blocks received for the snapshot validation and requests the following ones.
+// The node is stopped if the validation fails.
+func (node *FullNode) handleSnapshotBlocks(blockList []*blockchain.Block) {
+	validation := node.snapshotValidation
+	if validation == nil {
+		return
+	}
+	for _, block := range blockList {
+		validated, err := validation.validator.ValidateBlock(block)
+		if err != nil {
+			logError("UTXO snapshot validation failed, the chain is invalid and the node stops:", err)
+			// Stop waits for the message handlers, this one included
+			go validation.stop()
+			return
+		}
+		if validated {
+			logInfo("UTXO snapshot validated, the blocks below it build the same UTXO set")
+			return
+		}
+	}
+	validation.mutex.Lock()
+	validation.requestedAt = time.Time{}
+	validation.mutex.Unlock()
+	node.requestSnapshotBlocks()
+}
@@ -0,0 +1,150 @@
+package network
+
+import (
+	"EChain/blockchain"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotValidation(t *testing.T) {
+	t.Parallel()
+	params := &blockchain.RegTestParams
+	minerNode := NewMinerNode(params, "snapshot-source-test", params.GenesisAddress, blockchain.NewMemoryStore())
+	defer minerNode.Stop()
+	blockHashes, err := minerNode.GenerateBlocks(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "utxo.snapshot")
+	result, err := minerNode.rpcDumpTxOutSet([]json.RawMessage{json.RawMessage(`"` + path + `"`), json.RawMessage(`"` + hex.EncodeToString(blockHashes[2]) + `"`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshotResult := result.(SnapshotResult); snapshotResult.Height != 3 || snapshotResult.Path != path {
+		t.Fatalf("Expected a snapshot of block 3, actual: %+v", snapshotResult)
+	}
+
+	fullNode := NewFullNode(params, "snapshot-test", blockchain.NewMemoryStore())
+	defer fullNode.Stop()
+	file, _ := os.Open(path)
+	defer file.Close()
+	if _, err := fullNode.Blockchain.LoadUTXOSnapshot(file); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := fullNode.rpcGetBlockchainInfo(nil)
+	if blockchainInfo := info.(BlockchainInfo); blockchainInfo.Blocks != 3 || blockchainInfo.SnapshotHeight != 3 {
+		t.Fatalf("Expected the node to start at the snapshot block, actual: %+v", blockchainInfo)
+	}
+
+	// The blocks below the snapshot are requested from a peer storing them
+	peer, err := net.Listen(protocol, "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	fullNode.connectedPeers = []NodeInfo{{SPV, "spv-peer"}, {FULLNODE, peer.Addr().String()}}
+	receive := func(peer net.Listener) chan []byte {
+		received := make(chan []byte)
+		go func() {
+			conn, err := peer.Accept()
+			if err != nil {
+				close(received)
+				return
+			}
+			msg, _ := io.ReadAll(conn)
+			conn.Close()
+			received <- msg
+		}()
+		return received
+	}
+	received := receive(peer)
+	if err := fullNode.StartSnapshotValidation(fullNode.Stop); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-received
+	if len(msg) < msgTypeLength {
+		t.Fatalf("Expected the peer to receive a message")
+	}
+	var getdataMsg GetdataMessage
+	genericDeserialize(msg[msgTypeLength:], &getdataMsg)
+	if getMsgType(msg) != GETDATA_MSG || getdataMsg.Index != SNAPSHOT_BLOCKS_INDEX || len(getdataMsg.HashList) != 2 {
+		t.Fatalf("Expected blocks 1 and 2 to be requested, actual: %+v", getdataMsg)
+	}
+
+	// Blocks not received in time are requested from another peer
+	otherPeer, err := net.Listen(protocol, "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otherPeer.Close()
+	fullNode.connectedPeers = append(fullNode.connectedPeers, NodeInfo{FULLNODE, otherPeer.Addr().String()})
+	received = receive(otherPeer)
+	fullNode.snapshotValidation.mutex.Lock()
+	fullNode.snapshotValidation.requestedAt = time.Now().Add(-snapshotRequestTimeout)
+	fullNode.snapshotValidation.mutex.Unlock()
+	fullNode.requestSnapshotBlocks()
+	if msg := <-received; len(msg) < msgTypeLength || getMsgType(msg) != GETDATA_MSG {
+		t.Fatalf("Expected the blocks to be requested from the other peer")
+	}
+
+	blockList := []*blockchain.Block{}
+	for _, hash := range getdataMsg.HashList {
+		blockList = append(blockList, minerNode.Blockchain.GetBlock(hash))
+	}
+	fullNode.handleBlockdataMsg(serialize(BlockdataMessage{SNAPSHOT_BLOCKS_INDEX, blockList}))
+	if fullNode.Blockchain.GetSnapshot() != nil || fullNode.Blockchain.GetBlock(blockHashes[0]) == nil {
+		t.Fatalf("Expected the snapshot to be validated and the blocks below it stored")
+	}
+}
+
+func TestInvalidSnapshot(t *testing.T) {
+	t.Parallel()
+	params := &blockchain.RegTestParams
+	minerNode := NewMinerNode(params, "invalid-snapshot-source-test", params.GenesisAddress, blockchain.NewMemoryStore())
+	defer minerNode.Stop()
+	// The block below the snapshot claims more than the subsidy, it is stored without the checks of blocks from peers
+	greedyBlock := &blockchain.Block{
+		BlockHeader:  blockchain.BlockHeader{Timestamp: time.Now().String(), PrevHash: minerNode.Blockchain.LastHash},
+		Transactions: []*blockchain.Transaction{blockchain.CoinBaseTransaction(params.GenesisAddress, blockchain.COINBASE_REWARD+1)},
+	}
+	minerNode.mineBlock(greedyBlock)
+	minerNode.Blockchain.SetBlockVerifier(nil)
+	if err := minerNode.Blockchain.StoreNewBlock(greedyBlock); err != nil {
+		t.Fatal(err)
+	}
+	minerNode.Blockchain.SetBlockVerifier(minerNode.verifyBlockAt)
+	if _, err := minerNode.GenerateBlocks(1); err != nil {
+		t.Fatal(err)
+	}
+	var snapshotFile bytes.Buffer
+	if _, err := minerNode.Blockchain.DumpUTXOSnapshot(nil, &snapshotFile); err != nil {
+		t.Fatal(err)
+	}
+
+	fullNode := NewFullNode(params, "invalid-snapshot-test", blockchain.NewMemoryStore())
+	defer fullNode.Stop()
+	if _, err := fullNode.Blockchain.LoadUTXOSnapshot(&snapshotFile); err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan struct{})
+	if err := fullNode.StartSnapshotValidation(func() { close(stopped) }); err != nil {
+		t.Fatal(err)
+	}
+	fullNode.handleBlockdataMsg(serialize(BlockdataMessage{SNAPSHOT_BLOCKS_INDEX, []*blockchain.Block{greedyBlock}}))
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the node to stop once the snapshot validation failed")
+	}
+	if fullNode.Blockchain.SnapshotError() == nil || fullNode.StartSnapshotValidation(func() {}) == nil {
+		t.Fatalf("Expected the chain to be marked invalid")
+	}
+}
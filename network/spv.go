@@ -3,16 +3,17 @@ package network
 import (
 	"EChain/blockchain"
 	"bytes"
-	"fmt"
+	"context"
 	"io"
-	"log"
 	"net"
+	"sync"
 	"time"
 
-	"github.com/syndtr/goleveldb/leveldb"
 	"golang.org/x/exp/slices"
 )
 
+var walletTxnPrefix = []byte(blockchain.WalletNamespace) // verified transactions of monitored addresses, keyed by transaction hash
+
 type SPVNode struct {
 	P2PNode
 	blockchainHeader      *blockchain.BlockChainHeader
@@ -21,86 +22,74 @@ type SPVNode struct {
 	bloomFilter           []string
 	updatedBlockHeader    chan bool
 	requestingBlockHeader bool
+	pendingTxns           map[string]blockchain.Transaction // unconfirmed transactions of monitored addresses
+	pendingTxnsMutex      *sync.Mutex
 }
 
-func NewSPVNode(networkAddress string) *SPVNode {
-	db, err := leveldb.OpenFile("storage/"+networkAddress, nil)
-	if err != nil {
-		fmt.Println("can not start database at", networkAddress)
-		return nil
-	}
-	localBlockchainHeader := blockchain.InitBlockChainHeader(db)
-	utxoSet := blockchain.NewUTXOSet(db)
-	p2pNode := P2PNode{
-		Version:        1,
-		NetworkAddress: networkAddress,
-	}
+// NewSPVNode returns an SPV node keeping its headers and wallet transactions in store, the node closes store
+// when it is stopped
+func NewSPVNode(params *blockchain.ChainParams, networkAddress string, store blockchain.Store) *SPVNode {
+	localBlockchainHeader := blockchain.InitBlockChainHeader(params, store)
+	utxoSet := blockchain.NewUTXOSet(store)
 	return &SPVNode{
-		P2PNode:            p2pNode,
+		P2PNode:            newP2PNode(params, networkAddress),
 		blockchainHeader:   localBlockchainHeader,
 		utxoSet:            &utxoSet,
 		updatedBlockHeader: make(chan bool),
+		pendingTxns:        make(map[string]blockchain.Transaction),
+		pendingTxnsMutex:   &sync.Mutex{},
 	}
 }
 
 func (node *SPVNode) sendAddrMsg(toAddress string) {
-	fmt.Println("Send Addr msg from", node.NetworkAddress, "to", toAddress)
+	logDebug("Send Addr msg from", node.NetworkAddress, "to", toAddress)
 	addrMsg := AddrMessage{node.NetworkAddress}
 	sentData := append(msgTypeToBytes(ADDR_MSG), serialize(addrMsg)...)
 	sendMessage(toAddress, sentData)
 }
 
 func (node *SPVNode) sendVersionMsg(toAddress string) {
-	fmt.Println("Send Version msg from", node.NetworkAddress, "to", toAddress)
+	logDebug("Send Version msg from", node.NetworkAddress, "to", toAddress)
 	nBestHeight := node.blockchainHeader.GetHeight()
-	versionMsg := VersionMessage{node.Version, toAddress, node.NetworkAddress, nBestHeight}
+	// SPV nodes store no blocks, they are never asked for them
+	versionMsg := VersionMessage{node.Version, toAddress, node.NetworkAddress, nBestHeight, node.Params.NetworkMagic, 0}
 	sentData := append(msgTypeToBytes(VERSION_MSG), serialize(versionMsg)...)
 	sendMessage(toAddress, sentData)
 }
 
 func (node *SPVNode) sendVerackMsg(toAddress string) {
-	fmt.Println("Send Verack msg from", node.NetworkAddress, "to", toAddress)
+	logDebug("Send Verack msg from", node.NetworkAddress, "to", toAddress)
 	verackMsg := VerackMessage{SPV, node.NetworkAddress}
 	sentData := append(msgTypeToBytes(VERACK_MSG), serialize(verackMsg)...)
 	sendMessage(toAddress, sentData)
 }
 
 func (node *SPVNode) sendGetheadersMsg(toAddress string) {
-	fmt.Println("Send Getheaders msg from", node.NetworkAddress, "to", toAddress)
-	lastHeaderHash := node.blockchainHeader.LastHash
-	getheadersMsg := GetheadersMessage{lastHeaderHash, node.NetworkAddress}
+	logDebug("Send Getheaders msg from", node.NetworkAddress, "to", toAddress)
+	getheadersMsg := GetheadersMessage{node.blockchainHeader.GetBlockLocator(), nil, node.NetworkAddress}
 	sentData := append(msgTypeToBytes(GETHEADERS_MSG), serialize(getheadersMsg)...)
 	sendMessage(toAddress, sentData)
 }
 
 func (node *SPVNode) sendHeaderMessage(toAddress string, headerMsg *HeaderMessage) {
-	fmt.Println("Send Headers msg from", node.NetworkAddress, "to", toAddress)
+	logDebug("Send Headers msg from", node.NetworkAddress, "to", toAddress)
 	sentData := append(msgTypeToBytes(HEADERS_MSG), serialize(headerMsg)...)
 	sendMessage(toAddress, sentData)
 }
 
 func (node *SPVNode) sendFilterloadMsg(toAddress string) {
-	fmt.Println("Send filterload msg from", node.NetworkAddress, "to", toAddress)
+	logDebug("Send filterload msg from", node.NetworkAddress, "to", toAddress)
 	filterloadMsg := FilterloadMessage{node.NetworkAddress, node.bloomFilter}
 	sentData := append(msgTypeToBytes(FILTERLOAD_MSG), serialize(filterloadMsg)...)
 	sendMessage(toAddress, sentData)
 }
 
 func (node *SPVNode) sendMerkleblockMessage(toAddress string, merkleblockMsg *MerkleBlockMessage) {
-	fmt.Println("Send Merkleblock msg from", node.NetworkAddress, "to", toAddress)
+	logDebug("Send Merkleblock msg from", node.NetworkAddress, "to", toAddress)
 	sentData := append(msgTypeToBytes(MERKLEBLOCK_MSG), serialize(merkleblockMsg)...)
 	sendMessage(toAddress, sentData)
 }
 
-func (node *SPVNode) isTxnInputOfInterest(txnInput *blockchain.TxInput) bool {
-	for _, targetAddr := range node.monitorAddrList {
-		if txnInput.IsSignedBy(targetAddr) {
-			return true
-		}
-	}
-	return false
-}
-
 func (node *SPVNode) isTxnOutputOfInterest(txnOutput *blockchain.TxOutput) bool {
 	for _, targetAddr := range node.monitorAddrList {
 		if txnOutput.IsBoundTo(targetAddr) {
@@ -117,7 +106,9 @@ func (node *SPVNode) handleMerkleblockMsg(msg []byte) {
 	// Step 1: Request blockheader from other fullnodes if blockheader does not exist in SPV node
 	blockHeader := merkleblockMsg.BlockHeader
 	if !node.blockchainHeader.CheckHeaderExistence(&blockHeader) {
-		time.Sleep(3 * time.Second) // Optionally wait for other fullnodes to receive and verify new block
+		if !node.sleep(3 * time.Second) { // Optionally wait for other fullnodes to receive and verify new block
+			return
+		}
 		for _, connectedNode := range node.connectedPeers {
 			if (connectedNode.NodeType == FULLNODE || connectedNode.NodeType == MINER) && connectedNode.Address != merkleblockMsg.AddrFrom {
 				node.requestingBlockHeader = true
@@ -126,7 +117,11 @@ func (node *SPVNode) handleMerkleblockMsg(msg []byte) {
 				}(connectedNode.Address)
 			}
 		}
-		<-node.updatedBlockHeader
+		select {
+		case <-node.updatedBlockHeader:
+		case <-node.quit:
+			return
+		}
 	}
 	// Step 2: Verify transaction with Merkle proof
 	if !node.blockchainHeader.CheckHeaderExistence(&blockHeader) {
@@ -141,21 +136,16 @@ func (node *SPVNode) handleMerkleblockMsg(msg []byte) {
 		}
 	}
 	if !bytes.Equal(calculatedMerkleRoot, blockHeader.MerkleRoot) {
-		fmt.Println("transaction does not belong in block")
+		logWarn("transaction does not belong in block")
 		return
 	}
 
-	// Step 3: Update local UTXO set with new transaction
-	newTxInputs := []blockchain.TxInput{}
-	updatedTransaction := merkleblockMsg.Transaction
-
-	for _, input := range merkleblockMsg.Transaction.Inputs {
-		if node.isTxnInputOfInterest(&input) {
-			newTxInputs = append(newTxInputs, input)
-		}
-	}
-	updatedTransaction.Inputs = newTxInputs
-	node.utxoSet.UpdateWithNewTransaction(&updatedTransaction)
+	// Step 3: Update local UTXO set with new transaction.
+	// Inputs spending outputs that are not monitored have no entry in the local UTXO set and are skipped.
+	blockHeight := node.blockchainHeader.GetBlockHeight(blockHeader.GetHash())
+	node.utxoSet.UpdateWithNewTransaction(&merkleblockMsg.Transaction, blockHeight)
+	node.storeWalletTransaction(&merkleblockMsg.Transaction, blockHeader.GetHash())
+	node.removePendingTransaction(&merkleblockMsg.Transaction)
 
 	// Step 4: Relay merkleblock message to other SPV nodes
 	for _, connectedNode := range node.connectedPeers {
@@ -167,6 +157,121 @@ func (node *SPVNode) handleMerkleblockMsg(msg []byte) {
 	}
 }
 
+// storeWalletTransaction keeps a verified transaction so wallets can build their history from it
+func (node *SPVNode) storeWalletTransaction(transaction *blockchain.Transaction, blockHash []byte) {
+	confirmedTxn := ConfirmedTransaction{Transaction: *transaction, BlockHash: blockHash}
+	node.blockchainHeader.DataBase.Put(append(walletTxnPrefix, transaction.Hash...), serialize(confirmedTxn))
+}
+
+// removePendingTransaction drops a mined transaction and the pending transactions conflicting with it
+func (node *SPVNode) removePendingTransaction(minedTxn *blockchain.Transaction) {
+	node.pendingTxnsMutex.Lock()
+	defer node.pendingTxnsMutex.Unlock()
+	delete(node.pendingTxns, string(minedTxn.Hash))
+	for txnID, pendingTxn := range node.pendingTxns {
+		for _, pendingInput := range pendingTxn.Inputs {
+			if slices.ContainsFunc(minedTxn.Inputs, func(minedInput blockchain.TxInput) bool {
+				return bytes.Equal(minedInput.TxID, pendingInput.TxID) && minedInput.VOut == pendingInput.VOut
+			}) {
+				delete(node.pendingTxns, txnID)
+				break
+			}
+		}
+	}
+}
+
+// getConfirmations returns how deep the monitored transaction txnID is buried and whether it is a coinbase.
+// Outputs stored before transactions were recorded count as having one confirmation.
+func (node *SPVNode) getConfirmations(txnID []byte, tipHeight int) (int, bool) {
+	encodedTxn, err := node.blockchainHeader.DataBase.Get(append(walletTxnPrefix, txnID...))
+	if err != nil {
+		return 1, false
+	}
+	var confirmedTxn ConfirmedTransaction
+	genericDeserialize(encodedTxn, &confirmedTxn)
+	blockHeight := node.blockchainHeader.GetBlockHeight(confirmedTxn.BlockHash)
+	if blockHeight == -1 {
+		return 0, blockchain.IsCoinbaseTransaction(&confirmedTxn.Transaction)
+	}
+	return tipHeight - blockHeight + 1, blockchain.IsCoinbaseTransaction(&confirmedTxn.Transaction)
+}
+
+func (node *SPVNode) handleGetBalanceMsg(conn net.Conn, msg []byte) {
+	var getBalanceMsg GetBalanceMessage
+	genericDeserialize(msg, &getBalanceMsg)
+	conn.Write(serialize(node.GetBalance(getBalanceMsg.Addresses, getBalanceMsg.MinConfirmations)))
+	conn.Close()
+}
+
+// GetBalance splits the balance of addresses by the state of their outputs, pending transactions count as unconfirmed
+func (node *SPVNode) GetBalance(addresses []string, minConfirmations int) BalanceMessage {
+	if minConfirmations < 1 {
+		minConfirmations = 1
+	}
+
+	var balanceMsg BalanceMessage
+	node.pendingTxnsMutex.Lock()
+	spentByPending := make(map[string][]int)
+	for _, pendingTxn := range node.pendingTxns {
+		for _, input := range pendingTxn.Inputs {
+			spentByPending[string(input.TxID)] = append(spentByPending[string(input.TxID)], input.VOut)
+		}
+		for _, output := range pendingTxn.Outputs {
+			if isOutputBoundToAny(&output, addresses) {
+				balanceMsg.UnconfirmedIncoming += output.Value
+			}
+		}
+	}
+	node.pendingTxnsMutex.Unlock()
+
+	tipHeight := node.blockchainHeader.GetBlockHeight(node.blockchainHeader.LastHash)
+	for _, address := range addresses {
+		for txnID, txnOutputs := range node.utxoSet.FindUTXO(address) {
+			confirmations, isCoinbase := node.getConfirmations([]byte(txnID), tipHeight)
+			for _, output := range txnOutputs {
+				switch {
+				case slices.Contains(spentByPending[txnID], output.Index):
+					balanceMsg.UnconfirmedOutgoing += output.Value
+				case isCoinbase && confirmations < node.Params.CoinbaseMaturity:
+					balanceMsg.Immature += output.Value
+				case confirmations < minConfirmations:
+					balanceMsg.UnconfirmedIncoming += output.Value
+				default:
+					balanceMsg.Confirmed += output.Value
+				}
+			}
+		}
+	}
+	return balanceMsg
+}
+
+// Stop closes the P2P listener and the RPC server, waits for in-flight handlers and closes the database
+func (node *SPVNode) Stop() {
+	node.shutdown(func() {
+		node.blockchainHeader.DataBase.Close()
+	})
+}
+
+func (node *SPVNode) handleGetTxnsMsg(conn net.Conn, msg []byte) {
+	var getTxnsMsg GetTxnsMessage
+	genericDeserialize(msg, &getTxnsMsg)
+
+	txnsMsg := TxnsMessage{TipHeight: node.blockchainHeader.GetBlockHeight(node.blockchainHeader.LastHash)}
+	iter := node.blockchainHeader.DataBase.NewIterator(walletTxnPrefix)
+	for iter.Next() {
+		var confirmedTxn ConfirmedTransaction
+		genericDeserialize(iter.Value(), &confirmedTxn)
+		if isTransactionOfInterest(confirmedTxn.Transaction, getTxnsMsg.Addresses) {
+			confirmedTxn.BlockHeight = node.blockchainHeader.GetBlockHeight(confirmedTxn.BlockHash)
+			txnsMsg.Transactions = append(txnsMsg.Transactions, confirmedTxn)
+		}
+	}
+	iter.Release()
+
+	conn.Write(serialize(txnsMsg))
+	conn.Close()
+}
+
 func (node *SPVNode) handleNewAddrMsg(msg []byte) {
 	var newAddrMsg NewAddrMessage
 	genericDeserialize(msg, &newAddrMsg)
@@ -183,10 +288,17 @@ func (node *SPVNode) handleHeadersMsg(msg []byte) {
 	var headerMsg HeaderMessage
 	genericDeserialize(msg, &headerMsg)
 
+	if len(headerMsg.HeaderList) == 0 {
+		return
+	}
 	for _, header := range headerMsg.HeaderList {
 		node.blockchainHeader.SetHeader(header)
 	}
-	node.blockchainHeader.SetLastHash(headerMsg.HeaderList[len(headerMsg.HeaderList)-1].GetHash())
+	// Switch to the received branch only if it has more work than the active chain
+	lastHash := headerMsg.HeaderList[len(headerMsg.HeaderList)-1].GetHash()
+	if node.blockchainHeader.HasMoreWork(lastHash) {
+		node.blockchainHeader.SetLastHash(lastHash)
+	}
 	if node.requestingBlockHeader {
 		select {
 		case node.updatedBlockHeader <- true:
@@ -199,19 +311,13 @@ func (node *SPVNode) handleGetheadersMsg(msg []byte) {
 	var getheadersMsg GetheadersMessage
 	genericDeserialize(msg, &getheadersMsg)
 
-	remoteLastHeaderHash := getheadersMsg.TopHeaderHash
-	headerExisted, unmatchedHeaders := node.blockchainHeader.GetUnmatchedHeaders(remoteLastHeaderHash)
-	if headerExisted && len(unmatchedHeaders) > 0 {
-		headerList := []*blockchain.BlockHeader{}
-		for i := len(unmatchedHeaders) - 1; i >= 0; i-- {
-			headerList = append(headerList, unmatchedHeaders[i])
-			if len(headerList) >= 2000 {
-				break
-			}
-		}
+	headerList := node.blockchainHeader.GetHeadersAfter(getheadersMsg.BlockLocator, getheadersMsg.StopHash, 2000)
+	if len(headerList) > 0 {
 		headerMsg := HeaderMessage{headerList}
 		node.sendHeaderMessage(getheadersMsg.AddrFrom, &headerMsg)
-	} else if !headerExisted {
+	}
+	// The requester's tip is unknown, it is ahead of us or on another branch
+	if len(getheadersMsg.BlockLocator) > 0 && node.blockchainHeader.Index.GetEntry(getheadersMsg.BlockLocator[0]) == nil {
 		node.sendGetheadersMsg(getheadersMsg.AddrFrom)
 	}
 }
@@ -220,7 +326,7 @@ func (node *SPVNode) handleVersionMsg(msg []byte) {
 	var versionMsg VersionMessage
 	genericDeserialize(msg, &versionMsg)
 
-	if node.Version == versionMsg.Version {
+	if node.Version == versionMsg.Version && node.Params.NetworkMagic == versionMsg.NetworkMagic && node.hasPeerSlot(versionMsg.AddrMe) {
 		node.sendVerackMsg(versionMsg.AddrMe)
 		if !slices.Contains(node.getConnectedNodeAddresses(), versionMsg.AddrMe) {
 			node.sendVersionMsg(versionMsg.AddrMe)
@@ -232,7 +338,7 @@ func (node *SPVNode) handleVerackMsg(msg []byte) {
 	var verackMsg VerackMessage
 	genericDeserialize(msg, &verackMsg)
 
-	if slices.Contains(node.getConnectedNodeAddresses(), verackMsg.AddrFrom) {
+	if slices.Contains(node.getConnectedNodeAddresses(), verackMsg.AddrFrom) || !node.hasPeerSlot(verackMsg.AddrFrom) {
 		return
 	}
 	node.connectedPeers = append(node.connectedPeers, NodeInfo{verackMsg.NodeType, verackMsg.AddrFrom})
@@ -244,7 +350,7 @@ func (node *SPVNode) handleAddrMsg(msg []byte) {
 	var addrMsg AddrMessage
 	genericDeserialize(msg, &addrMsg)
 
-	if !slices.Contains(node.getConnectedNodeAddresses(), addrMsg.Address) {
+	if !slices.Contains(node.getConnectedNodeAddresses(), addrMsg.Address) && node.hasPeerSlot(addrMsg.Address) {
 		node.sendVersionMsg(addrMsg.Address)
 	}
 
@@ -264,20 +370,52 @@ func (node *SPVNode) handeGetUTXOMsg(conn net.Conn, msg []byte) {
 	genericDeserialize(msg, &getUTXOMsg)
 
 	utxoMap := node.utxoSet.FindUTXO(getUTXOMsg.TargetAddress)
+	if getUTXOMsg.MinConfirmations > 0 || getUTXOMsg.SpendableOnly {
+		tipHeight := node.blockchainHeader.GetBlockHeight(node.blockchainHeader.LastHash)
+		for txnID := range utxoMap {
+			confirmations, isCoinbase := node.getConfirmations([]byte(txnID), tipHeight)
+			if confirmations < getUTXOMsg.MinConfirmations || (getUTXOMsg.SpendableOnly && isCoinbase && confirmations < node.Params.CoinbaseMaturity) {
+				delete(utxoMap, txnID)
+			}
+		}
+	}
 	conn.Write(serialize(utxoMap))
 	conn.Close()
 }
 
 func (node *SPVNode) handleNewTxnMsg(msg []byte) {
+	var newTransaction blockchain.Transaction
+	genericDeserialize(msg, &newTransaction)
+	if isTransactionOfInterest(newTransaction, node.monitorAddrList) {
+		node.pendingTxnsMutex.Lock()
+		node.pendingTxns[string(newTransaction.Hash)] = newTransaction
+		node.pendingTxnsMutex.Unlock()
+	}
+
 	for _, connectedNode := range node.connectedPeers {
 		if connectedNode.NodeType == MINER || connectedNode.NodeType == FULLNODE {
-			fmt.Println("Send NewTxn msg from", node.NetworkAddress, "to", connectedNode.Address)
+			logDebug("Send NewTxn msg from", node.NetworkAddress, "to", connectedNode.Address)
 			sentData :=  append(msgTypeToBytes(NEWTXN_MSG), msg...)
 			sendMessage(connectedNode.Address, sentData)
 		}
 	}
 }
 
+// handleEstimateFeeMsg relays a fee estimate request to a connected full node, SPV nodes have no mempool
+func (node *SPVNode) handleEstimateFeeMsg(conn net.Conn, msg []byte) {
+	defer conn.Close()
+	for _, connectedNode := range node.connectedPeers {
+		if connectedNode.NodeType == MINER || connectedNode.NodeType == FULLNODE {
+			resp, err := requestMessage(connectedNode.Address, append(msgTypeToBytes(ESTIMATEFEE_MSG), msg...))
+			if err == nil && len(resp) > 0 {
+				conn.Write(resp)
+				return
+			}
+		}
+	}
+	conn.Write(serialize(FeeEstimateMessage{Error: "no full node connected"}))
+}
+
 func (node *SPVNode) updateBloomFilter() {
 	// Todo: Implement a realistic bloom filter
 	node.bloomFilter = node.monitorAddrList
@@ -313,34 +451,24 @@ func (node *SPVNode) handleConnection(conn net.Conn) {
 		node.handeGetUTXOMsg(conn, payload)
 	case NEWTXN_MSG:
 		node.handleNewTxnMsg(payload)
+	case ESTIMATEFEE_MSG:
+		node.handleEstimateFeeMsg(conn, payload)
+	case GETTXNS_MSG:
+		node.handleGetTxnsMsg(conn, payload)
+	case GETBALANCE_MSG:
+		node.handleGetBalanceMsg(conn, payload)
 	default:
-		fmt.Println("invalid message")
+		logWarn("invalid message")
 	}
 }
 
-func (node *SPVNode) StartP2PNode() {
-	fmt.Println(" ===== Starting blockchain node at", node.NetworkAddress, "=====")
-	ln, err := net.Listen(protocol, node.NetworkAddress)
-	if err != nil {
-		fmt.Println("can not start server at", node.NetworkAddress)
-		return
-	}
-
-	go func() {
-		time.Sleep(2 * time.Second)
-		for _, peerAddr := range initialPeers {
-			if peerAddr != node.NetworkAddress {
-				node.sendVersionMsg(peerAddr)
-			}
-		}
-	}()
-
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Panic(err.Error())
-		}
-
-		go node.handleConnection(conn)
+// Start listens for peers and connects to the initial peers in the background, the node is stopped once ctx is done
+func (node *SPVNode) Start(ctx context.Context) error {
+	if err := node.listen(ctx, node.handleConnection, node.Stop); err != nil {
+		return err
 	}
+	node.goWorker(func() {
+		node.connectToInitialPeers(node.sendVersionMsg)
+	})
+	return nil
 }
@@ -2,55 +2,121 @@ package network
 
 import (
 	"EChain/blockchain"
-	"fmt"
-	"sync"
+	"context"
+	"io"
+	"net"
 	"testing"
 	"time"
 )
 
-const (
-	NETWORK_NODES_NUM  = 1
-	FULLNODE_BLOCK_NUM = 50
-)
+const FULLNODE_BLOCK_NUM = 50
+
+// waitFor polls condition until it holds, failing the test after 10 seconds
+func waitFor(t *testing.T, condition func() bool) {
+	for deadline := time.Now().Add(10 * time.Second); !condition(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the network")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// openStore opens the on-disk database of the node at networkAddress
+func openStore(t *testing.T, params *blockchain.ChainParams, networkAddress string) blockchain.Store {
+	store, err := blockchain.OpenLevelDBStore(params.StoragePath(networkAddress))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
 
 func TestBlockHeaderHeightSPVNode(t *testing.T) {
-	var blockHeaderHeight int
-	minerNode := NewMinerNode("", "")
-
-	var wg sync.WaitGroup
-	for i := 0; i < NETWORK_NODES_NUM; i++ {
-		wg.Add(1)
-		portNumber := 8333 + i
-		go func() {
-			fullnode := NewFullNode("localhost:" + fmt.Sprint(portNumber))
-			for i := 0; i < FULLNODE_BLOCK_NUM; i++ {
-				var block blockchain.Block
-				lastHash, _ := fullnode.Blockchain.DataBase.Get([]byte(blockchain.LAST_HASH_STOGAGE_KEY), nil)
-				block.PrevHash = lastHash
-				minerNode.mineBlock(&block)
-				fullnode.Blockchain.StoreNewBlock(&block)
-			}
-			go func() {
-				time.Sleep(5 * time.Second) // wait for SPV node to finish synchronizing block headers
-				wg.Done()
-			}()
-			fullnode.StartP2PNode()
-		}()
-	}
-	go func() {
-		time.Sleep(3 * time.Second) // Wait for fullnode to finish building blocks (including mining time for each block)
-		wg.Add(1)
-		spvNode := NewSPVNode("localhost:8888")
-		go func() {
-			time.Sleep(3 * time.Second)
-			blockHeaderHeight = spvNode.GetHeaderHeight()
-			wg.Done()
-		}()
-		spvNode.StartP2PNode()
-	}()
-	wg.Wait()
-
-	if blockHeaderHeight != FULLNODE_BLOCK_NUM+1 { // +1 is for Genesis block
-		t.Fatalf("Expected SPV header's length to be %d", FULLNODE_BLOCK_NUM+1)
+	params := blockchain.RegTestParams
+	params.DataDir = t.TempDir()
+	params.InitialPeers = []string{"localhost:18650"}
+	minerNode := MinerNode{FullNode: FullNode{P2PNode: P2PNode{Params: &params}}}
+
+	fullnode := NewFullNode(&params, params.InitialPeers[0], blockchain.NewMemoryStore())
+	for i := 0; i < FULLNODE_BLOCK_NUM; i++ {
+		block := blockchain.Block{
+			BlockHeader:  blockchain.BlockHeader{PrevHash: fullnode.Blockchain.LastHash},
+			Transactions: []*blockchain.Transaction{blockchain.CoinBaseTransaction(params.GenesisAddress, blockchain.COINBASE_REWARD-i)},
+		}
+		minerNode.mineBlock(&block)
+		fullnode.Blockchain.StoreNewBlock(&block)
+	}
+	if err := fullnode.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer fullnode.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	spvNode := NewSPVNode(&params, "localhost:18651", openStore(t, &params, "localhost:18651"))
+	if err := spvNode.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return spvNode.GetHeaderHeight() == FULLNODE_BLOCK_NUM+1 }) // +1 is for Genesis block
+
+	cancel()
+	<-spvNode.Done()
+	if err := spvNode.Start(context.Background()); err == nil {
+		t.Fatalf("Expected a stopped node not to start again")
+	}
+	restarted := NewSPVNode(&params, "localhost:18651", openStore(t, &params, "localhost:18651"))
+	if err := restarted.Start(context.Background()); err != nil {
+		t.Fatalf("Expected the port and database of a stopped node to be released: %v", err)
+	}
+	restarted.Stop()
+}
+
+func TestSPVBalanceBreakdown(t *testing.T) {
+	t.Parallel()
+	spvNode := NewSPVNode(&blockchain.RegTestParams, "balance-test", blockchain.NewMemoryStore())
+	defer spvNode.Stop()
+	address := spvNode.Params.GenesisAddress
+	spvNode.monitorAddrList = []string{address}
+	genesisHash := spvNode.blockchainHeader.LastHash
+
+	coinbase := blockchain.CoinBaseTransaction(address, blockchain.COINBASE_REWARD)
+	payment := blockchain.Transaction{
+		Inputs:   []blockchain.TxInput{{TxID: []byte("external"), VOut: 0}},
+		Outputs:  []blockchain.TxOutput{{Value: 300, ScriptPubKey: coinbase.Outputs[0].ScriptPubKey}, {Value: 200, ScriptPubKey: coinbase.Outputs[0].ScriptPubKey}},
+		Locktime: coinbase.Locktime,
+	}
+	payment.SetHash()
+	for _, transaction := range []*blockchain.Transaction{coinbase, &payment} {
+		spvNode.utxoSet.UpdateWithNewTransaction(transaction, 0)
+		spvNode.storeWalletTransaction(transaction, genesisHash)
+	}
+
+	// Spend the 200 output, paying 150 back to the wallet
+	pending := blockchain.Transaction{
+		Inputs:  []blockchain.TxInput{{TxID: payment.Hash, VOut: 1}},
+		Outputs: []blockchain.TxOutput{{Value: 150, ScriptPubKey: coinbase.Outputs[0].ScriptPubKey}},
+	}
+	pending.SetHash()
+	spvNode.handleNewTxnMsg(serialize(pending))
+
+	getBalance := func(minConfirmations int) BalanceMessage {
+		client, server := net.Pipe()
+		go spvNode.handleGetBalanceMsg(server, serialize(GetBalanceMessage{[]string{address}, minConfirmations}))
+		resp, _ := io.ReadAll(client)
+		var balanceMsg BalanceMessage
+		genericDeserialize(resp, &balanceMsg)
+		return balanceMsg
+	}
+
+	expected := BalanceMessage{Confirmed: 300, UnconfirmedIncoming: 150, UnconfirmedOutgoing: 200, Immature: blockchain.COINBASE_REWARD}
+	if balance := getBalance(1); balance != expected {
+		t.Fatalf("Expected balance %+v, actual: %+v", expected, balance)
+	}
+	expected = BalanceMessage{UnconfirmedIncoming: 450, UnconfirmedOutgoing: 200, Immature: blockchain.COINBASE_REWARD}
+	if balance := getBalance(2); balance != expected {
+		t.Fatalf("Expected outputs with one confirmation to be unconfirmed, actual: %+v", balance)
+	}
+
+	spvNode.removePendingTransaction(&pending)
+	if balance := getBalance(1); balance.Confirmed != 500 || balance.UnconfirmedIncoming != 0 {
+		t.Fatalf("Expected a dropped pending transaction to leave the balance breakdown, actual: %+v", balance)
 	}
 }
@@ -3,16 +3,15 @@ package network
 import (
 	"EChain/blockchain"
 	"bytes"
-	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/sha256"
 	"encoding/gob"
-	"fmt"
 	"io"
 	"log"
 	"math/big"
 	"net"
+	"time"
 
+	"github.com/btcsuite/btcd/btcec"
 	"golang.org/x/crypto/ripemd160"
 )
 
@@ -23,22 +22,24 @@ func getPubkeyHashFromPubkey(pubkey []byte) []byte {
 	return hasher.Sum(nil)
 }
 
-func getECDSAPubkeyFromUncompressedPubkey(uncompressedPubKey []byte) ecdsa.PublicKey {
-	pubkeyCoordinates := uncompressedPubKey[1:] // remove the 1st byte prefix for uncompressed version
-	pubkeyLength := len(pubkeyCoordinates)
-	x := pubkeyCoordinates[:(pubkeyLength / 2)]
-	y := pubkeyCoordinates[(pubkeyLength / 2):]
-	bigIntX := new(big.Int).SetBytes(x)
-	bigIntY := new(big.Int).SetBytes(y)
-	curve := elliptic.P256()
-	ecdsaPubkey := ecdsa.PublicKey{Curve: curve, X: bigIntX, Y: bigIntY}
-	return ecdsaPubkey
+// verifySignature checks a fixed-width R || S signature against a compressed secp256k1 public key
+func verifySignature(compressedPubKey, signature, hash []byte) bool {
+	if len(compressedPubKey) != compressedPubKeyLength || len(signature) != signatureLength {
+		return false
+	}
+	pubkey, err := btcec.ParsePubKey(compressedPubKey, btcec.S256())
+	if err != nil {
+		return false
+	}
+	r := new(big.Int).SetBytes(signature[:(signatureLength / 2)])
+	s := new(big.Int).SetBytes(signature[(signatureLength / 2):])
+	return (&btcec.Signature{R: r, S: s}).Verify(hash, pubkey)
 }
 
 func sendMessageBlocking(toAddress string, msg []byte) {
 	conn, err := net.Dial(protocol, toAddress)
 	if err != nil {
-		fmt.Println("can not connect to", toAddress)
+		logWarn("can not connect to", toAddress)
 		return
 	}
 	conn.Write(msg)
@@ -47,10 +48,22 @@ func sendMessageBlocking(toAddress string, msg []byte) {
 	conn.Close()
 }
 
+// requestMessage sends msg and returns the response written back by the peer before it closed the connection
+func requestMessage(toAddress string, msg []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(protocol, toAddress, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.Write(msg)
+	conn.(*net.TCPConn).CloseWrite()
+	return io.ReadAll(conn)
+}
+
 func sendMessage(toAddress string, msg []byte) {
 	conn, err := net.Dial(protocol, toAddress)
 	if err != nil {
-		fmt.Println("can not connect to", toAddress)
+		logWarn("can not connect to", toAddress)
 		return
 	}
 	conn.Write(msg)
@@ -94,6 +107,15 @@ func isTransactionOfInterest(transaction blockchain.Transaction, bloomFilter []s
 	return false
 }
 
+func isOutputBoundToAny(output *blockchain.TxOutput, addresses []string) bool {
+	for _, address := range addresses {
+		if output.IsBoundTo(address) {
+			return true
+		}
+	}
+	return false
+}
+
 func getDoubleSHA256(data []byte) []byte {
 	firstHash := sha256.Sum256(data)
 	secondHash := sha256.Sum256(firstHash[:])
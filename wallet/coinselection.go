@@ -0,0 +1,245 @@
+package wallet
+
+import (
+	"EChain/blockchain"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	DefaultDustThreshold = 10     // satoshi, outputs below this value are not created
+	maxBnBTries          = 100000 // upper bound on the branch-and-bound search
+	pubKeyHashLength     = 20
+	txnIDLength          = 32
+)
+
+// Coin is an unspent transaction output owned by the wallet
+type Coin struct {
+	TxID    string
+	Index   int
+	Value   int
+	Address string
+}
+
+// CoinSelection is the result of selecting coins for a payment.
+// Change is zero when the leftover value was too small to be worth its own output and went to the fee instead.
+type CoinSelection struct {
+	Coins  []Coin
+	Fee    int
+	Change int
+}
+
+// SelectionParams describes the payment coins are selected for
+type SelectionParams struct {
+	Target        int // amount sent to the recipient
+	FeeRate       int // satoshi per byte of serialized transaction
+	DustThreshold int
+}
+
+type CoinSelector interface {
+	Select(coins []Coin, params SelectionParams) (*CoinSelection, error)
+}
+
+var (
+	txnSizeOnce    sync.Once
+	baseTxnSize    int // size of a transaction with one input and one output
+	txnInputSize   int // size added by each extra input
+	txnOutputSize  int // size added by each extra output
+	errInsufficent = fmt.Errorf("not enough balance")
+)
+
+func dummyTransaction(inputCount, outputCount int) *blockchain.Transaction {
+	transaction := blockchain.Transaction{Hash: make([]byte, txnIDLength), Locktime: getCurrentTimeInMilliSec()}
+	for i := 0; i < inputCount; i++ {
+		transaction.Inputs = append(transaction.Inputs, blockchain.TxInput{
+			TxID: make([]byte, txnIDLength),
+			VOut: i,
+			ScriptSig: blockchain.UnlockingScript{
+				Signature: make([]byte, signatureLength),
+				PubKey:    make([]byte, compressedPubKeyLen),
+			},
+		})
+	}
+	for i := 0; i < outputCount; i++ {
+		transaction.Outputs = append(transaction.Outputs, blockchain.TxOutput{
+			Value:        blockchain.COINBASE_REWARD,
+			ScriptPubKey: blockchain.LockingScript{PubKeyHash: make([]byte, pubKeyHashLength)},
+		})
+	}
+	return &transaction
+}
+
+// EstimateTransactionSize estimates the serialized size of a signed transaction with the given shape
+func EstimateTransactionSize(inputCount, outputCount int) int {
+	txnSizeOnce.Do(func() {
+		baseTxnSize = dummyTransaction(1, 1).Size()
+		txnInputSize = dummyTransaction(2, 1).Size() - baseTxnSize
+		txnOutputSize = dummyTransaction(1, 2).Size() - baseTxnSize
+	})
+	return baseTxnSize + (inputCount-1)*txnInputSize + (outputCount-1)*txnOutputSize
+}
+
+func estimateFee(inputCount, outputCount, feeRate int) int {
+	return EstimateTransactionSize(inputCount, outputCount) * feeRate
+}
+
+// inputCost is the fee needed to spend a single coin
+func inputCost(feeRate int) int {
+	return (EstimateTransactionSize(2, 1) - EstimateTransactionSize(1, 1)) * feeRate
+}
+
+// finalizeSelection computes fee and change of a set of coins, dropping change that would be dust
+func finalizeSelection(coins []Coin, params SelectionParams) (*CoinSelection, error) {
+	totalValue := 0
+	for _, coin := range coins {
+		totalValue += coin.Value
+	}
+
+	feeWithChange := estimateFee(len(coins), 2, params.FeeRate)
+	if change := totalValue - params.Target - feeWithChange; change >= params.DustThreshold && change > inputCost(params.FeeRate) {
+		return &CoinSelection{coins, feeWithChange, change}, nil
+	}
+	feeWithoutChange := estimateFee(len(coins), 1, params.FeeRate)
+	if totalValue >= params.Target+feeWithoutChange {
+		return &CoinSelection{coins, totalValue - params.Target, 0}, nil
+	}
+	return nil, errInsufficent
+}
+
+// accumulate takes coins in order until the payment and its fee are covered
+func accumulate(orderedCoins []Coin, params SelectionParams) (*CoinSelection, error) {
+	selectedCoins := []Coin{}
+	for _, coin := range orderedCoins {
+		if coin.Value <= inputCost(params.FeeRate) {
+			continue // spending this coin costs more than it is worth
+		}
+		selectedCoins = append(selectedCoins, coin)
+		if selection, err := finalizeSelection(selectedCoins, params); err == nil {
+			return selection, nil
+		}
+	}
+	return nil, errInsufficent
+}
+
+// LargestFirst spends the biggest coins first, minimizing the number of inputs
+type LargestFirst struct{}
+
+func (LargestFirst) Select(coins []Coin, params SelectionParams) (*CoinSelection, error) {
+	orderedCoins := slices.Clone(coins)
+	sort.SliceStable(orderedCoins, func(i, j int) bool { return orderedCoins[i].Value > orderedCoins[j].Value })
+	return accumulate(orderedCoins, params)
+}
+
+// SmallestFirst spends the smallest coins first, consolidating the wallet's UTXOs
+type SmallestFirst struct{}
+
+func (SmallestFirst) Select(coins []Coin, params SelectionParams) (*CoinSelection, error) {
+	orderedCoins := slices.Clone(coins)
+	sort.SliceStable(orderedCoins, func(i, j int) bool { return orderedCoins[i].Value < orderedCoins[j].Value })
+	return accumulate(orderedCoins, params)
+}
+
+// RandomSelection spends coins in random order, so the chosen inputs do not reveal the wallet's strategy
+type RandomSelection struct {
+	Rand *rand.Rand // optional, set for reproducible selections
+}
+
+func (selector RandomSelection) Select(coins []Coin, params SelectionParams) (*CoinSelection, error) {
+	orderedCoins := slices.Clone(coins)
+	shuffle := rand.Shuffle
+	if selector.Rand != nil {
+		shuffle = selector.Rand.Shuffle
+	}
+	shuffle(len(orderedCoins), func(i, j int) { orderedCoins[i], orderedCoins[j] = orderedCoins[j], orderedCoins[i] })
+	return accumulate(orderedCoins, params)
+}
+
+// BranchAndBound searches for a set of coins that pays the target and fee without a change output,
+// wasting at most the cost of creating and later spending change. If no such set exists, Fallback is used.
+type BranchAndBound struct {
+	Fallback CoinSelector // defaults to LargestFirst
+}
+
+func (selector BranchAndBound) Select(coins []Coin, params SelectionParams) (*CoinSelection, error) {
+	if selection := branchAndBound(coins, params); selection != nil {
+		return selection, nil
+	}
+	fallback := selector.Fallback
+	if fallback == nil {
+		fallback = LargestFirst{}
+	}
+	return fallback.Select(coins, params)
+}
+
+func branchAndBound(coins []Coin, params SelectionParams) *CoinSelection {
+	// Work with effective values: what each coin contributes after paying for its own input
+	costPerInput := inputCost(params.FeeRate)
+	candidates := []Coin{}
+	for _, coin := range coins {
+		if coin.Value > costPerInput {
+			candidates = append(candidates, coin)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Value > candidates[j].Value })
+
+	// Fee of a transaction without change that is not covered by the inputs' own costs
+	fixedFee := estimateFee(1, 1, params.FeeRate) - costPerInput
+	lowerBound := params.Target + fixedFee
+	// Creating a change output and spending it later
+	costOfChange := estimateFee(1, 2, params.FeeRate) - estimateFee(1, 1, params.FeeRate) + costPerInput
+	if costOfChange < params.DustThreshold {
+		costOfChange = params.DustThreshold
+	}
+	upperBound := lowerBound + costOfChange
+
+	remaining := 0
+	for _, coin := range candidates {
+		remaining += coin.Value - costPerInput
+	}
+
+	selected := make([]bool, len(candidates))
+	var bestSelection []bool
+	bestWaste := -1
+	tries := 0
+
+	var search func(depth, currentValue, remaining int)
+	search = func(depth, currentValue, remaining int) {
+		tries++
+		if tries > maxBnBTries || currentValue > upperBound || currentValue+remaining < lowerBound {
+			return
+		}
+		if currentValue >= lowerBound {
+			if waste := currentValue - lowerBound; bestWaste == -1 || waste < bestWaste {
+				bestWaste = waste
+				bestSelection = slices.Clone(selected)
+			}
+			return
+		}
+		if depth == len(candidates) {
+			return
+		}
+		effectiveValue := candidates[depth].Value - costPerInput
+		selected[depth] = true
+		search(depth+1, currentValue+effectiveValue, remaining-effectiveValue)
+		selected[depth] = false
+		search(depth+1, currentValue, remaining-effectiveValue)
+	}
+	search(0, 0, remaining)
+
+	if bestSelection == nil {
+		return nil
+	}
+	selectedCoins := []Coin{}
+	totalValue := 0
+	for i, isSelected := range bestSelection {
+		if isSelected {
+			selectedCoins = append(selectedCoins, candidates[i])
+			totalValue += candidates[i].Value
+		}
+	}
+	return &CoinSelection{selectedCoins, totalValue - params.Target, 0}
+}
@@ -0,0 +1,85 @@
+package wallet
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func testCoins(values ...int) []Coin {
+	coins := []Coin{}
+	for i, value := range values {
+		coins = append(coins, Coin{TxID: string(rune('a' + i)), Value: value})
+	}
+	return coins
+}
+
+func selectedValues(selection *CoinSelection) []int {
+	values := []int{}
+	for _, coin := range selection.Coins {
+		values = append(values, coin.Value)
+	}
+	return values
+}
+
+func TestCoinSelectionStrategies(t *testing.T) {
+	coins := testCoins(100, 700, 300, 50)
+	params := SelectionParams{Target: 320, DustThreshold: DefaultDustThreshold}
+
+	largest, err := LargestFirst{}.Select(coins, params)
+	if err != nil || len(largest.Coins) != 1 || largest.Coins[0].Value != 700 || largest.Change != 380 {
+		t.Fatalf("Expected largest-first to spend the 700 coin with 380 change, actual: %v", selectedValues(largest))
+	}
+
+	smallest, err := SmallestFirst{}.Select(coins, params)
+	if err != nil || len(smallest.Coins) != 3 || smallest.Change != 130 {
+		t.Fatalf("Expected smallest-first to spend 50, 100 and 300, actual: %v", selectedValues(smallest))
+	}
+
+	random, err := RandomSelection{rand.New(rand.NewSource(1))}.Select(coins, params)
+	if err != nil || random.Fee+random.Change+params.Target != sumCoins(random.Coins) {
+		t.Fatalf("Expected random selection to balance inputs and outputs")
+	}
+
+	// 300 + 50 pays 320 leaving 30, more than the dust threshold, so look for a closer match
+	exact, err := BranchAndBound{}.Select(testCoins(100, 700, 300, 25), params)
+	if err != nil || exact.Change != 0 || sumCoins(exact.Coins) != 325 {
+		t.Fatalf("Expected branch and bound to find the 300 + 25 match without change, actual: %v", selectedValues(exact))
+	}
+
+	if _, err := (LargestFirst{}).Select(coins, SelectionParams{Target: 2000}); err == nil {
+		t.Fatalf("Expected selection to fail when the balance is too low")
+	}
+}
+
+func TestFeeAwareSelection(t *testing.T) {
+	feeRate := 1
+	params := SelectionParams{Target: 5000, FeeRate: feeRate, DustThreshold: DefaultDustThreshold}
+	coins := testCoins(5000, 4000, 3000)
+
+	selection, err := LargestFirst{}.Select(coins, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selection.Coins) != 2 {
+		t.Fatalf("Expected the 5000 coin alone to be too small once fees are paid, actual: %v", selectedValues(selection))
+	}
+	expectedFee := EstimateTransactionSize(2, 2) * feeRate
+	if selection.Fee != expectedFee || selection.Change != 9000-5000-expectedFee {
+		t.Fatalf("Expected fee %d for two inputs and two outputs, actual: %d", expectedFee, selection.Fee)
+	}
+
+	// Change that would be dust goes to the fee instead
+	noChangeFee := EstimateTransactionSize(1, 1) * feeRate
+	selection, err = LargestFirst{}.Select(testCoins(5000+noChangeFee+5), params)
+	if err != nil || selection.Change != 0 || selection.Fee != noChangeFee+5 {
+		t.Fatalf("Expected dust change to be added to the fee")
+	}
+}
+
+func sumCoins(coins []Coin) int {
+	total := 0
+	for _, coin := range coins {
+		total += coin.Value
+	}
+	return total
+}
@@ -0,0 +1,212 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcutil/base58"
+)
+
+const (
+	HardenedKeyStart     = uint32(0x80000000) // child indexes from 2^31 derive hardened keys
+	extendedKeyLength    = 78                 // version(4) || depth(1) || fingerprint(4) || child(4) || chain code(32) || key(33)
+	extendedKeyChecksum  = 4
+	fingerprintLength    = 4
+	masterKeyHMACKeyword = "Bitcoin seed"
+)
+
+var (
+	xprvVersion = []byte{0x04, 0x88, 0xad, 0xe4}
+	xpubVersion = []byte{0x04, 0x88, 0xb2, 0x1e}
+)
+
+// ExtendedKey is a BIP32 extended private or public key
+type ExtendedKey struct {
+	key         []byte // 32-byte private scalar or 33-byte compressed public key
+	chainCode   []byte
+	depth       uint8
+	fingerprint []byte // fingerprint of the parent key
+	childIndex  uint32
+	isPrivate   bool
+}
+
+func NewMasterKey(seed []byte) (*ExtendedKey, error) {
+	if len(seed) < 16 || len(seed) > 64 {
+		return nil, fmt.Errorf("seed length must be between 16 and 64 bytes")
+	}
+	hasher := hmac.New(sha512.New, []byte(masterKeyHMACKeyword))
+	hasher.Write(seed)
+	digest := hasher.Sum(nil)
+
+	secretKey := new(big.Int).SetBytes(digest[:32])
+	if secretKey.Sign() == 0 || secretKey.Cmp(btcec.S256().N) >= 0 {
+		return nil, fmt.Errorf("seed derives an invalid master key")
+	}
+	return &ExtendedKey{
+		key:         digest[:32],
+		chainCode:   digest[32:],
+		fingerprint: make([]byte, fingerprintLength),
+		isPrivate:   true,
+	}, nil
+}
+
+func (extendedKey *ExtendedKey) IsPrivate() bool {
+	return extendedKey.isPrivate
+}
+
+func (extendedKey *ExtendedKey) PubKeyBytes() []byte {
+	if !extendedKey.isPrivate {
+		return extendedKey.key
+	}
+	_, pubKey := btcec.PrivKeyFromBytes(btcec.S256(), extendedKey.key)
+	return pubKey.SerializeCompressed()
+}
+
+func (extendedKey *ExtendedKey) PrivKey() (*btcec.PrivateKey, error) {
+	if !extendedKey.isPrivate {
+		return nil, fmt.Errorf("can not derive a private key from an extended public key")
+	}
+	privKey, _ := btcec.PrivKeyFromBytes(btcec.S256(), extendedKey.key)
+	return privKey, nil
+}
+
+// Child derives the child key at index following BIP32 CKDpriv / CKDpub
+func (extendedKey *ExtendedKey) Child(index uint32) (*ExtendedKey, error) {
+	isHardened := index >= HardenedKeyStart
+	if isHardened && !extendedKey.isPrivate {
+		return nil, fmt.Errorf("can not derive a hardened child from an extended public key")
+	}
+
+	var data []byte
+	if isHardened {
+		data = append([]byte{0x00}, extendedKey.key...)
+	} else {
+		data = append([]byte{}, extendedKey.PubKeyBytes()...)
+	}
+	data = binary.BigEndian.AppendUint32(data, index)
+
+	hasher := hmac.New(sha512.New, extendedKey.chainCode)
+	hasher.Write(data)
+	digest := hasher.Sum(nil)
+
+	curve := btcec.S256()
+	tweak := new(big.Int).SetBytes(digest[:32])
+	if tweak.Cmp(curve.N) >= 0 {
+		return nil, fmt.Errorf("invalid child at index %d", index)
+	}
+
+	var childKey []byte
+	if extendedKey.isPrivate {
+		childScalar := new(big.Int).Add(tweak, new(big.Int).SetBytes(extendedKey.key))
+		childScalar.Mod(childScalar, curve.N)
+		if childScalar.Sign() == 0 {
+			return nil, fmt.Errorf("invalid child at index %d", index)
+		}
+		childKey = make([]byte, 32)
+		childScalar.FillBytes(childKey)
+	} else {
+		parentPubKey, err := btcec.ParsePubKey(extendedKey.key, curve)
+		if err != nil {
+			return nil, err
+		}
+		tweakX, tweakY := curve.ScalarBaseMult(digest[:32])
+		childX, childY := curve.Add(tweakX, tweakY, parentPubKey.X, parentPubKey.Y)
+		if childX.Sign() == 0 && childY.Sign() == 0 {
+			return nil, fmt.Errorf("invalid child at index %d", index)
+		}
+		childKey = (&btcec.PublicKey{Curve: curve, X: childX, Y: childY}).SerializeCompressed()
+	}
+
+	return &ExtendedKey{
+		key:         childKey,
+		chainCode:   digest[32:],
+		depth:       extendedKey.depth + 1,
+		fingerprint: getPubkeyHashFromPubkey(extendedKey.PubKeyBytes())[:fingerprintLength],
+		childIndex:  index,
+		isPrivate:   extendedKey.isPrivate,
+	}, nil
+}
+
+// DerivePath derives the descendant key along path, a list of child indexes starting below this key
+func (extendedKey *ExtendedKey) DerivePath(path []uint32) (*ExtendedKey, error) {
+	currentKey := extendedKey
+	for _, index := range path {
+		childKey, err := currentKey.Child(index)
+		if err != nil {
+			return nil, err
+		}
+		currentKey = childKey
+	}
+	return currentKey, nil
+}
+
+// Neuter returns the extended public key corresponding to an extended private key
+func (extendedKey *ExtendedKey) Neuter() *ExtendedKey {
+	if !extendedKey.isPrivate {
+		return extendedKey
+	}
+	return &ExtendedKey{
+		key:         extendedKey.PubKeyBytes(),
+		chainCode:   extendedKey.chainCode,
+		depth:       extendedKey.depth,
+		fingerprint: extendedKey.fingerprint,
+		childIndex:  extendedKey.childIndex,
+	}
+}
+
+// String serializes the key in the base58check xprv / xpub format
+func (extendedKey *ExtendedKey) String() string {
+	serialized := make([]byte, 0, extendedKeyLength+extendedKeyChecksum)
+	if extendedKey.isPrivate {
+		serialized = append(serialized, xprvVersion...)
+	} else {
+		serialized = append(serialized, xpubVersion...)
+	}
+	serialized = append(serialized, extendedKey.depth)
+	serialized = append(serialized, extendedKey.fingerprint...)
+	serialized = binary.BigEndian.AppendUint32(serialized, extendedKey.childIndex)
+	serialized = append(serialized, extendedKey.chainCode...)
+	if extendedKey.isPrivate {
+		serialized = append(serialized, 0x00)
+	}
+	serialized = append(serialized, extendedKey.key...)
+	serialized = append(serialized, getChecksum(serialized)...)
+	return base58.Encode(serialized)
+}
+
+func ParseExtendedKey(encoded string) (*ExtendedKey, error) {
+	decoded := base58.Decode(encoded)
+	if len(decoded) != extendedKeyLength+extendedKeyChecksum {
+		return nil, fmt.Errorf("invalid extended key length")
+	}
+	payload := decoded[:extendedKeyLength]
+	if !bytes.Equal(getChecksum(payload), decoded[extendedKeyLength:]) {
+		return nil, fmt.Errorf("invalid extended key checksum")
+	}
+
+	extendedKey := &ExtendedKey{
+		depth:       payload[4],
+		fingerprint: payload[5:9],
+		childIndex:  binary.BigEndian.Uint32(payload[9:13]),
+		chainCode:   payload[13:45],
+	}
+	keyData := payload[45:]
+	switch {
+	case bytes.Equal(payload[:4], xprvVersion) && keyData[0] == 0x00:
+		extendedKey.isPrivate = true
+		extendedKey.key = keyData[1:]
+	case bytes.Equal(payload[:4], xpubVersion):
+		if _, err := btcec.ParsePubKey(keyData, btcec.S256()); err != nil {
+			return nil, err
+		}
+		extendedKey.key = keyData
+	default:
+		return nil, fmt.Errorf("unknown extended key version")
+	}
+	return extendedKey, nil
+}
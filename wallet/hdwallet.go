@@ -0,0 +1,232 @@
+package wallet
+
+import (
+	"fmt"
+
+	"github.com/tyler-smith/go-bip39"
+)
+
+const (
+	bip44Purpose        = 44
+	bip44CoinType       = 0
+	ExternalChain       = uint32(0) // receiving addresses
+	ChangeChain         = uint32(1) // change addresses
+	DefaultGapLimit     = 20        // consecutive unused addresses scanned before discovery stops (BIP44)
+	mnemonicEntropyBits = 128       // 12-word mnemonic
+)
+
+// HDSeed is the persisted state of a hierarchical deterministic wallet.
+// Every key in the wallet can be re-derived from the seed along m/44'/0'/account'/chain/index.
+type HDSeed struct {
+	Mnemonic          string
+	Seed              []byte
+	Account           uint32
+	NextExternalIndex uint32
+	NextChangeIndex   uint32
+}
+
+func NewMnemonic() (string, error) {
+	entropy, err := bip39.NewEntropy(mnemonicEntropyBits)
+	if err != nil {
+		return "", err
+	}
+	return bip39.NewMnemonic(entropy)
+}
+
+func newHDSeed(mnemonic, passphrase string, account uint32) (*HDSeed, error) {
+	seed, err := bip39.NewSeedWithErrorChecking(mnemonic, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := NewMasterKey(seed); err != nil {
+		return nil, err
+	}
+	return &HDSeed{Mnemonic: mnemonic, Seed: seed, Account: account}, nil
+}
+
+func (hdSeed *HDSeed) accountKey() (*ExtendedKey, error) {
+	masterKey, err := NewMasterKey(hdSeed.Seed)
+	if err != nil {
+		return nil, err
+	}
+	return masterKey.DerivePath([]uint32{
+		HardenedKeyStart + bip44Purpose,
+		HardenedKeyStart + bip44CoinType,
+		HardenedKeyStart + hdSeed.Account,
+	})
+}
+
+func (hdSeed *HDSeed) deriveWallet(chain, index uint32) (*Wallet, error) {
+	accountKey, err := hdSeed.accountKey()
+	if err != nil {
+		return nil, err
+	}
+	childKey, err := accountKey.DerivePath([]uint32{chain, index})
+	if err != nil {
+		return nil, err
+	}
+	privKey, err := childKey.PrivKey()
+	if err != nil {
+		return nil, err
+	}
+	wallet := newWalletFromPrivKey(privKey)
+	wallet.Path = fmt.Sprintf("m/%d'/%d'/%d'/%d/%d", bip44Purpose, bip44CoinType, hdSeed.Account, chain, index)
+	return wallet, nil
+}
+
+// CreateHDWallet generates a new mnemonic and makes it the seed of all addresses created from now on.
+// The returned mnemonic (together with passphrase) is the only backup needed to restore the wallet.
+func (wallets *Wallets) CreateHDWallet(passphrase string) (string, error) {
+	mnemonic, err := NewMnemonic()
+	if err != nil {
+		return "", err
+	}
+	hdSeed, err := newHDSeed(mnemonic, passphrase, 0)
+	if err != nil {
+		return "", err
+	}
+	wallets.mutex.Lock()
+	defer wallets.mutex.Unlock()
+	if wallets.isLocked() {
+		return "", fmt.Errorf("wallet is locked")
+	}
+	wallets.hdSeed = hdSeed
+	return mnemonic, nil
+}
+
+// IsHD reports whether addresses are derived from a seed. The seed is encrypted, so a locked wallet reports false.
+func (wallets *Wallets) IsHD() bool {
+	wallets.mutex.Lock()
+	defer wallets.mutex.Unlock()
+	return wallets.hdSeed != nil
+}
+
+// AccountExtendedPubKey returns the xpub of the BIP44 account, which can derive every address of the wallet
+// without exposing private keys.
+func (wallets *Wallets) AccountExtendedPubKey() (string, error) {
+	wallets.mutex.Lock()
+	defer wallets.mutex.Unlock()
+	if wallets.hdSeed == nil {
+		return "", fmt.Errorf("wallet is not hierarchical deterministic")
+	}
+	accountKey, err := wallets.hdSeed.accountKey()
+	if err != nil {
+		return "", err
+	}
+	return accountKey.Neuter().String(), nil
+}
+
+func (wallets *Wallets) deriveNextWallet(chain uint32) (*Wallet, error) {
+	nextIndex := &wallets.hdSeed.NextExternalIndex
+	if chain == ChangeChain {
+		nextIndex = &wallets.hdSeed.NextChangeIndex
+	}
+	newWallet, err := wallets.hdSeed.deriveWallet(chain, *nextIndex)
+	if err != nil {
+		return nil, err
+	}
+	*nextIndex++
+	wallets.addWallet(newWallet)
+	return newWallet, nil
+}
+
+// NewChangeAddress returns an unused address for receiving transaction change and writes it to the wallet file
+func (wallets *Wallets) NewChangeAddress() (string, error) {
+	wallets.mutex.Lock()
+	defer wallets.mutex.Unlock()
+	return wallets.addNewWallet(ChangeChain)
+}
+
+// RestoreHDWallet re-creates every address of a wallet from its mnemonic and writes them to the wallet file.
+// Both the receiving and the change chain are scanned until gapLimit consecutive addresses are unused;
+// each scanned address is registered with the connected SPV nodes so they keep monitoring it. An address
+// is used if the transaction history fetched from the SPV nodes shows it receiving or spending coins.
+// SPV nodes only store the transactions of addresses they were monitoring when the transactions were mined,
+// so addresses are only found used by SPV nodes that monitored the wallet before.
+func (wallets *Wallets) RestoreHDWallet(mnemonic, passphrase string, gapLimit int) error {
+	return wallets.restoreHDWallet(mnemonic, passphrase, gapLimit, wallets.usedAddresses)
+}
+
+func (wallets *Wallets) restoreHDWallet(mnemonic, passphrase string, gapLimit int, usedAddresses func([]string) (map[string]bool, error)) error {
+	if gapLimit <= 0 {
+		gapLimit = DefaultGapLimit
+	}
+	hdSeed, err := newHDSeed(mnemonic, passphrase, 0)
+	if err != nil {
+		return err
+	}
+	if wallets.IsLocked() {
+		return fmt.Errorf("wallet is locked")
+	}
+
+	// Addresses are discovered without holding the mutex, as it takes requests to the SPV nodes
+	derivedWallets := []*Wallet{}
+	for _, chain := range []uint32{ExternalChain, ChangeChain} {
+		nextIndex, chainWallets, err := wallets.discoverChain(hdSeed, chain, gapLimit, usedAddresses)
+		if err != nil {
+			return err
+		}
+		if chain == ExternalChain {
+			hdSeed.NextExternalIndex = nextIndex
+		} else {
+			hdSeed.NextChangeIndex = nextIndex
+		}
+		derivedWallets = append(derivedWallets, chainWallets...)
+	}
+
+	wallets.mutex.Lock()
+	defer wallets.mutex.Unlock()
+	if wallets.isLocked() {
+		return fmt.Errorf("wallet is locked")
+	}
+	previousSeed := wallets.hdSeed
+	newAddresses := []string{}
+	for _, derivedWallet := range derivedWallets {
+		if _, exists := wallets.wallets[derivedWallet.Address()]; !exists {
+			newAddresses = append(newAddresses, wallets.addWallet(derivedWallet))
+		}
+	}
+	wallets.hdSeed = hdSeed
+	if err := wallets.saveFile(); err != nil {
+		for _, address := range newAddresses {
+			delete(wallets.wallets, address)
+		}
+		wallets.hdSeed = previousSeed
+		return fmt.Errorf("can not save restored addresses: %w", err)
+	}
+	return nil
+}
+
+// discoverChain derives addresses of hdSeed on chain until gapLimit consecutive ones are unused, and returns
+// the index following the last used address together with every derived wallet. Addresses are checked in
+// batches reaching gapLimit past the last used address, so each batch takes a single history request.
+func (wallets *Wallets) discoverChain(hdSeed *HDSeed, chain uint32, gapLimit int, usedAddresses func([]string) (map[string]bool, error)) (uint32, []*Wallet, error) {
+	nextIndex := uint32(0)
+	derivedWallets := []*Wallet{}
+	for index := uint32(0); index < nextIndex+uint32(gapLimit); {
+		batchStart := index
+		batch := []string{}
+		for ; index < nextIndex+uint32(gapLimit); index++ {
+			derivedWallet, err := hdSeed.deriveWallet(chain, index)
+			if err != nil {
+				return 0, nil, err
+			}
+			derivedWallet.addressVersion = wallets.params.AddressVersion
+			address := derivedWallet.Address()
+			wallets.AddWalletAddrToSPVNodes(address)
+			derivedWallets = append(derivedWallets, derivedWallet)
+			batch = append(batch, address)
+		}
+
+		used, err := usedAddresses(batch)
+		if err != nil {
+			return 0, nil, err
+		}
+		for i, address := range batch {
+			if used[address] {
+				nextIndex = batchStart + uint32(i) + 1
+			}
+		}
+	}
+	return nextIndex, derivedWallets, nil
+}
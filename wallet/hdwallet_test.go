@@ -0,0 +1,119 @@
+package wallet
+
+import (
+	"EChain/blockchain"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+)
+
+const testMnemonic = "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about"
+
+func TestExtendedKeyDerivation(t *testing.T) {
+	// BIP32 test vector 1
+	seed, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	masterKey, err := NewMasterKey(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedMaster := "xprv9s21ZrQH143K3QTDL4LXw2F7HEK3wJUD2nW2nRk4stbPy6cq3jPPqjiChkVvvNKmPGJxWUtg6LnF5kejMRNNU3TGtRBeJgk33yuGBxrMPHi"
+	if masterKey.String() != expectedMaster {
+		t.Fatalf("Expected master key %s, actual: %s", expectedMaster, masterKey.String())
+	}
+
+	childKey, _ := masterKey.Child(HardenedKeyStart)
+	expectedChild := "xprv9uHRZZhk6KAJC1avXpDAp4MDc3sQKNxDiPvvkX8Br5ngLNv1TxvUxt4cV1rGL5hj6KCesnDYUhd7oWgT11eZG7XnxHrnYeSvkzY7d2bhkJ7"
+	if childKey.String() != expectedChild {
+		t.Fatalf("Expected m/0H key %s, actual: %s", expectedChild, childKey.String())
+	}
+
+	// Public derivation of a non-hardened child matches the public key of the private derivation
+	privChild, _ := childKey.Child(1)
+	pubChild, _ := childKey.Neuter().Child(1)
+	if privChild.Neuter().String() != pubChild.String() {
+		t.Fatalf("Expected public and private derivation to agree")
+	}
+
+	parsedKey, err := ParseExtendedKey(expectedChild)
+	if err != nil || parsedKey.String() != expectedChild {
+		t.Fatalf("Expected extended key to survive a string round trip")
+	}
+}
+
+func TestHDWalletAddresses(t *testing.T) {
+	wallets := NewWallets(&blockchain.MainNetParams)
+	wallets.filePath = filepath.Join(t.TempDir(), "wallets.json")
+	hdSeed, err := newHDSeed(testMnemonic, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallets.hdSeed = hdSeed
+
+	expectedAddress := "1LqBGSKuX5yYUonjxT5qGfpUsXKYYWeabA" // m/44'/0'/0'/0/0
+	if address, _ := wallets.AddNewWallet(); address != expectedAddress {
+		t.Fatalf("Expected first address %s, actual: %s", expectedAddress, address)
+	}
+	if wallets.GetWallet(expectedAddress).Path != "m/44'/0'/0'/0/0" {
+		t.Fatalf("Expected derivation path to be recorded")
+	}
+	if _, err := newHDSeed("abandon abandon abandon", "", 0); err == nil {
+		t.Fatalf("Expected invalid mnemonic to be rejected")
+	}
+}
+
+func TestRestoreHDWallet(t *testing.T) {
+	original := NewWallets(&blockchain.MainNetParams)
+	original.filePath = filepath.Join(t.TempDir(), "wallets.json")
+	mnemonic, err := original.CreateHDWallet("passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	usedAddresses := map[string]bool{}
+	for i := 0; i < 5; i++ {
+		address, _ := original.AddNewWallet()
+		if i == 0 || i == 3 {
+			usedAddresses[address] = true
+		}
+	}
+	changeAddress, _ := original.NewChangeAddress()
+	usedAddresses[changeAddress] = true
+
+	restored := NewWallets(&blockchain.MainNetParams)
+	restored.filePath = filepath.Join(t.TempDir(), "wallets.json")
+	gapLimit := 3
+	requests := 0
+	fetchHistory := func(addresses []string) (map[string]bool, error) {
+		requests++
+		restored.GetAddresses() // the wallet stays usable while the history is fetched
+		used := make(map[string]bool)
+		for _, address := range addresses {
+			used[address] = usedAddresses[address]
+		}
+		return used, nil
+	}
+	if err := restored.restoreHDWallet(mnemonic, "passphrase", gapLimit, fetchHistory); err != nil {
+		t.Fatal(err)
+	}
+	// Receiving addresses 0-2, 3 and 4-6 and change addresses 0-2 and 3 are checked in one request per batch
+	if requests != 5 {
+		t.Fatalf("Expected 5 history requests, actual: %d", requests)
+	}
+	if restored.hdSeed.NextExternalIndex != 4 || restored.hdSeed.NextChangeIndex != 1 {
+		t.Fatalf("Expected next indexes 4 and 1, actual: %d and %d", restored.hdSeed.NextExternalIndex, restored.hdSeed.NextChangeIndex)
+	}
+	for address := range usedAddresses {
+		if _, exists := restored.wallets[address]; !exists {
+			t.Fatalf("Expected used address %s to be restored", address)
+		}
+	}
+	saved, err := LoadWallets(restored.filePath, &blockchain.MainNetParams)
+	if err != nil || saved.hdSeed == nil || len(saved.wallets) != len(restored.wallets) {
+		t.Fatalf("Expected the restored wallet to be written to its file (%v)", err)
+	}
+
+	unsaved := NewWallets(&blockchain.MainNetParams)
+	unsaved.filePath = filepath.Join(t.TempDir(), "missing", "wallets.json")
+	if err := unsaved.restoreHDWallet(mnemonic, "passphrase", gapLimit, fetchHistory); err == nil || unsaved.hdSeed != nil || len(unsaved.wallets) != 0 {
+		t.Fatalf("Expected the restore to be undone if the wallet file can not be written (%v)", err)
+	}
+}
@@ -0,0 +1,446 @@
+package wallet
+
+import (
+	"EChain/blockchain"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	keystoreVersion  = 2
+	walletFileMode   = 0600
+	encryptionKeyLen = 32 // AES-256
+	saltLength       = 16
+	defaultScryptN   = 1 << 15
+	defaultScryptR   = 8
+	defaultScryptP   = 1
+	NoUnlockTimeout  = time.Duration(0) // keep the wallet unlocked until Lock is called
+)
+
+// unauthenticatedKeystoreVersion files did not authenticate their public keys and KDF parameters with the ciphertext
+const unauthenticatedKeystoreVersion = 1
+
+// scryptParams are stored next to the ciphertext so the cost can be raised for new wallets
+// without breaking existing files
+type scryptParams struct {
+	N, R, P int
+	Salt    []byte
+}
+
+type publicWalletJSON struct {
+	PublickKey []byte
+	Path       string `json:",omitempty"`
+}
+
+// encryptedWalletsFile is the layout of an encrypted wallets.json.
+// Ciphertext is the AES-GCM encryption of a walletsFile; public keys are kept in clear
+// so a locked wallet can still list its addresses and query balances.
+type encryptedWalletsFile struct {
+	Version    int
+	KDF        scryptParams
+	Nonce      []byte
+	Ciphertext []byte
+	PublicKeys map[string]publicWalletJSON
+}
+
+// additionalData returns the clear parts of the file that the ciphertext authenticates, so editing the
+// public keys or the KDF parameters makes Unlock fail
+func (keystore *encryptedWalletsFile) additionalData() ([]byte, error) {
+	if keystore.Version == unauthenticatedKeystoreVersion {
+		return nil, nil
+	}
+	return json.Marshal(struct {
+		Version    int
+		KDF        scryptParams
+		PublicKeys map[string]publicWalletJSON
+	}{keystore.Version, keystore.KDF, keystore.PublicKeys})
+}
+
+func deriveEncryptionKey(passphrase string, params scryptParams) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), params.Salt, params.N, params.R, params.P, encryptionKeyLen)
+}
+
+func newScryptParams() (scryptParams, error) {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return scryptParams{}, err
+	}
+	return scryptParams{defaultScryptN, defaultScryptR, defaultScryptP, salt}, nil
+}
+
+func encryptData(key, plaintext, additionalData []byte) ([]byte, []byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, gcm.Seal(nil, nonce, plaintext, additionalData), nil
+}
+
+func decryptData(key, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("incorrect passphrase or modified wallet file")
+	}
+	return plaintext, nil
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory and renames it over path,
+// so a crash never leaves a truncated wallet file behind
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath)
+
+	if err := tmpFile.Chmod(perm); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// LoadWallets reads the wallet file at filePath. A missing file yields an empty, unencrypted wallet
+// that is written to filePath on the first SaveFile. Encrypted wallets are returned locked.
+func LoadWallets(filePath string, params *blockchain.ChainParams) (*Wallets, error) {
+	loadedWallets := NewWallets(params)
+	loadedWallets.filePath = filePath
+	history, err := loadTxStore(filePath + txHistorySuffix)
+	if err != nil {
+		return nil, err
+	}
+	loadedWallets.history = history
+
+	jsonStr, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return &loadedWallets, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fileInfo, err := os.Stat(filePath); err == nil && fileInfo.Mode().Perm()&0077 != 0 {
+		if err := os.Chmod(filePath, walletFileMode); err != nil {
+			return nil, err
+		}
+	}
+
+	var encryptedFile encryptedWalletsFile
+	if err := json.Unmarshal(jsonStr, &encryptedFile); err == nil && encryptedFile.Ciphertext != nil {
+		if encryptedFile.Version != keystoreVersion && encryptedFile.Version != unauthenticatedKeystoreVersion {
+			return nil, fmt.Errorf("unsupported wallet file version %d", encryptedFile.Version)
+		}
+		loadedWallets.keystore = &encryptedFile
+		loadedWallets.setPublicWallets(encryptedFile.PublicKeys)
+		return &loadedWallets, nil
+	}
+
+	fmt.Fprintln(os.Stderr, "Wallet file", filePath, "is not encrypted, use EncryptWallet to protect the private keys")
+	migrated, err := loadedWallets.loadPlaintext(jsonStr)
+	if err != nil {
+		return nil, err
+	}
+	if migrated {
+		backupPath := filePath + legacyBackupSuffix
+		if err := writeFileAtomic(backupPath, jsonStr, walletFileMode); err != nil {
+			return nil, err
+		}
+		if err := loadedWallets.SaveFile(); err != nil {
+			return nil, err
+		}
+	}
+	return &loadedWallets, nil
+}
+
+// loadPlaintext fills the wallet from a decrypted wallet file and reports whether legacy keys were migrated
+func (wallets *Wallets) loadPlaintext(jsonStr []byte) (bool, error) {
+	var storedFile walletsFile
+	if err := json.Unmarshal(jsonStr, &storedFile); err != nil {
+		return false, err
+	}
+	storedWallets := storedFile.Wallets
+	if storedWallets == nil {
+		// Files written before HD support are a plain address -> wallet map
+		if err := json.Unmarshal(jsonStr, &storedWallets); err != nil {
+			return false, err
+		}
+	}
+
+	// Entries migrated from P-256 keys get new addresses, so re-key the map by the derived address
+	loadedWallets := make(map[string]Wallet)
+	migrated := false
+	for _, wallet := range storedWallets {
+		wallet.addressVersion = wallets.params.AddressVersion
+		if wallet.legacyAddress != "" {
+			fmt.Println("Migrated legacy wallet", wallet.legacyAddress, "to secp256k1 address", wallet.Address())
+			migrated = true
+		}
+		loadedWallets[wallet.Address()] = wallet
+	}
+	wallets.wallets = loadedWallets
+	wallets.hdSeed = storedFile.HDSeed
+	return migrated, nil
+}
+
+func (wallets *Wallets) setPublicWallets(publicKeys map[string]publicWalletJSON) {
+	wallets.wallets = make(map[string]Wallet)
+	for address, publicWallet := range publicKeys {
+		wallets.wallets[address] = Wallet{PublickKey: publicWallet.PublickKey, Path: publicWallet.Path, addressVersion: wallets.params.AddressVersion}
+	}
+}
+
+func (wallets *Wallets) publicKeys() map[string]publicWalletJSON {
+	publicKeys := make(map[string]publicWalletJSON)
+	for address, wallet := range wallets.wallets {
+		publicKeys[address] = publicWalletJSON{wallet.PublickKey, wallet.Path}
+	}
+	return publicKeys
+}
+
+// SaveFile writes the wallet to its file. Encrypted wallets must be unlocked to be saved.
+func (wallets *Wallets) SaveFile() error {
+	wallets.mutex.Lock()
+	defer wallets.mutex.Unlock()
+	return wallets.saveFile()
+}
+
+func (wallets *Wallets) saveFile() error {
+	plaintext, err := json.Marshal(walletsFile{wallets.hdSeed, wallets.wallets})
+	if err != nil {
+		return err
+	}
+	if wallets.keystore == nil {
+		return writeFileAtomic(wallets.filePath, plaintext, walletFileMode)
+	}
+	if wallets.encryptionKey == nil {
+		return fmt.Errorf("wallet is locked")
+	}
+
+	wallets.keystore.Version = keystoreVersion
+	wallets.keystore.PublicKeys = wallets.publicKeys()
+	additionalData, err := wallets.keystore.additionalData()
+	if err != nil {
+		return err
+	}
+	nonce, ciphertext, err := encryptData(wallets.encryptionKey, plaintext, additionalData)
+	if err != nil {
+		return err
+	}
+	wallets.keystore.Nonce = nonce
+	wallets.keystore.Ciphertext = ciphertext
+	encryptedJSON, err := json.Marshal(wallets.keystore)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(wallets.filePath, encryptedJSON, walletFileMode)
+}
+
+func (wallets *Wallets) IsEncrypted() bool {
+	wallets.mutex.Lock()
+	defer wallets.mutex.Unlock()
+	return wallets.keystore != nil
+}
+
+func (wallets *Wallets) IsLocked() bool {
+	wallets.mutex.Lock()
+	defer wallets.mutex.Unlock()
+	return wallets.isLocked()
+}
+
+func (wallets *Wallets) isLocked() bool {
+	return wallets.keystore != nil && wallets.encryptionKey == nil
+}
+
+// EncryptWallet encrypts an unencrypted wallet with passphrase, writes it and leaves it locked
+func (wallets *Wallets) EncryptWallet(passphrase string) error {
+	wallets.mutex.Lock()
+	defer wallets.mutex.Unlock()
+
+	if wallets.keystore != nil {
+		return fmt.Errorf("wallet is already encrypted")
+	}
+	if passphrase == "" {
+		return fmt.Errorf("passphrase must not be empty")
+	}
+	params, err := newScryptParams()
+	if err != nil {
+		return err
+	}
+	encryptionKey, err := deriveEncryptionKey(passphrase, params)
+	if err != nil {
+		return err
+	}
+
+	wallets.keystore = &encryptedWalletsFile{Version: keystoreVersion, KDF: params}
+	wallets.encryptionKey = encryptionKey
+	if err := wallets.saveFile(); err != nil {
+		wallets.keystore = nil
+		wallets.encryptionKey = nil
+		return err
+	}
+	wallets.lock()
+	return nil
+}
+
+// Unlock decrypts the private keys with passphrase. After timeout the wallet locks itself again,
+// pass NoUnlockTimeout to keep it unlocked until Lock is called.
+func (wallets *Wallets) Unlock(passphrase string, timeout time.Duration) error {
+	wallets.mutex.Lock()
+	defer wallets.mutex.Unlock()
+
+	if wallets.keystore == nil {
+		return fmt.Errorf("wallet is not encrypted")
+	}
+	encryptionKey, err := deriveEncryptionKey(passphrase, wallets.keystore.KDF)
+	if err != nil {
+		return err
+	}
+	additionalData, err := wallets.keystore.additionalData()
+	if err != nil {
+		return err
+	}
+	plaintext, err := decryptData(encryptionKey, wallets.keystore.Nonce, wallets.keystore.Ciphertext, additionalData)
+	if err != nil {
+		return err
+	}
+	if _, err := wallets.loadPlaintext(plaintext); err != nil {
+		return err
+	}
+	// Version 1 files are only protected by this check until they are saved again
+	if !reflect.DeepEqual(wallets.publicKeys(), wallets.keystore.PublicKeys) {
+		wallets.lock()
+		return fmt.Errorf("public keys of the wallet file do not match its private keys")
+	}
+	wallets.encryptionKey = encryptionKey
+
+	if wallets.lockTimer != nil {
+		wallets.lockTimer.Stop()
+		wallets.lockTimer = nil
+	}
+	if timeout > 0 {
+		wallets.lockTimer = time.AfterFunc(timeout, wallets.Lock)
+	}
+	return nil
+}
+
+// Lock wipes the decrypted private keys from memory. Addresses and public keys stay available.
+func (wallets *Wallets) Lock() {
+	wallets.mutex.Lock()
+	defer wallets.mutex.Unlock()
+	wallets.lock()
+}
+
+func (wallets *Wallets) lock() {
+	if wallets.keystore == nil {
+		return
+	}
+	if wallets.lockTimer != nil {
+		wallets.lockTimer.Stop()
+		wallets.lockTimer = nil
+	}
+	for _, wallet := range wallets.wallets {
+		if wallet.PrivateKey.D != nil {
+			wallet.PrivateKey.D.SetInt64(0)
+		}
+	}
+	if wallets.hdSeed != nil {
+		zeroBytes(wallets.hdSeed.Seed)
+		wallets.hdSeed = nil
+	}
+	zeroBytes(wallets.encryptionKey)
+	wallets.encryptionKey = nil
+	wallets.setPublicWallets(wallets.keystore.PublicKeys)
+}
+
+// ChangePassphrase re-encrypts the wallet under a new passphrase and a fresh salt
+func (wallets *Wallets) ChangePassphrase(oldPassphrase, newPassphrase string) error {
+	if newPassphrase == "" {
+		return fmt.Errorf("passphrase must not be empty")
+	}
+	wasLocked := wallets.IsLocked()
+	if err := wallets.Unlock(oldPassphrase, NoUnlockTimeout); err != nil {
+		return err
+	}
+
+	wallets.mutex.Lock()
+	defer wallets.mutex.Unlock()
+	params, err := newScryptParams()
+	if err != nil {
+		return err
+	}
+	encryptionKey, err := deriveEncryptionKey(newPassphrase, params)
+	if err != nil {
+		return err
+	}
+	previousParams, previousKey := wallets.keystore.KDF, wallets.encryptionKey
+	wallets.keystore.KDF = params
+	wallets.encryptionKey = encryptionKey
+	if err := wallets.saveFile(); err != nil {
+		wallets.keystore.KDF = previousParams
+		wallets.encryptionKey = previousKey
+		return err
+	}
+	if wasLocked {
+		wallets.lock()
+	}
+	return nil
+}
+
+// signingWallet returns a copy of the wallet for address that stays usable even if the wallet is locked meanwhile
+func (wallets *Wallets) signingWallet(address string) (*Wallet, error) {
+	wallets.mutex.Lock()
+	defer wallets.mutex.Unlock()
+
+	if wallets.isLocked() {
+		return nil, fmt.Errorf("wallet is locked")
+	}
+	wallet, existed := wallets.wallets[address]
+	if !existed {
+		return nil, fmt.Errorf("wallet does not contain keys for address %s", address)
+	}
+	wallet.PrivateKey.D = new(big.Int).Set(wallet.PrivateKey.D)
+	return &wallet, nil
+}
+
+func zeroBytes(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+}
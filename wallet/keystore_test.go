@@ -0,0 +1,118 @@
+package wallet
+
+import (
+	"EChain/blockchain"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEncryptedWalletFile(t *testing.T) {
+	walletFile := filepath.Join(t.TempDir(), "wallets.json")
+	wallets, err := LoadWallets(walletFile, &blockchain.MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, _ := wallets.AddNewWallet()
+	privKey := new(big.Int).Set(wallets.GetWallet(address).PrivateKey.D)
+
+	if err := wallets.EncryptWallet("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if fileInfo, _ := os.Stat(walletFile); fileInfo.Mode().Perm() != walletFileMode {
+		t.Fatalf("Expected wallet file permissions %o, actual: %o", walletFileMode, fileInfo.Mode().Perm())
+	}
+
+	loaded, err := LoadWallets(walletFile, &blockchain.MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.IsLocked() || len(loaded.GetAddresses()) != 1 {
+		t.Fatalf("Expected loaded wallet to be locked and to still list its address")
+	}
+	if _, err := loaded.AddNewWallet(); err == nil {
+		t.Fatalf("Expected a locked wallet to refuse creating keys")
+	}
+	if err := loaded.Unlock("wrong passphrase", NoUnlockTimeout); err == nil {
+		t.Fatalf("Expected unlocking with a wrong passphrase to fail")
+	}
+	if err := loaded.Unlock("correct horse", NoUnlockTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.GetWallet(address).PrivateKey.D.Cmp(privKey) != 0 {
+		t.Fatalf("Expected unlocked private key to match the original key")
+	}
+
+	// Keys created while unlocked are written right away and survive locking
+	newAddress, err := loaded.AddNewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPrivKey := new(big.Int).Set(loaded.GetWallet(newAddress).PrivateKey.D)
+	loaded.Lock()
+	if err := loaded.Unlock("correct horse", NoUnlockTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.GetWallet(newAddress).PrivateKey.D == nil || loaded.GetWallet(newAddress).PrivateKey.D.Cmp(newPrivKey) != 0 {
+		t.Fatalf("Expected the key created before Lock to be kept")
+	}
+
+	if err := loaded.ChangePassphrase("correct horse", "battery staple"); err != nil {
+		t.Fatal(err)
+	}
+	loaded.Lock()
+	if err := loaded.Unlock("correct horse", NoUnlockTimeout); err == nil {
+		t.Fatalf("Expected old passphrase to stop working")
+	}
+	if err := loaded.Unlock("battery staple", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if !loaded.IsLocked() {
+		t.Fatalf("Expected wallet to lock itself after the unlock timeout")
+	}
+}
+
+func TestModifiedWalletFile(t *testing.T) {
+	walletFile := filepath.Join(t.TempDir(), "wallets.json")
+	wallets, _ := LoadWallets(walletFile, &blockchain.MainNetParams)
+	address, _ := wallets.AddNewWallet()
+	otherWallet := createWallet()
+	if err := wallets.EncryptWallet("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	original, _ := os.ReadFile(walletFile)
+
+	// The address is pointed at a key the wallet does not own
+	writeModified := func(version int, encryptWithoutAD bool) {
+		var keystore encryptedWalletsFile
+		json.Unmarshal(original, &keystore)
+		keystore.Version = version
+		if encryptWithoutAD {
+			plaintext, _ := json.Marshal(walletsFile{wallets.hdSeed, wallets.wallets})
+			keystore.Nonce, keystore.Ciphertext, _ = encryptData(wallets.encryptionKey, plaintext, nil)
+		}
+		keystore.PublicKeys[address] = publicWalletJSON{PublickKey: otherWallet.PublickKey}
+		modified, _ := json.Marshal(keystore)
+		os.WriteFile(walletFile, modified, walletFileMode)
+	}
+
+	writeModified(keystoreVersion, false)
+	loaded, _ := LoadWallets(walletFile, &blockchain.MainNetParams)
+	if err := loaded.Unlock("correct horse", NoUnlockTimeout); err == nil || !loaded.IsLocked() {
+		t.Fatalf("Expected modified public keys to make unlocking fail")
+	}
+
+	// Version 1 files have their public keys checked against the decrypted keys
+	if err := wallets.Unlock("correct horse", NoUnlockTimeout); err != nil {
+		t.Fatal(err)
+	}
+	writeModified(unauthenticatedKeystoreVersion, true)
+	loaded, _ = LoadWallets(walletFile, &blockchain.MainNetParams)
+	if err := loaded.Unlock("correct horse", NoUnlockTimeout); err == nil || !loaded.IsLocked() {
+		t.Fatalf("Expected public keys not matching the private keys to make unlocking fail")
+	}
+}
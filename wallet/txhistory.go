@@ -0,0 +1,310 @@
+package wallet
+
+import (
+	"EChain/blockchain"
+	"EChain/network"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	txHistorySuffix = ".txns" // the history is stored next to the wallet file
+	TxSent          = "send"
+	TxReceived      = "receive"
+	TxSelf          = "self" // every output of the transaction pays the wallet itself
+	unconfirmed     = -1
+)
+
+// WalletTransaction is a transaction as seen from the wallet
+type WalletTransaction struct {
+	TxID          string `json:"txid"`        // hex encoded transaction hash
+	Direction     string `json:"direction"`   // TxSent, TxReceived or TxSelf
+	Amount        int    `json:"amount"`      // value paid to others for sent transactions, received by the wallet otherwise
+	Fee           int    `json:"fee"`         // fee paid by the wallet, 0 for received transactions
+	BlockHash     string `json:"blockhash"`   // empty while unconfirmed
+	BlockHeight   int    `json:"blockheight"` // -1 while unconfirmed
+	Confirmations int    `json:"confirmations"`
+	Time          int64  `json:"time"` // creation time in milliseconds
+}
+
+// txRecord is a transaction touching the wallet as kept in the history file
+type txRecord struct {
+	Transaction blockchain.Transaction
+	BlockHash   []byte
+	BlockHeight int
+	Fee         int // fee known when the wallet created the transaction, used if input values are unknown
+}
+
+type txHistoryFile struct {
+	TipHeight    int
+	Transactions map[string]*txRecord
+}
+
+// txStore persists the transactions of a wallet together with the chain height they were last synced at
+type txStore struct {
+	mutex        sync.Mutex
+	filePath     string
+	tipHeight    int
+	transactions map[string]*txRecord
+}
+
+func newTxStore(filePath string) *txStore {
+	return &txStore{filePath: filePath, tipHeight: unconfirmed, transactions: make(map[string]*txRecord)}
+}
+
+func loadTxStore(filePath string) (*txStore, error) {
+	store := newTxStore(filePath)
+	jsonStr, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var historyFile txHistoryFile
+	if err := json.Unmarshal(jsonStr, &historyFile); err != nil {
+		return nil, fmt.Errorf("can not read transaction history %s: %w", filePath, err)
+	}
+	store.tipHeight = historyFile.TipHeight
+	if historyFile.Transactions != nil {
+		store.transactions = historyFile.Transactions
+	}
+	return store, nil
+}
+
+// save must be called with the mutex held
+func (store *txStore) save() error {
+	jsonStr, err := json.Marshal(txHistoryFile{store.tipHeight, store.transactions})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(store.filePath, jsonStr, walletFileMode)
+}
+
+// addUnconfirmed records a transaction created by the wallet before it is mined
+func (store *txStore) addUnconfirmed(transaction blockchain.Transaction, fee int) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	txID := hex.EncodeToString(transaction.Hash)
+	if _, exists := store.transactions[txID]; !exists {
+		store.transactions[txID] = &txRecord{Transaction: transaction, BlockHeight: unconfirmed, Fee: fee}
+	}
+	return store.save()
+}
+
+// update records mined transactions and the current chain height
+func (store *txStore) update(confirmedTxns []network.ConfirmedTransaction, tipHeight int) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.tipHeight = tipHeight
+	for _, confirmedTxn := range confirmedTxns {
+		txID := hex.EncodeToString(confirmedTxn.Transaction.Hash)
+		record, exists := store.transactions[txID]
+		if !exists {
+			record = &txRecord{Transaction: confirmedTxn.Transaction}
+			store.transactions[txID] = record
+		}
+		record.BlockHash = confirmedTxn.BlockHash
+		record.BlockHeight = confirmedTxn.BlockHeight
+	}
+	return store.save()
+}
+
+// walletTransaction summarizes a record from the point of view of the wallet owning addresses.
+// Must be called with the mutex held.
+func (store *txStore) walletTransaction(txID string, record *txRecord, addresses []string) WalletTransaction {
+	isOwned := func(matches func(address string) bool) bool {
+		for _, address := range addresses {
+			if matches(address) {
+				return true
+			}
+		}
+		return false
+	}
+
+	ownInputValue, ownInputCount, knownInputCount := 0, 0, 0
+	for _, input := range record.Transaction.Inputs {
+		if !isOwned(input.IsSignedBy) {
+			continue
+		}
+		ownInputCount++
+		if prevRecord, exists := store.transactions[hex.EncodeToString(input.TxID)]; exists && input.VOut < len(prevRecord.Transaction.Outputs) {
+			ownInputValue += prevRecord.Transaction.Outputs[input.VOut].Value
+			knownInputCount++
+		}
+	}
+	receivedValue, paidValue := 0, 0
+	for _, output := range record.Transaction.Outputs {
+		if isOwned(output.IsBoundTo) {
+			receivedValue += output.Value
+		} else {
+			paidValue += output.Value
+		}
+	}
+
+	walletTxn := WalletTransaction{
+		TxID:        txID,
+		BlockHeight: record.BlockHeight,
+		Time:        record.Transaction.Locktime,
+	}
+	switch {
+	case ownInputCount == 0:
+		walletTxn.Direction = TxReceived
+		walletTxn.Amount = receivedValue
+	case paidValue == 0:
+		walletTxn.Direction = TxSelf
+		walletTxn.Amount = receivedValue
+	default:
+		walletTxn.Direction = TxSent
+		walletTxn.Amount = paidValue
+	}
+	if ownInputCount > 0 {
+		walletTxn.Fee = record.Fee
+		if knownInputCount == ownInputCount && ownInputCount == len(record.Transaction.Inputs) {
+			walletTxn.Fee = ownInputValue - receivedValue - paidValue
+		}
+	}
+	if record.BlockHeight != unconfirmed {
+		walletTxn.BlockHash = hex.EncodeToString(record.BlockHash)
+		walletTxn.Confirmations = store.tipHeight - record.BlockHeight + 1
+	}
+	return walletTxn
+}
+
+// usedAddresses returns the addresses paid or spending coins in a recorded transaction
+func (store *txStore) usedAddresses(addresses []string) map[string]bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	used := make(map[string]bool)
+	for _, record := range store.transactions {
+		for _, address := range addresses {
+			for _, input := range record.Transaction.Inputs {
+				if input.IsSignedBy(address) {
+					used[address] = true
+				}
+			}
+			for _, output := range record.Transaction.Outputs {
+				if output.IsBoundTo(address) {
+					used[address] = true
+				}
+			}
+		}
+	}
+	return used
+}
+
+// list returns the wallet transactions, most recent first
+func (store *txStore) list(addresses []string) []WalletTransaction {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	walletTxns := []WalletTransaction{}
+	for txID, record := range store.transactions {
+		walletTxns = append(walletTxns, store.walletTransaction(txID, record, addresses))
+	}
+	sort.Slice(walletTxns, func(i, j int) bool {
+		if walletTxns[i].Confirmations != walletTxns[j].Confirmations {
+			return walletTxns[i].Confirmations < walletTxns[j].Confirmations
+		}
+		if walletTxns[i].Time != walletTxns[j].Time {
+			return walletTxns[i].Time > walletTxns[j].Time
+		}
+		return walletTxns[i].TxID < walletTxns[j].TxID
+	})
+	return walletTxns
+}
+
+func (store *txStore) get(txID string, addresses []string) (WalletTransaction, bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	record, exists := store.transactions[txID]
+	if !exists {
+		return WalletTransaction{}, false
+	}
+	return store.walletTransaction(txID, record, addresses), true
+}
+
+// ListTransactions returns up to count transactions of the wallet, most recent first, after skipping skip of them.
+// A count of 0 or less returns all remaining transactions.
+func (wallets *Wallets) ListTransactions(count, skip int) []WalletTransaction {
+	walletTxns := wallets.history.list(wallets.GetAddresses())
+	if skip >= len(walletTxns) {
+		return []WalletTransaction{}
+	}
+	if skip > 0 {
+		walletTxns = walletTxns[skip:]
+	}
+	if count > 0 && count < len(walletTxns) {
+		walletTxns = walletTxns[:count]
+	}
+	return walletTxns
+}
+
+// GetTransaction looks up a wallet transaction by its hex encoded hash
+func (wallets *Wallets) GetTransaction(txID string) (WalletTransaction, error) {
+	walletTxn, exists := wallets.history.get(txID, wallets.GetAddresses())
+	if !exists {
+		return WalletTransaction{}, fmt.Errorf("transaction %s not found in wallet", txID)
+	}
+	return walletTxn, nil
+}
+
+// SyncTransactions fetches the mined transactions of the wallet's addresses from the connected SPV nodes,
+// updating block heights and confirmation counts of the history
+func (wallets *Wallets) SyncTransactions() error {
+	txnsMsg, err := wallets.fetchTransactions(wallets.GetAddresses())
+	if err != nil {
+		return err
+	}
+	return wallets.history.update(txnsMsg.Transactions, txnsMsg.TipHeight)
+}
+
+// usedAddresses syncs the history of addresses with a single request and returns those the history shows
+// receiving or spending coins
+func (wallets *Wallets) usedAddresses(addresses []string) (map[string]bool, error) {
+	txnsMsg, err := wallets.fetchTransactions(addresses)
+	if err != nil {
+		return nil, err
+	}
+	if err := wallets.history.update(txnsMsg.Transactions, txnsMsg.TipHeight); err != nil {
+		return nil, err
+	}
+	return wallets.history.usedAddresses(addresses), nil
+}
+
+// fetchTransactions asks the connected SPV nodes for the mined transactions of addresses
+func (wallets *Wallets) fetchTransactions(addresses []string) (network.TxnsMessage, error) {
+	getTxnsMsg := network.GetTxnsMessage{Addresses: addresses}
+	sentData := append(msgTypeToBytes(network.GETTXNS_MSG), serialize(getTxnsMsg)...)
+
+	lastErr := fmt.Errorf("can not sync transactions: no SPV node connected")
+	for _, connectedNode := range wallets.connectedNodes {
+		if connectedNode.NodeType != network.SPV {
+			continue
+		}
+		conn, err := net.DialTimeout(protocol, connectedNode.Address, time.Second)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		conn.Write(sentData)
+		conn.(*net.TCPConn).CloseWrite()
+		resp, err := io.ReadAll(conn)
+		conn.Close()
+		if err != nil || len(resp) == 0 {
+			lastErr = fmt.Errorf("can not sync transactions from %s", connectedNode.Address)
+			continue
+		}
+
+		var txnsMsg network.TxnsMessage
+		genericDeserialize(resp, &txnsMsg)
+		return txnsMsg, nil
+	}
+	return network.TxnsMessage{}, lastErr
+}
@@ -0,0 +1,66 @@
+package wallet
+
+import (
+	"EChain/blockchain"
+	"EChain/network"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+)
+
+func TestTransactionHistory(t *testing.T) {
+	historyPath := filepath.Join(t.TempDir(), "wallets.json"+txHistorySuffix)
+	store := newTxStore(historyPath)
+	ownWallet := createWallet()
+	changeWallet := createWallet()
+	addresses := []string{ownWallet.Address(), changeWallet.Address()}
+	otherAddress := createWallet().Address()
+
+	coinbase := blockchain.CoinBaseTransaction(ownWallet.Address(), blockchain.COINBASE_REWARD)
+	payment := blockchain.Transaction{
+		Inputs: []blockchain.TxInput{createTxnInput(coinbase.Hash, 0, ownWallet.PublickKey)},
+		Outputs: []blockchain.TxOutput{
+			createTxnOutput(300, otherAddress),
+			createTxnOutput(blockchain.COINBASE_REWARD-350, changeWallet.Address()),
+		},
+		Locktime: coinbase.Locktime + 1,
+	}
+	payment.SetHash()
+	if err := store.addUnconfirmed(payment, 40); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.update([]network.ConfirmedTransaction{{Transaction: *coinbase, BlockHash: []byte{1}, BlockHeight: 2}}, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadTxStore(historyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	walletTxns := loaded.list(addresses)
+	if len(walletTxns) != 2 {
+		t.Fatalf("Expected 2 transactions, actual: %d", len(walletTxns))
+	}
+
+	sent := walletTxns[0]
+	if sent.TxID != hex.EncodeToString(payment.Hash) || sent.Direction != TxSent || sent.Amount != 300 {
+		t.Fatalf("Expected the unconfirmed payment of 300 first, actual: %+v", sent)
+	}
+	// Input values are known from the coinbase, so the fee is computed rather than taken from the record
+	if sent.Fee != 50 || sent.BlockHeight != unconfirmed || sent.Confirmations != 0 {
+		t.Fatalf("Expected an unconfirmed payment with fee 50, actual: %+v", sent)
+	}
+
+	received := walletTxns[1]
+	if received.Direction != TxReceived || received.Amount != blockchain.COINBASE_REWARD || received.Fee != 0 {
+		t.Fatalf("Expected the coinbase to be received, actual: %+v", received)
+	}
+	if received.BlockHeight != 2 || received.Confirmations != 3 {
+		t.Fatalf("Expected 3 confirmations at height 2 with tip 4, actual: %d", received.Confirmations)
+	}
+
+	unusedAddress := createWallet().Address()
+	if used := loaded.usedAddresses(append(addresses, unusedAddress)); !used[ownWallet.Address()] || !used[changeWallet.Address()] || used[unusedAddress] {
+		t.Fatalf("Expected only the addresses paid by the history to be used, actual: %v", used)
+	}
+}
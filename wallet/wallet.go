@@ -1,41 +1,71 @@
 package wallet
 
 import (
+	"EChain/blockchain"
 	"bytes"
 	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
 	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math/big"
 
+	"github.com/btcsuite/btcd/btcec"
 	"github.com/btcsuite/btcutil/base58"
 	"golang.org/x/crypto/ripemd160"
 )
 
 const (
-	pubKeyConstantPrefix = byte(4) // For uncompressed public key
-	versionByte          = byte(0) // version byte prefixed to public key hash when calculating address
-	checksumLength       = 4       // length of checksum embedded in address
+	checksumLength      = 4  // length of checksum embedded in address
+	privKeyLength       = 32 // length of a secp256k1 private key scalar
+	compressedPubKeyLen = 33 // 0x02/0x03 prefix followed by the 32-byte X coordinate
+	signatureLength     = 64 // fixed-width R || S, each 32 bytes
 )
 
 type Wallet struct {
 	PrivateKey ecdsa.PrivateKey
+	PublickKey []byte // compressed secp256k1 public key
+	Path       string // BIP44 derivation path, empty for keys not derived from the HD seed
+
+	legacyAddress  string // address of the P-256 key this wallet was migrated from, if any
+	addressVersion byte   // address version byte of the wallet's network, see ChainParams
+}
+
+// walletJSON is the on-disk representation of a wallet.
+// Only the 32-byte private scalar is stored, everything else is derived from it.
+type walletJSON struct {
+	PrivateKey json.RawMessage
 	PublickKey []byte
+	Path       string `json:",omitempty"`
+}
+
+// legacyPrivateKeyJSON matches the way encoding/json serialized the old P-256 ecdsa.PrivateKey
+type legacyPrivateKeyJSON struct {
+	X, Y, D *big.Int
 }
 
 func createWallet() *Wallet {
-	curve := elliptic.P256()
-	privKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	privKey, err := btcec.NewPrivateKey(btcec.S256())
 	handleError(err)
+	return newWalletFromPrivKey(privKey)
+}
 
-	pubKey := privKey.PublicKey
-	uncompressedPubKey := append(pubKey.X.Bytes(), pubKey.Y.Bytes()...)
-	uncompressedPubKey = append([]byte{pubKeyConstantPrefix}, uncompressedPubKey...)
+func newWalletFromPrivKey(privKey *btcec.PrivateKey) *Wallet {
+	return &Wallet{
+		PrivateKey: *privKey.ToECDSA(),
+		PublickKey: privKey.PubKey().SerializeCompressed(),
+	}
+}
 
-	return &Wallet{*privKey, uncompressedPubKey}
+func (wallet *Wallet) btcecPrivKey() *btcec.PrivateKey {
+	return (*btcec.PrivateKey)(&wallet.PrivateKey)
 }
 
 func (wallet *Wallet) PubKeyHash() []byte {
-	sha256Hash := sha256.Sum256(wallet.PublickKey)
+	return getPubkeyHashFromPubkey(wallet.PublickKey)
+}
+
+func getPubkeyHashFromPubkey(pubkey []byte) []byte {
+	sha256Hash := sha256.Sum256(pubkey)
 	hasher := ripemd160.New()
 	hasher.Write(sha256Hash[:])
 	return hasher.Sum(nil)
@@ -48,18 +78,94 @@ func getChecksum(versionedHash []byte) []byte {
 	return checksum
 }
 
+func getAddressFromPubkeyHash(pubkeyHash []byte, version byte) string {
+	versionedHash := append([]byte{version}, pubkeyHash...)
+	return base58.Encode(append(versionedHash, getChecksum(versionedHash)...))
+}
+
 func (wallet *Wallet) Address() string {
-	pubkeyHash := wallet.PubKeyHash()
-	versionedHash := append([]byte{versionByte}, pubkeyHash...)
+	return getAddressFromPubkeyHash(wallet.PubKeyHash(), wallet.addressVersion)
+}
 
-	encoded := base58.Encode(append(versionedHash, getChecksum(versionedHash)...))
-	return encoded
+// Sign signs hash with the wallet's private key and returns the fixed-width 64-byte R || S encoding
+func (wallet *Wallet) Sign(hash []byte) ([]byte, error) {
+	signature, err := wallet.btcecPrivKey().Sign(hash)
+	if err != nil {
+		return nil, err
+	}
+	encoded := make([]byte, signatureLength)
+	signature.R.FillBytes(encoded[:signatureLength/2])
+	signature.S.FillBytes(encoded[signatureLength/2:])
+	return encoded, nil
 }
 
-func IsAddressValid(address string) bool {
+func (wallet Wallet) MarshalJSON() ([]byte, error) {
+	privKeyBytes := make([]byte, privKeyLength)
+	wallet.PrivateKey.D.FillBytes(privKeyBytes)
+	encodedPrivKey, err := json.Marshal(privKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(walletJSON{encodedPrivKey, wallet.PublickKey, wallet.Path})
+}
+
+func (wallet *Wallet) UnmarshalJSON(data []byte) error {
+	var stored walletJSON
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+
+	// Wallets written before the switch to secp256k1 stored the whole P-256 key as an object
+	if bytes.HasPrefix(bytes.TrimSpace(stored.PrivateKey), []byte("{")) {
+		var legacyKey legacyPrivateKeyJSON
+		if err := json.Unmarshal(stored.PrivateKey, &legacyKey); err != nil {
+			return err
+		}
+		if legacyKey.D == nil {
+			return fmt.Errorf("legacy wallet entry has no private key")
+		}
+		*wallet = *migrateLegacyKey(legacyKey.D, stored.PublickKey)
+		return nil
+	}
+
+	var privKeyBytes []byte
+	if err := json.Unmarshal(stored.PrivateKey, &privKeyBytes); err != nil {
+		return err
+	}
+	if len(privKeyBytes) != privKeyLength {
+		return fmt.Errorf("invalid private key length %d", len(privKeyBytes))
+	}
+	privKey, _ := btcec.PrivKeyFromBytes(btcec.S256(), privKeyBytes)
+	*wallet = *newWalletFromPrivKey(privKey)
+	wallet.Path = stored.Path
+	if !bytes.Equal(wallet.PublickKey, stored.PublickKey) {
+		return fmt.Errorf("stored public key does not match private key")
+	}
+	return nil
+}
+
+// migrateLegacyKey re-interprets the private scalar of an old P-256 wallet as a secp256k1 key.
+// Every P-256 scalar is smaller than the secp256k1 group order, so the key material stays valid,
+// but the public key - and therefore the address - changes.
+func migrateLegacyKey(legacyD *big.Int, legacyPubKey []byte) *Wallet {
+	privKeyBytes := make([]byte, privKeyLength)
+	legacyD.FillBytes(privKeyBytes)
+	privKey, _ := btcec.PrivKeyFromBytes(btcec.S256(), privKeyBytes)
+
+	wallet := newWalletFromPrivKey(privKey)
+	// P-256 wallets predate test networks
+	wallet.legacyAddress = getAddressFromPubkeyHash(getPubkeyHashFromPubkey(legacyPubKey), blockchain.MainNetParams.AddressVersion)
+	return wallet
+}
+
+// IsAddressValid reports whether address is a well-formed address of the network described by params
+func IsAddressValid(address string, params *blockchain.ChainParams) bool {
 	decoded := base58.Decode(address)
+	if len(decoded) <= 1+checksumLength {
+		return false
+	}
 	version := decoded[:1]
-	if !bytes.Equal(version, []byte{versionByte}) {
+	if !bytes.Equal(version, []byte{params.AddressVersion}) {
 		return false
 	}
 	payloadLastIndex := len(decoded) - checksumLength
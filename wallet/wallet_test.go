@@ -3,38 +3,74 @@ package wallet
 import (
 	"EChain/blockchain"
 	"EChain/network"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
 	"testing"
 	"time"
 )
 
-func setup() (*Wallets, string, string) {
-	wallets := NewWallets()
-	walletAddr1 := wallets.AddNewWallet()
-	walletAddr2 := wallets.AddNewWallet()
-	minerAddr := "localhost:8333"
-	fullnodeAddr := "localhost:8334"
-	spvAddr := "localhost:8335"
-
-	minerNode := network.NewMinerNode(minerAddr, walletAddr1)
-	go minerNode.StartP2PNode()
+// setup starts a regtest miner, full node and SPV node listening on basePort and the two following ports,
+// and mines one block paying the first of two new wallet addresses
+func setup(t *testing.T, basePort int) (*Wallets, *network.MinerNode, string, string) {
+	params := blockchain.RegTestParams
+	params.CoinbaseMaturity = 1 // spend the mined block's reward right away
+	params.InitialPeers = []string{}
+	for port := basePort; port < basePort+3; port++ {
+		params.InitialPeers = append(params.InitialPeers, "localhost:"+fmt.Sprint(port))
+	}
+	minerAddr, fullnodeAddr, spvAddr := params.InitialPeers[0], params.InitialPeers[1], params.InitialPeers[2]
 
-	fullNode := network.NewFullNode(fullnodeAddr)
-	go fullNode.StartP2PNode()
+	wallets, err := LoadWallets(filepath.Join(t.TempDir(), "wallets.json"), &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	walletAddr1, _ := wallets.AddNewWallet()
+	walletAddr2, _ := wallets.AddNewWallet()
 
-	spvNode := network.NewSPVNode(spvAddr)
-	go spvNode.StartP2PNode()
+	minerNode := network.NewMinerNode(&params, minerAddr, walletAddr1, blockchain.NewMemoryStore())
+	nodes := []network.Node{
+		minerNode,
+		network.NewFullNode(&params, fullnodeAddr, blockchain.NewMemoryStore()),
+		network.NewSPVNode(&params, spvAddr, blockchain.NewMemoryStore()),
+	}
+	for _, node := range nodes {
+		t.Cleanup(node.Stop)
+		if err := node.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
 
 	wallets.ConnectNode(network.SPV, spvAddr)
-	time.Sleep(2 * time.Second) // Wait for 3 nodes to finish connecting / synchronizing data
+	wallets.ConnectNode(network.MINER, minerAddr)
+	time.Sleep(3 * time.Second) // Wait for 3 nodes to finish connecting / synchronizing data
 	wallets.AddWalletAddrToSPVNodes(walletAddr1)
+	time.Sleep(500 * time.Millisecond) // Wait for the SPV node to load its Bloom filter to its peers
 
-	time.Sleep(7 * time.Second) // Wait for miner node to finish mining the first block after the Genesis block
+	if blockHashes, err := minerNode.GenerateBlocks(1); err != nil || len(blockHashes) != 1 {
+		t.Fatalf("Expected one block to be generated (%v)", err)
+	}
+	waitFor(t, func() bool { return wallets.GetBalance(walletAddr1) > 0 })
 
-	return &wallets, walletAddr1, walletAddr2
+	return wallets, minerNode, walletAddr1, walletAddr2
+}
+
+// waitFor polls condition until it holds, failing the test after 10 seconds
+func waitFor(t *testing.T, condition func() bool) {
+	for deadline := time.Now().Add(10 * time.Second); !condition(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the network")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
 }
 
 func TestGetBalance(t *testing.T) {
-	wallets, walletAddr, _ := setup()
+	wallets, _, walletAddr, _ := setup(t, 18444)
 	balance := wallets.GetBalance(walletAddr)
 	if balance != blockchain.COINBASE_REWARD {
 		t.Fatalf("Expected balance to be %d , actual: %d", blockchain.COINBASE_REWARD, balance)
@@ -42,17 +78,74 @@ func TestGetBalance(t *testing.T) {
 }
 
 func TestTransfer(t *testing.T) {
-	wallets, walletAddr1, walletAddr2 := setup()
-	wallets.Transfer(walletAddr1, walletAddr2, 500)
-	// Wait for new transaction to be propagated to SPV node
-	time.Sleep(time.Second)
-	// Wait for miner node to pick new transaction from mempool and start mining
-	// Miner nodes create new block every 10 seconds
-	time.Sleep(10 * time.Second)
-	minerWalletBalance := wallets.GetBalance(walletAddr1)
+	// The only coin of the wallet is the reward of the first mined block
+	wallets, minerNode, walletAddr1, walletAddr2 := setup(t, 18454)
+	txID, err := wallets.Transfer(walletAddr1, walletAddr2, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Mine blocks paying someone else until the new transaction, propagated to the miner, is confirmed
+	waitFor(t, func() bool {
+		minerNode.GenerateToAddress(1, blockchain.RegTestParams.GenesisAddress)
+		return wallets.GetBalance(walletAddr2) > 0
+	})
+	// Change goes to a fresh address of the sending wallet
+	minerWalletBalance := 0
+	for _, address := range wallets.GetAddresses() {
+		if address != walletAddr1 && address != walletAddr2 {
+			minerWalletBalance += wallets.GetBalance(address)
+		}
+	}
 	receiverWalletBalance := wallets.GetBalance(walletAddr2)
 
 	if minerWalletBalance != blockchain.COINBASE_REWARD-500 || receiverWalletBalance != 500 {
 		t.Fatalf("Expected wallet balances to be %d and %d, actual: %d and %d", blockchain.COINBASE_REWARD-500, 500, minerWalletBalance, receiverWalletBalance)
 	}
+	if _, err := wallets.GetTransaction(txID); err != nil {
+		t.Fatalf("Expected the transfer to be recorded under its transaction id: %v", err)
+	}
+}
+
+func TestWalletKeyEncoding(t *testing.T) {
+	wallet := createWallet()
+	if len(wallet.PublickKey) != 33 {
+		t.Fatalf("Expected compressed public key of 33 bytes, actual: %d", len(wallet.PublickKey))
+	}
+	signature, err := wallet.Sign(make([]byte, 32))
+	if err != nil || len(signature) != signatureLength {
+		t.Fatalf("Expected %d-byte signature, actual: %d (%v)", signatureLength, len(signature), err)
+	}
+
+	jsonStr, _ := json.Marshal(map[string]Wallet{wallet.Address(): *wallet})
+	var loaded map[string]Wallet
+	if err := json.Unmarshal(jsonStr, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if loadedWallet := loaded[wallet.Address()]; loadedWallet.Address() != wallet.Address() {
+		t.Fatalf("Expected wallet %s to survive a JSON round trip", wallet.Address())
+	}
+}
+
+func TestLegacyWalletMigration(t *testing.T) {
+	legacyKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	legacyPubKey := append([]byte{4}, append(legacyKey.X.Bytes(), legacyKey.Y.Bytes()...)...)
+	legacyAddress := getAddressFromPubkeyHash(getPubkeyHashFromPubkey(legacyPubKey), blockchain.MainNetParams.AddressVersion)
+	legacyJSON, _ := json.Marshal(map[string]interface{}{
+		legacyAddress: map[string]interface{}{
+			"PrivateKey": map[string]interface{}{"X": legacyKey.X, "Y": legacyKey.Y, "D": legacyKey.D},
+			"PublickKey": legacyPubKey,
+		},
+	})
+
+	var loaded map[string]Wallet
+	if err := json.Unmarshal(legacyJSON, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	migrated := loaded[legacyAddress]
+	if migrated.legacyAddress != legacyAddress || migrated.PrivateKey.D.Cmp(legacyKey.D) != 0 {
+		t.Fatalf("Expected legacy key to be re-used as secp256k1 key")
+	}
+	if len(migrated.PublickKey) != 33 || migrated.Address() == legacyAddress {
+		t.Fatalf("Expected migrated wallet to have a new compressed public key")
+	}
 }
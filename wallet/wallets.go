@@ -3,32 +3,50 @@ package wallet
 import (
 	"EChain/blockchain"
 	"EChain/network"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
-	"encoding/json"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"os"
+	"sort"
+	"sync"
 	"time"
 )
 
 const (
-	protocol       = "tcp"
-	walletFilePath = "wallets.json"
-	msgTypeLength  = 12
+	protocol              = "tcp"
+	DefaultWalletFilePath = "wallets.json"
+	legacyBackupSuffix    = ".p256" // suffix of the backup of a wallet file written before the switch to secp256k1
+	msgTypeLength         = 12
 )
 
 type Wallets struct {
+	params         *blockchain.ChainParams
 	connectedNodes []network.NodeInfo
-	wallets        map[string]Wallet
+	wallets        map[string]Wallet // entries of a locked wallet only carry public keys
+	hdSeed         *HDSeed           // nil while the wallet is locked
+	filePath       string
+	history        *txStore
+
+	mutex         sync.Mutex
+	keystore      *encryptedWalletsFile // nil for unencrypted wallets
+	encryptionKey []byte                // key derived from the passphrase, nil while locked
+	lockTimer     *time.Timer
 }
 
-func NewWallets() Wallets {
+// walletsFile is the layout of wallets.json
+type walletsFile struct {
+	HDSeed  *HDSeed `json:",omitempty"`
+	Wallets map[string]Wallet
+}
+
+func NewWallets(params *blockchain.ChainParams) Wallets {
 	return Wallets{
+		params:         params,
 		connectedNodes: []network.NodeInfo{},
 		wallets:        make(map[string]Wallet),
+		filePath:       DefaultWalletFilePath,
+		history:        newTxStore(DefaultWalletFilePath + txHistorySuffix),
 	}
 }
 
@@ -37,10 +55,14 @@ func (wallets *Wallets) ConnectNode(nodeType, address string) {
 }
 
 func (wallets *Wallets) GetWallet(address string) Wallet {
+	wallets.mutex.Lock()
+	defer wallets.mutex.Unlock()
 	return wallets.wallets[address]
 }
 
 func (wallets *Wallets) GetAddresses() []string {
+	wallets.mutex.Lock()
+	defer wallets.mutex.Unlock()
 	addresses := []string{}
 	for key := range wallets.wallets {
 		addresses = append(addresses, key)
@@ -48,83 +70,159 @@ func (wallets *Wallets) GetAddresses() []string {
 	return addresses
 }
 
-func (wallets *Wallets) AddNewWallet() string {
-	newWallet := createWallet()
+// AddNewWallet creates a new receiving address and writes it to the wallet file, so its key survives Lock.
+// Addresses of HD wallets are derived from the seed, otherwise a new random key is generated.
+func (wallets *Wallets) AddNewWallet() (string, error) {
+	wallets.mutex.Lock()
+	defer wallets.mutex.Unlock()
+	return wallets.addNewWallet(ExternalChain)
+}
+
+// addNewWallet creates an address on chain, or from a random key if the wallet has no HD seed, and saves the
+// wallet. The address is discarded if the wallet file can not be written.
+func (wallets *Wallets) addNewWallet(chain uint32) (string, error) {
+	if wallets.isLocked() {
+		return "", fmt.Errorf("wallet is locked")
+	}
+	var address string
+	var previousSeed HDSeed
+	if wallets.hdSeed != nil {
+		previousSeed = *wallets.hdSeed
+		newWallet, err := wallets.deriveNextWallet(chain)
+		if err != nil {
+			return "", err
+		}
+		address = newWallet.Address()
+	} else {
+		address = wallets.addWallet(createWallet())
+	}
+	if err := wallets.saveFile(); err != nil {
+		delete(wallets.wallets, address)
+		if wallets.hdSeed != nil {
+			*wallets.hdSeed = previousSeed
+		}
+		return "", fmt.Errorf("can not save new address: %w", err)
+	}
+	return address, nil
+}
+
+// addWallet stores a wallet under its address on the wallets' network and returns the address
+func (wallets *Wallets) addWallet(newWallet *Wallet) string {
+	newWallet.addressVersion = wallets.params.AddressVersion
 	walletAddress := newWallet.Address()
 	wallets.wallets[walletAddress] = *newWallet
 	return walletAddress
 }
 
-func LoadWallets() *Wallets {
-	if _, err := os.Stat(walletFilePath); os.IsNotExist(err) {
-		f, _ := os.Create(walletFilePath)
-		defer f.Close()
+// TransferOptions tune how Transfer builds a transaction. The zero value selects the largest coins first,
+// pays no fee and sends change to a fresh address of the wallet.
+type TransferOptions struct {
+	CoinSelector  CoinSelector
+	FeeRate       int // satoshi per byte
+	DustThreshold int // defaults to DefaultDustThreshold
 
-		newWallets := Wallets{}
-		newWallets.wallets = make(map[string]Wallet)
-		return &newWallets
-	}
-	jsonStr, err := os.ReadFile(walletFilePath)
-	handleError(err)
+	// Only coins with at least this many confirmations are spent, 0 also spends coins of unconfirmed blocks
+	MinConfirmations int
 
-	wallets := make(map[string]Wallet)
-	json.Unmarshal(jsonStr, &wallets)
-	for key, wallet := range wallets {
-		wallet.PrivateKey.Curve = elliptic.P256()
-		wallets[key] = wallet
-	}
+	// When FeeRate is zero and ConfirmationTarget is set, the fee rate is estimated by the connected nodes
+	// for confirmation within that many blocks, using FallbackFeeRate if no estimate is available
+	ConfirmationTarget int
+	FallbackFeeRate    int
+}
 
-	return &Wallets{wallets: wallets}
+// Transfer sends amount from the coins of fromAddress to toAddress and returns the hex encoded transaction hash
+func (wallets *Wallets) Transfer(fromAddress, toAddress string, amount int) (string, error) {
+	return wallets.TransferWithOptions([]string{fromAddress}, toAddress, amount, TransferOptions{})
 }
 
-func (wallets *Wallets) SaveFile() {
-	jsonStr, _ := json.Marshal(wallets.wallets)
-	err := os.WriteFile(walletFilePath, jsonStr, 0644)
-	handleError(err)
+// Send pays amount to toAddress from any coin owned by the wallet
+func (wallets *Wallets) Send(toAddress string, amount int, options TransferOptions) (string, error) {
+	return wallets.TransferWithOptions(wallets.GetAddresses(), toAddress, amount, options)
 }
 
-func (wallets *Wallets) Transfer(fromAddress, toAddress string, amount int) error {
-	senderWallet, existed := wallets.wallets[fromAddress]
-	if !existed {
-		return fmt.Errorf("wallet does not contain keys for address %s", fromAddress)
+// TransferWithOptions pays amount to toAddress using coins of fromAddresses. It returns once the transaction
+// has been handed to the connected nodes.
+func (wallets *Wallets) TransferWithOptions(fromAddresses []string, toAddress string, amount int, options TransferOptions) (string, error) {
+	if options.CoinSelector == nil {
+		options.CoinSelector = LargestFirst{}
 	}
-	utxoMap, err := wallets.getUTXOs(fromAddress)
-	if err != nil {
-		return err
+	if options.DustThreshold == 0 {
+		options.DustThreshold = DefaultDustThreshold
+	}
+	if amount < options.DustThreshold {
+		return "", fmt.Errorf("amount %d is below the dust threshold %d", amount, options.DustThreshold)
+	}
+	if options.FeeRate == 0 && options.ConfirmationTarget > 0 {
+		feeRate, err := wallets.EstimateFee(options.ConfirmationTarget)
+		if err != nil {
+			feeRate = options.FallbackFeeRate
+		}
+		options.FeeRate = feeRate
 	}
-	transferAmount := 0
-	newTxnInputs := []blockchain.TxInput{}
-	newTxnOutputs := []blockchain.TxOutput{}
 
-OuterLoop:
-	for txnID, txnOutputs := range utxoMap {
-		for _, output := range txnOutputs {
-			transferAmount += output.Value
-			newTxnInputs = append(newTxnInputs, createTxnInput([]byte(txnID), output.Index, senderWallet.PublickKey))
-			if transferAmount >= amount {
-				break OuterLoop
+	signers := make(map[string]*Wallet)
+	coins := []Coin{}
+	for _, fromAddress := range fromAddresses {
+		senderWallet, err := wallets.signingWallet(fromAddress)
+		if err != nil {
+			return "", err
+		}
+		signers[fromAddress] = senderWallet
+
+		utxoMap, err := wallets.getUTXOs(fromAddress, options.MinConfirmations, true)
+		if err != nil {
+			return "", err
+		}
+		for txnID, txnOutputs := range utxoMap {
+			for _, output := range txnOutputs {
+				coins = append(coins, Coin{txnID, output.Index, output.Value, fromAddress})
 			}
 		}
 	}
+	// Map iteration order is random, sort so that selection only depends on the strategy
+	sort.Slice(coins, func(i, j int) bool {
+		if coins[i].TxID != coins[j].TxID {
+			return coins[i].TxID < coins[j].TxID
+		}
+		return coins[i].Index < coins[j].Index
+	})
 
-	if transferAmount < amount {
-		return fmt.Errorf("not enough balance")
+	selection, err := options.CoinSelector.Select(coins, SelectionParams{amount, options.FeeRate, options.DustThreshold})
+	if err != nil {
+		return "", err
 	}
 
-	newTxnOutputs = append(newTxnOutputs, createTxnOutput(amount, toAddress))
-	if transferAmount > amount {
-		newTxnOutputs = append(newTxnOutputs, createTxnOutput(transferAmount-amount, fromAddress))
+	newTxnInputs := []blockchain.TxInput{}
+	for _, coin := range selection.Coins {
+		newTxnInputs = append(newTxnInputs, createTxnInput([]byte(coin.TxID), coin.Index, signers[coin.Address].PublickKey))
+	}
+	newTxnOutputs := []blockchain.TxOutput{createTxnOutput(amount, toAddress)}
+	if selection.Change > 0 {
+		changeAddress, err := wallets.newChangeAddress()
+		if err != nil {
+			return "", err
+		}
+		newTxnOutputs = append(newTxnOutputs, createTxnOutput(selection.Change, changeAddress))
 	}
 
 	newTransaction := blockchain.Transaction{Inputs: newTxnInputs, Outputs: newTxnOutputs, Locktime: getCurrentTimeInMilliSec()}
-	wallets.signTransaction(&newTransaction, senderWallet.PrivateKey)
+	for inputIndex, coin := range selection.Coins {
+		signature, err := signers[coin.Address].Sign(newTransaction.Inputs[inputIndex].Hash())
+		if err != nil {
+			return "", err
+		}
+		newTransaction.Inputs[inputIndex].ScriptSig.Signature = signature
+	}
 	newTransaction.SetHash()
 
 	sentData := append(msgTypeToBytes(network.NEWTXN_MSG), serialize(newTransaction)...)
 
 	// Broadcast new transaction to network
+	var wg sync.WaitGroup
 	for _, connectedNode := range wallets.connectedNodes {
+		wg.Add(1)
 		go func(targetAddress string) {
+			defer wg.Done()
 			conn, err := net.DialTimeout(protocol, targetAddress, time.Second)
 			if err != nil {
 				return
@@ -134,22 +232,28 @@ OuterLoop:
 			conn.Close()
 		}(connectedNode.Address)
 	}
+	wg.Wait()
 
-	return nil
+	if err := wallets.history.addUnconfirmed(newTransaction, selection.Fee); err != nil {
+		fmt.Println("Can not save transaction history:", err)
+	}
+	return hex.EncodeToString(newTransaction.Hash), nil
 }
 
-func (wallets *Wallets) signTransaction(transaction *blockchain.Transaction, privKey ecdsa.PrivateKey) {
-	for inputIndex, txnInput := range transaction.Inputs {
-		inputHash := txnInput.Hash()
-		r, s, _ := ecdsa.Sign(rand.Reader, &privKey, inputHash)
-		signature := append(r.Bytes(), s.Bytes()...)
-		transaction.Inputs[inputIndex].ScriptSig.Signature = signature
+// newChangeAddress creates an address for change, registers it with the SPV nodes and saves the wallet,
+// so the key holding the change can not get lost
+func (wallets *Wallets) newChangeAddress() (string, error) {
+	changeAddress, err := wallets.NewChangeAddress()
+	if err != nil {
+		return "", err
 	}
+	wallets.AddWalletAddrToSPVNodes(changeAddress)
+	return changeAddress, nil
 }
 
 func (wallets *Wallets) GetBalance(walletAddress string) int {
 	accountBalance := 0
-	utxoMap, err := wallets.getUTXOs(walletAddress)
+	utxoMap, err := wallets.getUTXOs(walletAddress, 0, false)
 	if err != nil {
 		fmt.Println(err.Error())
 		return 0
@@ -162,8 +266,52 @@ func (wallets *Wallets) GetBalance(walletAddress string) int {
 	return accountBalance
 }
 
-func (wallets *Wallets) getUTXOs(walletAddress string) (map[string]blockchain.TxOutputs, error) {
-	getUTXOMsg := network.GetUTXOMessage{TargetAddress: walletAddress}
+// Balance is the balance of the wallet split by the state of its coins
+type Balance network.BalanceMessage
+
+// Total is the value of every coin the wallet will own once its pending transactions are mined
+func (balance Balance) Total() int {
+	return balance.Confirmed + balance.UnconfirmedIncoming + balance.Immature
+}
+
+// GetBalances returns the balance of all addresses of the wallet. Coins with fewer than minConfirmations
+// confirmations count as unconfirmed incoming, a minConfirmations of 0 is treated as 1.
+func (wallets *Wallets) GetBalances(minConfirmations int) (Balance, error) {
+	getBalanceMsg := network.GetBalanceMessage{Addresses: wallets.GetAddresses(), MinConfirmations: minConfirmations}
+	sentData := append(msgTypeToBytes(network.GETBALANCE_MSG), serialize(getBalanceMsg)...)
+
+	lastErr := fmt.Errorf("can not query balance: no SPV node connected")
+	for _, connectedNode := range wallets.connectedNodes {
+		if connectedNode.NodeType != network.SPV {
+			continue
+		}
+		conn, err := net.DialTimeout(protocol, connectedNode.Address, time.Second)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		conn.Write(sentData)
+		conn.(*net.TCPConn).CloseWrite()
+		resp, err := io.ReadAll(conn)
+		conn.Close()
+		if err != nil || len(resp) == 0 {
+			lastErr = fmt.Errorf("can not query balance from %s", connectedNode.Address)
+			continue
+		}
+
+		var balanceMsg network.BalanceMessage
+		genericDeserialize(resp, &balanceMsg)
+		return Balance(balanceMsg), nil
+	}
+	return Balance{}, lastErr
+}
+
+// getUTXOs fetches the unspent outputs of walletAddress, spendableOnly leaves out immature coinbase outputs
+func (wallets *Wallets) getUTXOs(walletAddress string, minConfirmations int, spendableOnly bool) (map[string]blockchain.TxOutputs, error) {
+	if !wallets.hasSPVNode() {
+		return nil, fmt.Errorf("can not query UTXOs for %s: no SPV node connected", walletAddress)
+	}
+	getUTXOMsg := network.GetUTXOMessage{TargetAddress: walletAddress, MinConfirmations: minConfirmations, SpendableOnly: spendableOnly}
 	sentData := append(msgTypeToBytes(network.GETUTXO_MSG), serialize(getUTXOMsg)...)
 
 	successFlag := make(chan bool, len(wallets.connectedNodes))
@@ -219,12 +367,58 @@ OuterLoop:
 	return nil, fmt.Errorf("can not query UTXOs for %s", walletAddress)
 }
 
+// EstimateFee asks the connected nodes for the fee rate, in satoshi per byte,
+// needed to get a transaction mined within targetBlocks blocks
+func (wallets *Wallets) EstimateFee(targetBlocks int) (int, error) {
+	estimateFeeMsg := network.EstimateFeeMessage{TargetBlocks: targetBlocks}
+	sentData := append(msgTypeToBytes(network.ESTIMATEFEE_MSG), serialize(estimateFeeMsg)...)
+
+	lastErr := fmt.Errorf("no node connected")
+	for _, connectedNode := range wallets.connectedNodes {
+		conn, err := net.DialTimeout(protocol, connectedNode.Address, time.Second)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		conn.Write(sentData)
+		conn.(*net.TCPConn).CloseWrite()
+		resp, err := io.ReadAll(conn)
+		conn.Close()
+		if err != nil || len(resp) == 0 {
+			lastErr = fmt.Errorf("no fee estimate from %s", connectedNode.Address)
+			continue
+		}
+
+		var feeEstimateMsg network.FeeEstimateMessage
+		genericDeserialize(resp, &feeEstimateMsg)
+		if feeEstimateMsg.Error != "" {
+			lastErr = errors.New(feeEstimateMsg.Error)
+			continue
+		}
+		return feeEstimateMsg.FeeRate, nil
+	}
+	return 0, lastErr
+}
+
+func (wallets *Wallets) hasSPVNode() bool {
+	for _, connectedNode := range wallets.connectedNodes {
+		if connectedNode.NodeType == network.SPV {
+			return true
+		}
+	}
+	return false
+}
+
+// AddWalletAddrToSPVNodes asks the connected SPV nodes to monitor walletAddress
 func (wallets *Wallets) AddWalletAddrToSPVNodes(walletAddress string) {
 	newAddrMsg := network.NewAddrMessage{WalletAddress: walletAddress}
 	sentData := append(msgTypeToBytes(network.NEWADDR_MSG), serialize(newAddrMsg)...)
+	var wg sync.WaitGroup
 	for _, connectedNode := range wallets.connectedNodes {
 		if connectedNode.NodeType == network.SPV {
+			wg.Add(1)
 			go func(targetAddress string) {
+				defer wg.Done()
 				conn, err := net.DialTimeout(protocol, targetAddress, time.Second)
 				if err != nil {
 					return
@@ -235,4 +429,5 @@ func (wallets *Wallets) AddWalletAddrToSPVNodes(walletAddress string) {
 			}(connectedNode.Address)
 		}
 	}
+	wg.Wait()
 }